@@ -0,0 +1,504 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "sort"
+)
+
+// analyzeCommand implements 'flux analyze', which answers questions about
+// how a program behaves on every run: 'bounds' how often its loops run,
+// and 'halt' whether it stops at all
+func analyzeCommand(args []string) {
+    if len(args) == 0 || args[0] != "bounds" && args[0] != "halt" {
+        printUsage("analyze")
+        return
+    }
+    fs := commandFlags("analyze " + args[0])
+    maxStates := 0
+    if args[0] == "halt" {
+        fs.IntVar(&maxStates, "max-states", 1000000, "give up after exploring `n` states")
+    }
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args[1:])
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 || args[0] == "halt" && maxStates < 1 {
+        fmt.Println("Error: Please specify a file to analyze and a positive state limit")
+        printUsage("analyze")
+        return
+    }
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    program, err := loadProgram(filename, data, source)
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+    if args[0] == "halt" {
+        os.Exit(printHalting(filename, program, source.extensions, maxStates))
+    }
+    if !printLoopBounds(filename, program) {
+        os.Exit(1)
+    }
+}
+
+// printLoopBounds prints the verdict on each loop of the program and
+// reports whether none is sure never to end
+func printLoopBounds(filename string, program *Program) bool {
+    verdicts := analyzeBounds(program)
+    loops := make([]int, 0, len(verdicts))
+    for pc := range verdicts {
+        loops = append(loops, pc)
+    }
+    sort.Ints(loops)
+    fmt.Printf("Loop bounds for %s\n\n", filename)
+    if len(loops) == 0 {
+        fmt.Println("  (no loops)")
+    }
+    counts := make(map[verdictKind]int)
+    for _, pc := range loops {
+        v := verdicts[pc]
+        counts[v.kind]++
+        fmt.Printf("  %04d  %-20s %s\n", pc, program.Location(pc), v.text)
+    }
+    fmt.Printf("\n%d loop(s): %d bounded, %d never end, %d depend on how they are entered, %d unknown, %d skipped or not reached\n",
+        len(loops), counts[verdictBounded], counts[verdictInfinite], counts[verdictConditional], counts[verdictUnknown], counts[verdictSkipped]+counts[verdictUnreached])
+    return counts[verdictInfinite] == 0
+}
+
+// verdictKind classifies what the bounds analysis found out about a loop
+type verdictKind int
+
+const (
+    verdictUnreached   verdictKind = iota // No run gets to the loop
+    verdictSkipped                        // The accumulator is always 0 on entry
+    verdictBounded                        // The loop runs a known number of times
+    verdictInfinite                       // The loop never ends once reached
+    verdictConditional                    // Whether it ends depends on an unknown accumulator on entry
+    verdictUnknown                        // Nothing could be worked out
+)
+
+// loopVerdict is the analysis's conclusion about one loop
+type loopVerdict struct {
+    kind verdictKind
+    text string
+}
+
+// absKind says what the analysis knows about a value
+type absKind int
+
+const (
+    absUnknown absKind = iota
+    absConst           // The value is n
+    absVar             // The value is variable id, as it was when the iteration started, plus n
+)
+
+// The variables of a loop iteration: the accumulator, the registers and
+// the stack entries, numbered from the bottom
+const (
+    varAcc   = 0
+    varReg   = 1
+    varStack = varReg + NumRegisters
+)
+
+// absValue is a value as far as the analysis knows it
+type absValue struct {
+    kind absKind
+    id   int
+    n    int
+}
+
+// constValue returns the known value n
+func constValue(n int) absValue {
+    return absValue{kind: absConst, n: n}
+}
+
+// add returns the value plus k
+func (v absValue) add(k int) absValue {
+    if v.kind == absUnknown {
+        return v
+    }
+    v.n += k
+    return v
+}
+
+// absState is the machine state as far as the analysis knows it
+type absState struct {
+    acc       absValue
+    stack     []absValue // The top of the stack, bottom first
+    deep      bool       // Whether unknown values may lie below stack; if not, popping past it gives 0
+    regs      [NumRegisters]absValue
+    floorRead bool // Whether a pop went past stack and got 0
+    dead      bool // The code is not reached
+    mayHang   bool // A loop passed may not have ended
+}
+
+// initialState is the state every run starts in
+func initialState() absState {
+    s := absState{acc: constValue(0)}
+    for r := range s.regs {
+        s.regs[r] = constValue(0)
+    }
+    return s
+}
+
+// havoc returns a state in which nothing is known
+func (s absState) havoc() absState {
+    return absState{deep: true, mayHang: s.mayHang}
+}
+
+func (s *absState) push(v absValue) {
+    s.stack = append(s.stack[:len(s.stack):len(s.stack)], v)
+}
+
+func (s *absState) pop() absValue {
+    if len(s.stack) == 0 {
+        if s.deep {
+            return absValue{}
+        }
+        s.floorRead = true
+        return constValue(0)
+    }
+    v := s.stack[len(s.stack)-1]
+    s.stack = s.stack[:len(s.stack)-1]
+    return v
+}
+
+// variable returns the value of variable id in s
+func (s *absState) variable(id int) absValue {
+    switch {
+    case id == varAcc:
+        return s.acc
+    case id < varStack:
+        return s.regs[id-varReg]
+    case id-varStack < len(s.stack):
+        return s.stack[id-varStack]
+    }
+    return absValue{}
+}
+
+// variableName describes variable id for verdicts
+func variableName(id int) string {
+    switch {
+    case id == varAcc:
+        return "the accumulator"
+    case id < varStack:
+        return "register " + registerNames[id-varReg:id-varReg+1]
+    }
+    return fmt.Sprintf("stack entry %d (from the bottom)", id-varStack+1)
+}
+
+// boundsAnalyzer works out how often each loop of a program runs, starting,
+// as every run does, from a zero accumulator and an empty stack. Within a
+// loop it follows one iteration from unknown values. If the accumulator
+// at ']' comes out as a constant, or as a variable (the accumulator, a
+// register or a stack entry) that the iteration changes by a constant,
+// the trip count follows from the variable's value on entry.
+type boundsAnalyzer struct {
+    program  *Program
+    verdicts map[int]loopVerdict // By the address of each loop's LOOP
+}
+
+// analyzeBounds returns the verdict on every loop of program
+func analyzeBounds(program *Program) map[int]loopVerdict {
+    a := &boundsAnalyzer{program: program, verdicts: make(map[int]loopVerdict)}
+    a.run(0, len(program.Instructions), initialState())
+    for pc, inst := range program.Instructions {
+        if _, ok := a.verdicts[pc]; inst.Op == OpLoop && !ok {
+            a.verdicts[pc] = loopVerdict{verdictUnreached, "never reached"}
+        }
+    }
+    return a.verdicts
+}
+
+// record notes the verdict on the loop at pc. A loop analyzed more than
+// once, inside another loop, keeps the first verdict.
+func (a *boundsAnalyzer) record(pc int, kind verdictKind, format string, args ...any) {
+    if _, ok := a.verdicts[pc]; !ok {
+        a.verdicts[pc] = loopVerdict{kind, fmt.Sprintf(format, args...)}
+    }
+}
+
+// run follows the instructions from up to to, starting in state s, and
+// returns the state at to together with the first instruction the
+// analysis could not follow, if any
+func (a *boundsAnalyzer) run(from, to int, s absState) (absState, string) {
+    reason := ""
+    for pc := from; pc < to; pc++ {
+        inst := a.program.Instructions[pc]
+        if s.dead {
+            // Code after a loop that never ends is reached only by jumps
+            switch inst.Op {
+            case OpLoop:
+                pc = inst.Arg
+            case OpElse, OpEndIf, OpCatch, OpEndTry:
+                s = s.havoc()
+            }
+            continue
+        }
+        switch inst.Op {
+        case OpInc:
+            s.acc = s.acc.add(1)
+        case OpDec:
+            s.acc = s.acc.add(-1)
+        case OpAdd:
+            s.acc = s.acc.add(inst.Arg)
+        case OpSet:
+            v, err := a.program.Constants.IntValue(inst.Arg)
+            s.acc = absValue{}
+            if err == nil {
+                s.acc = constValue(v)
+            }
+        case OpPush:
+            s.push(s.acc)
+        case OpPop:
+            s.acc = s.pop()
+        case OpLoadReg:
+            s.acc = s.regs[inst.Arg]
+        case OpStoreReg:
+            s.regs[inst.Arg] = s.acc
+        case OpIn:
+            s.acc = absValue{}
+        case OpOut, OpOutNum, OpEmitBytes, OpDump:
+        case OpLoop:
+            s = a.loop(pc, s)
+            pc = inst.Arg
+        case OpQuote:
+            // A block runs whenever it is executed, in any state
+            a.run(pc+1, inst.Arg, initialState().havoc())
+            s = s.havoc()
+            pc = inst.Arg
+            if reason == "" {
+                reason = fmt.Sprintf("it uses %s", inst.Op)
+            }
+        default:
+            s = s.havoc()
+            if reason == "" {
+                reason = fmt.Sprintf("it uses %s", inst.Op)
+            }
+        }
+    }
+    return s, reason
+}
+
+// loop analyzes the loop at pc, entered in state entry, and returns the
+// state after it
+func (a *boundsAnalyzer) loop(pc int, entry absState) absState {
+    end := a.program.Instructions[pc].Arg
+    if entry.acc == constValue(0) {
+        a.record(pc, verdictSkipped, "never runs: the accumulator is 0 on entry")
+        return entry
+    }
+
+    // Follow one iteration with every variable unknown
+    start := absState{acc: absValue{absVar, varAcc, 0}, deep: entry.deep}
+    for r := range start.regs {
+        start.regs[r] = absValue{absVar, varReg + r, 0}
+    }
+    for i := range entry.stack {
+        start.stack = append(start.stack, absValue{absVar, varStack + i, 0})
+    }
+    after, reason := a.run(pc+1, end, start)
+
+    // When the loop ends the accumulator is 0, unless BREAK left early.
+    // An iteration that leaves the stack and registers as it found them
+    // leaves those of the entry.
+    stationary := len(after.stack) == len(start.stack) && after.deep == start.deep && after.regs == start.regs
+    for i := range after.stack {
+        stationary = stationary && after.stack[i] == start.stack[i]
+    }
+    exited := entry
+    if !stationary {
+        exited = entry.havoc()
+    }
+    exited.acc = constValue(0)
+    exited.mayHang = entry.mayHang || after.mayHang
+    exited.floorRead = entry.floorRead || after.floorRead
+
+    // An unknown accumulator on entry may be 0, skipping the loop
+    entered := entry.acc.kind == absConst
+    skipped := entry
+    skipped.acc = constValue(0)
+    leave := func(s absState, mayHang bool) absState {
+        s.mayHang = s.mayHang || mayHang
+        if entered {
+            return s
+        }
+        return joinStates(skipped, s)
+    }
+    ifEntered := ""
+    if !entered {
+        ifEntered = " once entered"
+    }
+
+    switch {
+    case reason != "":
+        a.record(pc, verdictUnknown, "cannot tell: %s", reason)
+        unknown := entry.havoc()
+        unknown.mayHang = true
+        return unknown
+    case after.dead && entered:
+        a.record(pc, verdictInfinite, "never ends: a loop inside it never ends")
+        return absState{dead: true}
+    case after.dead:
+        a.record(pc, verdictConditional, "never ends once entered: a loop inside it never ends")
+        skipped.mayHang = true
+        return skipped
+    case after.floorRead && len(after.stack) != len(start.stack):
+        a.record(pc, verdictUnknown, "cannot tell: it pops from a stack that changes from one iteration to the next")
+        return leave(exited, true)
+    }
+
+    hangNote := ""
+    if after.mayHang {
+        hangNote = ", if the loops inside it end"
+    }
+
+    // The value at ']' is that of variable id at the start of the
+    // iteration plus e, and the iteration changes the variable by d
+    cond := after.acc
+    id, e, d := varAcc, cond.n, 0
+    switch cond.kind {
+    case absUnknown:
+        a.record(pc, verdictUnknown, "cannot tell: the accumulator at ']' depends on input or on values the analysis does not follow")
+        return leave(exited, true)
+    case absConst:
+        if cond.n == 0 {
+            if entered {
+                a.record(pc, verdictBounded, "runs once%s", hangNote)
+                return a.instantiate(after, entry)
+            }
+            a.record(pc, verdictBounded, "runs at most once%s", hangNote)
+            return joinStates(skipped, a.instantiate(after, entry))
+        }
+        a.record(pc, kindIf(entered, verdictInfinite, verdictConditional), "never ends%s: the accumulator is %d at every ']'", ifEntered, cond.n)
+        return a.neverEnds(entered, skipped)
+    case absVar:
+        id = cond.id
+        next := after.variable(id)
+        if id == varAcc {
+            next = cond
+        }
+        if next.kind != absVar || next.id != id {
+            a.record(pc, verdictUnknown, "cannot tell: the accumulator at ']' follows %s, which changes in ways the analysis does not follow", variableName(id))
+            return leave(exited, true)
+        }
+        d = next.n
+    }
+
+    // Iteration k (from 0) ends with v0 + k*d + e at ']'
+    v0 := entry.variable(id)
+    if v0.kind != absConst {
+        // The variable is d-e at the last ']', so it must start at -e,
+        // -e-d, -e-2d and so on
+        if d == 0 {
+            a.record(pc, verdictConditional, "runs once if %s is %d on entry, otherwise never ends", variableName(id), -e)
+        } else {
+            a.record(pc, verdictConditional, "counts %s by %+d to %d: ends if it is %d, %d, %d, ... on entry, never otherwise", variableName(id), d, d-e, -e, -e-d, -e-2*d)
+        }
+        return leave(exited, true)
+    }
+    t := v0.n + e
+    switch {
+    case t == 0:
+        a.record(pc, verdictBounded, "runs once%s%s", ifEnteredNote(entered), hangNote)
+        return leave(a.instantiate(after, entry), false)
+    case d == 0:
+        a.record(pc, kindIf(entered, verdictInfinite, verdictConditional), "never ends%s: the accumulator is %d at every ']'", ifEntered, t)
+        return a.neverEnds(entered, skipped)
+    case t%d != 0 || -t/d < 0:
+        a.record(pc, kindIf(entered, verdictInfinite, verdictConditional), "never ends%s: %s starts at %d and changes by %+d, missing %d (until it wraps around)", ifEntered, variableName(id), v0.n, d, d-e)
+        return a.neverEnds(entered, skipped)
+    }
+    a.record(pc, verdictBounded, "runs %d times%s%s", -t/d+1, ifEnteredNote(entered), hangNote)
+    return leave(exited, false)
+}
+
+// neverEnds returns the state after a loop that never ends once entered
+func (a *boundsAnalyzer) neverEnds(entered bool, skipped absState) absState {
+    if entered {
+        return absState{dead: true}
+    }
+    skipped.mayHang = true
+    return skipped
+}
+
+// kindIf returns yes if cond holds and no otherwise
+func kindIf(cond bool, yes, no verdictKind) verdictKind {
+    if cond {
+        return yes
+    }
+    return no
+}
+
+// ifEnteredNote qualifies a trip count for a loop that may not be entered
+func ifEnteredNote(entered bool) string {
+    if entered {
+        return ""
+    }
+    return " if entered"
+}
+
+// instantiate returns the state after the iteration that ended in after,
+// given the state the iteration started in
+func (a *boundsAnalyzer) instantiate(after, entry absState) absState {
+    resolve := func(v absValue) absValue {
+        if v.kind == absVar {
+            return entry.variable(v.id).add(v.n)
+        }
+        return v
+    }
+    s := absState{
+        acc:       resolve(after.acc),
+        deep:      after.deep,
+        mayHang:   entry.mayHang || after.mayHang,
+        floorRead: entry.floorRead || after.floorRead,
+    }
+    for _, v := range after.stack {
+        s.stack = append(s.stack, resolve(v))
+    }
+    for r, v := range after.regs {
+        s.regs[r] = resolve(v)
+    }
+    return s
+}
+
+// joinStates returns what is known in both states
+func joinStates(x, y absState) absState {
+    switch {
+    case x.dead:
+        return y
+    case y.dead:
+        return x
+    }
+    same := func(v, w absValue) absValue {
+        if v == w {
+            return v
+        }
+        return absValue{}
+    }
+    s := absState{
+        acc:       same(x.acc, y.acc),
+        deep:      x.deep || y.deep,
+        mayHang:   x.mayHang || y.mayHang,
+        floorRead: x.floorRead || y.floorRead,
+    }
+    if len(x.stack) == len(y.stack) {
+        for i := range x.stack {
+            s.stack = append(s.stack, same(x.stack[i], y.stack[i]))
+        }
+    } else {
+        s.deep = true
+    }
+    for r := range s.regs {
+        s.regs[r] = same(x.regs[r], y.regs[r])
+    }
+    return s
+}
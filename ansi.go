@@ -0,0 +1,71 @@
+package main
+
+import "fmt"
+
+// Terminal controls of the ansi extension, selected by the accumulator
+const (
+    AnsiReset      = 0 // Reset colors and attributes
+    AnsiClear      = 1 // Clear the screen and move the cursor home
+    AnsiMove       = 2 // Move the cursor to the popped column, then row
+    AnsiForeground = 3 // Set the text color to the popped color
+    AnsiBackground = 4 // Set the background color to the popped color
+    AnsiHideCursor = 5 // Hide the cursor
+    AnsiShowCursor = 6 // Show the cursor
+    AnsiClearLine  = 7 // Clear the line the cursor is on
+)
+
+// ansiControl writes the terminal control sequence the accumulator
+// selects. Rows and columns count from 1; colors 0 to 7 are the standard
+// ones and 8 to 255 those of 256-color terminals.
+func (vm *VM) ansiControl() error {
+    var seq string
+    switch vm.accumulator {
+    case AnsiReset:
+        seq = ansiReset
+    case AnsiClear:
+        seq = ansiClear + ansiHome
+    case AnsiMove:
+        col, err := vm.pop()
+        if err != nil {
+            return err
+        }
+        row, err := vm.pop()
+        if err != nil {
+            return err
+        }
+        if row < 1 || col < 1 {
+            return fault(FaultOperand, "no row %d column %d to move to at %s", row, col, vm.program.Location(vm.pc))
+        }
+        seq = fmt.Sprintf("\x1b[%d;%dH", row, col)
+    case AnsiForeground, AnsiBackground:
+        color, err := vm.pop()
+        if err != nil {
+            return err
+        }
+        if color < 0 || color > 255 {
+            return fault(FaultOperand, "no color %d at %s", color, vm.program.Location(vm.pc))
+        }
+        layer := 3
+        if vm.accumulator == AnsiBackground {
+            layer = 4
+        }
+        if color < 8 {
+            seq = fmt.Sprintf("\x1b[%d%dm", layer, color)
+        } else {
+            seq = fmt.Sprintf("\x1b[%d8;5;%dm", layer, color)
+        }
+    case AnsiHideCursor:
+        seq = "\x1b[?25l"
+    case AnsiShowCursor:
+        seq = "\x1b[?25h"
+    case AnsiClearLine:
+        seq = "\x1b[2K"
+    default:
+        return fault(FaultOperand, "no terminal control %d at %s", vm.accumulator, vm.program.Location(vm.pc))
+    }
+    vm.outputBytes += int64(len(seq))
+    if _, err := vm.device.WriteString(seq); err != nil {
+        return fmt.Errorf("output error: %v", err)
+    }
+    return nil
+}
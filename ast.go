@@ -0,0 +1,314 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// syntaxTreeVersion is the format version written by 'flux parse -json'
+const syntaxTreeVersion = 1
+
+// SyntaxTree is a program's structure as exported by 'flux parse -json'.
+// Programs can be loaded from this form too, so tools may generate or
+// transform them without handling the source text.
+type SyntaxTree struct {
+    Flux       int     `json:"flux"`                 // Format version; nonzero marks the JSON as a tree
+    File       string  `json:"file,omitempty"`       // Source file the tree was parsed from
+    Extensions string  `json:"extensions,omitempty"` // Extensions the program uses, as for -ext
+    Header     string  `json:"header,omitempty"`     // Header lines of the source, which declare its data
+    Body       []*Node `json:"body"`
+}
+
+// Node is an operator or a bracketed construct of a syntax tree. Positions
+// describe where the node starts in the source and are ignored on import.
+type Node struct {
+    Kind     string  `json:"kind"`               // "op", "loop", "if", "block" or "try"
+    Op       string  `json:"op,omitempty"`       // The operator character, for "op"
+    Register string  `json:"register,omitempty"` // The register '$' and '=' name
+    Label    string  `json:"label,omitempty"`    // The data block '"' names
+    Pos      int     `json:"pos"`                // Source offset
+    Line     int     `json:"line,omitempty"`
+    Column   int     `json:"column,omitempty"`
+    Body     []*Node `json:"body,omitempty"`    // Contents of a loop, block or trap, or a conditional's then branch
+    Else     []*Node `json:"else,omitempty"`    // A conditional's else branch
+    Handler  []*Node `json:"handler,omitempty"` // A trap's handler
+}
+
+// nodeBrackets holds the characters that open, divide and close each
+// kind of construct
+var nodeBrackets = map[string]string{
+    "loop":  "[]",
+    "if":    "(:)",
+    "block": "{}",
+    "try":   "YHE",
+}
+
+// nodeKinds maps the opcodes that open constructs to their kind
+var nodeKinds = map[OpCode]string{
+    OpLoop:  "loop",
+    OpIf:    "if",
+    OpQuote: "block",
+    OpTry:   "try",
+}
+
+// coreOps maps the characters of the core operators other than the loop
+// brackets to what they compile to
+var coreOps = map[byte]OpCode{
+    '+': OpInc,
+    '-': OpDec,
+    '*': OpPush,
+    '/': OpPop,
+    '.': OpOut,
+    ',': OpIn,
+    '#': OpOutNum,
+}
+
+// compilesTo reports whether the operator char compiles to op
+func compilesTo(char byte, op OpCode) bool {
+    if char == '#' && op == OpOutFloat {
+        return true
+    }
+    if core, ok := coreOps[char]; ok {
+        return core == op
+    }
+    e, ok := extensionOps[char]
+    return ok && e.op == op
+}
+
+// parseCommand implements 'flux parse', which shows a program's syntax
+// tree as an outline or as JSON
+func parseCommand(args []string) {
+    fs := commandFlags("parse")
+    asJSON := fs.Bool("json", false, "print the tree as JSON, which flux accepts in place of source")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to parse")
+        printUsage("parse")
+        return
+    }
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    program, err := loadProgram(filename, data, source)
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+    tree, err := syntaxTree(program)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if *asJSON {
+        out, _ := json.MarshalIndent(tree, "", "  ")
+        fmt.Println(string(out))
+        return
+    }
+    printNodes(tree.Body, 0)
+}
+
+// printNodes prints nodes as an outline indented by depth
+func printNodes(nodes []*Node, depth int) {
+    for _, n := range nodes {
+        label := n.Op + n.Register + n.Label
+        if n.Kind != "op" {
+            label = n.Kind
+        }
+        fmt.Printf("%-8s %s%s\n", fmt.Sprintf("%d:%d", n.Line, n.Column), strings.Repeat("  ", depth), label)
+        printNodes(n.Body, depth+1)
+        if n.Else != nil {
+            fmt.Printf("%-8s %selse\n", "", strings.Repeat("  ", depth))
+            printNodes(n.Else, depth+1)
+        }
+        if n.Handler != nil {
+            fmt.Printf("%-8s %shandler\n", "", strings.Repeat("  ", depth))
+            printNodes(n.Handler, depth+1)
+        }
+    }
+}
+
+// syntaxTree rebuilds the structure of an unoptimized program from its
+// instructions and the source they were compiled from. Comments are not
+// part of the tree.
+func syntaxTree(program *Program) (*SyntaxTree, error) {
+    if program.Debug == nil {
+        return nil, fmt.Errorf("the program has no source to parse; it was compiled with -strip")
+    }
+    source := program.Debug.Source
+    tree := &SyntaxTree{Flux: syntaxTreeVersion, File: program.Debug.File, Extensions: program.Extensions.String()}
+    tree.Header = string(source[shebangLength(source):headerLength(source)])
+    lists := []*[]*Node{&tree.Body} // Where nodes are added, innermost last
+    var open []*Node                // The constructs being filled
+    lines := lineStarts(source)
+    for pc, inst := range program.Instructions {
+        pos := program.Debug.Positions[pc]
+        n := &Node{Pos: pos}
+        n.Line, n.Column = lineColAt(lines, pos)
+        switch inst.Op {
+        case OpLoop, OpIf, OpQuote, OpTry:
+            n.Kind = nodeKinds[inst.Op]
+            *lists[len(lists)-1] = append(*lists[len(lists)-1], n)
+            open = append(open, n)
+            lists = append(lists, &n.Body)
+            continue
+        case OpElse:
+            lists[len(lists)-1] = &open[len(open)-1].Else
+            continue
+        case OpCatch:
+            lists[len(lists)-1] = &open[len(open)-1].Handler
+            continue
+        case OpEnd, OpEndIf, OpReturn, OpEndTry:
+            open = open[:len(open)-1]
+            lists = lists[:len(lists)-1]
+            continue
+        case OpLoadReg, OpStoreReg:
+            n.Register = registerNames[inst.Arg : inst.Arg+1]
+        case OpData:
+            if pos+1 < len(source) {
+                n.Label = string(source[pos+1])
+            }
+        }
+        if pos >= len(source) || !compilesTo(source[pos], inst.Op) {
+            return nil, fmt.Errorf("instruction %04d has no operator in the source; parse the source rather than optimized bytecode", pc)
+        }
+        n.Kind, n.Op = "op", string(source[pos])
+        *lists[len(lists)-1] = append(*lists[len(lists)-1], n)
+    }
+    return tree, nil
+}
+
+// isSyntaxTree reports whether data is a syntax tree exported by 'flux
+// parse -json' rather than source
+func isSyntaxTree(data []byte) bool {
+    var header struct {
+        Flux int `json:"flux"`
+    }
+    return json.Unmarshal(data, &header) == nil && header.Flux > 0
+}
+
+// compileSyntaxTree compiles a program from its syntax tree, by way of the
+// source the tree describes, which becomes the program's debug source
+func compileSyntaxTree(data []byte, opts sourceOptions) (*Program, error) {
+    var tree SyntaxTree
+    if err := json.Unmarshal(data, &tree); err != nil {
+        return nil, err
+    }
+    if tree.Flux != syntaxTreeVersion {
+        return nil, fmt.Errorf("unsupported syntax tree version %d (expected %d)", tree.Flux, syntaxTreeVersion)
+    }
+    extensions, err := parseExtensions(tree.Extensions)
+    if err != nil {
+        return nil, err
+    }
+    var source bytes.Buffer
+    if tree.Header != "" {
+        header := strings.TrimSuffix(tree.Header, "\n") + "\n"
+        if headerLength(header) != len(header) {
+            return nil, fmt.Errorf("the tree's header has lines that are not header lines")
+        }
+        source.WriteString(header)
+    }
+    if err := renderNodes(&source, tree.Body, extensions); err != nil {
+        return nil, err
+    }
+    c := opts.compiler(source.String())
+    c.SetExtensions(extensions)
+    return c.Compile()
+}
+
+// renderNodes writes the source of nodes to buf, checking that every
+// operator is one the extensions provide
+func renderNodes(buf *bytes.Buffer, nodes []*Node, extensions ExtensionSet) error {
+    for _, n := range nodes {
+        if n.Kind == "op" {
+            if err := checkOperator(n, extensions); err != nil {
+                return err
+            }
+            buf.WriteString(n.Op + n.Register + n.Label)
+            continue
+        }
+        brackets, ok := nodeBrackets[n.Kind]
+        if !ok {
+            return fmt.Errorf("node at %d has unknown kind %q", n.Pos, n.Kind)
+        }
+        ext := ExtensionSet(0)
+        if n.Kind != "loop" {
+            ext = extensionOps[brackets[0]].ext
+        }
+        if extensions&ext != ext {
+            return fmt.Errorf("%s node at %d needs the %s extension, which the tree does not list", n.Kind, n.Pos, ext)
+        }
+        if n.Else != nil && n.Kind != "if" || n.Handler != nil && n.Kind != "try" {
+            return fmt.Errorf("%s node at %d cannot have an else branch or a handler", n.Kind, n.Pos)
+        }
+        buf.WriteByte(brackets[0])
+        if err := renderNodes(buf, n.Body, extensions); err != nil {
+            return err
+        }
+        if other := append(n.Else, n.Handler...); len(other) > 0 {
+            buf.WriteByte(brackets[1])
+            if err := renderNodes(buf, other, extensions); err != nil {
+                return err
+            }
+        }
+        buf.WriteByte(brackets[len(brackets)-1])
+    }
+    return nil
+}
+
+// checkOperator returns an error unless n is an operator on its own, not
+// part of a construct, that is core or provided by the extensions
+func checkOperator(n *Node, extensions ExtensionSet) error {
+    if len(n.Op) != 1 {
+        return fmt.Errorf("op node at %d has operator %q, which is not a single character", n.Pos, n.Op)
+    }
+    char := n.Op[0]
+    if _, ok := coreOps[char]; ok {
+        if n.Register != "" || n.Label != "" {
+            return fmt.Errorf("operator '%c' at %d does not take a register or label", char, n.Pos)
+        }
+        return nil
+    }
+    e, ok := extensionOps[char]
+    if !ok {
+        return fmt.Errorf("op node at %d has unknown operator %q", n.Pos, n.Op)
+    }
+    if extensions&e.ext == 0 {
+        return fmt.Errorf("operator '%c' at %d needs the %s extension, which the tree does not list", char, n.Pos, e.ext)
+    }
+    switch e.op {
+    case OpIf, OpElse, OpEndIf, OpQuote, OpReturn, OpTry, OpCatch, OpEndTry:
+        return fmt.Errorf("operator '%c' at %d belongs to a construct; use a node of that kind", char, n.Pos)
+    case OpLoadReg, OpStoreReg:
+        if len(n.Register) != 1 || !strings.Contains(registerNames, n.Register) {
+            return fmt.Errorf("operator '%c' at %d needs a register, one of %s", char, n.Pos, registerNames)
+        }
+        if n.Label != "" {
+            return fmt.Errorf("operator '%c' at %d does not take a label", char, n.Pos)
+        }
+        return nil
+    case OpData:
+        if len(n.Label) != 1 || n.Label[0] < 'a' || n.Label[0] > 'z' {
+            return fmt.Errorf("operator '%c' at %d needs the label of a data block, a to z", char, n.Pos)
+        }
+        if n.Register != "" {
+            return fmt.Errorf("operator '%c' at %d does not take a register", char, n.Pos)
+        }
+        return nil
+    }
+    if n.Register != "" || n.Label != "" {
+        return fmt.Errorf("operator '%c' at %d does not take a register or label", char, n.Pos)
+    }
+    return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "errors"
+)
+
+// EventKind says what an Event reports
+type EventKind int
+
+const (
+    EventOutput EventKind = iota // The program wrote Data
+    EventInput                   // The program is waiting for input
+    EventPause                   // The program has stopped at a pause
+    EventHalt                    // The program finished
+    EventError                   // The program stopped with Err
+)
+
+// eventKindNames maps each event kind to its name
+var eventKindNames = map[EventKind]string{
+    EventOutput: "output",
+    EventInput:  "input",
+    EventPause:  "pause",
+    EventHalt:   "halt",
+    EventError:  "error",
+}
+
+// String returns the name of the event kind
+func (k EventKind) String() string {
+    return eventKindNames[k]
+}
+
+// Event is something that happened while a program ran under Start
+type Event struct {
+    Kind  EventKind
+    Data  []byte // Output, for EventOutput
+    Err   error  // Why the program stopped, for EventError
+    Steps int    // Instructions executed when the event happened
+}
+
+// Start runs the program in a goroutine and reports what happens on the
+// returned channel: output as it is flushed, requests for input the
+// program is about to wait for, and finally a halt or an error, after
+// which the channel is closed. A program stopped with Pause reports an
+// EventPause. The channel is unbuffered, so a slow
+// receiver holds the program back. Cancelling ctx stops the program and
+// closes the channel, possibly without a final event.
+//
+// Output goes to the channel instead of the machine's device, and input
+// is read as usual from the device, through which a front end answers
+// input requests. The machine must not be used by anyone else until the channel
+// is closed.
+func (vm *VM) Start(ctx context.Context) (<-chan Event, error) {
+    if vm.runnable != nil {
+        return nil, vm.runnable
+    }
+    if !vm.running.CompareAndSwap(false, true) {
+        return nil, errors.New("the machine is already running")
+    }
+
+    events := make(chan Event)
+    send := func(e Event) bool {
+        e.Steps = vm.steps
+        select {
+        case events <- e:
+            return true
+        case <-ctx.Done():
+            return false
+        }
+    }
+    device, prevCtx := vm.device, vm.ctx
+    vm.device = &eventDevice{in: device, out: bufio.NewWriter(&eventWriter{send: send}), send: send}
+    vm.ctx = ctx
+    vm.onPause = func() { send(Event{Kind: EventPause}) }
+
+    go func() {
+        defer close(events)
+        err := vm.Run()
+        vm.device, vm.ctx, vm.onPause = device, prevCtx, nil
+        vm.running.Store(false)
+        if err != nil {
+            send(Event{Kind: EventError, Err: err})
+            return
+        }
+        send(Event{Kind: EventHalt})
+    }()
+    return events, nil
+}
+
+// eventWriter turns writes into output events
+type eventWriter struct {
+    send func(Event) bool
+}
+
+// Write sends a copy of p, failing once nobody receives events any more
+func (w *eventWriter) Write(p []byte) (int, error) {
+    if !w.send(Event{Kind: EventOutput, Data: append([]byte(nil), p...)}) {
+        return 0, context.Canceled
+    }
+    return len(p), nil
+}
+
+// eventDevice reads input from the machine's device, announcing reads
+// that may wait with an input event, and sends output as output events
+type eventDevice struct {
+    in   Device
+    out  *bufio.Writer
+    send func(Event) bool
+}
+
+// ReadByte sends an input event unless input is known to be waiting, then
+// reads from the machine's device
+func (d *eventDevice) ReadByte() (byte, error) {
+    if !deviceReady(d.in) && !d.send(Event{Kind: EventInput}) {
+        return 0, context.Canceled
+    }
+    return d.in.ReadByte()
+}
+
+func (d *eventDevice) WriteByte(c byte) error {
+    return d.out.WriteByte(c)
+}
+
+func (d *eventDevice) WriteString(s string) (int, error) {
+    return d.out.WriteString(s)
+}
+
+func (d *eventDevice) Write(p []byte) (int, error) {
+    return d.out.Write(p)
+}
+
+// Flush sends the output written since the last flush as one event
+func (d *eventDevice) Flush() error {
+    return d.out.Flush()
+}
+
+// Ready reports whether input is waiting, for the probe extension
+func (d *eventDevice) Ready() bool {
+    return deviceReady(d.in)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "context"
+    "crypto/subtle"
+    "errors"
+    "log"
+    "net/http"
+    "strings"
+)
+
+// ErrNoCredentials is returned by an Authenticator for a request that
+// carries no credentials of its kind, so that the next one may try
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator decides who sent an HTTP request, returning the name of
+// the client, such as the LMS an API key was issued to
+type Authenticator interface {
+    Authenticate(r *http.Request) (string, error)
+}
+
+// AuthFunc adapts a function to an Authenticator
+type AuthFunc func(r *http.Request) (string, error)
+
+func (f AuthFunc) Authenticate(r *http.Request) (string, error) {
+    return f(r)
+}
+
+// APIKeyAuth accepts requests carrying one of the keys, either as
+// "Authorization: Bearer <key>" or as "X-API-Key: <key>". keys maps each
+// key to the name of the client it was issued to.
+func APIKeyAuth(keys map[string]string) Authenticator {
+    return AuthFunc(func(r *http.Request) (string, error) {
+        key := r.Header.Get("X-API-Key")
+        if key == "" {
+            key = bearerToken(r)
+        }
+        if key == "" {
+            return "", ErrNoCredentials
+        }
+        // Compare with every key in constant time, so that timing does not
+        // tell how much of a guess was right
+        name, found := "", false
+        for k, n := range keys {
+            if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+                name, found = n, true
+            }
+        }
+        if !found {
+            return "", errors.New("unknown API key")
+        }
+        return name, nil
+    })
+}
+
+// BearerAuth accepts requests whose "Authorization: Bearer <token>"
+// header validate accepts, returning the client validate names. validate
+// typically checks an OpenID Connect ID token: its signature against the
+// provider's keys, its issuer, audience and expiry.
+func BearerAuth(validate func(ctx context.Context, token string) (string, error)) Authenticator {
+    return AuthFunc(func(r *http.Request) (string, error) {
+        token := bearerToken(r)
+        if token == "" {
+            return "", ErrNoCredentials
+        }
+        return validate(r.Context(), token)
+    })
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+    scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !ok || !strings.EqualFold(scheme, "Bearer") {
+        return ""
+    }
+    return strings.TrimSpace(token)
+}
+
+// authClientKey is the context key of the authenticated client
+type authClientKey struct{}
+
+// AuthClient returns the client RequireAuth authenticated the request as
+func AuthClient(ctx context.Context) string {
+    name, _ := ctx.Value(authClientKey{}).(string)
+    return name
+}
+
+// RequireAuth wraps h so that it only serves requests one of the
+// authenticators accepts, tried in order; others get a 401 APIError. Why
+// credentials were rejected is logged rather than told to the client, to
+// whom it could be a hint. The handler finds the client with AuthClient.
+func RequireAuth(h http.Handler, auths ...Authenticator) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        message := "authentication required"
+        for _, a := range auths {
+            name, err := a.Authenticate(r)
+            if err == nil {
+                h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authClientKey{}, name)))
+                return
+            }
+            if !errors.Is(err, ErrNoCredentials) {
+                log.Printf("%s %s from %s: invalid credentials: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+                message = "invalid credentials"
+            }
+        }
+        w.Header().Set("WWW-Authenticate", `Bearer realm="flux"`)
+        WriteAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: message})
+    })
+}
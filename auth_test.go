@@ -0,0 +1,73 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+    var logged strings.Builder
+    log.SetOutput(&logged)
+    defer log.SetOutput(os.Stderr)
+    keys := APIKeyAuth(map[string]string{"k1": "moodle", "k2": "canvas"})
+    tokens := BearerAuth(func(ctx context.Context, token string) (string, error) {
+        if token == "good-token" {
+            return "oidc", nil
+        }
+        return "", errors.New("signature of key 7 does not verify")
+    })
+    h := RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.WriteString(w, AuthClient(r.Context()))
+    }), keys, tokens)
+    tests := []struct {
+        name   string
+        header string // "Name: value"
+        status int
+        body   string // Client for 200, message for 401
+    }{
+        {"no credentials", "", http.StatusUnauthorized, "authentication required"},
+        {"API key header", "X-API-Key: k1", http.StatusOK, "moodle"},
+        {"API key as bearer", "Authorization: Bearer k2", http.StatusOK, "canvas"},
+        {"unknown key", "X-API-Key: k3", http.StatusUnauthorized, "invalid credentials"},
+        {"valid token", "Authorization: Bearer good-token", http.StatusOK, "oidc"},
+        {"invalid token", "Authorization: bearer bad-token", http.StatusUnauthorized, "invalid credentials"},
+        {"other scheme", "Authorization: Basic a2V5", http.StatusUnauthorized, "authentication required"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/grade", nil)
+            if name, value, ok := strings.Cut(tt.header, ": "); ok {
+                r.Header.Set(name, value)
+            }
+            w := httptest.NewRecorder()
+            h.ServeHTTP(w, r)
+            if w.Code != tt.status {
+                t.Fatalf("status %d, want %d", w.Code, tt.status)
+            }
+            body := w.Body.String()
+            if tt.status == http.StatusUnauthorized {
+                var e struct{ Error APIError }
+                if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+                    t.Fatalf("body %q is not an API error: %v", body, err)
+                }
+                body = e.Error.Message
+            }
+            if body != tt.body {
+                t.Errorf("body %q, want %q", body, tt.body)
+            }
+        })
+    }
+    for _, reason := range []string{"unknown API key", "signature of key 7 does not verify"} {
+        if !strings.Contains(logged.String(), reason) {
+            t.Errorf("log does not have %q:\n%s", reason, logged.String())
+        }
+    }
+}
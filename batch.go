@@ -0,0 +1,107 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "fmt"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// batchCase is one input file of 'flux run -input-dir'
+type batchCase struct {
+    name   string // File name within the input directory
+    output string // Path of the file receiving the output
+}
+
+// batchCases lists the regular files of dir, in name order, with the
+// output file of each in outDir: the input's name with its extension
+// replaced by .out
+func batchCases(dir, outDir string) ([]batchCase, error) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var cases []batchCase
+    for _, e := range entries {
+        if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+            continue
+        }
+        base := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+        cases = append(cases, batchCase{name: e.Name(), output: filepath.Join(outDir, base+".out")})
+    }
+    return cases, nil
+}
+
+// runBatch implements 'flux run -input-dir': it runs program once for
+// every file in the input directory, with the file as input, and writes
+// each run's output to a file in the output directory. The program is
+// compiled once and a single machine is recycled with Reset, so a run
+// costs little more than executing the program.
+func runBatch(program *Program, opts runOptions) {
+    cases, err := batchCases(opts.inputDir, opts.outputDir)
+    if err != nil {
+        fmt.Printf("Error reading input directory: %v\n", err)
+        return
+    }
+    if err := os.MkdirAll(opts.outputDir, 0o755); err != nil {
+        fmt.Printf("Error creating output directory: %v\n", err)
+        return
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    vm := NewVM(program, nil, nil)
+    vm.SetContext(ctx)
+    start := time.Now()
+    failed, ran := 0, 0
+    var steps int
+    for _, c := range cases {
+        if ctx.Err() != nil {
+            fmt.Println("Interrupted")
+            break
+        }
+        input, err := os.ReadFile(filepath.Join(opts.inputDir, c.name))
+        if err != nil {
+            fmt.Printf("Error reading input '%s': %v\n", c.name, err)
+            failed++
+            continue
+        }
+        f, err := os.Create(c.output)
+        if err != nil {
+            fmt.Printf("Error writing output '%s': %v\n", c.output, err)
+            failed++
+            continue
+        }
+        // Every case starts as a fresh run would, down to the fake clock
+        vm.Reset(program)
+        if err := opts.apply(vm); err != nil {
+            f.Close()
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+        vm.SetIO(bytes.NewReader(input), bufio.NewWriter(f))
+        err = vm.Run()
+        if cerr := vm.CloseFiles(); err == nil && cerr != nil {
+            err = fmt.Errorf("closing files: %v", cerr)
+        }
+        if cerr := f.Close(); err == nil && cerr != nil {
+            err = fmt.Errorf("output error: %v", cerr)
+        }
+        ran++
+        steps += vm.StepCount()
+        if err != nil {
+            fmt.Printf("FAIL  %s: %v\n", c.name, err)
+            failed++
+        }
+    }
+    fmt.Printf("Ran %d of %d input(s) in %v, %d failed; output in %s\n", ran, len(cases), roundDuration(time.Since(start)), failed, opts.outputDir)
+    if opts.stats {
+        fmt.Printf("Steps: %d in total\n", steps)
+    }
+}
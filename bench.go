@@ -0,0 +1,304 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "math"
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// benchCommand implements 'flux bench', which times a program at several
+// optimization levels and checks that they all produce the same output,
+// or with -vm times the VM itself on built-in workloads and with -compile
+// the compiler
+func benchCommand(args []string) {
+    fs := commandFlags("bench")
+    levelList := fs.String("levels", "O0,O1,O2", "comma-separated optimization `levels` to compare")
+    repeat := fs.Int("repeat", 10, "time `n` runs at each level")
+    inputFile := fs.String("input", "", "feed the contents of `file` to every run (default: no input)")
+    maxSteps := fs.Int("max-steps", 1000000000, "abort a run after `n` instructions")
+    vmOnly := fs.Bool("vm", false, "time the VM on built-in workloads instead of a program")
+    compileOnly := fs.Bool("compile", false, "time compiling the file, or a generated multi-megabyte source, instead of running it")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    levels, err := parseLevels(*levelList)
+    if len(positional) != 1 && !((*vmOnly || *compileOnly) && len(positional) == 0) || err != nil || *repeat < 1 {
+        fmt.Println("Error: Please specify a file to benchmark, valid levels and a positive repeat count")
+        printUsage("bench")
+        fmt.Println("       flux bench -vm [-levels O0,O1,O2] [-repeat n]")
+        fmt.Println("       flux bench -compile [-repeat n] [-ext list] [file]")
+        return
+    }
+    if *vmOnly {
+        benchVM(levels, *repeat, source.extensions)
+        return
+    }
+    if *compileOnly {
+        name, code := "generated source", compileWorkload(compileWorkloadSize)
+        if len(positional) == 1 {
+            data, err := os.ReadFile(positional[0])
+            if err != nil {
+                fmt.Printf("Error reading file '%s': %v\n", positional[0], err)
+                return
+            }
+            name, code = positional[0], string(data)
+        }
+        benchCompile(name, code, *repeat, source)
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    var input []byte
+    if *inputFile != "" {
+        input, err = os.ReadFile(*inputFile)
+        if err != nil {
+            fmt.Printf("Error reading input file '%s': %v\n", *inputFile, err)
+            return
+        }
+    }
+    program, err := loadProgram(filename, data, source)
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+
+    fmt.Printf("Benchmarking %s, %d run(s) per level\n\n", filename, *repeat)
+    fmt.Printf("  %-5s %12s %14s %12s %12s\n", "level", "instructions", "steps", "mean", "stddev")
+    var results []benchResult
+    for _, level := range levels {
+        optimized, _ := Optimize(program, level)
+        r, err := benchProgram(optimized, source.extensions, input, *maxSteps, *repeat)
+        if err != nil {
+            fmt.Printf("  O%-4d failed: %v\n", level, err)
+            os.Exit(1)
+        }
+        r.level = level
+        results = append(results, r)
+        fmt.Printf("  O%-4d %12d %14d %12v %12v\n", level, len(optimized.Instructions), r.steps, roundDuration(r.mean), roundDuration(r.stddev))
+    }
+
+    fmt.Println()
+    mismatch := false
+    for _, r := range results[1:] {
+        if !bytes.Equal(r.output, results[0].output) {
+            mismatch = true
+            fmt.Printf("MISMATCH: O%d output differs from O%d: %s\n", r.level, results[0].level, describeMismatch(results[0].output, r.output))
+        }
+    }
+    if mismatch {
+        os.Exit(1)
+    }
+    fmt.Printf("Output identical at every level (%d byte(s))\n", len(results[0].output))
+}
+
+// vmWorkload is a synthetic program that exercises one part of the VM
+type vmWorkload struct {
+    name        string
+    description string
+    source      string
+    input       []byte
+}
+
+// vmWorkloads lists the workloads of 'flux bench -vm'. Each executes a few
+// million instructions unoptimized.
+var vmWorkloads = []vmWorkload{
+    {
+        name:        "loop",
+        description: "nested counting loops",
+        source:      strings.Repeat("+", 20) + "[*" + strings.Repeat("+", 20) + "[*" + strings.Repeat("+", 50) + "[*" + strings.Repeat("+", 20) + "[-]/-]/-]/-]",
+    },
+    {
+        // Push a sentinel 0 above the outer counter, 5000 values above
+        // that, then pop back down to the sentinel
+        name:        "stack",
+        description: "filling and draining a deep stack",
+        source:      strings.Repeat("+", 50) + "[*[-]*" + strings.Repeat("+", 5000) + "[*-]/[/]/-]",
+    },
+    {
+        name:        "io",
+        description: "copying input to output a byte at a time",
+        source:      ",[.,]",
+        input:       bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog.\n"), 20000),
+    },
+}
+
+// benchVM times the built-in workloads at each level and prints how many
+// instructions per second the VM executes, so that changes to dispatch
+// and the optimizer can be compared on the same machine
+func benchVM(levels []int, repeat int, extensions ExtensionSet) {
+    fmt.Printf("Benchmarking the VM, %d run(s) per workload and level\n\n", repeat)
+    fmt.Printf("  %-8s %-5s %12s %12s %14s\n", "workload", "level", "steps", "mean", "ops/sec")
+    for _, w := range vmWorkloads {
+        program, err := NewCompiler(w.source).Compile()
+        if err != nil {
+            panic(fmt.Sprintf("workload %s: %v", w.name, err))
+        }
+        var reference []byte
+        for _, level := range levels {
+            optimized, _ := Optimize(program, level)
+            r, err := benchProgram(optimized, extensions, w.input, 0, repeat)
+            if err != nil {
+                fmt.Printf("  %-8s O%-4d failed: %v\n", w.name, level, err)
+                os.Exit(1)
+            }
+            if reference == nil {
+                reference = r.output
+            } else if !bytes.Equal(r.output, reference) {
+                fmt.Printf("  %-8s O%-4d MISMATCH: %s\n", w.name, level, describeMismatch(reference, r.output))
+                os.Exit(1)
+            }
+            fmt.Printf("  %-8s O%-4d %12d %12v %14s\n", w.name, level, r.steps, roundDuration(r.mean), formatRate(float64(r.steps)/r.mean.Seconds()))
+        }
+    }
+    fmt.Println()
+    for _, w := range vmWorkloads {
+        fmt.Printf("  %-8s %s\n", w.name, w.description)
+    }
+}
+
+// compileWorkloadSize is the size of the source 'flux bench -compile'
+// generates, in bytes
+const compileWorkloadSize = 8 << 20
+
+// compileWorkload returns about size bytes of source like that programs
+// generate: long runs of arithmetic, nested loops and a comment on every
+// line
+func compileWorkload(size int) string {
+    var b strings.Builder
+    b.Grow(size + 100)
+    for i := 0; b.Len() < size; i++ {
+        fmt.Fprintf(&b, "%s[*%s[-]/-]%s. step %d\n", strings.Repeat("+", 1+i%17), strings.Repeat("-", 1+i%5), strings.Repeat("+", i%7), i)
+    }
+    return b.String()
+}
+
+// benchCompile times compiling code repeat times and prints the throughput
+// and how much each compilation allocates, which is what makes the
+// garbage collector run
+func benchCompile(name, code string, repeat int, source sourceOptions) {
+    fmt.Printf("Benchmarking the compiler on %s (%d bytes), %d run(s)\n\n", name, len(code), repeat)
+    var before, after runtime.MemStats
+    var instructions int
+    runtime.GC()
+    runtime.ReadMemStats(&before)
+    start := time.Now()
+    for range repeat {
+        program, err := source.compiler(code).Compile()
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+        instructions = len(program.Instructions)
+    }
+    elapsed := time.Since(start)
+    runtime.ReadMemStats(&after)
+
+    mean := elapsed / time.Duration(repeat)
+    fmt.Printf("  instructions   %d\n", instructions)
+    fmt.Printf("  mean           %v\n", roundDuration(mean))
+    fmt.Printf("  throughput     %sB/s\n", formatRate(float64(len(code))/mean.Seconds()))
+    fmt.Printf("  allocations    %d per compile, %d bytes\n", (after.Mallocs-before.Mallocs)/uint64(repeat), (after.TotalAlloc-before.TotalAlloc)/uint64(repeat))
+    fmt.Printf("  GC cycles      %d\n", after.NumGC-before.NumGC)
+}
+
+// formatRate formats a rate per second with a metric prefix
+func formatRate(rate float64) string {
+    switch {
+    case rate >= 1e9:
+        return fmt.Sprintf("%.2f G", rate/1e9)
+    case rate >= 1e6:
+        return fmt.Sprintf("%.2f M", rate/1e6)
+    case rate >= 1e3:
+        return fmt.Sprintf("%.2f k", rate/1e3)
+    }
+    return fmt.Sprintf("%.0f", rate)
+}
+
+// parseLevels parses a list of optimization levels such as "O0,O2"; the
+// O is optional
+func parseLevels(list string) ([]int, error) {
+    var levels []int
+    for _, field := range strings.Split(list, ",") {
+        level, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(field), "O"))
+        if err != nil || level < 0 || level > 2 {
+            return nil, fmt.Errorf("invalid optimization level %q", field)
+        }
+        levels = append(levels, level)
+    }
+    return levels, nil
+}
+
+// roundDuration rounds d to about four significant digits for display
+func roundDuration(d time.Duration) time.Duration {
+    switch {
+    case d >= 10*time.Second:
+        return d.Round(10 * time.Millisecond)
+    case d >= time.Second:
+        return d.Round(time.Millisecond)
+    case d >= time.Millisecond:
+        return d.Round(time.Microsecond)
+    }
+    return d
+}
+
+// benchResult is the outcome of timing one program
+type benchResult struct {
+    level  int           // Optimization level the program was built at
+    steps  int           // Instructions executed by a run
+    mean   time.Duration // Mean wall time of a run
+    stddev time.Duration // Standard deviation of the wall times
+    output []byte        // Output of the first run
+}
+
+// benchProgram runs program repeat times with the same input and times
+// the runs. The clock and sleep extensions get a fake clock, so that
+// their readings are repeatable and SLEEP takes no time.
+func benchProgram(program *Program, extensions ExtensionSet, input []byte, maxSteps, repeat int) (benchResult, error) {
+    var r benchResult
+    times := make([]float64, repeat)
+    for i := range times {
+        var output bytes.Buffer
+        vm := NewVM(program, bytes.NewReader(input), &output)
+        vm.SetExtensions(extensions)
+        vm.SetMaxSteps(maxSteps)
+        vm.SetClock(NewFakeClock(time.Unix(0, 0), time.Millisecond))
+        start := time.Now()
+        err := vm.Run()
+        times[i] = float64(time.Since(start))
+        vm.CloseFiles()
+        if err != nil {
+            return r, err
+        }
+        if i == 0 {
+            r.steps, r.output = vm.StepCount(), output.Bytes()
+        }
+    }
+
+    mean := 0.0
+    for _, t := range times {
+        mean += t
+    }
+    mean /= float64(repeat)
+    variance := 0.0
+    for _, t := range times {
+        variance += (t - mean) * (t - mean)
+    }
+    if repeat > 1 {
+        variance /= float64(repeat - 1)
+    }
+    r.mean, r.stddev = time.Duration(mean), time.Duration(math.Sqrt(variance))
+    return r, nil
+}
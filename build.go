@@ -0,0 +1,277 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "syscall"
+)
+
+// embedMagic ends an executable made by 'flux build -self-contained'.
+// The layout is the flux executable, then the program's bytecode, then
+// the bytecode's length as a little-endian uint64 and this marker, so
+// the program is found by reading the end of the file.
+const embedMagic = "FLUXEMBD"
+
+// embedTrailerSize is the size of the length and marker after the bytecode
+const embedTrailerSize = 8 + len(embedMagic)
+
+// buildCommand implements 'flux build'
+func buildCommand(args []string) {
+    fs := commandFlags("build")
+    selfContained := fs.Bool("self-contained", false, "embed the program in a copy of flux, making an executable that needs no other files")
+    level := fs.Int("O", 0, "optimization `level`: 0 (only long constant output), 1 or 2")
+    output := fs.String("o", "", "write the executable to `file`")
+    strip := fs.Bool("strip", false, "leave source and debug information out, so runtime errors give addresses")
+    targets := fs.String("targets", "", "build for each GOOS/GOARCH in the comma-separated `list` with the Go toolchain, such as linux/amd64,windows/amd64")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 || *output == "" {
+        fmt.Println("Error: Please specify a program and an output file")
+        printUsage("build")
+        return
+    }
+    if !*selfContained {
+        fmt.Println("Error: Please specify -self-contained, the only kind of build flux makes")
+        printUsage("build")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    if *targets != "" {
+        list, err := parseBuildTargets(*targets)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+        if isBytecode(data) || isBundle(data) {
+            fmt.Printf("Error: '%s' is compiled; building for other targets needs the source\n", filename)
+            return
+        }
+        program, err := loadProgram(filename, data, source)
+        if err != nil {
+            fmt.Printf("%v\n", err)
+            return
+        }
+        if !buildForTargets(program, filename, *output, list) {
+            os.Exit(1)
+        }
+        return
+    }
+    program, err := loadProgram(filename, data, source)
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+    program, _ = Optimize(program, *level)
+    if *strip {
+        program.Debug = nil
+    }
+    image, err := executableImage()
+    if err != nil {
+        fmt.Printf("Error reading the flux executable: %v\n", err)
+        return
+    }
+    if err := os.WriteFile(*output, embedProgram(image, program), 0755); err != nil {
+        fmt.Printf("Error writing file '%s': %v\n", *output, err)
+        return
+    }
+    fmt.Printf("Built %s from %s (%d instructions", *output, filename, len(program.Instructions))
+    if program.Extensions != 0 {
+        fmt.Printf(", extensions %s enabled", program.Extensions)
+    }
+    fmt.Println(")")
+}
+
+// executableImage returns the running flux executable. It holds no
+// program, since a built executable runs its program instead of flux's
+// commands.
+func executableImage() ([]byte, error) {
+    path, err := os.Executable()
+    if err != nil {
+        return nil, err
+    }
+    return os.ReadFile(path)
+}
+
+// embedProgram appends program to a flux executable image
+func embedProgram(image []byte, program *Program) []byte {
+    code := encodeBytecode(program)
+    out := append(image[:len(image):len(image)], code...)
+    out = binary.LittleEndian.AppendUint64(out, uint64(len(code)))
+    return append(out, embedMagic...)
+}
+
+// embeddedLength reads the trailer at the end of an executable of the
+// given size, returning the length of the embedded bytecode
+func embeddedLength(trailer []byte, size int64) (int64, bool) {
+    if len(trailer) != embedTrailerSize || !bytes.HasSuffix(trailer, []byte(embedMagic)) {
+        return 0, false
+    }
+    n := int64(binary.LittleEndian.Uint64(trailer))
+    if n <= 0 || n > size-int64(embedTrailerSize) {
+        return 0, false
+    }
+    return n, true
+}
+
+// embeddedProgram returns the program embedded in the running executable,
+// or nil for a plain flux
+func embeddedProgram() *Program {
+    path, err := os.Executable()
+    if err != nil {
+        return nil
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return nil
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil || info.Size() < int64(embedTrailerSize) {
+        return nil
+    }
+    trailer := make([]byte, embedTrailerSize)
+    if _, err := f.ReadAt(trailer, info.Size()-int64(embedTrailerSize)); err != nil {
+        return nil
+    }
+    n, ok := embeddedLength(trailer, info.Size())
+    if !ok {
+        return nil
+    }
+    code := make([]byte, n)
+    if _, err := f.ReadAt(code, info.Size()-int64(embedTrailerSize)-n); err != nil && err != io.EOF {
+        return nil
+    }
+    program, err := decodeBytecode(code)
+    if err != nil {
+        return nil
+    }
+    return program
+}
+
+// runEmbedded runs the program of a built executable on standard input
+// and output, with the extensions it needs enabled, as if it were a
+// program of its own: there is no banner, and a runtime error goes to
+// standard error with exit status 1
+func runEmbedded(program *Program) {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        stop()
+    }()
+    vm := NewVM(program, nil, nil)
+    vm.SetDevice(NewStdioDevice())
+    vm.SetExtensions(program.Extensions)
+    vm.SetContext(ctx)
+    err := vm.Run()
+    if cerr := vm.CloseFiles(); err == nil && cerr != nil {
+        err = fmt.Errorf("closing files: %v", cerr)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Runtime error: %v\n", err)
+        os.Exit(1)
+    }
+}
+
+// buildTarget is a platform of 'flux build -targets'
+type buildTarget struct {
+    goos, goarch string
+}
+
+func (t buildTarget) String() string {
+    return t.goos + "/" + t.goarch
+}
+
+// executable names the executable for the target: the -o name with the
+// platform appended, and .exe for Windows
+func (t buildTarget) executable(output string) string {
+    name := fmt.Sprintf("%s-%s-%s", output, t.goos, t.goarch)
+    if t.goos == "windows" {
+        name += ".exe"
+    }
+    return name
+}
+
+// parseBuildTargets parses a -targets list. Whether Go supports each
+// platform is left to the Go toolchain.
+func parseBuildTargets(list string) ([]buildTarget, error) {
+    var targets []buildTarget
+    seen := make(map[buildTarget]bool)
+    for _, item := range strings.Split(list, ",") {
+        goos, goarch, ok := strings.Cut(strings.TrimSpace(item), "/")
+        if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+            return nil, fmt.Errorf("invalid target %q: expected GOOS/GOARCH, such as linux/amd64", item)
+        }
+        t := buildTarget{goos, goarch}
+        if !seen[t] {
+            seen[t] = true
+            targets = append(targets, t)
+        }
+    }
+    return targets, nil
+}
+
+// buildForTargets translates program to Go and builds it for each target
+// with the Go toolchain, as flux cannot copy itself for another system.
+// It reports whether every build succeeded.
+func buildForTargets(program *Program, filename, output string, targets []buildTarget) bool {
+    goTool, err := exec.LookPath("go")
+    if err != nil {
+        fmt.Println("Error: building for other targets needs the Go toolchain, which was not found")
+        return false
+    }
+    if err := checkTranspilable("go", program); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return false
+    }
+    dir, err := os.MkdirTemp("", "flux-build-")
+    if err != nil {
+        fmt.Printf("Error creating work directory: %v\n", err)
+        return false
+    }
+    defer os.RemoveAll(dir)
+    src := filepath.Join(dir, "main.go")
+    if err := os.WriteFile(src, []byte(transpileGo(program, filename)), 0644); err != nil {
+        fmt.Printf("Error writing file '%s': %v\n", src, err)
+        return false
+    }
+
+    failed := 0
+    for _, t := range targets {
+        bin, err := filepath.Abs(t.executable(output))
+        if err != nil {
+            fmt.Printf("FAIL  %s: %v\n", t, err)
+            failed++
+            continue
+        }
+        cmd := exec.Command(goTool, "build", "-trimpath", "-o", bin, src)
+        cmd.Dir = dir
+        cmd.Env = append(os.Environ(), "GOOS="+t.goos, "GOARCH="+t.goarch, "CGO_ENABLED=0")
+        if out, err := cmd.CombinedOutput(); err != nil {
+            fmt.Printf("FAIL  %s: %v\n%s\n", t, err, strings.TrimSpace(string(out)))
+            failed++
+            continue
+        }
+        fmt.Printf("ok    %-16s %s\n", t, t.executable(output))
+    }
+    fmt.Printf("Built %d of %d target(s) from %s\n", len(targets)-failed, len(targets), filename)
+    return failed == 0
+}
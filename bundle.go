@@ -0,0 +1,212 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "unicode/utf8"
+)
+
+// bundleVersion is the format version written by 'flux bundle'
+const bundleVersion = 1
+
+// programBundle is a program archived with everything needed to run it
+// and to rebuild it: the source, the options it was compiled with, the
+// bytecode and hashes of both. Building the same source with the same
+// options gives the same bundle byte for byte, as nothing in it depends
+// on when or where it was built.
+type programBundle struct {
+    Version         int    `json:"flux_bundle"`
+    File            string `json:"file"`                   // Name of the source file
+    Source          string `json:"source,omitempty"`       // The source, if it is UTF-8 text
+    SourceBytes     []byte `json:"source_bytes,omitempty"` // The source otherwise
+    SourceHash      string `json:"source_sha256"`
+    Level           int    `json:"opt_level"`
+    Extensions      string `json:"extensions"`
+    MaxNesting      int    `json:"max_nesting"`
+    ISA             int    `json:"isa"`
+    BytecodeVersion int    `json:"bytecode_version"`
+    Bytecode        []byte `json:"bytecode"`
+    BytecodeHash    string `json:"bytecode_sha256"`
+}
+
+// isBundle reports whether data is a bundle written by 'flux bundle'
+func isBundle(data []byte) bool {
+    var header struct {
+        Version int `json:"flux_bundle"`
+    }
+    return json.Unmarshal(data, &header) == nil && header.Version > 0
+}
+
+// sha256Hex returns the SHA-256 of data in hex
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// buildBundle compiles source with the options and optimizes it to level
+func buildBundle(filename string, source []byte, opts sourceOptions, level int) (*programBundle, error) {
+    program, err := opts.compiler(string(source)).Compile()
+    if err != nil {
+        return nil, err
+    }
+    program.Debug.File = filename
+    program, _ = Optimize(program, level)
+    b := &programBundle{
+        Version:         bundleVersion,
+        File:            filename,
+        SourceHash:      sha256Hex(source),
+        Level:           level,
+        Extensions:      opts.extensions.String(),
+        MaxNesting:      opts.maxNesting,
+        ISA:             program.ISA,
+        BytecodeVersion: bytecodeVersion,
+        Bytecode:        encodeBytecode(program),
+    }
+    if utf8.Valid(source) {
+        b.Source = string(source)
+    } else {
+        b.SourceBytes = source
+    }
+    b.BytecodeHash = sha256Hex(b.Bytecode)
+    return b, nil
+}
+
+// source returns the bundled source
+func (b *programBundle) source() []byte {
+    if b.SourceBytes != nil {
+        return b.SourceBytes
+    }
+    return []byte(b.Source)
+}
+
+// sourceOptions returns the options the bundle was compiled with
+func (b *programBundle) sourceOptions() (sourceOptions, error) {
+    extensions, err := parseExtensions(b.Extensions)
+    return sourceOptions{maxNesting: b.MaxNesting, extensions: extensions}, err
+}
+
+// decodeBundle parses a bundle and checks that its bytecode is intact
+func decodeBundle(data []byte) (*programBundle, error) {
+    var b programBundle
+    if err := json.Unmarshal(data, &b); err != nil {
+        return nil, err
+    }
+    if b.Version != bundleVersion {
+        return nil, fmt.Errorf("unsupported bundle version %d (expected %d)", b.Version, bundleVersion)
+    }
+    if got := sha256Hex(b.Bytecode); got != b.BytecodeHash {
+        return nil, fmt.Errorf("bytecode does not match its hash (recorded %s, actual %s)", b.BytecodeHash, got)
+    }
+    return &b, nil
+}
+
+// loadBundle returns the program of a bundle, as 'flux run' and the other
+// commands that take a program load it
+func loadBundle(filename string, data []byte) (*Program, error) {
+    b, err := decodeBundle(data)
+    if err != nil {
+        return nil, fmt.Errorf("Error loading bundle '%s': %v", filename, err)
+    }
+    return loadBytecode(filename, b.Bytecode, false)
+}
+
+// bundleCommand implements 'flux bundle'
+func bundleCommand(args []string) {
+    fs := commandFlags("bundle")
+    level := fs.Int("O", 0, "optimization `level`: 0 (only long constant output), 1 or 2")
+    output := fs.String("o", "", "write the bundle to `file`")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 || *output == "" {
+        fmt.Println("Error: Please specify a source file and an output file")
+        printUsage("bundle")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    if isBytecode(data) || isSyntaxTree(data) || isBundle(data) {
+        fmt.Printf("Error: '%s' is not source; a bundle is built from the source\n", filename)
+        return
+    }
+    b, err := buildBundle(filename, data, source, *level)
+    if err != nil {
+        fmt.Printf("Compilation error: %v\n", err)
+        return
+    }
+    out, _ := json.MarshalIndent(b, "", "  ")
+    if err := os.WriteFile(*output, append(out, '\n'), 0644); err != nil {
+        fmt.Printf("Error writing file '%s': %v\n", *output, err)
+        return
+    }
+    fmt.Printf("Bundled %s to %s (bytecode sha256 %s)\n", filename, *output, b.BytecodeHash)
+}
+
+// verifyBundleCommand implements 'flux verify-bundle': it checks the
+// hashes of a bundle and rebuilds the bytecode from the bundled source
+// and options, which must give the same bytes. It exits with status 1 if
+// the bundle fails a check.
+func verifyBundleCommand(args []string) {
+    fs := commandFlags("verify-bundle")
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a bundle to verify")
+        printUsage("verify-bundle")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    if err := verifyBundle(data); err != nil {
+        fmt.Printf("FAIL  %s: %v\n", filename, err)
+        os.Exit(1)
+    }
+    fmt.Printf("ok    %s\n", filename)
+}
+
+// verifyBundle returns the first check the bundle fails
+func verifyBundle(data []byte) error {
+    b, err := decodeBundle(data)
+    if err != nil {
+        return err
+    }
+    source := b.source()
+    if got := sha256Hex(source); got != b.SourceHash {
+        return fmt.Errorf("source does not match its hash (recorded %s, actual %s)", b.SourceHash, got)
+    }
+    if b.BytecodeVersion != bytecodeVersion || b.ISA != ISAVersion {
+        return fmt.Errorf("built for bytecode version %d and instruction set %d; this flux writes %d and %d, so it cannot rebuild it",
+            b.BytecodeVersion, b.ISA, bytecodeVersion, ISAVersion)
+    }
+    opts, err := b.sourceOptions()
+    if err != nil {
+        return err
+    }
+    rebuilt, err := buildBundle(b.File, source, opts, b.Level)
+    if err != nil {
+        return fmt.Errorf("rebuilding: %v", err)
+    }
+    if !bytes.Equal(rebuilt.Bytecode, b.Bytecode) {
+        return fmt.Errorf("rebuilding from the source gives different bytecode (sha256 %s)", rebuilt.BytecodeHash)
+    }
+    return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/big"
+)
+
+// bytecodeMagic starts every compiled .fluxc file
+const bytecodeMagic = "FLXC"
+
+// bytecodeVersion is the layout version written by encodeBytecode
+const bytecodeVersion = 4
+
+// The .fluxc layout, with every count and length a uvarint:
+//
+//    "FLXC" version, instruction set version
+//    SHA-256 of the source (32 bytes), extension bitset
+//    constant count, then per constant:
+//        'b' length bytes                     byte string
+//        'i' sign length big-endian-magnitude  integer (sign 1 = negative)
+//    data cell count, then each cell as a signed varint
+//    instruction count, then per instruction:
+//        opcode byte, argument as a signed varint
+//    debug flag byte, then if it is 1:
+//        file name length bytes, source length bytes, one position per instruction
+
+// isBytecode reports whether data is a compiled program rather than source
+func isBytecode(data []byte) bool {
+    return bytes.HasPrefix(data, []byte(bytecodeMagic))
+}
+
+// encodeBytecode serializes a program, including its debug information if
+// it has any
+func encodeBytecode(program *Program) []byte {
+    program.decodeDebug()
+    var b []byte
+    b = append(b, bytecodeMagic...)
+    b = binary.AppendUvarint(b, bytecodeVersion)
+    b = binary.AppendUvarint(b, uint64(program.ISA))
+    b = append(b, program.SourceHash[:]...)
+    b = binary.AppendUvarint(b, uint64(program.Extensions))
+
+    b = binary.AppendUvarint(b, uint64(program.Constants.Len()))
+    for _, c := range program.Constants.Entries() {
+        if c.IsInt() {
+            b = append(b, 'i')
+            if c.Int.Sign() < 0 {
+                b = append(b, 1)
+            } else {
+                b = append(b, 0)
+            }
+            mag := c.Int.Bytes()
+            b = binary.AppendUvarint(b, uint64(len(mag)))
+            b = append(b, mag...)
+        } else {
+            b = append(b, 'b')
+            b = binary.AppendUvarint(b, uint64(len(c.Bytes)))
+            b = append(b, c.Bytes...)
+        }
+    }
+    b = binary.AppendUvarint(b, uint64(len(program.Data)))
+    for _, cell := range program.Data {
+        b = binary.AppendVarint(b, int64(cell))
+    }
+
+    b = binary.AppendUvarint(b, uint64(len(program.Instructions)))
+    for _, inst := range program.Instructions {
+        b = append(b, byte(inst.Op))
+        b = binary.AppendVarint(b, int64(inst.Arg))
+    }
+
+    if program.Debug == nil {
+        return append(b, 0)
+    }
+    b = append(b, 1)
+    b = binary.AppendUvarint(b, uint64(len(program.Debug.File)))
+    b = append(b, program.Debug.File...)
+    b = binary.AppendUvarint(b, uint64(len(program.Debug.Source)))
+    b = append(b, program.Debug.Source...)
+    for _, pos := range program.Debug.Positions {
+        b = binary.AppendUvarint(b, uint64(pos))
+    }
+    return b
+}
+
+// bytecodeReader decodes the fields of a .fluxc file
+type bytecodeReader struct {
+    data []byte
+    err  error
+}
+
+// errTruncated reports a file that ends in the middle of a field
+var errTruncated = errors.New("unexpected end of file")
+
+func (r *bytecodeReader) uvarint() uint64 {
+    if r.err != nil {
+        return 0
+    }
+    v, n := binary.Uvarint(r.data)
+    if n <= 0 {
+        r.err = errTruncated
+        return 0
+    }
+    r.data = r.data[n:]
+    return v
+}
+
+func (r *bytecodeReader) varint() int64 {
+    if r.err != nil {
+        return 0
+    }
+    v, n := binary.Varint(r.data)
+    if n <= 0 {
+        r.err = errTruncated
+        return 0
+    }
+    r.data = r.data[n:]
+    return v
+}
+
+func (r *bytecodeReader) bytes(n uint64) []byte {
+    if r.err != nil {
+        return nil
+    }
+    if n > uint64(len(r.data)) {
+        r.err = errTruncated
+        return nil
+    }
+    b := r.data[:n]
+    r.data = r.data[n:]
+    return b
+}
+
+func (r *bytecodeReader) byte() byte {
+    b := r.bytes(1)
+    if b == nil {
+        return 0
+    }
+    return b[0]
+}
+
+// decodeBytecode parses a .fluxc file and checks that the program is well
+// formed: known opcodes, matching loop targets, constant references of the
+// right kind and debug positions inside the source
+func decodeBytecode(data []byte) (*Program, error) {
+    program, err := decodeBytecodeLazily(data)
+    if err != nil {
+        return nil, err
+    }
+    if err := program.decodeDebug(); err != nil {
+        return nil, err
+    }
+    return program, nil
+}
+
+// decodeBytecodeLazily is decodeBytecode without the debug section, which
+// holds the whole source and is by far the largest part of a big file. The
+// program keeps the section undecoded, referring to data, until something
+// asks for a source position; data must stay valid until then.
+func decodeBytecodeLazily(data []byte) (*Program, error) {
+    if !isBytecode(data) {
+        return nil, fmt.Errorf("invalid bytecode file: missing %q header", bytecodeMagic)
+    }
+    r := &bytecodeReader{data: data[len(bytecodeMagic):]}
+    if v := r.uvarint(); r.err == nil && v != bytecodeVersion {
+        return nil, fmt.Errorf("unsupported bytecode version %d (expected %d); recompile the source", v, bytecodeVersion)
+    }
+    program := &Program{ISA: int(r.uvarint())}
+    if r.err == nil && program.ISA > ISAVersion {
+        return nil, fmt.Errorf("program was compiled for instruction set version %d, but this VM implements version %d; upgrade flux to run it", program.ISA, ISAVersion)
+    }
+    copy(program.SourceHash[:], r.bytes(uint64(len(program.SourceHash))))
+    program.Extensions = ExtensionSet(r.uvarint())
+    if unknown := program.Extensions &^ allExtensions(); r.err == nil && unknown != 0 {
+        return nil, fmt.Errorf("program needs extensions this VM does not know (%s); upgrade flux to run it", unknown)
+    }
+
+    var constants []Constant
+    for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+        switch tag := r.byte(); tag {
+        case 'b':
+            constants = append(constants, Constant{Bytes: append([]byte{}, r.bytes(r.uvarint())...)})
+        case 'i':
+            negative := r.byte() == 1
+            v := new(big.Int).SetBytes(r.bytes(r.uvarint()))
+            if negative {
+                v.Neg(v)
+            }
+            constants = append(constants, Constant{Int: v})
+        default:
+            if r.err == nil {
+                return nil, fmt.Errorf("invalid bytecode file: unknown constant tag %q", tag)
+            }
+        }
+    }
+    pool := constPoolOf(constants)
+    program.Constants = pool
+    for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+        program.Data = append(program.Data, int(r.varint()))
+    }
+
+    n := r.uvarint()
+    instructions := make([]Instruction, 0, min(n, uint64(len(r.data)/2))) // Every instruction takes at least 2 bytes
+    for ; n > 0 && r.err == nil; n-- {
+        op := OpCode(r.byte())
+        arg := int(r.varint())
+        if r.err == nil {
+            if _, ok := op.Info(); !ok {
+                return nil, fmt.Errorf("invalid bytecode file: unknown opcode %d at %04d", op, len(instructions))
+            }
+        }
+        instructions = append(instructions, Instruction{Op: op, Arg: arg})
+    }
+    if r.byte() == 1 && r.err == nil {
+        program.pendingDebug = r.data
+        r.data = nil
+    }
+    if r.err != nil {
+        return nil, fmt.Errorf("invalid bytecode file: %v", r.err)
+    }
+    if len(r.data) > 0 {
+        return nil, fmt.Errorf("invalid bytecode file: %d unexpected trailing byte(s)", len(r.data))
+    }
+
+    var open []int
+    blocks := make(map[int]bool)
+    for i, inst := range instructions {
+        switch inst.Op {
+        case OpLoop:
+            open = append(open, i)
+        case OpEnd:
+            if len(open) == 0 || inst.Arg != open[len(open)-1] || instructions[inst.Arg].Op != OpLoop || instructions[inst.Arg].Arg != i {
+                return nil, fmt.Errorf("invalid bytecode file: END at %04d does not match its LOOP", i)
+            }
+            open = open[:len(open)-1]
+        case OpIf, OpQuote, OpTry:
+            open = append(open, i)
+        case OpElse:
+            if len(open) == 0 || instructions[open[len(open)-1]].Op != OpIf || instructions[open[len(open)-1]].Arg != i {
+                return nil, fmt.Errorf("invalid bytecode file: ELSE at %04d does not match its IF", i)
+            }
+            open[len(open)-1] = i
+        case OpEndIf:
+            if len(open) == 0 || (instructions[open[len(open)-1]].Op != OpIf && instructions[open[len(open)-1]].Op != OpElse) || instructions[open[len(open)-1]].Arg != i {
+                return nil, fmt.Errorf("invalid bytecode file: ENDIF at %04d does not match its IF", i)
+            }
+            open = open[:len(open)-1]
+        case OpCatch:
+            if len(open) == 0 || instructions[open[len(open)-1]].Op != OpTry || instructions[open[len(open)-1]].Arg != i {
+                return nil, fmt.Errorf("invalid bytecode file: CATCH at %04d does not match its TRY", i)
+            }
+            open[len(open)-1] = i
+        case OpEndTry:
+            if len(open) == 0 || instructions[open[len(open)-1]].Op != OpCatch || instructions[open[len(open)-1]].Arg != i {
+                return nil, fmt.Errorf("invalid bytecode file: ENDTRY at %04d does not match its CATCH", i)
+            }
+            open = open[:len(open)-1]
+        case OpReturn:
+            if len(open) == 0 || instructions[open[len(open)-1]].Op != OpQuote || instructions[open[len(open)-1]].Arg != i {
+                return nil, fmt.Errorf("invalid bytecode file: RET at %04d does not match its QUOTE", i)
+            }
+            if blocks[inst.Arg] {
+                return nil, fmt.Errorf("invalid bytecode file: RET at %04d repeats block number %d", i, inst.Arg)
+            }
+            blocks[inst.Arg] = true
+            open = open[:len(open)-1]
+        case OpBreak, OpContinue:
+            loop := -1
+            for j := len(open) - 1; j >= 0 && loop < 0 && instructions[open[j]].Op != OpQuote && instructions[open[j]].Op != OpTry && instructions[open[j]].Op != OpCatch; j-- {
+                if instructions[open[j]].Op == OpLoop {
+                    loop = open[j]
+                }
+            }
+            if loop < 0 || instructions[loop].Arg != inst.Arg {
+                return nil, fmt.Errorf("invalid bytecode file: %s at %04d does not target the END of its loop", inst.Op, i)
+            }
+        case OpLoadReg, OpStoreReg:
+            if inst.Arg < 0 || inst.Arg >= NumRegisters {
+                return nil, fmt.Errorf("invalid bytecode file: %s at %04d refers to register %d of %d", inst.Op, i, inst.Arg, NumRegisters)
+            }
+        case OpSet:
+            if _, err := pool.IntValue(inst.Arg); err != nil {
+                return nil, fmt.Errorf("invalid bytecode file: SET at %04d: %v", i, err)
+            }
+        case OpEmitBytes:
+            if c, err := pool.At(inst.Arg); err != nil || c.IsInt() {
+                return nil, fmt.Errorf("invalid bytecode file: EMIT at %04d does not refer to a byte string", i)
+            }
+        case OpData:
+            if inst.Arg < 0 || inst.Arg > len(program.Data) {
+                return nil, fmt.Errorf("invalid bytecode file: DATA at %04d refers to offset %d of %d data cells", i, inst.Arg, len(program.Data))
+            }
+        }
+    }
+    if len(open) > 0 {
+        start := open[len(open)-1]
+        switch instructions[start].Op {
+        case OpLoop:
+            return nil, fmt.Errorf("invalid bytecode file: LOOP at %04d has no END", start)
+        case OpQuote:
+            return nil, fmt.Errorf("invalid bytecode file: QUOTE at %04d has no RET", start)
+        }
+        return nil, fmt.Errorf("invalid bytecode file: %s at %04d has no ENDIF", instructions[start].Op, start)
+    }
+    if undeclared := requiredExtensions(instructions) &^ program.Extensions; undeclared != 0 {
+        return nil, fmt.Errorf("invalid bytecode file: instructions use extension(s) %s, which the header does not declare", undeclared)
+    }
+    program.Instructions = instructions
+    return program, nil
+}
+
+// decodeDebug decodes the debug section that decodeBytecodeLazily left
+// undecoded, if there is one. A section that turns out to be invalid
+// leaves the program without debug information.
+func (p *Program) decodeDebug() error {
+    if p.pendingDebug == nil {
+        return nil
+    }
+    r := &bytecodeReader{data: p.pendingDebug}
+    p.pendingDebug = nil
+    debug := &DebugInfo{}
+    debug.File = string(r.bytes(r.uvarint()))
+    debug.Source = append([]byte{}, r.bytes(r.uvarint())...)
+    debug.Positions = make([]int, 0, len(p.Instructions))
+    for range p.Instructions {
+        pos := r.uvarint()
+        if r.err == nil && pos > uint64(len(debug.Source)) {
+            return fmt.Errorf("invalid bytecode file: position %d is outside the source", pos)
+        }
+        debug.Positions = append(debug.Positions, int(pos))
+    }
+    if r.err != nil {
+        return fmt.Errorf("invalid bytecode file: %v", r.err)
+    }
+    if len(r.data) > 0 {
+        return fmt.Errorf("invalid bytecode file: %d unexpected trailing byte(s)", len(r.data))
+    }
+    p.Debug = debug
+    return nil
+}
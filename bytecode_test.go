@@ -0,0 +1,132 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "math/big"
+    "slices"
+    "strings"
+    "testing"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+    tests := []struct {
+        name   string
+        source string
+        exts   ExtensionSet
+        level  int
+    }{
+        {"core", "++[-#]*,/.", 0, 0},
+        {"constants", "++++++++++++++++++++++++++++++++++++++++++++++++.+.+.,[-]+#", 0, 1},
+        {"blocks and jumps", "+(#:-)[-!;]{#}*x", ExtIf | ExtBreak | ExtEval, 0},
+        {"registers and traps", "+=b$bY/HE", ExtRegisters | ExtTrap, 0},
+        {"data", "%data a 1 -2\n%data b \"Hi\"\n\"a*\"b*L#", ExtHeap, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            compiler := NewCompiler(tt.source)
+            compiler.SetExtensions(tt.exts)
+            program, err := compiler.Compile()
+            if err != nil {
+                t.Fatal(err)
+            }
+            program, _ = Optimize(program, tt.level)
+            data := encodeBytecode(program)
+            if !isBytecode(data) {
+                t.Fatalf("encoding does not start with %q", bytecodeMagic)
+            }
+            decoded, err := decodeBytecode(data)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !slices.Equal(decoded.Instructions, program.Instructions) {
+                t.Errorf("instructions %v, want %v", decoded.Instructions, program.Instructions)
+            }
+            if got, want := decoded.Constants.Entries(), program.Constants.Entries(); !slices.EqualFunc(got, want, func(a, b Constant) bool { return a.String() == b.String() }) {
+                t.Errorf("constants %v, want %v", got, want)
+            }
+            if !slices.Equal(decoded.Data, program.Data) {
+                t.Errorf("data %v, want %v", decoded.Data, program.Data)
+            }
+            if decoded.ISA != program.ISA || decoded.Extensions != program.Extensions || decoded.SourceHash != program.SourceHash {
+                t.Errorf("header ISA %d, extensions %s; want %d, %s (or the source hash differs)", decoded.ISA, decoded.Extensions, program.ISA, program.Extensions)
+            }
+            if decoded.Debug == nil || string(decoded.Debug.Source) != tt.source || !slices.Equal(decoded.Debug.Positions, program.Debug.Positions) {
+                t.Errorf("debug information lost")
+            }
+            if again := encodeBytecode(decoded); !bytes.Equal(again, data) {
+                t.Errorf("encoding the decoded program gives different bytes")
+            }
+        })
+    }
+}
+
+func TestBytecodeStripped(t *testing.T) {
+    program, err := NewCompiler("+#").Compile()
+    if err != nil {
+        t.Fatal(err)
+    }
+    program.Debug = nil
+    decoded, err := decodeBytecode(encodeBytecode(program))
+    if err != nil || decoded.Debug != nil {
+        t.Errorf("decoding a stripped program = %v, debug %v; want no debug information", err, decoded.Debug)
+    }
+}
+
+// bytecodeOf encodes a program of the given instructions, without debug
+// information
+func bytecodeOf(exts ExtensionSet, constants []Constant, data []int, instructions ...Instruction) []byte {
+    program := NewProgram(instructions)
+    program.Extensions, program.Constants, program.Data = exts, constPoolOf(constants), data
+    return encodeBytecode(program)
+}
+
+func TestBytecodeInvalid(t *testing.T) {
+    valid := bytecodeOf(0, nil, nil, Instruction{Op: OpInc}, Instruction{Op: OpOutNum})
+    version := func(v, isa uint64) []byte {
+        b := binary.AppendUvarint([]byte(bytecodeMagic), v)
+        return append(binary.AppendUvarint(b, isa), valid[len(bytecodeMagic)+2:]...)
+    }
+    loop := func(end int) []Instruction {
+        return []Instruction{{Op: OpInc}, {Op: OpLoop, Arg: 2}, {Op: OpEnd, Arg: end}}
+    }
+    hello := []Constant{{Bytes: []byte("hi")}}
+    seven := []Constant{{Int: big.NewInt(7)}}
+    tests := []struct {
+        name  string
+        data  []byte
+        error string
+    }{
+        {"source", []byte("+#"), "missing \"FLXC\" header"},
+        {"version", version(bytecodeVersion+1, ISAVersion), "unsupported bytecode version"},
+        {"instruction set", version(bytecodeVersion, ISAVersion+1), "upgrade flux"},
+        {"unknown extension", bytecodeOf(1<<40, nil, nil, Instruction{Op: OpInc}), "extensions this VM does not know"},
+        {"truncated", valid[:len(valid)-3], "unexpected end of file"},
+        {"trailing bytes", append(valid[:len(valid):len(valid)], 0), "trailing byte"},
+        {"unknown opcode", bytecodeOf(0, nil, nil, Instruction{Op: 200}), "unknown opcode 200"},
+        {"unmatched END", bytecodeOf(0, nil, nil, loop(0)...), "END at 0002 does not match its LOOP"},
+        {"LOOP without END", bytecodeOf(0, nil, nil, Instruction{Op: OpLoop, Arg: 1}, Instruction{Op: OpInc}), "LOOP at 0000 has no END"},
+        {"SET of a byte string", bytecodeOf(0, hello, nil, Instruction{Op: OpSet}), "SET at 0000"},
+        {"EMIT of an integer", bytecodeOf(0, seven, nil, Instruction{Op: OpEmitBytes}), "EMIT at 0000 does not refer to a byte string"},
+        {"constant out of range", bytecodeOf(0, seven, nil, Instruction{Op: OpSet, Arg: 1}), "SET at 0000"},
+        {"BREAK outside a loop", bytecodeOf(ExtBreak, nil, nil, Instruction{Op: OpBreak}), "BREAK at 0000 does not target"},
+        {"undeclared extension", bytecodeOf(0, nil, nil, Instruction{Op: OpProbe}), "the header does not declare"},
+        {"register out of range", bytecodeOf(ExtRegisters, nil, nil, Instruction{Op: OpLoadReg, Arg: NumRegisters}), "refers to register"},
+        {"DATA past the data", bytecodeOf(ExtHeap, nil, []int{1}, Instruction{Op: OpData, Arg: 2}), "DATA at 0000 refers to offset 2"},
+        {"negative DATA offset", bytecodeOf(ExtHeap, nil, nil, Instruction{Op: OpData, Arg: -1}), "DATA at 0000"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := decodeBytecode(tt.data)
+            if err == nil || !strings.Contains(err.Error(), tt.error) {
+                t.Errorf("error %v, want one containing %q", err, tt.error)
+            }
+        })
+    }
+    // Every shorter prefix of a valid file is refused, not misread
+    for n := range len(valid) {
+        if _, err := decodeBytecode(valid[:n]); err == nil {
+            t.Errorf("prefix of %d bytes decoded", n)
+        }
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "context"
+    "time"
+)
+
+// Clock supplies time to the clock and sleep extensions. Replacing the
+// system clock with a FakeClock makes programs that use them repeatable.
+type Clock interface {
+    Now() time.Time
+    // Sleep pauses for d, returning ctx's error if it is cancelled first
+    Sleep(ctx context.Context, d time.Duration) error
+}
+
+// systemClock is the real clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+    return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// FakeClock is a deterministic clock: every reading advances it by Step,
+// and sleeping advances it by the requested duration without pausing
+type FakeClock struct {
+    now  time.Time
+    Step time.Duration
+}
+
+// NewFakeClock creates a fake clock showing start
+func NewFakeClock(start time.Time, step time.Duration) *FakeClock {
+    return &FakeClock{now: start, Step: step}
+}
+
+// Now returns the clock's time and then advances it by Step
+func (c *FakeClock) Now() time.Time {
+    now := c.now
+    c.now = c.now.Add(c.Step)
+    return now
+}
+
+// Sleep advances the clock by d at once
+func (c *FakeClock) Sleep(ctx context.Context, d time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    c.now = c.now.Add(d)
+    return nil
+}
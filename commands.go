@@ -0,0 +1,242 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "slices"
+    "strings"
+)
+
+// command is a subcommand of flux. The registry generates the command
+// list of 'flux help', 'flux help <command>' and usage messages from it.
+type command struct {
+    name        string
+    aliases     []string            // Other names that run it
+    args        string              // Its arguments in the command list, such as "<file>"
+    summary     string              // What it does; further lines continue it in the command list
+    usage       []string            // Synopses for usage messages, without "flux "; none if it takes no arguments
+    subcommands []string            // Arguments that select one of its flag sets, such as "run" of 'flux spec run'
+    run         func(args []string) // Runs it with the arguments after its name
+}
+
+// commands lists every command in the order of 'flux help'. It is filled
+// in by init, since 'flux help' reads it.
+var commands []*command
+
+func init() {
+    commands = []*command{
+        {name: "help", aliases: []string{"-h", "--help"}, args: "[command]", summary: "Show this help message, or the usage and flags of a command",
+            run: helpCommand},
+        {name: "guide", summary: "Show beginner's tutorial and user guide",
+            run: func([]string) { showGuide() }},
+        {name: "reference", aliases: []string{"ref"}, summary: "Show complete language reference",
+            run: func([]string) { showReference() }},
+        {name: "doc", args: "[op]", summary: "Document an operation, by character, mnemonic or name (-json)",
+            usage: []string{"doc [-json] ['+' | LOOP | OpLoop]"},
+            run:   docCommand},
+        {name: "examples", summary: "Show example programs with explanations",
+            run: func([]string) { showExamples() }},
+        {name: "demo", summary: "Run interactive demonstration programs",
+            run: func([]string) { runDemo() }},
+        {name: "run", args: "<file>", summary: "Compile and execute a Flux program or .fluxc file\n(-O0|-O1|-O2, -max-steps n, -strict-stack, -check-overflow,\n-stats, -digest, -core file, -ext list)",
+            usage: []string{"run [-O0|-O1|-O2] [-opt-report] [-max-steps n] [-strict-stack] [-check-overflow] [-max-sleep d] [-fake-clock step] [-stats] [-digest] [-deterministic] [-profile interval] [-record-trace file] [-core file] [-io-log file] [-prompt text] [-input-dir dir -output-dir dir] [-ext list] <file>"},
+            run:   runCommand},
+        {name: "compile", args: "<file>", summary: "Compile program and show bytecode\n(-O0|-O1|-O2, -o file.fluxc to save it, -json)",
+            usage: []string{"compile [-O0|-O1|-O2] [-opt-report] [-json | -o file.fluxc [-strip]] <file>"},
+            run:   compileCommand},
+        {name: "interactive", aliases: []string{"repl"}, summary: "Start interactive REPL",
+            run: func([]string) { runInteractive() }},
+        {name: "debug", args: "<file>", summary: "Step through a program with watchpoints",
+            usage: []string{"debug [-input file] [-ext list] [-tui | -script file] <file>"},
+            run:   debugCommand},
+        {name: "transpile", args: "<file>", summary: "Translate a program to Go or C (-target go|c)",
+            usage: []string{"transpile [-target go|c] [-o file] [-ext list] <file>"},
+            run:   transpileCommand},
+        {name: "verify", args: "<file>", summary: "Check that transpiled output matches the VM",
+            usage: []string{"verify [-input file] [-timeout d] [-max-steps n] [-ext list] <file>"},
+            run:   verifyCommand},
+        {name: "fuzz", summary: "Property-test the compiler and VM with random programs",
+            usage: []string{"fuzz [-n cases] [-seed s]"},
+            run:   fuzzCommand},
+        {name: "selftest", summary: "Check the core semantics under a VM configuration (-O, -ext, -strict-stack)",
+            usage: []string{"selftest [-v] [-O0|-O1|-O2] [-strict-stack] [-check-overflow] [-max-steps n] [-ext list]"},
+            run:   selfTestCommand},
+        {name: "spec", args: "run|export", summary: "Run a conformance suite of JSON spec tests, or export the semantics",
+            usage: []string{"spec run [-v] [-p n] [-run regexp] [-shard k/n] [-format text|junit|tap|json] <dir|file>...",
+                "spec export [-format json]"},
+            subcommands: []string{"run", "export"},
+            run:         specCommand},
+        {name: "test", args: "<dir>", summary: "Same as spec run",
+            usage: []string{"test [-v] [-p n] [-run regexp] [-shard k/n] [-format text|junit|tap|json] <dir|file>..."},
+            run:   func(args []string) { specCommand(append([]string{"run"}, args...)) }},
+        {name: "min", args: "<file>", summary: "Strip comments and whitespace (-w n, -decoy)",
+            usage: []string{"min [-w n] [-decoy] [-seed s] [-o file] [-ext list] <file>"},
+            run:   minCommand},
+        {name: "diff", args: "<a> <b>", summary: "Compare two programs by bytecode, ignoring comments",
+            usage: []string{"diff [-raw] [-O0|-O1|-O2] [-ext list] <a.flux> <b.flux>"},
+            run:   diffCommand},
+        {name: "reduce", args: "<file>", summary: "Shrink a program while a -check command still succeeds",
+            usage: []string{"reduce -check 'flux run {} | grep -q BUG' [-o file] [-timeout d] [-ext list] <file>"},
+            run:   reduceCommand},
+        {name: "link", args: "<files>", summary: "Join compiled programs into one (-o file.fluxc, -p n)",
+            usage: []string{"link [-p n] [-ext list] <a.fluxc|a.flux> <b.fluxc|b.flux>... -o <file.fluxc>"},
+            run:   linkCommand},
+        {name: "bundle", args: "<file>", summary: "Archive source, options and bytecode in one reproducible file",
+            usage: []string{"bundle [-O0|-O1|-O2] [-max-nesting n] [-ext list] -o <file.bundle> <file>"},
+            run:   bundleCommand},
+        {name: "verify-bundle", args: "<file>", summary: "Check a bundle's hashes and rebuild its bytecode",
+            usage: []string{"verify-bundle <file.bundle>"},
+            run:   verifyBundleCommand},
+        {name: "build", args: "<file>", summary: "Make a standalone executable of a program (-self-contained)",
+            usage: []string{"build -self-contained [-O0|-O1|-O2] [-strip] [-ext list] -o <executable> <file>", "build -self-contained -targets os/arch,... [-ext list] -o <name> <file>"},
+            run:   buildCommand},
+        {name: "pipe", args: "<files>", summary: "Run programs concurrently, each feeding the next",
+            usage: []string{"pipe [-O0|-O1|-O2] [-max-steps n] [-strict-stack] [-check-overflow] [-stats] [-ext list] <a.flux> <b.flux>..."},
+            run:   pipeCommand},
+        {name: "watch", args: "<file>", summary: "Run a program again whenever it changes (-hot)",
+            usage: []string{"watch [-hot] [-interval d] [-O0|-O1|-O2] [-max-steps n] [-stats] [-ext list] <file>"},
+            run:   watchCommand},
+        {name: "serve", summary: "Run programs and REPL sessions for clients over HTTP",
+            usage: []string{"serve [-addr host:port] [-workers n] [-slice n] [-max-steps n] [-timeout d] [-max-output n] [-session-steps n] [-report-steps n] [-session-ttl d] [-max-sessions n] [-max-live n] [-rate r] [-burst n] [-max-body n] [-max-source n] [-max-stdin n] [-trust-proxy [-trusted-proxies list]] [-api-keys file] [-ext list]"},
+            run:   serveCommand},
+        {name: "parse", args: "<file>", summary: "Show a program's syntax tree (-json)",
+            usage: []string{"parse [-json] [-ext list] <file>"},
+            run:   parseCommand},
+        {name: "grammar", summary: "Write editor syntax highlighting (-format tmlanguage|vim|emacs)",
+            usage: []string{"grammar [-format tmlanguage|vim|emacs] > file"},
+            run:   grammarCommand},
+        {name: "trace", args: "analyze <f>", summary: "Summarize a trace recorded with 'run -record-trace'",
+            usage:       []string{"trace analyze [-top n] [-events n] <file.ftrace>"},
+            subcommands: []string{"analyze"},
+            run:         traceCommand},
+        {name: "stats", args: "<file>", summary: "Show program size, operation counts and loop nesting",
+            usage: []string{"stats [-O0|-O1|-O2] [-max-nesting n] [-ext list] <file>"},
+            run:   statsCommand},
+        {name: "analyze", args: "bounds|halt <f>", summary: "Report how often each loop runs (bounds), or decide whether\na program without input halts (halt, -max-states n)",
+            usage:       []string{"analyze bounds [-ext list] <file>", "analyze halt [-max-states n] [-ext list] <file>"},
+            subcommands: []string{"bounds", "halt"},
+            run:         analyzeCommand},
+        {name: "bench", args: "<file>", summary: "Time a program at each optimization level (-vm, -compile)",
+            usage: []string{"bench [-levels O0,O1,O2] [-repeat n] [-input file] [-max-steps n] [-vm] [-compile] [-ext list] <file>"},
+            run:   benchCommand},
+        {name: "extensions", aliases: []string{"ext"}, args: "[file]", summary: "List extensions, or those a program needs",
+            usage: []string{"extensions [-ext list] [file]"},
+            run:   extensionsCommand},
+        {name: "opcodes", summary: "List the bytecode instructions (-json)",
+            usage: []string{"opcodes [-json]"},
+            run:   opcodesCommand},
+    }
+}
+
+// lookupCommand returns the command with the given name or alias, or nil
+func lookupCommand(name string) *command {
+    for _, c := range commands {
+        if c.name == name || slices.Contains(c.aliases, name) {
+            return c
+        }
+    }
+    return nil
+}
+
+// printCommandList prints the COMMANDS section of 'flux help': each
+// command with its arguments, and its summary from column 22, or on the
+// next line if they do not fit
+func printCommandList() {
+    for _, c := range commands {
+        label := strings.TrimSpace(c.name + " " + c.args)
+        lines := strings.Split(c.summary, "\n")
+        if aliases := visibleAliases(c); len(aliases) > 0 {
+            lines[0] += " (also: " + strings.Join(aliases, ", ") + ")"
+        }
+        if len(label) > 17 {
+            fmt.Printf("    %s\n", label)
+            label = ""
+        }
+        fmt.Printf("    %-17s %s\n", label, lines[0])
+        for _, line := range lines[1:] {
+            fmt.Printf("    %-17s %s\n", "", line)
+        }
+    }
+}
+
+// visibleAliases returns the aliases of c worth listing; the usual help
+// flags go without saying
+func visibleAliases(c *command) []string {
+    var aliases []string
+    for _, a := range c.aliases {
+        if !strings.HasPrefix(a, "-") {
+            aliases = append(aliases, a)
+        }
+    }
+    return aliases
+}
+
+// helpCommand implements 'flux help', and with a command name shows what
+// the command does, its usage and its flags
+func helpCommand(args []string) {
+    if len(args) == 0 {
+        showHelp()
+        return
+    }
+    c := lookupCommand(args[0])
+    if c == nil || len(args) > 1 {
+        fmt.Printf("Unknown command: %s\n", strings.Join(args, " "))
+        fmt.Println("Run 'flux help' for the list of commands")
+        return
+    }
+    fmt.Printf("flux %s: %s\n", c.name, strings.ReplaceAll(c.summary, "\n", " "))
+    if aliases := visibleAliases(c); len(aliases) > 0 {
+        fmt.Printf("Also: %s\n", strings.Join(aliases, ", "))
+    }
+    if len(c.usage) == 0 {
+        return
+    }
+    // Asked for help, a command's flag set prints its usage and flags
+    if len(c.subcommands) == 0 {
+        fmt.Println()
+        c.run([]string{"-h"})
+        return
+    }
+    for _, sub := range c.subcommands {
+        fmt.Println()
+        c.run([]string{sub, "-h"})
+    }
+}
+
+// printUsage prints the usage of the command, or of a subcommand such as
+// "analyze halt", from the registry
+func printUsage(name string) {
+    c := lookupCommand(strings.Fields(name)[0])
+    var synopses []string
+    for _, u := range c.usage {
+        if u == name || strings.HasPrefix(u, name+" ") {
+            synopses = append(synopses, u)
+        }
+    }
+    for i, u := range synopses {
+        if i == 0 {
+            fmt.Printf("Usage: flux %s\n", u)
+        } else {
+            fmt.Printf("       flux %s\n", u)
+        }
+    }
+}
+
+// commandFlags returns a flag set for the named command or subcommand.
+// Given -h, or a flag it does not know, it prints the usage from the
+// registry and what each flag does.
+func commandFlags(name string) *flag.FlagSet {
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+    fs.SetOutput(os.Stdout)
+    fs.Usage = func() {
+        printUsage(name)
+        hasFlags := false
+        fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+        if hasFlags {
+            fmt.Println("Flags:")
+            fs.PrintDefaults()
+        }
+    }
+    return fs
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "fmt"
+    "math/big"
+)
+
+// Constant is an entry in a program's constant pool: either a byte string
+// (written by EMIT) or an integer (loaded by SET)
+type Constant struct {
+    Bytes []byte   `json:"bytes,omitempty"`
+    Int   *big.Int `json:"int,omitempty"`
+}
+
+// IsInt reports whether the constant is an integer
+func (c Constant) IsInt() bool {
+    return c.Int != nil
+}
+
+// String formats the constant for listings
+func (c Constant) String() string {
+    if c.IsInt() {
+        return c.Int.String()
+    }
+    return fmt.Sprintf("%q", c.Bytes)
+}
+
+// ConstPool holds the constants instructions refer to by index. Adding a
+// constant that is already present returns the existing index.
+type ConstPool struct {
+    entries []Constant
+    index   map[string]int // Entry key -> index, for deduplication
+}
+
+// NewConstPool creates an empty constant pool
+func NewConstPool() *ConstPool {
+    return &ConstPool{index: make(map[string]int)}
+}
+
+// add appends c unless an entry with the same key exists
+func (p *ConstPool) add(key string, c Constant) int {
+    if i, ok := p.index[key]; ok {
+        return i
+    }
+    p.entries = append(p.entries, c)
+    p.index[key] = len(p.entries) - 1
+    return len(p.entries) - 1
+}
+
+// AddBytes adds a byte string and returns its index
+func (p *ConstPool) AddBytes(b []byte) int {
+    return p.add("b"+string(b), Constant{Bytes: append([]byte(nil), b...)})
+}
+
+// AddInt adds an integer and returns its index
+func (p *ConstPool) AddInt(v *big.Int) int {
+    return p.add("i"+v.String(), Constant{Int: new(big.Int).Set(v)})
+}
+
+// Len returns the number of constants in the pool
+func (p *ConstPool) Len() int {
+    if p == nil {
+        return 0
+    }
+    return len(p.entries)
+}
+
+// At returns the constant at index i
+func (p *ConstPool) At(i int) (Constant, error) {
+    if i < 0 || i >= p.Len() {
+        return Constant{}, fmt.Errorf("constant %d out of range (pool has %d)", i, p.Len())
+    }
+    return p.entries[i], nil
+}
+
+// Entries returns the constants in index order
+func (p *ConstPool) Entries() []Constant {
+    if p == nil {
+        return nil
+    }
+    return p.entries
+}
+
+// IntValue returns the integer constant at index i as an accumulator
+// value, wrapping it to the accumulator's width like arithmetic does
+func (p *ConstPool) IntValue(i int) (int, error) {
+    c, err := p.At(i)
+    if err != nil {
+        return 0, err
+    }
+    if !c.IsInt() {
+        return 0, fmt.Errorf("constant %d is not an integer", i)
+    }
+    mask := new(big.Int).SetUint64(^uint64(0))
+    return int(new(big.Int).And(c.Int, mask).Uint64()), nil
+}
+
+// constPoolOf rebuilds a pool from entries read from a core or bytecode
+// file, keeping every entry at its original index
+func constPoolOf(entries []Constant) *ConstPool {
+    p := NewConstPool()
+    for _, c := range entries {
+        key := "b" + string(c.Bytes)
+        if c.IsInt() {
+            key = "i" + c.Int.String()
+        }
+        if _, ok := p.index[key]; !ok {
+            p.index[key] = len(p.entries)
+        }
+        p.entries = append(p.entries, c)
+    }
+    return p
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+)
+
+// coreTraceEntries is how many recently executed instructions a core file
+// keeps
+const coreTraceEntries = 64
+
+// coreFormat identifies core files and their layout version
+const coreFormat = "flux-core/1"
+
+// coreDump is the post-mortem record written when a program aborts. It
+// holds everything 'flux debug -core' needs to show where and in what
+// state the machine stopped, without the original source file.
+type coreDump struct {
+    Format       string            `json:"format"`
+    File         string            `json:"file"`
+    Source       string            `json:"source"`
+    Error        string            `json:"error"`
+    Steps        int               `json:"steps"`
+    State        Snapshot          `json:"state"`
+    Instructions []coreInstruction `json:"instructions"`
+    Constants    []Constant        `json:"constants,omitempty"`
+    Data         []int             `json:"data,omitempty"`
+    ISA          int               `json:"isa"`
+    Extensions   ExtensionSet      `json:"extensions,omitempty"`
+    Positions    []int             `json:"positions"`
+    Trace        []coreTraceEntry  `json:"trace"`
+}
+
+// coreInstruction is an instruction with its opcode spelled out
+type coreInstruction struct {
+    Op  string `json:"op"`
+    Arg int    `json:"arg,omitempty"`
+}
+
+// coreTraceEntry is a TraceEntry with its opcode spelled out
+type coreTraceEntry struct {
+    PC          int    `json:"pc"`
+    Op          string `json:"op"`
+    Accumulator int    `json:"acc"`
+    Depth       int    `json:"depth"`
+}
+
+// newCoreDump captures the state of a machine that stopped with err. A
+// program without debug information is recorded with every instruction
+// at offset 0 of an empty source, and loads without it again.
+func newCoreDump(vm *VM, err error) *coreDump {
+    program := vm.program
+    program.decodeDebug()
+    core := &coreDump{
+        Format:     coreFormat,
+        Error:      err.Error(),
+        Steps:      vm.StepCount(),
+        State:      vm.Snapshot(),
+        Constants:  program.Constants.Entries(),
+        Data:       program.Data,
+        ISA:        program.ISA,
+        Extensions: program.Extensions,
+    }
+    if program.Debug != nil {
+        core.File, core.Source, core.Positions = program.Debug.File, string(program.Debug.Source), program.Debug.Positions
+    } else {
+        core.Positions = make([]int, len(program.Instructions))
+    }
+    for _, inst := range program.Instructions {
+        core.Instructions = append(core.Instructions, coreInstruction{Op: inst.Op.String(), Arg: inst.Arg})
+    }
+    for _, e := range vm.TraceRing() {
+        core.Trace = append(core.Trace, coreTraceEntry{PC: e.PC, Op: e.Op.String(), Accumulator: e.Accumulator, Depth: e.Depth})
+    }
+    return core
+}
+
+// write saves the core dump as JSON
+func (c *coreDump) write(path string) error {
+    data, err := json.MarshalIndent(c, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// loadCoreDump reads a core file written by write
+func loadCoreDump(path string) (*coreDump, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var core coreDump
+    if err := json.Unmarshal(data, &core); err != nil {
+        return nil, fmt.Errorf("invalid core file: %v", err)
+    }
+    if core.Format != coreFormat {
+        return nil, fmt.Errorf("unsupported core file format %q", core.Format)
+    }
+    if len(core.Positions) != len(core.Instructions) {
+        return nil, fmt.Errorf("invalid core file: %d positions for %d instructions", len(core.Positions), len(core.Instructions))
+    }
+    return &core, nil
+}
+
+// program rebuilds the program stored in the core file
+func (c *coreDump) program() (*Program, error) {
+    instructions := make([]Instruction, len(c.Instructions))
+    for i, ci := range c.Instructions {
+        op, ok := opcodeByName(ci.Op)
+        if !ok {
+            return nil, fmt.Errorf("invalid core file: unknown opcode %q at %04d", ci.Op, i)
+        }
+        instructions[i] = Instruction{Op: op, Arg: ci.Arg}
+    }
+    program := &Program{
+        Instructions: instructions,
+        Constants:    constPoolOf(c.Constants),
+        Data:         c.Data,
+        ISA:          c.ISA,
+        Extensions:   c.Extensions,
+    }
+    if c.File != "" || c.Source != "" {
+        program.Debug = &DebugInfo{File: c.File, Source: []byte(c.Source), Positions: c.Positions}
+    }
+    return program, nil
+}
+
+// trace decodes the recorded instructions leading up to the abort
+func (c *coreDump) trace() []TraceEntry {
+    entries := make([]TraceEntry, 0, len(c.Trace))
+    for _, e := range c.Trace {
+        op, _ := opcodeByName(e.Op)
+        entries = append(entries, TraceEntry{PC: e.PC, Op: op, Accumulator: e.Accumulator, Depth: e.Depth})
+    }
+    return entries
+}
@@ -0,0 +1,102 @@
+package main
+
+import "fmt"
+
+// MaxCoroutines is how many coroutines a program may spawn in one run
+const MaxCoroutines = 1000
+
+// coroutine is one of the machines taking turns on a program. The one
+// running lives in the VM itself; the others wait here with their state
+// saved.
+type coroutine struct {
+    state   Snapshot // Machine state while another coroutine runs
+    inbox   []int    // Values sent to it and not yet received, oldest first
+    waiting bool     // Blocked receiving from an empty inbox
+    done    bool     // Returned from its block
+}
+
+// coroutineTable returns the coroutines of the run, creating the entry
+// for the main program, number 0, on first use
+func (vm *VM) coroutineTable() []*coroutine {
+    if vm.coroutines == nil {
+        vm.coroutines = []*coroutine{{}}
+    }
+    return vm.coroutines
+}
+
+// spawn pops a block number and creates a coroutine that runs the block
+// on a machine of its own, starting with its number in the accumulator
+// and an empty stack. The spawning program gets the number too.
+func (vm *VM) spawn() error {
+    n, err := vm.pop()
+    if err != nil {
+        return err
+    }
+    start, ok := vm.block(n)
+    if !ok {
+        return fault(FaultOperand, "%d is not a block at %s", n, vm.program.Location(vm.pc))
+    }
+    table := vm.coroutineTable()
+    if len(table) > MaxCoroutines {
+        return fault(FaultLimit, "more than %d coroutines at %s", MaxCoroutines, vm.program.Location(vm.pc))
+    }
+    id := len(table)
+    // Returning from the block leads past the last instruction, which ends
+    // the coroutine
+    state := Snapshot{Accumulator: id, PC: start, Calls: []int{len(vm.instructions)}}
+    vm.coroutines = append(table, &coroutine{state: state})
+    vm.accumulator = id
+    return nil
+}
+
+// send pops a coroutine number and adds the accumulator to that
+// coroutine's inbox
+func (vm *VM) send() error {
+    to, err := vm.pop()
+    if err != nil {
+        return err
+    }
+    table := vm.coroutineTable()
+    if to < 0 || to >= len(table) {
+        return fault(FaultOperand, "no coroutine %d at %s", to, vm.program.Location(vm.pc))
+    }
+    if table[to].done {
+        return fault(FaultOperand, "coroutine %d has finished at %s", to, vm.program.Location(vm.pc))
+    }
+    table[to].inbox = append(table[to].inbox, vm.accumulator)
+    return nil
+}
+
+// receive loads the oldest value in the running coroutine's inbox into
+// the accumulator. It reports false, marking the coroutine as waiting,
+// when the inbox is empty.
+func (vm *VM) receive() bool {
+    c := vm.coroutineTable()[vm.current]
+    if len(c.inbox) == 0 {
+        c.waiting = true
+        return false
+    }
+    vm.accumulator = c.inbox[0]
+    c.inbox = c.inbox[1:]
+    return true
+}
+
+// switchCoroutine saves the running coroutine and resumes the next one, in
+// order of number, that can make progress. The running coroutine itself
+// comes last, so it keeps running when no other can.
+func (vm *VM) switchCoroutine() error {
+    table := vm.coroutineTable()
+    table[vm.current].state = vm.threadState()
+    for i := 1; i <= len(table); i++ {
+        next := (vm.current + i) % len(table)
+        c := table[next]
+        if c.done || c.waiting && len(c.inbox) == 0 {
+            continue
+        }
+        c.waiting = false
+        vm.current = next
+        vm.restoreThread(c.state)
+        return nil
+    }
+    return fmt.Errorf("deadlock: every coroutine is waiting to receive (coroutine %d at %s)", vm.current, vm.program.Location(vm.pc))
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// debugger drives a VM one instruction at a time under user control
+type debugger struct {
+    vm          *VM
+    program     *Program      // Program being debugged, at the bytecode level if it has no debug information
+    name        string        // Name of the program's file
+    extensions  ExtensionSet  // Extensions the machine may execute
+    input       io.Reader     // Program input for ','
+    output      io.Writer     // Program output
+    commands    *bufio.Reader // Debugger command input
+    out         io.Writer     // Debugger messages
+    watches     []*watchpoint
+    breakpoints []*breakpoint // Breakpoint table consulted before each step
+    nextID      int           // Number given to the next watch or breakpoint
+    stoppedAt   int           // Address of the breakpoint we are stopped at, or -1
+    checkpoints []Snapshot    // Saved states, numbered from 1
+    failures    int           // Number of failed 'expect' commands
+    postMortem  []TraceEntry  // Instructions leading up to a loaded core dump
+}
+
+// condition compares a machine property against a constant, e.g. acc > 1000
+type condition struct {
+    subject string // "acc" or "depth"
+    op      string // One of == != < <= > >=
+    value   int
+}
+
+// conditionPattern matches conditions such as "acc == 0" or "depth>50"
+var conditionPattern = regexp.MustCompile(`^\s*(acc|depth)\s*(==|!=|<=|>=|<|>)\s*(-?\d+)\s*$`)
+
+// parseCondition parses a condition expression
+func parseCondition(text string) (condition, error) {
+    m := conditionPattern.FindStringSubmatch(text)
+    if m == nil {
+        return condition{}, fmt.Errorf("invalid condition %q (expected e.g. 'acc == 0' or 'depth > 50')", text)
+    }
+    value, err := strconv.Atoi(m[3])
+    if err != nil {
+        return condition{}, fmt.Errorf("invalid value in condition: %v", err)
+    }
+    return condition{subject: m[1], op: m[2], value: value}, nil
+}
+
+// eval evaluates the condition against the machine state
+func (c condition) eval(vm *VM) bool {
+    actual := vm.accumulator
+    if c.subject == "depth" {
+        actual = len(vm.stack)
+    }
+
+    switch c.op {
+    case "==":
+        return actual == c.value
+    case "!=":
+        return actual != c.value
+    case "<":
+        return actual < c.value
+    case "<=":
+        return actual <= c.value
+    case ">":
+        return actual > c.value
+    case ">=":
+        return actual >= c.value
+    }
+    return false
+}
+
+func (c condition) String() string {
+    return fmt.Sprintf("%s %s %d", c.subject, c.op, c.value)
+}
+
+// watchpoint pauses execution when its condition becomes true. It fires on
+// the transition from false to true, so a condition that stays satisfied
+// does not stop every following instruction.
+type watchpoint struct {
+    id   int
+    cond condition
+    last bool // Value of the condition after the previous instruction
+}
+
+// breakpoint stops execution before the instruction at addr is executed
+type breakpoint struct {
+    id        int
+    addr      int        // Instruction address
+    spec      string     // Location as the user gave it
+    cond      *condition // Only stop when this holds, if set
+    ignore    int        // Number of upcoming hits to pass over
+    hits      int        // Times the breakpoint was reached
+    temporary bool       // Delete after the first stop
+}
+
+// resolveLocation turns a breakpoint location into an instruction address.
+// A location is either an address such as 0042 or file:line, which selects
+// the first instruction compiled from that line.
+func (d *debugger) resolveLocation(spec string) (int, error) {
+    if i := strings.LastIndex(spec, ":"); i >= 0 {
+        line, err := strconv.Atoi(spec[i+1:])
+        if err != nil || line < 1 {
+            return 0, fmt.Errorf("invalid line number in %q", spec)
+        }
+        if d.program.Debug == nil {
+            return 0, fmt.Errorf("the program has no source lines; give an address such as 0042")
+        }
+        lines := lineStarts(d.program.Debug.Source)
+        for addr, offset := range d.program.Debug.Positions {
+            if l, _ := lineColAt(lines, offset); l == line {
+                return addr, nil
+            }
+        }
+        return 0, fmt.Errorf("no instructions on line %d", line)
+    }
+
+    addr, err := strconv.Atoi(spec)
+    if err != nil {
+        return 0, fmt.Errorf("invalid location %q (expected an address like 0042 or file:line)", spec)
+    }
+    if addr < 0 || addr >= len(d.program.Instructions) {
+        return 0, fmt.Errorf("address %04d is outside the program (0000-%04d)", addr, len(d.program.Instructions)-1)
+    }
+    return addr, nil
+}
+
+// addBreakpoint parses "<location> [if <cond>]" and adds it to the table
+func (d *debugger) addBreakpoint(args string, temporary bool) {
+    spec, condText, hasCond := strings.Cut(args, " if ")
+    spec = strings.TrimSpace(spec)
+    if spec == "" {
+        fmt.Fprintln(d.out, "Usage: break <addr|file:line> [if <cond>]")
+        return
+    }
+
+    addr, err := d.resolveLocation(spec)
+    if err != nil {
+        fmt.Fprintf(d.out, "Error: %v\n", err)
+        return
+    }
+
+    b := &breakpoint{id: d.nextID, addr: addr, spec: spec, temporary: temporary}
+    if hasCond {
+        cond, err := parseCondition(condText)
+        if err != nil {
+            fmt.Fprintf(d.out, "Error: %v\n", err)
+            return
+        }
+        b.cond = &cond
+    }
+    d.nextID++
+    d.breakpoints = append(d.breakpoints, b)
+
+    kind := "Breakpoint"
+    if temporary {
+        kind = "Temporary breakpoint"
+    }
+    fmt.Fprintf(d.out, "%s %d at %04d (%s)", kind, b.id, addr, d.location(addr))
+    if b.cond != nil {
+        fmt.Fprintf(d.out, " if %s", b.cond)
+    }
+    fmt.Fprintln(d.out)
+}
+
+// checkBreakpoints consults the table for the instruction about to run and
+// returns the breakpoint to stop at, if any. Every matching breakpoint whose
+// condition holds counts a hit, even while its ignore count runs down.
+func (d *debugger) checkBreakpoints() *breakpoint {
+    var stop *breakpoint
+    for _, b := range d.breakpoints {
+        if b.addr != d.vm.pc || (b.cond != nil && !b.cond.eval(d.vm)) {
+            continue
+        }
+        b.hits++
+        if b.ignore > 0 {
+            b.ignore--
+            continue
+        }
+        if stop == nil {
+            stop = b
+        }
+    }
+    if stop != nil && stop.temporary {
+        d.deleteBreakpoint(stop.id)
+    }
+    return stop
+}
+
+// deleteBreakpoint removes a breakpoint and reports whether it existed
+func (d *debugger) deleteBreakpoint(id int) bool {
+    for i, b := range d.breakpoints {
+        if b.id == id {
+            d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+// debugCommand implements 'flux debug'
+func debugCommand(args []string) {
+    fs := commandFlags("debug")
+    inputFile := fs.String("input", "", "read program input from `file` instead of the terminal")
+    useTUI := fs.Bool("tui", false, "use the full-screen terminal interface")
+    scriptFile := fs.String("script", "", "run debugger commands from `file` instead of prompting")
+    coreFile := fs.String("core", "", "inspect the core `file` written by 'flux run -core'")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 && !(*coreFile != "" && len(positional) == 0) {
+        fmt.Println("Error: Please specify a file to debug")
+        printUsage("debug")
+        fmt.Println("       flux debug -core <core file>")
+        return
+    }
+
+    var (
+        program *Program
+        core    *coreDump
+    )
+    if *coreFile != "" {
+        core, err = loadCoreDump(*coreFile)
+        if err == nil {
+            program, err = core.program()
+        }
+        if err != nil {
+            fmt.Printf("Error loading core file '%s': %v\n", *coreFile, err)
+            return
+        }
+        source.extensions |= program.Extensions // The aborted run had them enabled
+    } else {
+        filename := positional[0]
+        data, err := os.ReadFile(filename)
+        if err != nil {
+            fmt.Printf("Error reading file '%s': %v\n", filename, err)
+            return
+        }
+        program, err = loadProgram(filename, data, source)
+        if err != nil {
+            fmt.Printf("%v\n", err)
+            return
+        }
+    }
+
+    commands := bufio.NewReader(os.Stdin)
+    var input io.Reader = commands
+    if *scriptFile != "" {
+        script, err := os.Open(*scriptFile)
+        if err != nil {
+            fmt.Printf("Error opening script '%s': %v\n", *scriptFile, err)
+            return
+        }
+        defer script.Close()
+        commands = bufio.NewReader(script)
+    }
+    if *inputFile != "" {
+        f, err := os.Open(*inputFile)
+        if err != nil {
+            fmt.Printf("Error opening input file '%s': %v\n", *inputFile, err)
+            return
+        }
+        defer f.Close()
+        input = f
+    }
+
+    d := &debugger{
+        program:    program,
+        extensions: source.extensions,
+        input:      input,
+        output:     os.Stdout,
+        commands:   commands,
+        out:        os.Stdout,
+        nextID:     1,
+    }
+    switch {
+    case program.Debug != nil && program.Debug.File != "":
+        d.name = program.Debug.File
+    case core != nil:
+        d.name = *coreFile
+    default:
+        d.name = positional[0]
+    }
+    if core != nil {
+        d.loadCore(core)
+        d.repl()
+        return
+    }
+    if *scriptFile != "" {
+        d.restart()
+        d.runScript()
+        if d.failures > 0 {
+            fmt.Fprintf(d.out, "%d expectation(s) failed\n", d.failures)
+            os.Exit(1)
+        }
+        return
+    }
+    if *useTUI {
+        d.runTUI()
+        return
+    }
+    d.restart()
+
+    d.greet()
+    d.repl()
+}
+
+// loadCore puts the machine into the state recorded in a core dump and
+// reports why the program stopped
+func (d *debugger) loadCore(core *coreDump) {
+    d.restart()
+    d.vm.Restore(core.State)
+    d.stoppedAt = d.vm.pc
+    for _, w := range d.watches {
+        w.last = w.cond.eval(d.vm)
+    }
+    d.postMortem = core.trace()
+
+    fmt.Fprintf(d.out, "Post-mortem of %s after %d steps\n", d.name, core.Steps)
+    fmt.Fprintf(d.out, "Program stopped with: %s\n", core.Error)
+    if !d.vm.Halted() {
+        fmt.Fprintf(d.out, "Failing instruction: %04d %s at %s\n", d.vm.pc, d.vm.instructions[d.vm.pc].Op, d.location(d.vm.pc))
+    }
+    fmt.Fprintln(d.out, "Use 'trace' to see the instructions leading up to it, 'help' for commands.")
+    d.printState()
+}
+
+// greet introduces a debugging session
+func (d *debugger) greet() {
+    fmt.Fprintf(d.out, "Debugging %s (%d instructions). Type 'help' for commands.\n", d.name, len(d.program.Instructions))
+    if d.program.Debug == nil {
+        fmt.Fprintln(d.out, "No debug information: debugging by instruction address.")
+    }
+}
+
+// restart creates a fresh machine at the start of the program
+func (d *debugger) restart() {
+    if d.vm != nil {
+        d.vm.CloseFiles()
+    }
+    d.vm = NewVM(d.program, d.input, d.output)
+    d.vm.SetExtensions(d.extensions)
+    d.vm.EnableTraceRing(coreTraceEntries)
+    d.stoppedAt = -1
+    for _, b := range d.breakpoints {
+        b.hits = 0
+    }
+    for _, w := range d.watches {
+        w.last = w.cond.eval(d.vm)
+    }
+}
+
+// location describes the source position of the instruction at addr
+func (d *debugger) location(addr int) string {
+    if addr >= len(d.program.Instructions) {
+        return "end of program"
+    }
+    return d.program.Location(addr)
+}
+
+// repl reads and executes debugger commands until quit or end of input
+func (d *debugger) repl() {
+    for {
+        fmt.Fprint(d.out, "(fdb) ")
+        line, err := d.commands.ReadString('\n')
+        if err != nil && line == "" {
+            fmt.Fprintln(d.out)
+            return
+        }
+        if !d.execute(strings.TrimSpace(line)) {
+            return
+        }
+    }
+}
+
+// runScript executes commands non-interactively, echoing each one before
+// its results so the transcript can be compared against an expected one.
+// Blank lines and lines starting with '#' are skipped.
+func (d *debugger) runScript() {
+    for {
+        line, err := d.commands.ReadString('\n')
+        line = strings.TrimSpace(line)
+        if line != "" && !strings.HasPrefix(line, "#") {
+            fmt.Fprintf(d.out, "(fdb) %s\n", line)
+            if !d.execute(line) {
+                return
+            }
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+// execute runs one debugger command and reports whether to keep going
+func (d *debugger) execute(line string) bool {
+    fields := strings.Fields(line)
+    if len(fields) == 0 {
+        return true
+    }
+
+    switch fields[0] {
+    case "help", "h":
+        fmt.Fprintln(d.out, "Commands:")
+        fmt.Fprintln(d.out, "  step [n]          Execute n instructions (default 1)  (also: s)")
+        fmt.Fprintln(d.out, "  continue          Run until a breakpoint or watchpoint stops it  (also: c)")
+        fmt.Fprintln(d.out, "  break <loc> [if <cond>]")
+        fmt.Fprintln(d.out, "                    Stop before the instruction at loc, an address such as")
+        fmt.Fprintln(d.out, "                    0042 or file:line, optionally only when cond holds  (also: b)")
+        fmt.Fprintln(d.out, "  tbreak <loc> [if <cond>]")
+        fmt.Fprintln(d.out, "                    Like break, but deleted after it first stops")
+        fmt.Fprintln(d.out, "  ignore <n> <count> Pass over the next count hits of breakpoint n")
+        fmt.Fprintln(d.out, "  delete <n>        Delete breakpoint n")
+        fmt.Fprintln(d.out, "  breaks            List breakpoints with their hit counts")
+        fmt.Fprintln(d.out, "  watch <cond>      Pause when cond becomes true, e.g. 'watch acc == 0',")
+        fmt.Fprintln(d.out, "                    'watch acc > 1000', 'watch depth > 50'")
+        fmt.Fprintln(d.out, "  watches           List watchpoints")
+        fmt.Fprintln(d.out, "  unwatch <n>       Delete watchpoint n")
+        fmt.Fprintln(d.out, "  expect <cond>     Check a condition; in a script a failure sets the exit status")
+        fmt.Fprintln(d.out, "  checkpoint        Save the current machine state")
+        fmt.Fprintln(d.out, "  checkpoints       List saved states")
+        fmt.Fprintln(d.out, "  restore <n>       Return to checkpoint n (output already written and")
+        fmt.Fprintln(d.out, "                    input already read are not undone)")
+        fmt.Fprintln(d.out, "  print             Show accumulator, stack and position  (also: p)")
+        fmt.Fprintln(d.out, "  trace             Show the most recently executed instructions")
+        fmt.Fprintln(d.out, "  list [n]          Disassemble n instructions around the current one  (also: l)")
+        fmt.Fprintln(d.out, "  restart           Start the program again from the beginning")
+        fmt.Fprintln(d.out, "  quit              Leave the debugger  (also: q)")
+
+    case "step", "s":
+        n := 1
+        if len(fields) > 1 {
+            v, err := strconv.Atoi(fields[1])
+            if err != nil || v < 1 {
+                fmt.Fprintln(d.out, "Usage: step [n]")
+                return true
+            }
+            n = v
+        }
+        d.run(n)
+
+    case "continue", "c":
+        d.run(-1)
+
+    case "break", "b", "tbreak":
+        args := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+        d.addBreakpoint(args, fields[0] == "tbreak")
+
+    case "ignore":
+        if len(fields) != 3 {
+            fmt.Fprintln(d.out, "Usage: ignore <n> <count>")
+            return true
+        }
+        id, _ := strconv.Atoi(fields[1])
+        count, err := strconv.Atoi(fields[2])
+        if err != nil || count < 0 {
+            fmt.Fprintln(d.out, "Usage: ignore <n> <count>")
+            return true
+        }
+        for _, b := range d.breakpoints {
+            if b.id == id {
+                b.ignore = count
+                fmt.Fprintf(d.out, "Will ignore next %d crossings of breakpoint %d\n", count, id)
+                return true
+            }
+        }
+        fmt.Fprintf(d.out, "No breakpoint %s\n", fields[1])
+
+    case "delete", "d":
+        if len(fields) != 2 {
+            fmt.Fprintln(d.out, "Usage: delete <n>")
+            return true
+        }
+        id, _ := strconv.Atoi(fields[1])
+        if d.deleteBreakpoint(id) {
+            fmt.Fprintf(d.out, "Deleted breakpoint %d\n", id)
+        } else {
+            fmt.Fprintf(d.out, "No breakpoint %s\n", fields[1])
+        }
+
+    case "breaks":
+        if len(d.breakpoints) == 0 {
+            fmt.Fprintln(d.out, "No breakpoints")
+        }
+        for _, b := range d.breakpoints {
+            fmt.Fprintf(d.out, "  %d  %04d  %s", b.id, b.addr, b.spec)
+            if b.cond != nil {
+                fmt.Fprintf(d.out, " if %s", b.cond)
+            }
+            if b.temporary {
+                fmt.Fprint(d.out, " (temporary)")
+            }
+            fmt.Fprintf(d.out, "  hits=%d", b.hits)
+            if b.ignore > 0 {
+                fmt.Fprintf(d.out, " ignore=%d", b.ignore)
+            }
+            fmt.Fprintln(d.out)
+        }
+
+    case "watch":
+        cond, err := parseCondition(strings.TrimSpace(strings.TrimPrefix(line, "watch")))
+        if err != nil {
+            fmt.Fprintf(d.out, "Error: %v\n", err)
+            return true
+        }
+        w := &watchpoint{id: d.nextID, cond: cond, last: cond.eval(d.vm)}
+        d.nextID++
+        d.watches = append(d.watches, w)
+        fmt.Fprintf(d.out, "Watchpoint %d: %s\n", w.id, cond)
+
+    case "watches":
+        if len(d.watches) == 0 {
+            fmt.Fprintln(d.out, "No watchpoints")
+        }
+        for _, w := range d.watches {
+            fmt.Fprintf(d.out, "  %d  %s\n", w.id, w.cond)
+        }
+
+    case "unwatch":
+        if len(fields) != 2 {
+            fmt.Fprintln(d.out, "Usage: unwatch <n>")
+            return true
+        }
+        id, _ := strconv.Atoi(fields[1])
+        for i, w := range d.watches {
+            if w.id == id {
+                d.watches = append(d.watches[:i], d.watches[i+1:]...)
+                fmt.Fprintf(d.out, "Deleted watchpoint %d\n", id)
+                return true
+            }
+        }
+        fmt.Fprintf(d.out, "No watchpoint %s\n", fields[1])
+
+    case "expect":
+        cond, err := parseCondition(strings.TrimSpace(strings.TrimPrefix(line, "expect")))
+        if err != nil {
+            fmt.Fprintf(d.out, "Error: %v\n", err)
+            d.failures++
+            return true
+        }
+        if cond.eval(d.vm) {
+            fmt.Fprintf(d.out, "ok: %s\n", cond)
+        } else {
+            d.failures++
+            fmt.Fprintf(d.out, "FAILED: %s (acc=%d, depth %d)\n", cond, d.vm.accumulator, len(d.vm.stack))
+        }
+
+    case "checkpoint":
+        d.checkpoints = append(d.checkpoints, d.vm.Snapshot())
+        fmt.Fprintf(d.out, "Checkpoint %d: %s\n", len(d.checkpoints), d.describeSnapshot(d.checkpoints[len(d.checkpoints)-1]))
+
+    case "checkpoints":
+        if len(d.checkpoints) == 0 {
+            fmt.Fprintln(d.out, "No checkpoints")
+        }
+        for i, snap := range d.checkpoints {
+            fmt.Fprintf(d.out, "  %d  %s\n", i+1, d.describeSnapshot(snap))
+        }
+
+    case "restore":
+        if len(fields) != 2 {
+            fmt.Fprintln(d.out, "Usage: restore <n>")
+            return true
+        }
+        n, err := strconv.Atoi(fields[1])
+        if err != nil || n < 1 || n > len(d.checkpoints) {
+            fmt.Fprintf(d.out, "No checkpoint %s\n", fields[1])
+            return true
+        }
+        d.vm.Restore(d.checkpoints[n-1])
+        d.stoppedAt = d.vm.pc
+        for _, w := range d.watches {
+            w.last = w.cond.eval(d.vm)
+        }
+        fmt.Fprintf(d.out, "Restored checkpoint %d\n", n)
+        d.printState()
+
+    case "print", "p":
+        d.printState()
+
+    case "trace":
+        entries := append(append([]TraceEntry(nil), d.postMortem...), d.vm.TraceRing()...)
+        if len(entries) == 0 {
+            fmt.Fprintln(d.out, "No instructions executed yet")
+        }
+        for _, e := range entries {
+            fmt.Fprintf(d.out, "  %04d  %-8s acc=%-6d depth=%-4d %s\n", e.PC, e.Op, e.Accumulator, e.Depth, d.location(e.PC))
+        }
+
+    case "list", "l":
+        n := 10
+        if len(fields) > 1 {
+            if v, err := strconv.Atoi(fields[1]); err == nil && v > 0 {
+                n = v
+            }
+        }
+        d.list(n)
+
+    case "restart":
+        d.restart()
+        fmt.Fprintln(d.out, "Restarted")
+
+    case "quit", "q", "exit":
+        return false
+
+    default:
+        fmt.Fprintf(d.out, "Unknown command: %s (type 'help')\n", fields[0])
+    }
+    return true
+}
+
+// run executes up to n instructions, or until the program ends when n is
+// negative, stopping early when a watchpoint fires or an error occurs
+func (d *debugger) run(n int) {
+    if d.vm.Halted() {
+        fmt.Fprintln(d.out, "Program has finished (use 'restart' to run it again)")
+        return
+    }
+
+    for i := 0; (n < 0 || i < n) && !d.vm.Halted(); i++ {
+        // The breakpoint we are stopped at does not stop us again
+        if i > 0 || d.vm.pc != d.stoppedAt {
+            if b := d.checkBreakpoints(); b != nil {
+                d.stoppedAt = b.addr
+                fmt.Fprintf(d.out, "\nBreakpoint %d at %04d (%s), hit %d\n", b.id, b.addr, d.location(b.addr), b.hits)
+                d.printState()
+                return
+            }
+        }
+        d.stoppedAt = -1
+
+        addr := d.vm.pc
+        inst := d.vm.instructions[addr]
+        if err := d.vm.Step(); err != nil {
+            fmt.Fprintf(d.out, "\nRuntime error at %04d (%s): %v\n", addr, d.location(addr), err)
+            return
+        }
+
+        if w := d.checkWatches(); w != nil {
+            fmt.Fprintf(d.out, "\nWatchpoint %d (%s) triggered by %04d %s at %s\n", w.id, w.cond, addr, inst.Op, d.location(addr))
+            d.printState()
+            return
+        }
+    }
+
+    if d.vm.Halted() {
+        fmt.Fprintln(d.out, "\nProgram finished")
+    }
+    d.printState()
+}
+
+// checkWatches updates all watchpoints and returns the first that fired
+func (d *debugger) checkWatches() *watchpoint {
+    var fired *watchpoint
+    for _, w := range d.watches {
+        now := w.cond.eval(d.vm)
+        if now && !w.last && fired == nil {
+            fired = w
+        }
+        w.last = now
+    }
+    return fired
+}
+
+// describeSnapshot summarizes a saved state in one line
+func (d *debugger) describeSnapshot(s Snapshot) string {
+    where := "end of program"
+    if s.PC < len(d.program.Instructions) {
+        where = fmt.Sprintf("%04d %s", s.PC, d.location(s.PC))
+    }
+    desc := fmt.Sprintf("at %s, acc=%d, depth %d", where, s.Accumulator, len(s.Stack))
+    if len(s.Heap) > 0 {
+        desc += fmt.Sprintf(", %d heap cell(s)", len(s.Heap))
+    }
+    return desc
+}
+
+// printState shows the machine registers and the next instruction
+func (d *debugger) printState() {
+    fmt.Fprintf(d.out, "acc=%d  stack=%v (depth %d)\n", d.vm.accumulator, d.vm.stack, len(d.vm.stack))
+    if d.program.Extensions&ExtRegisters != 0 {
+        fmt.Fprintf(d.out, "registers: %s\n", formatRegisters(d.vm.registers))
+    }
+    if n := len(d.vm.coroutines); n > 0 {
+        fmt.Fprintf(d.out, "coroutine %d of %d\n", d.vm.current, n)
+    }
+    if n := len(d.vm.heap); n > 0 {
+        fmt.Fprintf(d.out, "heap: %d cell(s)\n", n)
+    }
+    if n := len(d.vm.traps); n > 0 {
+        fmt.Fprintf(d.out, "%d trap handler(s) installed, innermost at %04d\n", n, d.vm.traps[n-1].Handler)
+    }
+    if n := len(d.vm.calls); n > 0 {
+        fmt.Fprintf(d.out, "in a block %d call(s) deep, returning to %04d\n", n, d.vm.calls[n-1])
+    }
+    if d.vm.Halted() {
+        fmt.Fprintln(d.out, "pc at end of program")
+        return
+    }
+    pc := d.vm.pc
+    if d.program.Debug == nil {
+        fmt.Fprintf(d.out, "next: %04d %s\n", pc, d.vm.instructions[pc].Op)
+        return
+    }
+    fmt.Fprintf(d.out, "next: %04d %s at %s\n", pc, d.vm.instructions[pc].Op, d.location(pc))
+}
+
+// list disassembles n instructions centred on the program counter
+func (d *debugger) list(n int) {
+    start := d.vm.pc - n/2
+    if start < 0 {
+        start = 0
+    }
+    end := start + n
+    if end > len(d.program.Instructions) {
+        end = len(d.program.Instructions)
+    }
+
+    for i := start; i < end; i++ {
+        marker := "  "
+        if i == d.vm.pc {
+            marker = "=>"
+        }
+        inst := d.program.Instructions[i]
+        operand := ""
+        if hasJumpTarget(inst.Op) {
+            operand = fmt.Sprintf("-> %04d", inst.Arg)
+        } else {
+            operand = valueOperand(inst, d.program.Constants)
+        }
+        where := ""
+        if d.program.Debug != nil {
+            where = d.location(i)
+        }
+        fmt.Fprintf(d.out, "%s %04d  %-8s %-8s %s\n", marker, i, inst.Op, operand, where)
+    }
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "os"
+)
+
+// Device is where a running program's input comes from and its output
+// goes. The machine reads a byte for each ',' and writes what '.', '#',
+// EMIT and the other output instructions produce; it flushes when the
+// program ends and before every instruction that may wait, so a device
+// may hold output back until then. NewVM and SetIO wrap a reader and a
+// writer in one; SetDevice installs any other.
+type Device interface {
+    // ReadByte returns the next byte of input, or io.EOF at its end
+    ReadByte() (byte, error)
+    WriteByte(c byte) error
+    WriteString(s string) (int, error)
+    // Flush delivers output held back by the device
+    Flush() error
+}
+
+// deviceReady reports whether reading from d would return a byte without
+// blocking, for the probe extension. Devices report it with a Ready
+// method; those without one are taken to have nothing waiting.
+func deviceReady(d Device) bool {
+    r, ok := d.(interface{ Ready() bool })
+    return ok && r.Ready()
+}
+
+// writeBytes writes b to d, without copying it if d is also a writer
+func writeBytes(d Device, b []byte) error {
+    if w, ok := d.(io.Writer); ok {
+        _, err := w.Write(b)
+        return err
+    }
+    _, err := d.WriteString(string(b))
+    return err
+}
+
+// StreamDevice is a Device reading one stream and writing another
+type StreamDevice struct {
+    r   io.Reader
+    w   io.Writer
+    buf [1]byte
+}
+
+// NewStreamDevice returns a device reading input and writing output. A
+// nil input is at its end; a nil output discards what is written. Input
+// is read a byte at a time, so the program reads no more of it than it
+// asks for and whatever follows is left to others. Output is written as
+// it comes unless output buffers, in which case Flush flushes it.
+func NewStreamDevice(input io.Reader, output io.Writer) *StreamDevice {
+    if output == nil {
+        output = io.Discard
+    }
+    return &StreamDevice{r: input, w: output}
+}
+
+// NewStdioDevice returns a device reading standard input and writing
+// standard output through a buffer
+func NewStdioDevice() *StreamDevice {
+    return NewStreamDevice(os.Stdin, bufio.NewWriter(os.Stdout))
+}
+
+func (d *StreamDevice) ReadByte() (byte, error) {
+    if d.r == nil {
+        return 0, io.EOF
+    }
+    n, err := d.r.Read(d.buf[:])
+    switch {
+    case n > 0:
+        return d.buf[0], nil
+    case err == nil:
+        return 0, io.EOF // A read of nothing reads as the end, as ',' always took it
+    }
+    return 0, err
+}
+
+func (d *StreamDevice) WriteByte(c byte) error {
+    d.buf[0] = c
+    _, err := d.w.Write(d.buf[:])
+    return err
+}
+
+func (d *StreamDevice) WriteString(s string) (int, error) {
+    return io.WriteString(d.w, s)
+}
+
+func (d *StreamDevice) Write(b []byte) (int, error) {
+    return d.w.Write(b)
+}
+
+// Flush flushes the output if it buffers
+func (d *StreamDevice) Flush() error {
+    if f, ok := d.w.(interface{ Flush() error }); ok {
+        return f.Flush()
+    }
+    return nil
+}
+
+// Ready reports whether the input can tell that data is waiting
+func (d *StreamDevice) Ready() bool {
+    return d.r != nil && inputReady(d.r)
+}
+
+// Reader returns the stream the device reads
+func (d *StreamDevice) Reader() io.Reader {
+    return d.r
+}
+
+// Writer returns the stream the device writes
+func (d *StreamDevice) Writer() io.Writer {
+    return d.w
+}
+
+// BufferDevice is a Device reading input held in memory and collecting
+// the output there, for programs run on fixed input such as in tests,
+// benchmarks and the fuzzer
+type BufferDevice struct {
+    in  *bytes.Reader
+    out bytes.Buffer
+}
+
+// NewBufferDevice returns a device whose input is the given bytes
+func NewBufferDevice(input []byte) *BufferDevice {
+    return &BufferDevice{in: bytes.NewReader(input)}
+}
+
+func (d *BufferDevice) ReadByte() (byte, error) {
+    return d.in.ReadByte()
+}
+
+func (d *BufferDevice) WriteByte(c byte) error {
+    return d.out.WriteByte(c)
+}
+
+func (d *BufferDevice) WriteString(s string) (int, error) {
+    return d.out.WriteString(s)
+}
+
+func (d *BufferDevice) Write(b []byte) (int, error) {
+    return d.out.Write(b)
+}
+
+func (d *BufferDevice) Flush() error {
+    return nil
+}
+
+// Ready reports whether input is left, which is never waited for
+func (d *BufferDevice) Ready() bool {
+    return d.in.Len() > 0
+}
+
+// Output returns what the program has written. It aliases the device's
+// buffer until the next write.
+func (d *BufferDevice) Output() []byte {
+    return d.out.Bytes()
+}
+
+// String returns what the program has written
+func (d *BufferDevice) String() string {
+    return d.out.String()
+}
+
+// CaptureDevice is a Device that keeps a program's output in memory up to
+// a limit, so that a program printing without end cannot exhaust it.
+// Output past the limit is counted but dropped, and the program runs on
+// regardless; Truncated tells that it happened. It reads the input given
+// to SetInput, or none.
+type CaptureDevice struct {
+    in        io.Reader
+    out       bytes.Buffer
+    max       int
+    written   int64 // Bytes the program wrote, kept or not
+    truncated bool
+    buf       [1]byte
+}
+
+// NewCaptureDevice returns a device keeping up to maxBytes of output;
+// zero or less keeps it all
+func NewCaptureDevice(maxBytes int) *CaptureDevice {
+    return &CaptureDevice{max: maxBytes}
+}
+
+// SetInput makes the device read r, for instance a strings.Reader
+func (d *CaptureDevice) SetInput(r io.Reader) {
+    d.in = r
+}
+
+func (d *CaptureDevice) ReadByte() (byte, error) {
+    if d.in == nil {
+        return 0, io.EOF
+    }
+    n, err := d.in.Read(d.buf[:])
+    switch {
+    case n > 0:
+        return d.buf[0], nil
+    case err == nil:
+        return 0, io.EOF
+    }
+    return 0, err
+}
+
+func (d *CaptureDevice) WriteByte(c byte) error {
+    d.buf[0] = c
+    _, err := d.Write(d.buf[:])
+    return err
+}
+
+// WriteString keeps what fits of s, reporting it all written like Write
+func (d *CaptureDevice) WriteString(s string) (int, error) {
+    n := len(s)
+    d.written += int64(n)
+    if d.max > 0 && d.out.Len()+len(s) > d.max {
+        s = s[:d.max-d.out.Len()]
+        d.truncated = true
+    }
+    d.out.WriteString(s)
+    return n, nil
+}
+
+// Write keeps what fits of b. It reports all of b written, so that the
+// program is not stopped by an output error.
+func (d *CaptureDevice) Write(b []byte) (int, error) {
+    n := len(b)
+    d.written += int64(n)
+    if d.max > 0 && d.out.Len()+len(b) > d.max {
+        b = b[:d.max-d.out.Len()]
+        d.truncated = true
+    }
+    d.out.Write(b)
+    return n, nil
+}
+
+func (d *CaptureDevice) Flush() error {
+    return nil
+}
+
+// Ready reports whether the input can tell that data is waiting
+func (d *CaptureDevice) Ready() bool {
+    return d.in != nil && inputReady(d.in)
+}
+
+// Bytes returns the output kept. It aliases the device's buffer until the
+// next write.
+func (d *CaptureDevice) Bytes() []byte {
+    return d.out.Bytes()
+}
+
+// String returns the output kept
+func (d *CaptureDevice) String() string {
+    return d.out.String()
+}
+
+// Truncated reports whether the program wrote more than the limit, so
+// that output was dropped
+func (d *CaptureDevice) Truncated() bool {
+    return d.truncated
+}
+
+// Written returns how many bytes the program wrote, including those
+// dropped
+func (d *CaptureDevice) Written() int64 {
+    return d.written
+}
+
+// PipeDevice is a Device whose output is the input of another reader,
+// usually the next program of a pipeline. Writes wait until the reader
+// takes the output.
+type PipeDevice struct {
+    StreamDevice
+    pr *io.PipeReader
+    pw *io.PipeWriter
+    bw *bufio.Writer
+}
+
+// NewPipeDevice returns a device reading input, whose output is read
+// from Reader
+func NewPipeDevice(input io.Reader) *PipeDevice {
+    pr, pw := io.Pipe()
+    d := &PipeDevice{pr: pr, pw: pw, bw: bufio.NewWriter(pw)}
+    d.StreamDevice = StreamDevice{r: input, w: d.bw}
+    return d
+}
+
+// Reader returns the end of the pipe the output comes out of. Closing it
+// makes further writes to the device fail instead of waiting.
+func (d *PipeDevice) Reader() *io.PipeReader {
+    return d.pr
+}
+
+// Close flushes the output and closes the pipe, so that its reader sees
+// the end of the input
+func (d *PipeDevice) Close() error {
+    err := d.bw.Flush()
+    if cerr := d.pw.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// FakeDevice is a Device for testing embedders: it reads Input, collects
+// Output and fails as configured, and counts flushes
+type FakeDevice struct {
+    Input    []byte       // Input still to be read
+    Output   bytes.Buffer // What has been written
+    ReadErr  error        // Returned once Input is used up, instead of io.EOF
+    WriteErr error        // Returned by every write, if set, which writes nothing
+    FlushErr error        // Returned by every flush, if set
+    Flushes  int          // Times Flush was called
+    Reads    int          // Times ReadByte was called, including at the end of input
+}
+
+func (d *FakeDevice) ReadByte() (byte, error) {
+    d.Reads++
+    if len(d.Input) == 0 {
+        if d.ReadErr != nil {
+            return 0, d.ReadErr
+        }
+        return 0, io.EOF
+    }
+    c := d.Input[0]
+    d.Input = d.Input[1:]
+    return c, nil
+}
+
+func (d *FakeDevice) WriteByte(c byte) error {
+    if d.WriteErr != nil {
+        return d.WriteErr
+    }
+    return d.Output.WriteByte(c)
+}
+
+func (d *FakeDevice) WriteString(s string) (int, error) {
+    if d.WriteErr != nil {
+        return 0, d.WriteErr
+    }
+    return d.Output.WriteString(s)
+}
+
+func (d *FakeDevice) Flush() error {
+    d.Flushes++
+    return d.FlushErr
+}
+
+// Ready reports whether input is left
+func (d *FakeDevice) Ready() bool {
+    return len(d.Input) > 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "strings"
+    "testing"
+)
+
+// newTestVM compiles source for a machine that writes to the returned
+// device and stops after maxSteps instructions
+func newTestVM(t *testing.T, source string, exts ExtensionSet, maxSteps int) (*VM, *BufferDevice) {
+    t.Helper()
+    compiler := NewCompiler(source)
+    compiler.SetExtensions(exts)
+    program, err := compiler.Compile()
+    if err != nil {
+        t.Fatal(err)
+    }
+    out := NewBufferDevice(nil)
+    vm := NewVM(program, nil, nil)
+    vm.SetDevice(out)
+    vm.SetExtensions(exts)
+    vm.SetMaxSteps(maxSteps)
+    return vm, out
+}
+
+func TestDevices(t *testing.T) {
+    const source, input, output = ",.,.#,#", "ab", "ab980" // End of input reads as 0
+    tests := []struct {
+        name   string
+        device func() (Device, func() string)
+    }{
+        {"stream", func() (Device, func() string) {
+            var out bytes.Buffer
+            return NewStreamDevice(strings.NewReader(input), &out), out.String
+        }},
+        {"buffer", func() (Device, func() string) {
+            d := NewBufferDevice([]byte(input))
+            return d, d.String
+        }},
+        {"capture", func() (Device, func() string) {
+            d := NewCaptureDevice(0)
+            d.SetInput(strings.NewReader(input))
+            return d, d.String
+        }},
+        {"pipe", func() (Device, func() string) {
+            d := NewPipeDevice(strings.NewReader(input))
+            read := make(chan string)
+            go func() {
+                b, _ := io.ReadAll(d.Reader())
+                read <- string(b)
+            }()
+            return d, func() string {
+                d.Close()
+                return <-read
+            }
+        }},
+        {"fake", func() (Device, func() string) {
+            d := &FakeDevice{Input: []byte(input)}
+            return d, d.Output.String
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            device, written := tt.device()
+            vm, _ := newTestVM(t, source, 0, 0)
+            vm.SetDevice(device)
+            if err := vm.Run(); err != nil {
+                t.Fatal(err)
+            }
+            if got := written(); got != output {
+                t.Errorf("output %q, want %q", got, output)
+            }
+        })
+    }
+}
+
+func TestCaptureDevice(t *testing.T) {
+    d := NewCaptureDevice(4)
+    d.WriteString("ab")
+    d.WriteByte('c')
+    if n, err := d.Write([]byte("def")); n != 3 || err != nil {
+        t.Errorf("Write past the limit = %d, %v; want 3, nil", n, err)
+    }
+    d.WriteString("gh")
+    if d.String() != "abcd" || !d.Truncated() || d.Written() != 8 {
+        t.Errorf("kept %q, truncated %v, written %d; want \"abcd\", true, 8", d.String(), d.Truncated(), d.Written())
+    }
+    if _, err := d.ReadByte(); err != io.EOF {
+        t.Errorf("ReadByte without input = %v, want io.EOF", err)
+    }
+}
+
+func TestFakeDeviceErrors(t *testing.T) {
+    errDevice := errors.New("device failed")
+    tests := []struct {
+        name   string
+        device *FakeDevice
+        source string
+    }{
+        {"read", &FakeDevice{ReadErr: errDevice}, ","},
+        {"write", &FakeDevice{WriteErr: errDevice}, "+."},
+        {"write number", &FakeDevice{WriteErr: errDevice}, "+#"},
+        {"flush", &FakeDevice{FlushErr: errDevice}, "+#"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            vm, _ := newTestVM(t, tt.source, 0, 0)
+            vm.SetDevice(tt.device)
+            if err := vm.Run(); err == nil || !strings.Contains(err.Error(), errDevice.Error()) {
+                t.Errorf("run ended with %v, want the device's error", err)
+            }
+        })
+    }
+    d := &FakeDevice{Input: []byte("x")}
+    vm, _ := newTestVM(t, ",,#", 0, 0)
+    vm.SetDevice(d)
+    vm.Run()
+    if d.Reads != 2 || d.Flushes == 0 || d.Output.String() != "0" {
+        t.Errorf("%d reads, %d flushes, output %q; want 2, some, \"0\"", d.Reads, d.Flushes, d.Output.String())
+    }
+}
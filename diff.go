@@ -0,0 +1,199 @@
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+// diffContext is how many instructions around a divergence 'flux diff'
+// shows from each program
+const diffContext = 3
+
+// diffProgram is one side of a comparison
+type diffProgram struct {
+    name         string
+    source       []byte
+    instructions []Instruction
+    constants    *ConstPool
+    positions    []int
+}
+
+// loadDiffProgram compiles a file for comparison, optimizing and
+// normalizing it if asked
+func loadDiffProgram(filename string, normalize bool, level int, source sourceOptions) (*diffProgram, error) {
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("reading file '%s': %v", filename, err)
+    }
+    program, err := source.compiler(string(data)).Compile()
+    if err != nil {
+        return nil, fmt.Errorf("compiling '%s': %v", filename, err)
+    }
+    program, _ = Optimize(program, level)
+    instructions, positions := program.Instructions, program.Debug.Positions
+    if normalize {
+        instructions, positions = normalizeInstructions(instructions, positions)
+    }
+    return &diffProgram{name: filename, source: data, instructions: instructions, constants: program.Constants, positions: positions}, nil
+}
+
+// normalizeInstructions removes operation pairs that cancel out: an
+// increment next to a decrement and a push immediately popped again.
+// Removing a pair can expose another, so "+*/-" normalizes to nothing.
+// Jump targets are recomputed for the shorter program.
+func normalizeInstructions(instructions []Instruction, positions []int) ([]Instruction, []int) {
+    out := make([]Instruction, 0, len(instructions))
+    pos := make([]int, 0, len(positions))
+    for i, inst := range instructions {
+        if n := len(out); n > 0 {
+            prev := out[n-1].Op
+            if (prev == OpInc && inst.Op == OpDec) || (prev == OpDec && inst.Op == OpInc) ||
+                (prev == OpPush && inst.Op == OpPop) {
+                out = out[:n-1]
+                pos = pos[:n-1]
+                continue
+            }
+        }
+        out = append(out, inst)
+        pos = append(pos, positions[i])
+    }
+    relink(out)
+    return out, pos
+}
+
+// relink recomputes the jump targets of every loop, conditional, block and trap
+// after instructions have been added or removed
+func relink(instructions []Instruction) {
+    var open []int
+    for i := range instructions {
+        switch instructions[i].Op {
+        case OpLoop:
+            open = append(open, i)
+        case OpEnd:
+            start := open[len(open)-1]
+            open = open[:len(open)-1]
+            instructions[start].Arg = i
+            instructions[i].Arg = start
+            linkLoopExits(instructions, start)
+        case OpIf, OpQuote, OpTry:
+            open = append(open, i)
+        case OpElse, OpCatch:
+            instructions[open[len(open)-1]].Arg = i
+            open[len(open)-1] = i
+        case OpEndIf, OpReturn, OpEndTry:
+            instructions[open[len(open)-1]].Arg = i
+            open = open[:len(open)-1]
+        }
+    }
+}
+
+// linkLoopExits points the BREAK and CONTINUE instructions of the loop at
+// start, but not those of loops nested in it, at the loop's END
+func linkLoopExits(instructions []Instruction, start int) {
+    end := instructions[start].Arg
+    for i := start + 1; i < end; i++ {
+        switch instructions[i].Op {
+        case OpLoop:
+            i = instructions[i].Arg
+        case OpBreak, OpContinue:
+            instructions[i].Arg = end
+        }
+    }
+}
+
+// diffCommand implements 'flux diff', which compares two programs by their
+// bytecode rather than their text, so comments and layout do not matter
+func diffCommand(args []string) {
+    fs := commandFlags("diff")
+    raw := fs.Bool("raw", false, "compare the bytecode as compiled, without cancelling +- and */ pairs")
+    var level int
+    fs.IntVar(&level, "O", 0, "optimize both programs at `level` before comparing")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 2 {
+        fmt.Println("Error: Please specify two files to compare")
+        printUsage("diff")
+        return
+    }
+
+    a, err := loadDiffProgram(positional[0], !*raw, level, source)
+    if err != nil {
+        fmt.Printf("Error %v\n", err)
+        return
+    }
+    b, err := loadDiffProgram(positional[1], !*raw, level, source)
+    if err != nil {
+        fmt.Printf("Error %v\n", err)
+        return
+    }
+
+    at := firstDifference(a, b)
+    if at < 0 {
+        fmt.Printf("%s and %s are structurally identical (%d instructions)\n", a.name, b.name, len(a.instructions))
+        return
+    }
+
+    fmt.Printf("%s and %s differ at instruction %04d\n", a.name, b.name, at)
+    for _, p := range []*diffProgram{a, b} {
+        fmt.Printf("\n%s (%d instructions):\n", p.name, len(p.instructions))
+        p.printRegion(at)
+    }
+    os.Exit(1)
+}
+
+// firstDifference returns the index of the first instruction at which a
+// and b differ, or -1 if they are identical. Constants are compared by
+// value, since the same constant may sit at different pool indexes.
+func firstDifference(a, b *diffProgram) int {
+    for i := 0; i < len(a.instructions) || i < len(b.instructions); i++ {
+        if i >= len(a.instructions) || i >= len(b.instructions) {
+            return i
+        }
+        x, y := a.instructions[i], b.instructions[i]
+        if x.Op != y.Op {
+            return i
+        }
+        switch x.Op {
+        case OpSet, OpEmitBytes:
+            if valueOperand(x, a.constants) != valueOperand(y, b.constants) {
+                return i
+            }
+        default:
+            if x.Arg != y.Arg {
+                return i
+            }
+        }
+    }
+    return -1
+}
+
+// printRegion lists the instructions around index at, marking at itself
+// with its source location
+func (p *diffProgram) printRegion(at int) {
+    if at >= len(p.instructions) {
+        fmt.Println("  <end of program>")
+    }
+    start := at - diffContext
+    if start < 0 {
+        start = 0
+    }
+    for i := start; i <= at+diffContext && i < len(p.instructions); i++ {
+        marker := " "
+        if i == at {
+            marker = ">"
+        }
+        inst := p.instructions[i]
+        line, col := lineCol(p.source, p.positions[i])
+        text := inst.Op.String()
+        if hasJumpTarget(inst.Op) {
+            text = fmt.Sprintf("%-8s  → %d", text, inst.Arg)
+        } else if operand := valueOperand(inst, p.constants); operand != "" {
+            text = fmt.Sprintf("%-8s  %s", text, operand)
+        }
+        fmt.Printf("%s %04d  %-16s %d:%d\n", marker, i, text, line, col)
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "hash"
+)
+
+// runDigest fingerprints a run for 'flux run -digest': the output written
+// through it and the machine's final state. Runs with equal digests
+// produced the same output and ended in the same state.
+type runDigest struct {
+    output hash.Hash
+}
+
+// newRunDigest returns a digest with no output yet
+func newRunDigest() *runDigest {
+    return &runDigest{output: sha256.New()}
+}
+
+// Write adds program output to the digest
+func (d *runDigest) Write(p []byte) (int, error) {
+    return d.output.Write(p)
+}
+
+// Sum returns the digest in hex: the SHA-256 of the output's SHA-256
+// followed by whether the run failed and the final accumulator, stack,
+// registers and heap, each value as 8 bytes little-endian and the stack
+// and heap preceded by their lengths. Error messages are left out because
+// they name the source file.
+func (d *runDigest) Sum(vm *VM, failed bool) string {
+    h := sha256.New()
+    h.Write(d.output.Sum(nil))
+    var buf [8]byte
+    word := func(v int) {
+        binary.LittleEndian.PutUint64(buf[:], uint64(v))
+        h.Write(buf[:])
+    }
+    status := 0
+    if failed {
+        status = 1
+    }
+    word(status)
+    word(vm.accumulator)
+    word(len(vm.stack))
+    for _, v := range vm.stack {
+        word(v)
+    }
+    for _, v := range vm.registers {
+        word(v)
+    }
+    word(len(vm.heap))
+    for _, v := range vm.heap {
+        word(v)
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
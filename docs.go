@@ -0,0 +1,252 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// OpDoc documents an opcode for people: 'flux doc', 'flux reference' and
+// editor hovers render it
+type OpDoc struct {
+    Name      string   `json:"name"`                // Go name of the opcode, such as "OpLoop"
+    Mnemonic  string   `json:"mnemonic"`            // Name in listings, such as "LOOP"
+    Symbol    string   `json:"symbol,omitempty"`    // Source character; absent for opcodes only the optimizer emits
+    Extension string   `json:"extension,omitempty"` // Absent for the core language
+    Summary   string   `json:"summary"`
+    Semantics []string `json:"semantics"` // What it does, precisely, a sentence each
+    Examples  []string `json:"examples"`
+}
+
+// opDoc is what opDocs adds to an opcode's OpInfo
+type opDoc struct {
+    name      string
+    semantics []string
+    examples  []string
+}
+
+// opDocs documents every opcode, indexed by opcode. It is the language
+// reference: the operations of the core language are described here in
+// full; those of the extensions by their summary in opTable, with the
+// README's EXTENSIONS section for the details.
+var opDocs = [...]opDoc{
+    OpInc: {"OpInc",
+        []string{"accumulator = accumulator + 1"},
+        []string{"If acc=5, then after '+' acc=6"}},
+    OpDec: {"OpDec",
+        []string{"accumulator = accumulator - 1"},
+        []string{"If acc=5, then after '-' acc=4"}},
+    OpPush: {"OpPush",
+        []string{
+            "stack.push(accumulator)",
+            "The accumulator value is copied to the top of the stack",
+            "The accumulator itself remains unchanged",
+        },
+        []string{"If acc=5, after '*' the stack has 5 on top and acc is still 5"}},
+    OpPop: {"OpPop",
+        []string{
+            "accumulator = stack.pop()",
+            "If the stack is empty, the accumulator becomes 0",
+            "The value is removed from the stack",
+        },
+        []string{"If stack=[3,7] (7 on top) and acc=5, after '/' acc=7 and stack=[3]"}},
+    OpLoop: {"OpLoop",
+        []string{
+            "If accumulator == 0, jump forward past the matching ']'",
+            "If accumulator != 0, continue execution into the loop body",
+            "The loop condition is checked only at the '[', not continuously",
+        },
+        []string{"If acc=0, execution jumps past the loop", "If acc=5, execution enters the loop"}},
+    OpEnd: {"OpEnd",
+        []string{
+            "If accumulator != 0, jump backward to the matching '['",
+            "If accumulator == 0, continue execution past the loop",
+            "This creates a while-loop structure that continues as long as acc != 0",
+        },
+        []string{"If acc=3, jump back to '['", "If acc=0, exit loop"}},
+    OpOut: {"OpOut",
+        []string{"Prints the character corresponding to (accumulator mod 256)"},
+        []string{"If acc=65, outputs 'A'", "If acc=72, outputs 'H'"}},
+    OpIn: {"OpIn",
+        []string{
+            "Reads a single character from the input stream",
+            "Sets the accumulator to the ASCII value of that character",
+            "On EOF (end of file), sets the accumulator to 0",
+        },
+        []string{"If the user types 'A', acc becomes 65"}},
+    OpOutNum: {"OpOutNum",
+        []string{
+            "Prints the numeric value of the accumulator in decimal",
+            "This is an extension for practical debugging and numeric output",
+        },
+        []string{"If acc=42, outputs \"42\""}},
+    OpAdd: {"OpAdd",
+        []string{"accumulator = accumulator + Arg", "The optimizer emits it for runs of '+' and '-'"},
+        []string{"'+++' becomes ADD 3"}},
+    OpSet: {"OpSet",
+        []string{"accumulator = constant Arg", "The optimizer emits it where the accumulator is known, such as after '[-]'"},
+        []string{"'[-]++' becomes SET 2"}},
+    OpEmitBytes: {"OpEmitBytes",
+        []string{"Writes the byte string constant Arg to the output", "The optimizer emits it for long runs of constant output"},
+        nil},
+    OpProbe:     {name: "OpProbe"},
+    OpSleep:     {name: "OpSleep"},
+    OpClock:     {name: "OpClock"},
+    OpTime:      {name: "OpTime"},
+    OpFileOpen:  {name: "OpFileOpen"},
+    OpFileRead:  {name: "OpFileRead"},
+    OpFileWrite: {name: "OpFileWrite"},
+    OpFileClose: {name: "OpFileClose"},
+    OpAnd:       {name: "OpAnd"},
+    OpOr:        {name: "OpOr"},
+    OpXor:       {name: "OpXor"},
+    OpShl:       {name: "OpShl"},
+    OpShr:       {name: "OpShr"},
+    OpIf:        {name: "OpIf"},
+    OpElse:      {name: "OpElse"},
+    OpEndIf:     {name: "OpEndIf"},
+    OpBreak:     {name: "OpBreak"},
+    OpContinue:  {name: "OpContinue"},
+    OpPeek:      {name: "OpPeek"},
+    OpData:      {name: "OpData"},
+    OpLoadReg:   {name: "OpLoadReg"},
+    OpStoreReg:  {name: "OpStoreReg"},
+    OpDup:       {name: "OpDup"},
+    OpSwap:      {name: "OpSwap"},
+    OpRot:       {name: "OpRot"},
+    OpOver:      {name: "OpOver"},
+    OpDepth:     {name: "OpDepth"},
+    OpDump:      {name: "OpDump"},
+    OpAssert:    {name: "OpAssert"},
+    OpQuote:     {name: "OpQuote"},
+    OpReturn:    {name: "OpReturn"},
+    OpExec:      {name: "OpExec"},
+    OpSpawn:     {name: "OpSpawn"},
+    OpSend:      {name: "OpSend"},
+    OpReceive:   {name: "OpReceive"},
+    OpTry:       {name: "OpTry"},
+    OpCatch:     {name: "OpCatch"},
+    OpEndTry:    {name: "OpEndTry"},
+    OpAlloc:     {name: "OpAlloc"},
+    OpPoke:      {name: "OpPoke"},
+    OpToFloat:   {name: "OpToFloat"},
+    OpToInt:     {name: "OpToInt"},
+    OpFAdd:      {name: "OpFAdd"},
+    OpFSub:      {name: "OpFSub"},
+    OpFMul:      {name: "OpFMul"},
+    OpFDiv:      {name: "OpFDiv"},
+    OpOutFloat:  {name: "OpOutFloat"},
+    OpAnsi:      {name: "OpAnsi"},
+    OpGetenv:    {name: "OpGetenv"},
+    OpAccept:    {name: "OpAccept"},
+    OpNetRead:   {name: "OpNetRead"},
+    OpNetWrite:  {name: "OpNetWrite"},
+}
+
+// Every opcode must be documented
+var _ = [1]struct{}{}[len(opDocs)-len(opTable)]
+
+// Doc returns the documentation of the opcode
+func (op OpCode) Doc() (OpDoc, bool) {
+    info, ok := op.Info()
+    if !ok {
+        return OpDoc{}, false
+    }
+    d := opDocs[op]
+    doc := OpDoc{Name: d.name, Mnemonic: info.Mnemonic, Summary: info.Summary,
+        Semantics: append([]string{}, d.semantics...), Examples: append([]string{}, d.examples...)}
+    if info.Operator != 0 {
+        doc.Symbol = string(info.Operator)
+    }
+    if info.Extension != 0 {
+        doc.Extension = info.Extension.String()
+    }
+    return doc, true
+}
+
+// Ops returns the documentation of every opcode, in opcode order
+func Ops() []OpDoc {
+    docs := make([]OpDoc, len(opTable))
+    for op := range opTable {
+        docs[op], _ = OpCode(op).Doc()
+    }
+    return docs
+}
+
+// LookupOps finds the opcodes a query names: a source character, which
+// may stand for more than one ('#' is OUTNUM, or OUTF with the float
+// extension), a mnemonic such as "loop" or a Go name such as "OpLoop"
+func LookupOps(query string) []OpDoc {
+    var found []OpDoc
+    for _, doc := range Ops() {
+        if doc.Symbol == query || strings.EqualFold(doc.Mnemonic, query) || strings.EqualFold(doc.Name, query) {
+            found = append(found, doc)
+        }
+    }
+    return found
+}
+
+// Render writes the documentation as text, as 'flux doc' shows it
+func (d OpDoc) Render() string {
+    var b strings.Builder
+    symbol := d.Symbol
+    if symbol == "" {
+        symbol = " "
+    }
+    fmt.Fprintf(&b, "%s  %s (%s)", symbol, d.Mnemonic, d.Name)
+    switch {
+    case d.Extension != "":
+        fmt.Fprintf(&b, ", %s extension", d.Extension)
+    case d.Symbol == "":
+        b.WriteString(", emitted by the optimizer only")
+    }
+    fmt.Fprintf(&b, "\n     %s\n", d.Summary)
+    for _, s := range d.Semantics {
+        fmt.Fprintf(&b, "     %s\n", s)
+    }
+    for i, e := range d.Examples {
+        label := "        "
+        if i == 0 {
+            label = "Example:"
+        }
+        fmt.Fprintf(&b, "     %s %s\n", label, e)
+    }
+    return b.String()
+}
+
+// docCommand implements 'flux doc'
+func docCommand(args []string) {
+    fs := commandFlags("doc")
+    asJSON := fs.Bool("json", false, "print the documentation as JSON")
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    var docs []OpDoc
+    switch len(positional) {
+    case 0:
+        docs = Ops()
+    case 1:
+        if docs = LookupOps(positional[0]); len(docs) == 0 {
+            fmt.Printf("Error: no operation '%s' (try a character such as '+', a mnemonic such as LOOP, or a name such as OpLoop)\n", positional[0])
+            os.Exit(1)
+        }
+    default:
+        fmt.Println("Error: Please specify at most one operation")
+        printUsage("doc")
+        return
+    }
+
+    if *asJSON {
+        out, _ := json.MarshalIndent(docs, "", "  ")
+        fmt.Println(string(out))
+        return
+    }
+    for i, d := range docs {
+        if i > 0 {
+            fmt.Println()
+        }
+        fmt.Print(d.Render())
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+// SetEnv gives the env extension the environment variables it may read.
+// Programs see only these; any other name reads as unset. Nil, the
+// default, refuses environment access altogether.
+func (vm *VM) SetEnv(env map[string]string) {
+    vm.env = env
+}
+
+// allowedEnv returns the variables among names that are set in the
+// process environment, for SetEnv
+func allowedEnv(names []string) map[string]string {
+    env := make(map[string]string)
+    for _, name := range names {
+        if value, ok := os.LookupEnv(name); ok {
+            env[name] = value
+        }
+    }
+    return env
+}
+
+// getenv implements GETENV: it pops a name length and that many character
+// codes (first character deepest), as OPEN does, and pushes the variable's
+// value with its first byte on top, so popping reads it in order. The
+// accumulator receives the value's length, or -1 if it is unset.
+func (vm *VM) getenv() error {
+    if vm.env == nil {
+        return fmt.Errorf("environment access is disabled at %s (run with -allow-env name)", vm.program.Location(vm.pc))
+    }
+    n, err := vm.pop()
+    if err != nil {
+        return err
+    }
+    if n < 0 || n > len(vm.stack) {
+        return fmt.Errorf("GETENV at %s: name length %d, but the stack holds %d value(s)", vm.program.Location(vm.pc), n, len(vm.stack))
+    }
+    name := make([]byte, n)
+    for i := range name {
+        name[i] = byte(vm.stack[len(vm.stack)-n+i])
+    }
+    vm.stack = vm.stack[:len(vm.stack)-n]
+
+    value, ok := vm.env[string(name)]
+    if !ok {
+        vm.accumulator = -1
+        return nil
+    }
+    for i := len(value) - 1; i >= 0; i-- {
+        vm.stack = append(vm.stack, int(value[i]))
+    }
+    vm.accumulator = len(value)
+    return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "sort"
+)
+
+// extensionsCommand implements 'flux extensions'. Without a file it lists
+// the extensions this build knows; with one it reports which extensions the
+// program needs and whether the machine configured by -ext could run it.
+func extensionsCommand(args []string) {
+    fs := commandFlags("extensions")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+
+    switch len(positional) {
+    case 0:
+        listExtensions()
+        return
+    case 1:
+    default:
+        fmt.Println("Error: Please specify at most one file")
+        printUsage("extensions")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    program, err := loadProgram(filename, data, source)
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+
+    vm := NewVM(program, nil, nil)
+    vm.SetExtensions(source.extensions)
+    required := NewCompiler("").RequiredExtensions(program)
+    fmt.Printf("%s: instruction set version %d (this VM implements %d)\n", filename, program.ISA, ISAVersion)
+    if required == 0 {
+        fmt.Println("Needs no extensions")
+        return
+    }
+    fmt.Printf("Needs extensions: %s\n", required)
+    missing := required &^ vm.SupportedExtensions()
+    if missing != 0 {
+        fmt.Printf("Not enabled: %s (run with -ext %s)\n", missing, missing)
+        os.Exit(1)
+    }
+    fmt.Println("All enabled")
+}
+
+// listExtensions prints every extension this build knows
+func listExtensions() {
+    if len(extensionNames) == 0 {
+        fmt.Println("This build of flux defines no extensions")
+        return
+    }
+    var exts []ExtensionSet
+    for ext := range extensionNames {
+        exts = append(exts, ext)
+    }
+    sort.Slice(exts, func(i, j int) bool { return exts[i] < exts[j] })
+    for _, ext := range exts {
+        fmt.Printf("  %-10s %s\n", extensionNames[ext], extensionSummaries[ext])
+    }
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// File modes for OPEN, taken from the accumulator
+const (
+    fileRead   = 0 // Open an existing file for reading
+    fileWrite  = 1 // Create or truncate a file for writing
+    fileAppend = 2 // Create a file or append to it
+)
+
+// FileAccess is the sandbox of the fs extension: programs may only open
+// files inside its directories. A VM without one refuses all file access.
+type FileAccess struct {
+    roots []string // Absolute directories, with symbolic links resolved
+}
+
+// NewFileAccess grants access to the files under each of dirs
+func NewFileAccess(dirs ...string) (*FileAccess, error) {
+    a := &FileAccess{}
+    for _, dir := range dirs {
+        root, err := resolvePath(dir)
+        if err != nil {
+            return nil, err
+        }
+        a.roots = append(a.roots, root)
+    }
+    return a, nil
+}
+
+// resolvePath returns the absolute form of path with symbolic links in its
+// directory resolved, so a link cannot lead out of the sandbox
+func resolvePath(path string) (string, error) {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return "", err
+    }
+    if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+        return resolved, nil
+    }
+    // The file may not exist yet; resolve the directory it would be in
+    dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// allowed returns the resolved form of path if it lies inside the sandbox
+func (a *FileAccess) allowed(path string) (string, bool) {
+    resolved, err := resolvePath(path)
+    if err != nil {
+        return "", false
+    }
+    for _, root := range a.roots {
+        if resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+            return resolved, true
+        }
+    }
+    return "", false
+}
+
+// openFile is a file opened by a program
+type openFile struct {
+    file   *os.File
+    reader *bufio.Reader // Set when open for reading
+    writer *bufio.Writer // Set when open for writing
+}
+
+// SetFileAccess enables the fs extension's file operations within the
+// sandbox a; nil disables them
+func (vm *VM) SetFileAccess(a *FileAccess) {
+    vm.fileAccess = a
+}
+
+// fileOpen implements OPEN: it pops a path length and that many character
+// codes (first character deepest) and pushes a handle for the file, or 0
+// if it cannot be opened. The accumulator selects the mode and receives
+// the handle too.
+func (vm *VM) fileOpen() error {
+    if vm.fileAccess == nil {
+        return fmt.Errorf("file access is disabled at %s (run with -allow-fs dir)", vm.program.Location(vm.pc))
+    }
+    n, err := vm.pop()
+    if err != nil {
+        return err
+    }
+    if n < 0 || n > len(vm.stack) {
+        return fmt.Errorf("OPEN at %s: path length %d, but the stack holds %d value(s)", vm.program.Location(vm.pc), n, len(vm.stack))
+    }
+    name := make([]byte, n)
+    for i := range name {
+        name[i] = byte(vm.stack[len(vm.stack)-n+i])
+    }
+    vm.stack = vm.stack[:len(vm.stack)-n]
+
+    path, ok := vm.fileAccess.allowed(string(name))
+    if !ok {
+        return fmt.Errorf("OPEN at %s: %q is outside the directories allowed with -allow-fs", vm.program.Location(vm.pc), name)
+    }
+    var f *os.File
+    switch vm.accumulator {
+    case fileRead:
+        f, err = os.Open(path)
+    case fileWrite:
+        f, err = os.Create(path)
+    case fileAppend:
+        f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    default:
+        return fmt.Errorf("OPEN at %s: unknown mode %d (0 read, 1 write, 2 append)", vm.program.Location(vm.pc), vm.accumulator)
+    }
+
+    handle := 0
+    if err == nil {
+        of := &openFile{file: f}
+        if vm.accumulator == fileRead {
+            of.reader = bufio.NewReader(f)
+        } else {
+            of.writer = bufio.NewWriter(f)
+        }
+        if vm.files == nil {
+            vm.files = make(map[int]*openFile)
+        }
+        vm.nextHandle++
+        handle = vm.nextHandle
+        vm.files[handle] = of
+    }
+    vm.stack = append(vm.stack, handle)
+    vm.accumulator = handle
+    return nil
+}
+
+// file returns the open file whose handle is on top of the stack
+func (vm *VM) file(op OpCode) (int, *openFile, error) {
+    if len(vm.stack) == 0 {
+        return 0, nil, fmt.Errorf("%s at %s: no file handle on the stack", op, vm.program.Location(vm.pc))
+    }
+    handle := vm.stack[len(vm.stack)-1]
+    f, ok := vm.files[handle]
+    if !ok {
+        return 0, nil, fmt.Errorf("%s at %s: %d is not an open file handle", op, vm.program.Location(vm.pc), handle)
+    }
+    return handle, f, nil
+}
+
+// fileRead implements READ: it reads a byte from the file whose handle is
+// on top of the stack into the accumulator, or -1 at end of file
+func (vm *VM) fileRead() error {
+    _, f, err := vm.file(OpFileRead)
+    if err != nil {
+        return err
+    }
+    if f.reader == nil {
+        return fmt.Errorf("READ at %s: file is open for writing", vm.program.Location(vm.pc))
+    }
+    b, err := f.reader.ReadByte()
+    if err != nil {
+        vm.accumulator = -1
+        return nil
+    }
+    vm.accumulator = int(b)
+    return nil
+}
+
+// fileWrite implements WRITE: it writes the accumulator modulo 256 to the
+// file whose handle is on top of the stack
+func (vm *VM) fileWrite() error {
+    _, f, err := vm.file(OpFileWrite)
+    if err != nil {
+        return err
+    }
+    if f.writer == nil {
+        return fmt.Errorf("WRITE at %s: file is open for reading", vm.program.Location(vm.pc))
+    }
+    if err := f.writer.WriteByte(byte(vm.accumulator % 256)); err != nil {
+        return fmt.Errorf("WRITE at %s: %v", vm.program.Location(vm.pc), err)
+    }
+    return nil
+}
+
+// fileClose implements CLOSE: it pops a handle and closes its file
+func (vm *VM) fileClose() error {
+    handle, f, err := vm.file(OpFileClose)
+    if err != nil {
+        return err
+    }
+    vm.stack = vm.stack[:len(vm.stack)-1]
+    delete(vm.files, handle)
+    if err := f.close(); err != nil {
+        return fmt.Errorf("CLOSE at %s: %v", vm.program.Location(vm.pc), err)
+    }
+    return nil
+}
+
+// close flushes and closes the file
+func (f *openFile) close() error {
+    var err error
+    if f.writer != nil {
+        err = f.writer.Flush()
+    }
+    if cerr := f.file.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// CloseFiles closes every file the program left open, flushing pending
+// writes, and the connection of the net extension, and returns the first
+// error
+func (vm *VM) CloseFiles() error {
+    first := vm.closeConn()
+    for handle, f := range vm.files {
+        if err := f.close(); err != nil && first == nil {
+            first = err
+        }
+        delete(vm.files, handle)
+    }
+    return first
+}
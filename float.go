@@ -0,0 +1,73 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+)
+
+// The float extension keeps float64 values in the accumulator, the stack
+// and registers as their IEEE 754 bit patterns, so the rest of the machine
+// carries them around unchanged
+
+// toFloat returns the float64 whose bit pattern is v
+func toFloat(v int) float64 {
+    return math.Float64frombits(uint64(v))
+}
+
+// fromFloat returns the bit pattern of f
+func fromFloat(f float64) int {
+    return int(math.Float64bits(f))
+}
+
+// SetFloatPrecision sets how many digits after the decimal point OUTF
+// prints; a negative precision prints as few as identify the value
+func (vm *VM) SetFloatPrecision(n int) {
+    vm.floatPrecision = n
+}
+
+// formatFloat formats f for OUTF at the machine's precision
+func (vm *VM) formatFloat(f float64) string {
+    if vm.floatPrecision < 0 {
+        return strconv.FormatFloat(f, 'g', -1, 64)
+    }
+    return strconv.FormatFloat(f, 'f', vm.floatPrecision, 64)
+}
+
+// float executes the float extension's conversions and arithmetic. The
+// arithmetic combines the accumulator with the popped top of the stack,
+// which is the right-hand operand, as in the bitwise extension.
+func (vm *VM) float(op OpCode) error {
+    switch op {
+    case OpToFloat:
+        vm.accumulator = fromFloat(float64(vm.accumulator))
+        return nil
+    case OpToInt:
+        f := toFloat(vm.accumulator)
+        if math.IsNaN(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+            return fault(FaultOperand, "cannot convert %g to an integer at %s", f, vm.program.Location(vm.pc))
+        }
+        vm.accumulator = int(f)
+        return nil
+    }
+
+    v, err := vm.pop()
+    if err != nil {
+        return err
+    }
+    a, b := toFloat(vm.accumulator), toFloat(v)
+    switch op {
+    case OpFAdd:
+        a += b
+    case OpFSub:
+        a -= b
+    case OpFMul:
+        a *= b
+    case OpFDiv:
+        a /= b
+    default:
+        return fmt.Errorf("internal error: %s is not a float operation", op)
+    }
+    vm.accumulator = fromFloat(a)
+    return nil
+}
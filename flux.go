@@ -2,10 +2,20 @@ package main
 
 import (
     "bufio"
+    "context"
+    "crypto/sha256"
+    "flag"
     "fmt"
     "io"
     "os"
+    "os/signal"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
 )
 
 /*
@@ -60,61 +70,9 @@ STACK:
 
 ## OPERATION REFERENCE
 
-Flux has exactly 9 operations:
-
-ARITHMETIC OPERATIONS:
-+    Increment accumulator
-     Effect: accumulator = accumulator + 1
-     Example: If acc=5, then after '+' acc=6
-
--    Decrement accumulator
-     Effect: accumulator = accumulator - 1
-     Example: If acc=5, then after '-' acc=4
-
-STACK OPERATIONS:
-*    Push accumulator to stack
-     Effect: stack.push(accumulator)
-     The accumulator value is copied to the top of the stack
-     The accumulator itself remains unchanged
-     Example: If acc=5, after '*' the stack has 5 on top and acc is still 5
-
-/    Pop stack to accumulator
-     Effect: accumulator = stack.pop()
-     If stack is empty, accumulator becomes 0
-     The value is removed from the stack
-     Example: If stack=[3,7] (7 on top) and acc=5, after '/' acc=7 and stack=[3]
-
-CONTROL FLOW OPERATIONS:
-[    Begin while loop
-     If accumulator == 0, jump forward past the matching ']'
-     If accumulator != 0, continue execution into the loop body
-     The loop condition is checked only at the '[', not continuously
-     Example: If acc=0, execution jumps past the loop
-     If acc=5, execution enters the loop
-
-]    End while loop
-     If accumulator != 0, jump backward to the matching '['
-     If accumulator == 0, continue execution past the loop
-     This creates a while-loop structure that continues as long as acc != 0
-     Example: If acc=3, jump back to '['
-     If acc=0, exit loop
-
-INPUT/OUTPUT OPERATIONS:
-.    Output accumulator as ASCII character
-     Prints the character corresponding to (accumulator mod 256)
-     Example: If acc=65, outputs 'A'
-     If acc=72, outputs 'H'
-
-,    Input one character
-     Reads a single character from input stream
-     Sets accumulator to the ASCII value of that character
-     On EOF (end of file), sets accumulator to 0
-     Example: If user types 'A', acc becomes 65
-
-#    Output accumulator as decimal number
-     Prints the numeric value of the accumulator
-     This is an extension for practical debugging and numeric output
-     Example: If acc=42, outputs "42"
+Flux has exactly 9 operations: + - * / [ ] . , and #. Each is documented,
+with its effect and examples, in opDocs (docs.go), the one description of
+the operations that 'flux doc', 'flux reference' and editor tooling render.
 
 WHITESPACE AND COMMENTS:
 - Spaces, tabs, newlines, and carriage returns are ignored
@@ -128,21 +86,161 @@ END OF REFERENCE GUIDE
 type OpCode byte
 
 const (
-    OpInc    OpCode = iota // + : Increment accumulator
-    OpDec                  // - : Decrement accumulator
-    OpPush                 // * : Push accumulator to stack
-    OpPop                  // / : Pop stack to accumulator
-    OpLoop                 // [ : Begin loop
-    OpEnd                  // ] : End loop
-    OpOut                  // . : Output as ASCII
-    OpIn                   // , : Input character
-    OpOutNum               // # : Output as number
+    OpInc       OpCode = iota // + : Increment accumulator
+    OpDec                     // - : Decrement accumulator
+    OpPush                    // * : Push accumulator to stack
+    OpPop                     // / : Pop stack to accumulator
+    OpLoop                    // [ : Begin loop
+    OpEnd                     // ] : End loop
+    OpOut                     // . : Output as ASCII
+    OpIn                      // , : Input character
+    OpOutNum                  // # : Output as number
+    OpAdd                     // Add Arg to accumulator (optimizer only)
+    OpSet                     // Set accumulator to integer constant Arg (optimizer only)
+    OpEmitBytes               // Write byte string constant Arg to output (optimizer only)
+    OpProbe                   // ~ : Set accumulator to 1 if input is ready, else 0 (probe extension)
+    OpSleep                   // z : Pause for accumulator milliseconds (sleep extension)
+    OpClock                   // t : Load milliseconds since the program started (clock extension)
+    OpTime                    // T : Load the Unix time in seconds (clock extension)
+    OpFileOpen                // O : Open the file named on the stack (fs extension)
+    OpFileRead                // R : Read a byte from the file on top of the stack (fs extension)
+    OpFileWrite               // W : Write a byte to the file on top of the stack (fs extension)
+    OpFileClose               // C : Close the file on top of the stack (fs extension)
+    OpAnd                     // & : Accumulator AND popped value (bitwise extension)
+    OpOr                      // | : Accumulator OR popped value (bitwise extension)
+    OpXor                     // ^ : Accumulator XOR popped value (bitwise extension)
+    OpShl                     // < : Shift accumulator left by popped value (bitwise extension)
+    OpShr                     // > : Shift accumulator right by popped value (bitwise extension)
+    OpIf                      // ( : Jump past the matching ELSE or ENDIF if acc == 0 (if extension)
+    OpElse                    // : : Jump past the matching ENDIF (if extension)
+    OpEndIf                   // ) : End of a conditional (if extension)
+    OpBreak                   // ! : Jump past the innermost loop's END (break extension)
+    OpContinue                // ; : Jump to the innermost loop's END (break extension)
+    OpPeek                    // L : Load the heap cell at the popped address and index (heap extension)
+    OpData                    // " : Load the address of the data block at offset Arg (heap extension)
+    OpLoadReg                 // $ : Load register Arg into the accumulator (registers extension)
+    OpStoreReg                // = : Store the accumulator in register Arg (registers extension)
+    OpDup                     // d : Duplicate the top of the stack (stack extension)
+    OpSwap                    // s : Swap the top two stack entries (stack extension)
+    OpRot                     // r : Rotate the third stack entry to the top (stack extension)
+    OpOver                    // o : Copy the second stack entry to the top (stack extension)
+    OpDepth                   // @ : Load the stack depth (stack extension)
+    OpDump                    // ? : Write the machine state to the dump output (dump extension)
+    OpAssert                  // A : Fail unless acc equals the popped value (assert extension)
+    OpQuote                   // { : Push the block's number and jump past its RET (eval extension)
+    OpReturn                  // } : Return from block number Arg (eval extension)
+    OpExec                    // x : Call the block whose number is popped (eval extension)
+    OpSpawn                   // P : Start the popped block as a coroutine (coroutine extension)
+    OpSend                    // S : Send acc to the popped coroutine and yield (coroutine extension)
+    OpReceive                 // G : Receive a value, waiting for one if need be (coroutine extension)
+    OpTry                     // Y : Install a handler past the matching CATCH (trap extension)
+    OpCatch                   // H : Remove the handler and jump past the matching ENDTRY (trap extension)
+    OpEndTry                  // E : End of a trap (trap extension)
+    OpAlloc                   // N : Allocate acc heap cells and load the first's address (heap extension)
+    OpPoke                    // K : Store acc in the heap cell at the popped address and index (heap extension)
+    OpToFloat                 // F : Convert acc to a float (float extension)
+    OpToInt                   // I : Convert acc to an integer, truncating (float extension)
+    OpFAdd                    // U : Add the popped float to acc (float extension)
+    OpFSub                    // V : Subtract the popped float from acc (float extension)
+    OpFMul                    // M : Multiply acc by the popped float (float extension)
+    OpFDiv                    // D : Divide acc by the popped float (float extension)
+    OpOutFloat                // # : Output acc as a float (float extension)
+    OpAnsi                    // % : Output the terminal control acc selects (ansi extension)
+    OpGetenv                  // Q : Push the value of the environment variable named on the stack (env extension)
+    OpAccept                  // l : Wait for a TCP connection (net extension)
+    OpNetRead                 // i : Read a byte from the connection (net extension)
+    OpNetWrite                // w : Write acc to the connection (net extension)
 )
 
 // Instruction represents a single bytecode instruction with optional argument
 type Instruction struct {
     Op  OpCode // The operation to perform
-    Arg int    // Argument (used for loop jump addresses)
+    Arg int    // Argument (loop jump address, addend or constant pool index)
+}
+
+// NumRegisters is how many named registers the registers extension offers
+const NumRegisters = 8
+
+// registerNames holds the name of each register, by number
+const registerNames = "abcdefgh"
+
+// DefaultMaxSleep is the longest a single SLEEP pauses unless the VM is
+// configured otherwise
+const DefaultMaxSleep = 10 * time.Second
+
+// DefaultMaxCallDepth is how deeply blocks of the eval extension may call
+// each other unless the VM is configured otherwise
+const DefaultMaxCallDepth = 10000
+
+// interruptInterval is how many instructions the VM executes between
+// checks of its context and for pauses, so a cancelled or paused run
+// stops promptly without a check on every step
+const interruptInterval = 1024
+
+// DefaultMaxNesting is the deepest loop nesting the compiler accepts unless
+// configured otherwise. Hand-written programs come nowhere near it.
+const DefaultMaxNesting = 1000
+
+// extensionOp is the instruction an extension operator compiles to
+type extensionOp struct {
+    ext ExtensionSet // Extension the operator belongs to
+    op  OpCode       // Instruction it compiles to
+}
+
+// extensionOps maps the characters of extension operators to what they
+// compile to
+var extensionOps = map[byte]extensionOp{
+    '~': {ExtProbe, OpProbe},
+    'z': {ExtSleep, OpSleep},
+    't': {ExtClock, OpClock},
+    'T': {ExtClock, OpTime},
+    'O': {ExtFS, OpFileOpen},
+    'R': {ExtFS, OpFileRead},
+    'W': {ExtFS, OpFileWrite},
+    'C': {ExtFS, OpFileClose},
+    '&': {ExtBitwise, OpAnd},
+    '|': {ExtBitwise, OpOr},
+    '^': {ExtBitwise, OpXor},
+    '<': {ExtBitwise, OpShl},
+    '>': {ExtBitwise, OpShr},
+    '(': {ExtIf, OpIf},
+    ':': {ExtIf, OpElse},
+    ')': {ExtIf, OpEndIf},
+    '!': {ExtBreak, OpBreak},
+    ';': {ExtBreak, OpContinue},
+    'L': {ExtHeap, OpPeek},
+    '"': {ExtHeap, OpData},
+    '$': {ExtRegisters, OpLoadReg},
+    '=': {ExtRegisters, OpStoreReg},
+    'd': {ExtStack, OpDup},
+    's': {ExtStack, OpSwap},
+    'r': {ExtStack, OpRot},
+    'o': {ExtStack, OpOver},
+    '@': {ExtStack, OpDepth},
+    '?': {ExtDump, OpDump},
+    'A': {ExtAssert, OpAssert},
+    '{': {ExtEval, OpQuote},
+    '}': {ExtEval, OpReturn},
+    'x': {ExtEval, OpExec},
+    'P': {ExtCoroutine, OpSpawn},
+    'S': {ExtCoroutine, OpSend},
+    'G': {ExtCoroutine, OpReceive},
+    'Y': {ExtTrap, OpTry},
+    'H': {ExtTrap, OpCatch},
+    'E': {ExtTrap, OpEndTry},
+    'N': {ExtHeap, OpAlloc},
+    'K': {ExtHeap, OpPoke},
+    'F': {ExtFloat, OpToFloat},
+    'I': {ExtFloat, OpToInt},
+    'U': {ExtFloat, OpFAdd},
+    'V': {ExtFloat, OpFSub},
+    'M': {ExtFloat, OpFMul},
+    'D': {ExtFloat, OpFDiv},
+    '%': {ExtAnsi, OpAnsi},
+    'Q': {ExtEnv, OpGetenv},
+    'l': {ExtNet, OpAccept},
+    'i': {ExtNet, OpNetRead},
+    'w': {ExtNet, OpNetWrite},
 }
 
 // Compiler transforms Flux source code into executable bytecode
@@ -150,28 +248,99 @@ type Compiler struct {
     source       []byte        // Source code as byte array
     instructions []Instruction // Generated bytecode instructions
     loopStack    []int         // Stack of loop start positions for bracket matching
+    ifStack      []int         // Addresses of the open conditionals' IF, or ELSE once seen
+    blockStack   []int         // Addresses of the open blocks' QUOTE
+    tryStack     []int         // Addresses of the open traps' TRY, or CATCH once seen
+    blocks       int           // Number of blocks compiled so far
     position     int           // Current position in source (for error reporting)
+    positions    []int         // Source offset of each emitted instruction
+    constants    *ConstPool    // Constants referred to by instructions
+    dataOffsets  map[byte]int  // Offset in data of each declared block, by label
+    data         []int         // Cells of the declared data blocks, in declaration order
+    maxNesting   int           // Reject loops nested deeper than this (0 = no limit)
+    extensions   ExtensionSet  // Extensions whose operators are recognized
 }
 
 // NewCompiler creates a new compiler instance with the given source code
 func NewCompiler(source string) *Compiler {
     return &Compiler{
-        source:       []byte(source),
-        instructions: make([]Instruction, 0, len(source)), // Pre-allocate for efficiency
-        loopStack:    make([]int, 0, 16),                  // Pre-allocate small loop stack
-        position:     0,
+        source:     []byte(source),
+        loopStack:  make([]int, 0, 16), // Pre-allocate small loop stack
+        constants:  NewConstPool(),
+        position:   0,
+        maxNesting: DefaultMaxNesting,
+    }
+}
+
+// shebangLength returns the length of the "#!" line that lets a source
+// file be executed directly, or 0 if source does not start with one. The
+// line is a comment, although '#' and '!' are operators.
+func shebangLength[S string | []byte](source S) int {
+    if len(source) < 2 || source[0] != '#' || source[1] != '!' {
+        return 0
+    }
+    for i := 2; i < len(source); i++ {
+        if source[i] == '\n' {
+            return i + 1
+        }
     }
+    return len(source)
+}
+
+// SetExtensions enables the operators of the given extensions. Their
+// characters are comments otherwise, so existing programs keep their
+// meaning.
+func (c *Compiler) SetExtensions(set ExtensionSet) {
+    c.extensions = set
+}
+
+// SetMaxNesting limits how deeply loops may be nested; zero removes the
+// limit
+func (c *Compiler) SetMaxNesting(n int) {
+    c.maxNesting = n
 }
 
 // Compile performs the complete compilation pipeline:
 // 1. Lexical analysis (tokenization)
 // 2. Syntax analysis (bracket matching validation)
 // 3. Code generation (bytecode emission)
-// Returns the compiled instructions or an error
-func (c *Compiler) Compile() ([]Instruction, error) {
+// Returns the compiled program or an error
+func (c *Compiler) Compile() (*Program, error) {
+    start := headerLength(c.source)
+    meta, err := parseHeader(c.source)
+    if err != nil {
+        return nil, err
+    }
+    if missing := meta.requires() &^ c.extensions; missing != 0 {
+        return nil, c.errorf(-1, "the header requires extension(s) %s, which are not enabled (run with -ext %s)", missing, missing)
+    }
+    if err := c.declareData(meta.data()); err != nil {
+        return nil, err
+    }
+
+    // Count the operators first, so that the bytecode and its positions
+    // are allocated once at their final size instead of being grown by
+    // append, which for multi-megabyte generated sources copies hundreds
+    // of megabytes. Everything else is a comment.
+    var operator [256]bool
+    for b := range operator {
+        operator[b] = isOperator(byte(b), c.extensions)
+    }
+    n := 0
+    for _, b := range c.source[start:] {
+        if operator[b] {
+            n++
+        }
+    }
+    c.instructions = make([]Instruction, 0, n)
+    c.positions = make([]int, 0, n)
+
     // Single-pass compilation: scan source left to right
-    for c.position = 0; c.position < len(c.source); c.position++ {
+    for c.position = start; c.position < len(c.source); c.position++ {
         char := c.source[c.position]
+        if !operator[char] {
+            continue
+        }
 
         switch char {
         case '+':
@@ -192,6 +361,9 @@ func (c *Compiler) Compile() ([]Instruction, error) {
 
         case '[':
             // Loop start: if acc == 0, jump past matching ]
+            if c.maxNesting > 0 && len(c.loopStack) >= c.maxNesting {
+                return nil, c.errorf(c.position, "loops nested deeper than %d at position %d", c.maxNesting, c.position)
+            }
             loopStart := len(c.instructions)
             c.emit(OpLoop, 0) // Emit with placeholder jump address
             c.loopStack = append(c.loopStack, loopStart)
@@ -199,11 +371,14 @@ func (c *Compiler) Compile() ([]Instruction, error) {
         case ']':
             // Loop end: if acc != 0, jump back to matching [
             if len(c.loopStack) == 0 {
-                return nil, fmt.Errorf("compilation error: unmatched ']' at position %d", c.position)
+                return nil, c.errorf(c.position, "unmatched ']' at position %d", c.position)
             }
 
             // Pop the matching loop start position
             loopStart := c.loopStack[len(c.loopStack)-1]
+            if err := c.checkNesting(loopStart); err != nil {
+                return nil, err
+            }
             c.loopStack = c.loopStack[:len(c.loopStack)-1]
 
             loopEnd := len(c.instructions)
@@ -214,187 +389,1300 @@ func (c *Compiler) Compile() ([]Instruction, error) {
             // Patch the loop start instruction with the end address
             // This allows O(1) jump when condition is false
             c.instructions[loopStart].Arg = loopEnd
+            linkLoopExits(c.instructions, loopStart)
 
         case '.':
             // Output operation: print character
             c.emit(OpOut, 0)
 
-        case ',':
-            // Input operation: read character
-            c.emit(OpIn, 0)
+        case ',':
+            // Input operation: read character
+            c.emit(OpIn, 0)
+
+        case '#':
+            // Numeric output operation: print number, which the float
+            // extension prints as a float
+            if c.extensions&ExtFloat != 0 {
+                c.emit(OpOutFloat, 0)
+            } else {
+                c.emit(OpOutNum, 0)
+            }
+
+        case ' ', '\t', '\n', '\r':
+            // Whitespace: ignored
+
+        default:
+            // An operator of an enabled extension, or else a comment,
+            // which allows for readable, documented code
+            e, ok := extensionOps[char]
+            if !ok || c.extensions&e.ext == 0 {
+                break
+            }
+            switch e.op {
+            case OpIf, OpElse, OpEndIf:
+                if err := c.conditional(e.op); err != nil {
+                    return nil, err
+                }
+            case OpBreak, OpContinue:
+                if len(c.loopStack) == 0 {
+                    return nil, c.errorf(c.position, "'%c' outside a loop at position %d", char, c.position)
+                }
+                if n := len(c.blockStack); n > 0 && c.blockStack[n-1] > c.loopStack[len(c.loopStack)-1] {
+                    return nil, c.errorf(c.position, "'%c' at position %d cannot leave the block opened at position %d", char, c.position, c.positions[c.blockStack[n-1]])
+                }
+                if n := len(c.tryStack); n > 0 && c.tryStack[n-1] > c.loopStack[len(c.loopStack)-1] {
+                    return nil, c.errorf(c.position, "'%c' at position %d cannot leave the trap opened at position %d", char, c.position, c.positions[c.tryStack[n-1]])
+                }
+                c.emit(e.op, 0) // Linked when the loop closes
+            case OpData:
+                offset, err := c.dataBlock()
+                if err != nil {
+                    return nil, err
+                }
+                c.emit(e.op, offset)
+                c.position++
+            case OpQuote, OpReturn:
+                if err := c.block(e.op); err != nil {
+                    return nil, err
+                }
+            case OpTry, OpCatch, OpEndTry:
+                if err := c.trap(e.op); err != nil {
+                    return nil, err
+                }
+            case OpLoadReg, OpStoreReg:
+                reg, err := c.register()
+                if err != nil {
+                    return nil, err
+                }
+                c.emit(e.op, reg)
+                c.position++
+            default:
+                c.emit(e.op, 0)
+            }
+        }
+    }
+
+    // Validate that all loops are properly closed
+    if len(c.loopStack) > 0 {
+        return nil, c.errorf(-1, "%d unmatched '[' bracket(s) in source code", len(c.loopStack))
+    }
+    if len(c.ifStack) > 0 {
+        return nil, c.errorf(-1, "%d unmatched '(' bracket(s) in source code", len(c.ifStack))
+    }
+    if len(c.blockStack) > 0 {
+        return nil, c.errorf(-1, "%d unmatched '{' bracket(s) in source code", len(c.blockStack))
+    }
+    if len(c.tryStack) > 0 {
+        return nil, c.errorf(-1, "%d unmatched 'Y' bracket(s) in source code", len(c.tryStack))
+    }
+
+    return &Program{
+        Instructions: c.instructions,
+        Constants:    c.constants,
+        Data:         c.data,
+        Debug:        &DebugInfo{Source: c.source, Positions: c.positions},
+        SourceHash:   sha256.Sum256(c.source),
+        ISA:          ISAVersion,
+        Extensions:   requiredExtensions(c.instructions) | meta.requires(),
+    }, nil
+}
+
+// RequiredExtensions reports the extensions a program needs. They are
+// derived from the instructions rather than taken from the program's
+// header, so the answer can be trusted for bytecode from any source.
+func (c *Compiler) RequiredExtensions(program *Program) ExtensionSet {
+    return requiredExtensions(program.Instructions)
+}
+
+// conditional compiles the parts of '( then : else )'. IF jumps past the
+// ELSE, or past the ENDIF when there is no else branch, and ELSE jumps
+// past the ENDIF.
+func (c *Compiler) conditional(op OpCode) error {
+    if op == OpIf {
+        c.ifStack = append(c.ifStack, len(c.instructions))
+        c.emit(OpIf, 0)
+        return nil
+    }
+
+    char := c.source[c.position]
+    n := len(c.ifStack)
+    if n == 0 {
+        return c.errorf(c.position, "unmatched '%c' at position %d", char, c.position)
+    }
+    open := c.ifStack[n-1]
+    if err := c.checkNesting(open); err != nil {
+        return err
+    }
+
+    here := len(c.instructions)
+    if op == OpElse {
+        if c.instructions[open].Op == OpElse {
+            return c.errorf(c.position, "second ':' in a conditional at position %d", c.position)
+        }
+        c.emit(OpElse, 0)
+        c.instructions[open].Arg = here
+        c.ifStack[n-1] = here
+        return nil
+    }
+    c.emit(OpEndIf, 0)
+    c.instructions[open].Arg = here
+    c.ifStack = c.ifStack[:n-1]
+    return nil
+}
+
+// declareData lays out the declared data blocks, which need the heap
+// extension, since they are loaded into heap cells
+func (c *Compiler) declareData(blocks []DataBlock) error {
+    if len(blocks) == 0 {
+        return nil
+    }
+    if c.extensions&ExtHeap == 0 {
+        return c.errorf(-1, "the program declares data, which needs the heap extension (run with -ext heap)")
+    }
+    c.dataOffsets = make(map[byte]int, len(blocks))
+    for _, block := range blocks {
+        c.dataOffsets[block.Label] = len(c.data)
+        c.data = append(c.data, block.Cells...)
+    }
+    return nil
+}
+
+// block compiles the braces of '{ code }'. QUOTE pushes the block's
+// number, which blocks get in source order from 1, and jumps past the RET
+// that carries it; EXEC calls the block and RET returns from it.
+func (c *Compiler) block(op OpCode) error {
+    if op == OpQuote {
+        c.blockStack = append(c.blockStack, len(c.instructions))
+        c.emit(OpQuote, 0)
+        return nil
+    }
+
+    n := len(c.blockStack)
+    if n == 0 {
+        return c.errorf(c.position, "unmatched '}' at position %d", c.position)
+    }
+    open := c.blockStack[n-1]
+    if err := c.checkNesting(open); err != nil {
+        return err
+    }
+    c.blocks++
+    c.instructions[open].Arg = len(c.instructions)
+    c.emit(OpReturn, c.blocks)
+    c.blockStack = c.blockStack[:n-1]
+    return nil
+}
+
+// trap compiles the parts of 'Y body H handler E'. TRY installs a handler
+// that continues past the CATCH; CATCH, reached when the body completes,
+// removes it and jumps past the ENDTRY. Without a handler, E compiles to
+// a CATCH and an ENDTRY, so a caught fault continues after the E.
+func (c *Compiler) trap(op OpCode) error {
+    if op == OpTry {
+        c.tryStack = append(c.tryStack, len(c.instructions))
+        c.emit(OpTry, 0)
+        return nil
+    }
+
+    char := c.source[c.position]
+    n := len(c.tryStack)
+    if n == 0 {
+        return c.errorf(c.position, "unmatched '%c' at position %d", char, c.position)
+    }
+    open := c.tryStack[n-1]
+    if err := c.checkNesting(open); err != nil {
+        return err
+    }
+
+    if op == OpCatch {
+        if c.instructions[open].Op == OpCatch {
+            return c.errorf(c.position, "second '%c' in a trap at position %d", char, c.position)
+        }
+        c.instructions[open].Arg = len(c.instructions)
+        c.tryStack[n-1] = len(c.instructions)
+        c.emit(OpCatch, 0)
+        return nil
+    }
+    if c.instructions[open].Op == OpTry {
+        c.instructions[open].Arg = len(c.instructions)
+        open = len(c.instructions)
+        c.emit(OpCatch, 0)
+    }
+    c.instructions[open].Arg = len(c.instructions)
+    c.emit(OpEndTry, 0)
+    c.tryStack = c.tryStack[:n-1]
+    return nil
+}
+
+// CompileError is an error in the source of a program. Pos is the offset
+// of the character at fault, or -1 when the error is not at one place,
+// such as a bracket that is never closed.
+type CompileError struct {
+    Pos int
+    Msg string
+}
+
+func (e *CompileError) Error() string {
+    return "compilation error: " + e.Msg
+}
+
+// errorf returns a CompileError at pos
+func (c *Compiler) errorf(pos int, format string, args ...any) error {
+    return &CompileError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// checkNesting returns an error if a loop, conditional, block or trap was opened
+// after the construct at address open, which the character at the current
+// position continues or closes, so that the two would overlap
+func (c *Compiler) checkNesting(open int) error {
+    for _, stack := range [][]int{c.loopStack, c.ifStack, c.blockStack, c.tryStack} {
+        if n := len(stack); n > 0 && stack[n-1] > open {
+            inner := c.positions[stack[n-1]]
+            return c.errorf(c.position, "'%c' at position %d closes around the unclosed '%c' at position %d",
+                c.source[c.position], c.position, c.source[inner], inner)
+        }
+    }
+    return nil
+}
+
+// dataBlock reads the label of the data block following the operator at
+// the current position and returns the block's offset in the data
+func (c *Compiler) dataBlock() (int, error) {
+    if c.position+1 < len(c.source) {
+        if offset, ok := c.dataOffsets[c.source[c.position+1]]; ok {
+            return offset, nil
+        }
+        if label := c.source[c.position+1]; label >= 'a' && label <= 'z' {
+            return 0, c.errorf(c.position, "'%c' at position %d names data block %c, which is not declared", c.source[c.position], c.position, label)
+        }
+    }
+    return 0, c.errorf(c.position, "'%c' at position %d must be followed by the label of a data block, a to z", c.source[c.position], c.position)
+}
+
+// register reads the name of the register following the operator at the
+// current position and returns its number
+func (c *Compiler) register() (int, error) {
+    if c.position+1 < len(c.source) {
+        if reg := strings.IndexByte(registerNames, c.source[c.position+1]); reg >= 0 {
+            return reg, nil
+        }
+    }
+    return 0, c.errorf(c.position, "'%c' at position %d must be followed by a register name, a to h", c.source[c.position], c.position)
+}
+
+// emit appends a new instruction to the bytecode sequence
+func (c *Compiler) emit(op OpCode, arg int) {
+    c.instructions = append(c.instructions, Instruction{Op: op, Arg: arg})
+    c.positions = append(c.positions, c.position)
+}
+
+// lineCol converts a byte offset in source into a 1-based line and column
+func lineCol(source []byte, offset int) (int, int) {
+    line, col := 1, 1
+    for i := 0; i < offset && i < len(source); i++ {
+        if source[i] == '\n' {
+            line++
+            col = 1
+        } else {
+            col++
+        }
+    }
+    return line, col
+}
+
+// lineStarts returns the offset of the start of each line of source, for
+// lineColAt
+func lineStarts(source []byte) []int {
+    starts := []int{0}
+    for i, b := range source {
+        if b == '\n' {
+            starts = append(starts, i+1)
+        }
+    }
+    return starts
+}
+
+// lineColAt is lineCol for an offset within the source whose line starts
+// are given, without scanning the source again, for callers converting
+// an offset for every instruction
+func lineColAt(starts []int, offset int) (int, int) {
+    line := sort.SearchInts(starts, offset+1) // Lines starting at or before offset
+    return line, offset - starts[line-1] + 1
+}
+
+// VM represents the Flux virtual machine that executes compiled bytecode
+type VM struct {
+    program        *Program          // The program to execute
+    instructions   []Instruction     // The program's instructions, for quick access
+    accumulator    int               // The single accumulator register
+    stack          []int             // The unbounded stack
+    pc             int               // Program counter (instruction pointer)
+    device         Device            // Input for ',' and output for '.', '#' and the like
+    trace          io.Writer         // Receives one line per executed instruction when set
+    dumpOutput     io.Writer         // Receives the output of DUMP
+    steps          int               // Number of instructions executed so far
+    outputBytes    int64             // Bytes written to the output so far
+    maxDepth       int               // Deepest the stack has been
+    maxSteps       int               // Abort after this many instructions (0 = no limit)
+    strictStack    bool              // Treat popping an empty stack as an error
+    extensions     ExtensionSet      // Extensions programs may use
+    checkOverflow  bool              // Treat accumulator overflow as an error instead of wrapping
+    deterministic  bool              // Refuse programs whose output may vary between runs
+    ctx            context.Context   // Cancels waits such as SLEEP
+    clock          Clock             // Time source for the clock and sleep extensions
+    fileAccess     *FileAccess       // Sandbox for the fs extension, or nil to refuse file access
+    env            map[string]string // Variables the env extension may read, or nil to refuse
+    netAddr        string            // Address the net extension may listen on, or "" to refuse
+    conn           *netConn          // Connection accepted by the net extension
+    files          map[int]*openFile // Files opened by the program, by handle
+    nextHandle     int               // Last file handle given out
+    start          time.Time         // When the program started, by clock
+    maxSleep       time.Duration     // Longest single SLEEP; longer requests are cut short
+    calls          []int             // Return addresses of the blocks being executed
+    maxCallDepth   int               // Most blocks that may be executing at once (0 = no limit)
+    blockStarts    map[int]int       // Address of each block's first instruction by number, built on first EXEC
+    coroutines     []*coroutine      // Coroutines of the run by number, once the program uses them
+    current        int               // Number of the running coroutine
+    traps          []Trap            // Installed trap handlers, innermost last
+    heap           []int             // Heap cells, the data blocks and those allocated; address 1 is the first
+    dataBase       int               // Position in heap of the loaded program's data
+    maxHeap        int               // Most heap cells the program may allocate (0 = no limit)
+    floatPrecision int               // Digits OUTF prints after the decimal point (negative = as many as needed)
+    registers      [NumRegisters]int // Named registers of the registers extension
+    ring           []TraceEntry      // Most recently executed instructions, when enabled
+    ringNext       int               // Slot in ring that receives the next entry
+    recorder       *traceRecorder    // Writes a trace of every instruction, when recording
+    ioLog          *ioLog            // Logs the program's input and output, when logging
+    sampler        *sampler          // Counts where the program spends its time, when profiling
+    quota          *quota            // Thresholds of resource use to report, if any
+    running        atomic.Bool       // Whether Start is running the program
+    pauseMu        sync.Mutex        // Guards resume
+    resume         chan struct{}     // Closed by Resume; non-nil while a pause is requested
+    paused         atomic.Bool       // Whether the program has stopped at a pause
+    onPause        func()            // Called when the program stops at a pause
+    runnable       error             // Why the program may not run here, nil if it may
+}
+
+// TraceEntry records the machine state just before an instruction executed
+type TraceEntry struct {
+    PC          int    // Address of the instruction
+    Op          OpCode // The instruction's operation
+    Accumulator int    // Accumulator before execution
+    Depth       int    // Stack depth before execution
+}
+
+// NewVM creates a new virtual machine with the given program and I/O
+// streams. A nil program is an empty one, to be replaced with Load.
+func NewVM(program *Program, input io.Reader, output io.Writer) *VM {
+    if program == nil {
+        program = NewProgram(nil)
+    }
+    vm := &VM{
+        program:        program,
+        instructions:   program.Instructions,
+        heap:           append([]int(nil), program.Data...),
+        accumulator:    0,                   // Start with accumulator at 0
+        stack:          make([]int, 0, 256), // Pre-allocate stack with reasonable capacity
+        pc:             0,                   // Start at first instruction
+        device:         NewStreamDevice(input, output),
+        dumpOutput:     os.Stderr,
+        ctx:            context.Background(),
+        clock:          systemClock{},
+        start:          time.Now(),
+        maxSleep:       DefaultMaxSleep,
+        maxCallDepth:   DefaultMaxCallDepth,
+        maxHeap:        DefaultMaxHeap,
+        floatPrecision: -1,
+    }
+    vm.runnable = vm.checkRunnable()
+    return vm
+}
+
+// Load replaces the program and rewinds the program counter while keeping
+// the accumulator and stack intact, so a session can run several programs
+// against the same machine state. The program's data is added to the
+// heap.
+func (vm *VM) Load(program *Program) {
+    vm.program = program
+    vm.instructions = program.Instructions
+    vm.dataBase = len(vm.heap)
+    vm.heap = append(vm.heap, program.Data...)
+    vm.pc = 0
+    vm.calls = vm.calls[:0]
+    vm.blockStarts = nil
+    vm.traps = vm.traps[:0]
+    vm.coroutines = nil
+    vm.current = 0
+    vm.runnable = vm.checkRunnable()
+}
+
+// Reset prepares the machine to run program from the start, as a new VM
+// would, but keeps the memory it has allocated for the stack, the heap,
+// block calls, trap handlers and the trace ring, and keeps its settings:
+// limits, extensions, sandboxes, clock, context and I/O streams. Files and
+// the connection left open are closed without reporting errors; call
+// CloseFiles first to see them. Machines can thus be recycled through a
+// sync.Pool by servers running many small programs.
+func (vm *VM) Reset(program *Program) {
+    vm.CloseFiles()
+    vm.heap = vm.heap[:0]
+    vm.Load(program)
+    vm.accumulator = 0
+    vm.stack = vm.stack[:0]
+    vm.registers = [NumRegisters]int{}
+    vm.steps = 0
+    vm.outputBytes = 0
+    vm.maxDepth = 0
+    vm.nextHandle = 0
+    vm.start = vm.clock.Now()
+    vm.ring = vm.ring[:0]
+    vm.ringNext = 0
+    if vm.quota != nil {
+        vm.quota.rearm()
+    }
+}
+
+// SetIO replaces the machine's input and output streams, so a recycled
+// machine can serve a new request
+func (vm *VM) SetIO(input io.Reader, output io.Writer) {
+    vm.device = NewStreamDevice(input, output)
+}
+
+// SetDevice replaces the device the machine reads input from and writes
+// output to
+func (vm *VM) SetDevice(d Device) {
+    vm.device = d
+}
+
+// Device returns the device the machine reads input from and writes
+// output to
+func (vm *VM) Device() Device {
+    return vm.device
+}
+
+// Program returns the program the machine is running
+func (vm *VM) Program() *Program {
+    return vm.program
+}
+
+// SetMaxSteps limits the number of instructions Run may execute; zero
+// removes the limit
+func (vm *VM) SetMaxSteps(n int) {
+    vm.maxSteps = n
+}
+
+// SetMaxCallDepth limits how many blocks may be executing at once, so
+// runaway recursion fails instead of exhausting memory; zero removes the
+// limit
+func (vm *VM) SetMaxCallDepth(n int) {
+    vm.maxCallDepth = n
+}
+
+// SetContext makes the machine abandon waits, such as a SLEEP, when ctx is
+// cancelled; the instruction then fails with the context's error. A
+// program that is busy computing stops within a few instructions.
+func (vm *VM) SetContext(ctx context.Context) {
+    vm.ctx = ctx
+}
+
+// SetClock replaces the system clock, for instance with a FakeClock to make
+// runs repeatable. The program's start time is read from the new clock.
+func (vm *VM) SetClock(c Clock) {
+    vm.clock = c
+    vm.start = c.Now()
+}
+
+// SetMaxSleep caps how long a single SLEEP may pause; longer requests are
+// shortened to d, and zero disables pausing altogether
+func (vm *VM) SetMaxSleep(d time.Duration) {
+    vm.maxSleep = d
+}
+
+// SetDumpOutput sends the output of DUMP to w instead of standard error
+func (vm *VM) SetDumpOutput(w io.Writer) {
+    vm.dumpOutput = w
+}
+
+// SetCheckOverflow makes arithmetic that overflows the accumulator a
+// runtime error instead of wrapping around
+func (vm *VM) SetCheckOverflow(check bool) {
+    vm.checkOverflow = check
+}
+
+// SetDeterministic makes the machine refuse to run programs whose output
+// may differ between runs or platforms given the same input, such as
+// programs reading the clock
+func (vm *VM) SetDeterministic(on bool) {
+    vm.deterministic = on
+    vm.runnable = vm.checkRunnable()
+}
+
+// checkRunnable returns an error if the machine may not execute its
+// program. Load and the settings it depends on keep its result in
+// runnable, which the ways of running the program check before the first
+// instruction rather than step before every one.
+func (vm *VM) checkRunnable() error {
+    if err := vm.program.checkRunnable(vm.extensions); err != nil {
+        return err
+    }
+    if vm.deterministic {
+        return vm.program.checkDeterministic()
+    }
+    return nil
+}
+
+// SetExtensions sets the extensions the machine may execute. Running a
+// program that needs any other extension fails before its first
+// instruction.
+func (vm *VM) SetExtensions(set ExtensionSet) {
+    vm.extensions = set
+    vm.runnable = vm.checkRunnable()
+}
+
+// SupportedExtensions returns the extensions the machine may execute
+func (vm *VM) SupportedExtensions() ExtensionSet {
+    return vm.extensions
+}
+
+// SetStrictStack makes popping an empty stack a runtime error instead of
+// yielding zero
+func (vm *VM) SetStrictStack(strict bool) {
+    vm.strictStack = strict
+}
+
+// EnableTraceRing keeps the last n executed instructions for post-mortem
+// inspection; zero disables recording
+func (vm *VM) EnableTraceRing(n int) {
+    vm.ring = make([]TraceEntry, 0, n)
+    vm.ringNext = 0
+}
+
+// TraceRing returns the recorded instructions, oldest first
+func (vm *VM) TraceRing() []TraceEntry {
+    if len(vm.ring) < cap(vm.ring) {
+        return append([]TraceEntry(nil), vm.ring...)
+    }
+    return append(append([]TraceEntry(nil), vm.ring[vm.ringNext:]...), vm.ring[:vm.ringNext]...)
+}
+
+// StepCount returns the number of instructions executed so far
+func (vm *VM) StepCount() int {
+    return vm.steps
+}
+
+// SetTrace enables instruction tracing to w, or disables it when w is nil
+func (vm *VM) SetTrace(w io.Writer) {
+    vm.trace = w
+}
+
+// Accumulator returns the current accumulator value
+func (vm *VM) Accumulator() int {
+    return vm.accumulator
+}
+
+// Stack returns a copy of the stack contents, bottom first
+func (vm *VM) Stack() []int {
+    return append([]int(nil), vm.stack...)
+}
+
+// Snapshot is a copy of the machine state that can be restored later.
+// Input already consumed and output already written are not part of it.
+type Snapshot struct {
+    Accumulator int               // Accumulator value
+    Stack       []int             // Stack contents, bottom first
+    Registers   [NumRegisters]int // Named registers
+    Calls       []int             // Return addresses of the blocks being executed
+    Traps       []Trap            // Installed trap handlers, innermost last
+    PC          int               // Address of the next instruction
+    Heap        []int             // Cells of the heap extension, the cell at address 1 first
+}
+
+// Snapshot captures the current machine state
+func (vm *VM) Snapshot() Snapshot {
+    s := vm.threadState()
+    s.Heap = vm.Heap()
+    return s
+}
+
+// Restore returns the machine to a previously captured state
+func (vm *VM) Restore(s Snapshot) {
+    vm.restoreThread(s)
+    vm.heap = append(vm.heap[:0], s.Heap...)
+}
+
+// threadState captures the state of the running coroutine: all of the
+// machine's but the heap, which coroutines share
+func (vm *VM) threadState() Snapshot {
+    return Snapshot{
+        Accumulator: vm.accumulator,
+        Stack:       vm.Stack(),
+        Registers:   vm.registers,
+        Calls:       append([]int(nil), vm.calls...),
+        Traps:       append([]Trap(nil), vm.traps...),
+        PC:          vm.pc,
+    }
+}
+
+// restoreThread resumes a coroutine captured by threadState, leaving the
+// heap alone
+func (vm *VM) restoreThread(s Snapshot) {
+    vm.accumulator = s.Accumulator
+    vm.stack = append(vm.stack[:0], s.Stack...)
+    vm.registers = s.Registers
+    vm.calls = append(vm.calls[:0], s.Calls...)
+    vm.traps = append(vm.traps[:0], s.Traps...)
+    vm.pc = s.PC
+}
+
+// Run executes the bytecode program from start to finish
+// Returns an error if any runtime error occurs (typically I/O errors)
+func (vm *VM) Run() error {
+    if vm.runnable != nil {
+        return vm.runnable
+    }
+    for vm.pc < len(vm.instructions) {
+        if err := vm.advance(); err != nil {
+            vm.Flush() // Keep the output that led up to the error
+            return err
+        }
+    }
+
+    return vm.Flush()
+}
+
+// RunSteps executes at most n instructions, stopping early if the program
+// ends, and reports whether it has ended. Calling it until it has is the
+// same as calling Run: output is flushed when the program ends, however
+// it ends, and may otherwise stay buffered until a later call, or Flush.
+// It lets a host run a program a slice at a time on its own goroutine,
+// such as once per frame of a game loop.
+func (vm *VM) RunSteps(n int) (halted bool, err error) {
+    if vm.runnable != nil {
+        return true, vm.runnable
+    }
+    for i := 0; i < n && vm.pc < len(vm.instructions); i++ {
+        if err := vm.advance(); err != nil {
+            vm.Flush()
+            return true, err
+        }
+    }
+    if vm.pc < len(vm.instructions) {
+        return false, nil
+    }
+    return true, vm.Flush()
+}
+
+// Flush writes out any output held back by the machine's device. Run
+// flushes when the program ends, however it ends, and every instruction
+// that may wait flushes first, so a prompt shows before the program reads
+// the answer.
+func (vm *VM) Flush() error {
+    if err := vm.device.Flush(); err != nil {
+        return fmt.Errorf("output error: %v", err)
+    }
+    return nil
+}
+
+// Halted reports whether the program counter has run past the last instruction
+func (vm *VM) Halted() bool {
+    return vm.pc >= len(vm.instructions)
+}
+
+// PC returns the address of the next instruction to execute
+func (vm *VM) PC() int {
+    return vm.pc
+}
+
+// Step executes the single instruction at the program counter. A fault
+// with a trap handler installed continues at the handler.
+func (vm *VM) Step() error {
+    if vm.runnable != nil {
+        return vm.runnable
+    }
+    return vm.advance()
+}
+
+// advance is Step for callers that have already checked the program may
+// run
+func (vm *VM) advance() error {
+    if vm.recorder != nil {
+        return vm.recordStep()
+    }
+    return vm.catch(vm.step())
+}
+
+// StepLimitError is the error of a machine that reached its step limit
+type StepLimitError struct {
+    Limit int
+}
+
+func (e *StepLimitError) Error() string {
+    return fmt.Sprintf("step limit of %d instructions exceeded", e.Limit)
+}
+
+// step executes the single instruction at the program counter
+func (vm *VM) step() error {
+    if vm.Halted() {
+        return nil
+    }
+
+    if vm.maxSteps > 0 && vm.steps >= vm.maxSteps {
+        return &StepLimitError{vm.maxSteps}
+    }
+    if vm.steps%interruptInterval == 0 {
+        if err := vm.checkpoint(); err != nil {
+            return err
+        }
+    }
+    if vm.quota != nil {
+        if err := vm.checkQuota(); err != nil {
+            return err
+        }
+    }
+    vm.steps++
+    if vm.sampler != nil {
+        vm.sampler.sample(vm.pc)
+    }
+
+    inst := vm.instructions[vm.pc]
+    jumped := false // Track if we jumped
+    yield := false  // Whether another coroutine gets its turn afterwards
+
+    if cap(vm.ring) > 0 {
+        entry := TraceEntry{PC: vm.pc, Op: inst.Op, Accumulator: vm.accumulator, Depth: len(vm.stack)}
+        if len(vm.ring) < cap(vm.ring) {
+            vm.ring = append(vm.ring, entry)
+        } else {
+            vm.ring[vm.ringNext] = entry
+        }
+        vm.ringNext = (vm.ringNext + 1) % cap(vm.ring)
+    }
+
+    if vm.trace != nil {
+        fmt.Fprintf(vm.trace, "[trace] %04d  %-8s acc=%d depth=%d\n", vm.pc, inst.Op, vm.accumulator, len(vm.stack))
+    }
+
+    switch inst.Op {
+    case OpInc:
+        if err := vm.add(1); err != nil {
+            return err
+        }
+
+    case OpDec:
+        if err := vm.add(-1); err != nil {
+            return err
+        }
+
+    case OpPush:
+        vm.stack = append(vm.stack, vm.accumulator)
+
+    case OpPop:
+        v, err := vm.pop()
+        if err != nil {
+            return err
+        }
+        vm.accumulator = v
+
+    case OpLoop:
+        if vm.accumulator == 0 {
+            vm.pc = inst.Arg
+            jumped = true // We jumped, don't increment pc
+        }
+
+    case OpEnd:
+        if vm.accumulator != 0 {
+            vm.pc = inst.Arg
+            jumped = true // We jumped, don't increment pc
+        }
+
+    case OpIf:
+        if vm.accumulator == 0 {
+            vm.pc = inst.Arg + 1
+            jumped = true
+        }
+
+    case OpElse:
+        vm.pc = inst.Arg + 1
+        jumped = true
+
+    case OpEndIf:
+
+    case OpBreak:
+        vm.pc = inst.Arg + 1
+        jumped = true
+
+    case OpContinue:
+        vm.pc = inst.Arg
+        jumped = true
+
+    case OpPeek, OpPoke:
+        i, err := vm.cell()
+        if err != nil {
+            return err
+        }
+        if inst.Op == OpPeek {
+            vm.accumulator = vm.heap[i]
+        } else {
+            vm.heap[i] = vm.accumulator
+        }
+
+    case OpData:
+        vm.accumulator = vm.dataBase + inst.Arg + 1
+
+    case OpAlloc:
+        if err := vm.alloc(); err != nil {
+            return err
+        }
+
+    case OpLoadReg, OpStoreReg:
+        if inst.Arg < 0 || inst.Arg >= NumRegisters {
+            return fmt.Errorf("invalid %s at instruction %d: no register %d", inst.Op, vm.pc, inst.Arg)
+        }
+        if inst.Op == OpLoadReg {
+            vm.accumulator = vm.registers[inst.Arg]
+        } else {
+            vm.registers[inst.Arg] = vm.accumulator
+        }
+
+    case OpDup, OpSwap, OpRot, OpOver:
+        if err := vm.shuffle(inst.Op); err != nil {
+            return err
+        }
+
+    case OpDepth:
+        vm.accumulator = len(vm.stack)
+
+    case OpDump:
+        vm.dump()
+
+    case OpAssert:
+        want, err := vm.pop()
+        if err != nil {
+            return err
+        }
+        if vm.accumulator != want {
+            return fault(FaultAssert, "assertion failed at %s: expected %d, got %d", vm.program.Location(vm.pc), want, vm.accumulator)
+        }
+
+    case OpQuote:
+        vm.stack = append(vm.stack, vm.instructions[inst.Arg].Arg)
+        vm.pc = inst.Arg + 1
+        jumped = true
+
+    case OpReturn:
+        if len(vm.calls) == 0 {
+            return fmt.Errorf("invalid RET at instruction %d: no block is executing", vm.pc)
+        }
+        vm.pc = vm.calls[len(vm.calls)-1]
+        vm.calls = vm.calls[:len(vm.calls)-1]
+        jumped = true
+
+    case OpExec:
+        n, err := vm.pop()
+        if err != nil {
+            return err
+        }
+        start, ok := vm.block(n)
+        if !ok {
+            return fault(FaultOperand, "%d is not a block at %s", n, vm.program.Location(vm.pc))
+        }
+        if vm.maxCallDepth > 0 && len(vm.calls) >= vm.maxCallDepth {
+            return fault(FaultLimit, "blocks nested more than %d calls deep at %s", vm.maxCallDepth, vm.program.Location(vm.pc))
+        }
+        vm.calls = append(vm.calls, vm.pc+1)
+        vm.pc = start
+        jumped = true
+
+    case OpSpawn:
+        if err := vm.spawn(); err != nil {
+            return err
+        }
+
+    case OpSend:
+        if err := vm.send(); err != nil {
+            return err
+        }
+        yield = true
+
+    case OpReceive:
+        if !vm.receive() {
+            jumped = true // Receive again when resumed
+            yield = true
+        }
+
+    case OpTry:
+        vm.traps = append(vm.traps, Trap{Handler: inst.Arg + 1, Depth: len(vm.stack), Calls: len(vm.calls)})
+
+    case OpCatch:
+        if len(vm.traps) == 0 {
+            return fmt.Errorf("invalid CATCH at instruction %d: no trap handler is installed", vm.pc)
+        }
+        vm.traps = vm.traps[:len(vm.traps)-1]
+        vm.pc = inst.Arg + 1
+        jumped = true
+
+    case OpEndTry:
+
+    case OpToFloat, OpToInt, OpFAdd, OpFSub, OpFMul, OpFDiv:
+        if err := vm.float(inst.Op); err != nil {
+            return err
+        }
+
+    case OpAnsi:
+        if err := vm.ansiControl(); err != nil {
+            return err
+        }
+
+    case OpGetenv:
+        if err := vm.getenv(); err != nil {
+            return err
+        }
+
+    case OpAccept:
+        if err := vm.Flush(); err != nil {
+            return err
+        }
+        if err := vm.netAccept(); err != nil {
+            return err
+        }
+
+    case OpNetRead:
+        if err := vm.netRead(); err != nil {
+            return err
+        }
+
+    case OpNetWrite:
+        if err := vm.netWrite(); err != nil {
+            return err
+        }
+
+    case OpOutFloat:
+        s := vm.formatFloat(toFloat(vm.accumulator))
+        vm.outputBytes += int64(len(s))
+        if _, err := vm.device.WriteString(s); err != nil {
+            return fmt.Errorf("output error: %v", err)
+        }
+
+    case OpOut:
+        vm.outputBytes++
+        if err := vm.device.WriteByte(byte(vm.accumulator % 256)); err != nil {
+            return fmt.Errorf("output error: %v", err)
+        }
+
+    case OpIn:
+        if err := vm.Flush(); err != nil {
+            return err
+        }
+        c, err := vm.device.ReadByte()
+        if err != nil && err != io.EOF {
+            return fmt.Errorf("input error: %v", err)
+        }
+        if err == io.EOF {
+            c = 0
+        }
+        vm.accumulator = int(c)
+
+    case OpOutNum:
+        s := strconv.Itoa(vm.accumulator)
+        vm.outputBytes += int64(len(s))
+        if _, err := vm.device.WriteString(s); err != nil {
+            return fmt.Errorf("output error: %v", err)
+        }
+
+    case OpAdd:
+        if err := vm.add(inst.Arg); err != nil {
+            return err
+        }
+
+    case OpSet:
+        v, err := vm.program.Constants.IntValue(inst.Arg)
+        if err != nil {
+            return fmt.Errorf("invalid SET at instruction %d: %v", vm.pc, err)
+        }
+        vm.accumulator = v
+
+    case OpEmitBytes:
+        c, err := vm.program.Constants.At(inst.Arg)
+        if err != nil || c.IsInt() {
+            return fmt.Errorf("invalid EMIT at instruction %d: constant %d is not a byte string", vm.pc, inst.Arg)
+        }
+        vm.outputBytes += int64(len(c.Bytes))
+        if err := writeBytes(vm.device, c.Bytes); err != nil {
+            return fmt.Errorf("output error: %v", err)
+        }
+
+    case OpProbe:
+        if err := vm.Flush(); err != nil {
+            return err
+        }
+        vm.accumulator = 0
+        if deviceReady(vm.device) {
+            vm.accumulator = 1
+        }
+
+    case OpSleep:
+        if err := vm.Flush(); err != nil {
+            return err
+        }
+        if err := vm.sleep(vm.accumulator); err != nil {
+            return err
+        }
+
+    case OpClock:
+        vm.accumulator = int(vm.clock.Now().Sub(vm.start) / time.Millisecond)
+
+    case OpTime:
+        vm.accumulator = int(vm.clock.Now().Unix())
 
-        case '#':
-            // Numeric output operation: print number
-            c.emit(OpOutNum, 0)
+    case OpFileOpen:
+        if err := vm.fileOpen(); err != nil {
+            return err
+        }
 
-        case ' ', '\t', '\n', '\r':
-            // Whitespace: ignored
+    case OpFileRead:
+        if err := vm.fileRead(); err != nil {
+            return err
+        }
 
-        default:
-            // Any other character: treated as comment, ignored
-            // This allows for readable, documented code
+    case OpFileWrite:
+        if err := vm.fileWrite(); err != nil {
+            return err
         }
-    }
 
-    // Validate that all loops are properly closed
-    if len(c.loopStack) > 0 {
-        return nil, fmt.Errorf("compilation error: %d unmatched '[' bracket(s) in source code", len(c.loopStack))
+    case OpFileClose:
+        if err := vm.fileClose(); err != nil {
+            return err
+        }
+
+    case OpAnd, OpOr, OpXor, OpShl, OpShr:
+        if err := vm.bitwise(inst.Op); err != nil {
+            return err
+        }
+
+    default:
+        return fmt.Errorf("internal error: invalid opcode %d at position %d", inst.Op, vm.pc)
     }
 
-    return c.instructions, nil
-}
+    // Only increment pc if we didn't jump
+    if !jumped {
+        vm.pc++
+    }
+    if len(vm.stack) > vm.maxDepth {
+        vm.maxDepth = len(vm.stack)
+    }
 
-// emit appends a new instruction to the bytecode sequence
-func (c *Compiler) emit(op OpCode, arg int) {
-    c.instructions = append(c.instructions, Instruction{Op: op, Arg: arg})
+    // A coroutine ends when it returns from its block; the program ends
+    // when the main program, coroutine 0, does
+    if vm.current != 0 && vm.Halted() {
+        vm.coroutines[vm.current].done = true
+        yield = true
+    }
+    if yield {
+        return vm.switchCoroutine()
+    }
+    return nil
 }
 
-// VM represents the Flux virtual machine that executes compiled bytecode
-type VM struct {
-    instructions []Instruction // The bytecode program to execute
-    accumulator  int           // The single accumulator register
-    stack        []int         // The unbounded stack
-    pc           int           // Program counter (instruction pointer)
-    input        io.Reader     // Input stream for ',' operation
-    output       io.Writer     // Output stream for '.' and '#' operations
+// sleep pauses for ms milliseconds, capped at the machine's limit,
+// returning early with an error if the machine's context is cancelled.
+// Zero and negative durations do not pause.
+func (vm *VM) sleep(ms int) error {
+    if ms <= 0 {
+        return nil
+    }
+    d := vm.maxSleep
+    if ms < int(vm.maxSleep/time.Millisecond) {
+        d = time.Duration(ms) * time.Millisecond
+    }
+    if err := vm.clock.Sleep(vm.ctx, d); err != nil {
+        return fmt.Errorf("interrupted during SLEEP at %s: %v", vm.program.Location(vm.pc), err)
+    }
+    return nil
 }
 
-// NewVM creates a new virtual machine with the given bytecode and I/O streams
-func NewVM(instructions []Instruction, input io.Reader, output io.Writer) *VM {
-    return &VM{
-        instructions: instructions,
-        accumulator:  0,                       // Start with accumulator at 0
-        stack:        make([]int, 0, 256),     // Pre-allocate stack with reasonable capacity
-        pc:           0,                       // Start at first instruction
-        input:        input,                   // Input stream
-        output:       output,                  // Output stream
+// pop removes and returns the top of the stack. An empty stack yields
+// zero, or an error when strict stack checking is enabled.
+func (vm *VM) pop() (int, error) {
+    if len(vm.stack) == 0 {
+        if vm.strictStack {
+            return 0, fault(FaultUnderflow, "stack underflow: pop from empty stack at instruction %d", vm.pc)
+        }
+        return 0, nil
     }
+    v := vm.stack[len(vm.stack)-1]
+    vm.stack = vm.stack[:len(vm.stack)-1]
+    return v, nil
 }
 
-// Run executes the bytecode program from start to finish
-// Returns an error if any runtime error occurs (typically I/O errors)
-func (vm *VM) Run() error {
-    for vm.pc < len(vm.instructions) {
-        inst := vm.instructions[vm.pc]
-        jumped := false  // Track if we jumped
-
-        switch inst.Op {
-        case OpInc:
-            vm.accumulator++
-
-        case OpDec:
-            vm.accumulator--
-
-        case OpPush:
-            vm.stack = append(vm.stack, vm.accumulator)
-
-        case OpPop:
-            if len(vm.stack) > 0 {
-                vm.accumulator = vm.stack[len(vm.stack)-1]
-                vm.stack = vm.stack[:len(vm.stack)-1]
-            } else {
-                vm.accumulator = 0
-            }
-
-        case OpLoop:
-            if vm.accumulator == 0 {
-                vm.pc = inst.Arg
-                jumped = true  // We jumped, don't increment pc
-            }
-
-        case OpEnd:
-            if vm.accumulator != 0 {
-                vm.pc = inst.Arg
-                jumped = true  // We jumped, don't increment pc
-            }
-
-        case OpOut:
-            char := byte(vm.accumulator % 256)
-            _, err := vm.output.Write([]byte{char})
-            if err != nil {
-                return fmt.Errorf("output error: %v", err)
+// block returns the address of the first instruction of block number n
+func (vm *VM) block(n int) (int, bool) {
+    if vm.blockStarts == nil {
+        vm.blockStarts = make(map[int]int)
+        for i, inst := range vm.instructions {
+            if inst.Op == OpQuote && inst.Arg > i && inst.Arg < len(vm.instructions) {
+                vm.blockStarts[vm.instructions[inst.Arg].Arg] = i + 1
             }
+        }
+    }
+    start, ok := vm.blockStarts[n]
+    return start, ok
+}
 
-        case OpIn:
-            buf := make([]byte, 1)
-            n, err := vm.input.Read(buf)
-            if err != nil && err != io.EOF {
-                return fmt.Errorf("input error: %v", err)
-            }
-            if err == io.EOF || n == 0 {
-                vm.accumulator = 0
-            } else {
-                vm.accumulator = int(buf[0])
-            }
+// dump writes the accumulator, the stack and, for programs that use them,
+// the registers to the dump output. Write errors are ignored, so a failing
+// diagnostic never stops the program.
+func (vm *VM) dump() {
+    vm.Flush() // Keep dumps in order with the output around them
+    line := fmt.Sprintf("[dump] %s acc=%d depth=%d stack=%v", vm.program.Location(vm.pc), vm.accumulator, len(vm.stack), vm.stack)
+    if vm.program.Extensions&ExtRegisters != 0 {
+        line += " registers: " + formatRegisters(vm.registers)
+    }
+    fmt.Fprintln(vm.dumpOutput, line)
+}
 
-        case OpOutNum:
-            _, err := fmt.Fprintf(vm.output, "%d", vm.accumulator)
-            if err != nil {
-                return fmt.Errorf("output error: %v", err)
-            }
+// formatRegisters lists register values by name
+func formatRegisters(regs [NumRegisters]int) string {
+    parts := make([]string, len(regs))
+    for i, v := range regs {
+        parts[i] = fmt.Sprintf("%c=%d", registerNames[i], v)
+    }
+    return strings.Join(parts, " ")
+}
 
-        default:
-            return fmt.Errorf("internal error: invalid opcode %d at position %d", inst.Op, vm.pc)
+// shuffleDepth is how many stack entries each stack manipulation uses
+var shuffleDepth = map[OpCode]int{OpDup: 1, OpSwap: 2, OpRot: 3, OpOver: 2}
+
+// shuffle rearranges the top of the stack in the manner of Forth's DUP,
+// SWAP, ROT and OVER. Entries missing from a short stack count as zero,
+// as with pop.
+func (vm *VM) shuffle(op OpCode) error {
+    var v [3]int // The entries used, deepest first
+    n := shuffleDepth[op]
+    for i := n - 1; i >= 0; i-- {
+        top, err := vm.pop()
+        if err != nil {
+            return err
         }
+        v[i] = top
+    }
+    switch op {
+    case OpDup:
+        vm.stack = append(vm.stack, v[0], v[0])
+    case OpSwap:
+        vm.stack = append(vm.stack, v[1], v[0])
+    case OpRot:
+        vm.stack = append(vm.stack, v[1], v[2], v[0])
+    case OpOver:
+        vm.stack = append(vm.stack, v[0], v[1], v[0])
+    }
+    return nil
+}
 
-        // Only increment pc if we didn't jump
-        if !jumped {
-            vm.pc++
+// bitwise combines the accumulator with the popped top of the stack. A
+// shift by 64 or more clears the accumulator, or fills it with its sign
+// bit when shifting right; a negative shift count is an error.
+func (vm *VM) bitwise(op OpCode) error {
+    v, err := vm.pop()
+    if err != nil {
+        return err
+    }
+    switch op {
+    case OpAnd:
+        vm.accumulator &= v
+    case OpOr:
+        vm.accumulator |= v
+    case OpXor:
+        vm.accumulator ^= v
+    case OpShl, OpShr:
+        if v < 0 {
+            return fault(FaultOperand, "negative shift count %d at %s", v, vm.program.Location(vm.pc))
         }
+        if op == OpShr {
+            vm.accumulator >>= uint(v)
+            break
+        }
+        shifted := vm.accumulator << uint(v)
+        if vm.checkOverflow && shifted>>uint(v) != vm.accumulator {
+            return fault(FaultOverflow, "accumulator overflow: %d << %d at %s", vm.accumulator, v, vm.program.Location(vm.pc))
+        }
+        vm.accumulator = shifted
     }
+    return nil
+}
 
+// add adds delta to the accumulator, wrapping on overflow unless overflow
+// checking is enabled
+func (vm *VM) add(delta int) error {
+    sum := vm.accumulator + delta
+    if vm.checkOverflow && (delta > 0 && sum < vm.accumulator || delta < 0 && sum > vm.accumulator) {
+        return fault(FaultOverflow, "accumulator overflow: %d %+d at %s", vm.accumulator, delta, vm.program.Location(vm.pc))
+    }
+    vm.accumulator = sum
     return nil
 }
 
 // Main function: Entry point for the Flux compiler
 func main() {
+    // An executable made by 'flux build -self-contained' is its program
+    if program := embeddedProgram(); program != nil {
+        runEmbedded(program)
+        return
+    }
+
     // If no arguments, show help
     if len(os.Args) < 2 {
         showHelp()
         return
     }
 
-    command := os.Args[1]
-
-    // Dispatch to appropriate command handler
-    switch command {
-    case "help", "-h", "--help":
-        showHelp()
-
-    case "guide":
-        showGuide()
-
-    case "reference", "ref":
-        showReference()
-
-    case "examples":
-        showExamples()
+    c, args := lookupCommand(os.Args[1]), os.Args[2:]
+    if c == nil && isProgramFile(os.Args[1]) {
+        // 'flux prog.flux' runs the program, which is also what a
+        // "#!/usr/bin/env flux" line at its start asks for
+        c, args = lookupCommand("run"), os.Args[1:]
+    }
+    if c == nil {
+        fmt.Printf("Unknown command: %s\n", os.Args[1])
+        fmt.Println("Run 'flux help' for usage information")
+        return
+    }
+    c.run(args)
+}
 
-    case "demo":
-        runDemo()
+// isProgramFile reports whether the first argument of flux, not being a
+// command, names a program to run: a file that exists, or any name ending
+// in .flux or .fluxc, which run then reports missing
+func isProgramFile(arg string) bool {
+    if strings.HasSuffix(arg, ".flux") || strings.HasSuffix(arg, ".fluxc") {
+        return true
+    }
+    info, err := os.Stat(arg)
+    return err == nil && info.Mode().IsRegular()
+}
 
-    case "run":
-        if len(os.Args) < 3 {
-            fmt.Println("Error: Please specify a file to run")
-            fmt.Println("Usage: flux run <file>")
-            return
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments and returns the positional arguments in order
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+    // Accept the conventional -O2 spelling for the optimization level
+    if fs.Lookup("O") != nil {
+        args = append([]string(nil), args...)
+        for i, arg := range args {
+            if len(arg) == 3 && arg[:2] == "-O" && arg[2] >= '0' && arg[2] <= '9' {
+                args[i] = "-O=" + arg[2:]
+            }
         }
-        runFile(os.Args[2])
+    }
 
-    case "compile":
-        if len(os.Args) < 3 {
-            fmt.Println("Error: Please specify a file to compile")
-            fmt.Println("Usage: flux compile <file>")
-            return
+    var positional []string
+    for {
+        if err := fs.Parse(args); err != nil {
+            return nil, err
         }
-        compileFile(os.Args[2])
-
-    case "interactive", "repl":
-        runInteractive()
-
-    default:
-        fmt.Printf("Unknown command: %s\n", command)
-        fmt.Println("Run 'flux help' for usage information")
+        args = fs.Args()
+        if len(args) == 0 {
+            return positional, nil
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
     }
 }
 
@@ -406,17 +1694,11 @@ func showHelp() {
 
 USAGE
     flux <command> [arguments]
+    flux <file> [flags]         Same as 'flux run', also for "#!/usr/bin/env flux"
 
-COMMANDS
-    help              Show this help message
-    guide             Show beginner's tutorial and user guide
-    reference         Show complete language reference (also: ref)
-    examples          Show example programs with explanations
-    demo              Run interactive demonstration programs
-    run <file>        Compile and execute a Flux program
-    compile <file>    Compile program and show bytecode
-    interactive       Start interactive REPL (also: repl)
-
+COMMANDS`)
+    printCommandList()
+    fmt.Println(`
 QUICK REFERENCE
     +    Increment accumulator       *    Push to stack
     -    Decrement accumulator       /    Pop from stack
@@ -460,13 +1742,31 @@ you need in under an hour.
 `)
 }
 
-// showReference displays the complete language reference
+// showReference displays the complete language reference, rendered
+// from opDocs: the core operations, then those of each extension
 func showReference() {
     fmt.Println(`
                    FLUX COMPLETE LANGUAGE REFERENCE                       
 
-[Complete reference documentation would continue here...]
+The accumulator starts at zero and the stack empty; popping an empty
+stack gives zero. Characters that are not operations are comments.
 `)
+    fmt.Println("CORE OPERATIONS")
+    fmt.Println()
+    var extended []OpDoc
+    for _, d := range Ops() {
+        switch {
+        case d.Extension != "":
+            extended = append(extended, d)
+        case d.Symbol != "":
+            fmt.Println(d.Render())
+        }
+    }
+    fmt.Println("EXTENSION OPERATIONS (enable with -ext; see 'flux extensions')")
+    fmt.Println()
+    for _, d := range extended {
+        fmt.Println(d.Render())
+    }
 }
 
 // showExamples displays example programs
@@ -528,9 +1828,151 @@ func runDemo() {
     fmt.Println("Try writing your own programs using these patterns!")
 }
 
+// runOptions holds the execution settings shared by commands that run
+// programs
+type runOptions struct {
+    maxSteps      int           // Abort after this many instructions (0 = no limit)
+    strictStack   bool          // Popping an empty stack is an error
+    checkOverflow bool          // Accumulator overflow is an error
+    coreFile      string        // Write a core file here if the program aborts
+    maxSleep      time.Duration // Longest single SLEEP
+    maxHeap       int           // Most heap cells a program may allocate (0 = no limit)
+    precision     int           // Digits the float extension prints after the decimal point
+    fakeClock     time.Duration // Use a fake clock advancing by this much per reading (0 = real clock)
+    allowFS       []string      // Directories the fs extension may access
+    allowEnv      []string      // Environment variables the env extension may read
+    allowNet      string        // Address the net extension may listen on
+    optLevel      int           // Optimization level (0 = none)
+    optReport     bool          // Print what the optimizer did
+    stats         bool          // Print resource statistics after the run
+    digest        bool          // Print a digest of the output and final state
+    traceFile     string        // Record a trace of the run to this file
+    profile       time.Duration // Sample the running instruction this often (0 = no profile)
+    prompt        string        // Shown when the program waits for input typed at a terminal ("" = none)
+    ioLog         string        // Log the program's input and output to this file
+    deterministic bool          // Refuse programs whose output may vary between runs
+    inputDir      string        // Run once for each file here, with the file as input
+    outputDir     string        // Receives the output of each run over inputDir
+    sourceOptions
+}
+
+// register adds the option flags to fs
+func (o *runOptions) register(fs *flag.FlagSet) {
+    fs.IntVar(&o.maxSteps, "max-steps", 0, "abort after `n` instructions (0 = no limit)")
+    fs.BoolVar(&o.strictStack, "strict-stack", false, "treat popping an empty stack as an error")
+    fs.BoolVar(&o.checkOverflow, "check-overflow", false, "treat accumulator overflow as an error instead of wrapping")
+    fs.DurationVar(&o.maxSleep, "max-sleep", DefaultMaxSleep, "cap each SLEEP of the sleep extension at `duration`")
+    fs.IntVar(&o.maxHeap, "max-heap", DefaultMaxHeap, "let the heap extension allocate at most `n` cells (0 = no limit)")
+    fs.IntVar(&o.precision, "precision", -1, "print floats of the float extension with `n` digits after the decimal point (-1 = as many as needed)")
+    fs.DurationVar(&o.fakeClock, "fake-clock", 0, "replace the clock with a fake one that starts at the Unix epoch and advances by `step` per reading")
+    fs.Func("allow-fs", "let the fs extension access files under `dir` (repeatable)", func(dir string) error {
+        o.allowFS = append(o.allowFS, dir)
+        return nil
+    })
+    fs.StringVar(&o.allowNet, "allow-net", "", "let the net extension accept one TCP connection on `addr`, such as :8080")
+    fs.Func("allow-env", "let the env extension read the environment variable `name` (repeatable)", func(name string) error {
+        o.allowEnv = append(o.allowEnv, name)
+        return nil
+    })
+    fs.BoolVar(&o.stats, "stats", false, "print the steps, peak stack depth and memory the run used")
+    fs.BoolVar(&o.deterministic, "deterministic", false, "refuse programs using the probe, clock, fs, env or net extensions, so that the output depends on the input alone")
+    fs.BoolVar(&o.digest, "digest", false, "print a SHA-256 digest of the output and the final machine state")
+    fs.DurationVar(&o.profile, "profile", 0, "sample the running instruction every `interval`, such as 100us, and print where the run spent its time")
+    fs.StringVar(&o.traceFile, "record-trace", "", "record every executed instruction to `file` for 'flux trace analyze'")
+    fs.StringVar(&o.coreFile, "core", "", "write a core `file` for 'flux debug -core' if the program aborts")
+    registerOptFlags(fs, &o.optLevel, &o.optReport)
+    o.sourceOptions.register(fs)
+}
+
+// registerOptFlags adds the optimizer flags shared by run and compile
+func registerOptFlags(fs *flag.FlagSet, level *int, report *bool) {
+    fs.IntVar(level, "O", 0, "optimization `level`: 0 (only long constant output), 1 or 2")
+    fs.BoolVar(report, "opt-report", false, "print what the optimizer changed")
+}
+
+// sourceOptions holds the settings that control how source is compiled,
+// shared by every command that compiles programs
+type sourceOptions struct {
+    maxNesting int          // Deepest loop nesting the compiler accepts
+    extensions ExtensionSet // Extensions enabled in the compiler and the VM
+}
+
+// register adds the -max-nesting and -ext flags to fs
+func (o *sourceOptions) register(fs *flag.FlagSet) {
+    fs.IntVar(&o.maxNesting, "max-nesting", DefaultMaxNesting, "reject loops nested more than `n` deep (0 = no limit)")
+    registerExtFlag(fs, &o.extensions)
+}
+
+// compiler returns a compiler for source configured with the options
+func (o sourceOptions) compiler(source string) *Compiler {
+    c := NewCompiler(source)
+    c.SetMaxNesting(o.maxNesting)
+    c.SetExtensions(o.extensions)
+    return c
+}
+
+// apply configures vm according to the options
+func (o *runOptions) apply(vm *VM) error {
+    vm.SetMaxSteps(o.maxSteps)
+    vm.SetStrictStack(o.strictStack)
+    vm.SetCheckOverflow(o.checkOverflow)
+    vm.SetDeterministic(o.deterministic)
+    vm.SetMaxSleep(o.maxSleep)
+    vm.SetMaxHeap(o.maxHeap)
+    vm.SetFloatPrecision(o.precision)
+    if o.fakeClock > 0 {
+        vm.SetClock(NewFakeClock(time.Unix(0, 0), o.fakeClock))
+    }
+    if len(o.allowFS) > 0 {
+        access, err := NewFileAccess(o.allowFS...)
+        if err != nil {
+            return fmt.Errorf("-allow-fs: %v", err)
+        }
+        vm.SetFileAccess(access)
+    }
+    if len(o.allowEnv) > 0 {
+        vm.SetEnv(allowedEnv(o.allowEnv))
+    }
+    vm.SetNetAccess(o.allowNet)
+    vm.SetExtensions(o.extensions)
+    if o.coreFile != "" {
+        vm.EnableTraceRing(coreTraceEntries)
+    }
+    return nil
+}
+
+// runCommand implements 'flux run'
+func runCommand(args []string) {
+    var opts runOptions
+    fs := commandFlags("run")
+    opts.register(fs)
+    fs.StringVar(&opts.ioLog, "io-log", "", "log every byte the program reads and writes, with the time and instruction, to `file`")
+    fs.StringVar(&opts.prompt, "prompt", defaultInputPrompt, "show `text` when the program waits for input typed at a terminal ('' for none)")
+    fs.StringVar(&opts.inputDir, "input-dir", "", "run the program once for each file in `dir`, with the file as input")
+    fs.StringVar(&opts.outputDir, "output-dir", "", "write the output of each run over -input-dir to `dir`, as name.out")
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to run")
+        printUsage("run")
+        return
+    }
+    if (opts.inputDir == "") != (opts.outputDir == "") {
+        fmt.Println("Error: -input-dir and -output-dir go together")
+        return
+    }
+    if opts.inputDir != "" && (opts.coreFile != "" || opts.digest || opts.traceFile != "" || opts.profile != 0 || opts.ioLog != "") {
+        fmt.Println("Error: -core, -digest, -record-trace, -profile and -io-log apply to a single run, not -input-dir")
+        return
+    }
+    runFile(positional[0], opts)
+}
+
 // runFile compiles and executes a Flux source file
-func runFile(filename string) {
-    data, err := os.ReadFile(filename)
+func runFile(filename string, opts runOptions) {
+    data, err := readProgramFile(filename)
     if err != nil {
         fmt.Printf("Error reading file '%s': %v\n", filename, err)
         return
@@ -538,48 +1980,303 @@ func runFile(filename string) {
 
     fmt.Printf("Executing %s...\n", filename)
     fmt.Println("")
-    execute(string(data))
+
+    // A compiled program starts without decoding the source in its debug
+    // section, which only an error or a profile needs
+    var program *Program
+    if isBytecode(data) {
+        program, err = loadBytecode(filename, data, true)
+    } else {
+        program, err = loadProgram(filename, data, opts.sourceOptions)
+    }
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+    if opts.deterministic {
+        if err := program.checkDeterministic(); err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+    }
+    // A .fluxc file went through the level 0 passes when it was compiled
+    if !isBytecode(data) || opts.optLevel > 0 || opts.optReport {
+        var report *OptReport
+        program, report = Optimize(program, opts.optLevel)
+        if opts.optReport {
+            report.Print(os.Stdout, program.Debug)
+            fmt.Println()
+        }
+    }
+    if opts.inputDir != "" {
+        runBatch(program, opts)
+        return
+    }
+
+    var input io.Reader = os.Stdin
+    if program.Extensions&ExtProbe != 0 {
+        // Polling needs keys as they are pressed rather than whole lines
+        if isTerminal(os.Stdin) {
+            if state, err := makeCbreak(os.Stdin); err == nil {
+                defer restoreTerminal(os.Stdin, state)
+            }
+        }
+        input = newPollingReader(os.Stdin)
+    } else if opts.prompt != "" && isTerminal(os.Stdin) {
+        input = newPromptingReader(os.Stdin, opts.prompt)
+    }
+
+    // The first interrupt stops the program cleanly: output is flushed,
+    // files are closed and the terminal restored. A second one, for a
+    // program stuck waiting for input, kills the process as usual.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        stop()
+    }()
+    var output io.Writer = os.Stdout
+    var digest *runDigest
+    if opts.digest {
+        digest = newRunDigest()
+        output = io.MultiWriter(os.Stdout, digest)
+    }
+    vm := NewVM(program, input, bufio.NewWriter(output))
+    vm.SetContext(ctx)
+    if err := opts.apply(vm); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if opts.traceFile != "" {
+        f, err := os.Create(opts.traceFile)
+        if err == nil {
+            err = vm.RecordTrace(f)
+        }
+        if err != nil {
+            fmt.Printf("Error writing trace file '%s': %v\n", opts.traceFile, err)
+            return
+        }
+        defer func() {
+            err := vm.StopTrace()
+            if cerr := f.Close(); err == nil {
+                err = cerr
+            }
+            if err != nil {
+                fmt.Printf("Error writing trace file '%s': %v\n", opts.traceFile, err)
+            } else {
+                fmt.Printf("Trace written to %s (summarize with 'flux trace analyze %s')\n", opts.traceFile, opts.traceFile)
+            }
+        }()
+    }
+    if opts.ioLog != "" {
+        f, err := os.Create(opts.ioLog)
+        if err != nil {
+            fmt.Printf("Error writing I/O log '%s': %v\n", opts.ioLog, err)
+            return
+        }
+        vm.LogIO(f)
+        defer func() {
+            err := vm.StopIOLog()
+            if cerr := f.Close(); err == nil {
+                err = cerr
+            }
+            if err != nil {
+                fmt.Printf("Error writing I/O log '%s': %v\n", opts.ioLog, err)
+            }
+        }()
+    }
+    if opts.profile != 0 {
+        if err := vm.StartSampling(opts.profile); err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+    }
+    err = vm.Run()
+    profile := vm.StopSampling()
+    if cerr := vm.CloseFiles(); err == nil && cerr != nil {
+        err = fmt.Errorf("closing files: %v", cerr)
+    }
+    if err != nil {
+        fmt.Printf("\nRuntime error: %v\n", err)
+        if opts.stats {
+            vm.Stats().Print(os.Stdout)
+        } else {
+            fmt.Printf("Stopped after %d steps\n", vm.StepCount())
+        }
+        if profile != nil {
+            profile.Print(os.Stdout, program)
+        }
+        if opts.coreFile != "" {
+            core := newCoreDump(vm, err)
+            if werr := core.write(opts.coreFile); werr != nil {
+                fmt.Printf("Error writing core file '%s': %v\n", opts.coreFile, werr)
+            } else {
+                fmt.Printf("Core written to %s (inspect with 'flux debug -core %s')\n", opts.coreFile, opts.coreFile)
+            }
+        }
+        if digest != nil {
+            fmt.Printf("Digest: %s\n", digest.Sum(vm, true))
+        }
+        return
+    }
     fmt.Println()
+    if opts.stats {
+        vm.Stats().Print(os.Stdout)
+    }
+    if profile != nil {
+        profile.Print(os.Stdout, program)
+    }
+    if digest != nil {
+        fmt.Printf("Digest: %s\n", digest.Sum(vm, false))
+    }
+}
+
+// loadProgram compiles source with the given options, or decodes it if it
+// is a compiled .fluxc file
+func loadProgram(filename string, data []byte, opts sourceOptions) (*Program, error) {
+    if isBytecode(data) {
+        return loadBytecode(filename, data, false)
+    }
+    if isBundle(data) {
+        return loadBundle(filename, data)
+    }
+    if isSyntaxTree(data) {
+        program, err := compileSyntaxTree(data, opts)
+        if err != nil {
+            return nil, fmt.Errorf("Error loading syntax tree: %v", err)
+        }
+        program.Debug.File = filename
+        return program, nil
+    }
+
+    program, err := opts.compiler(string(data)).Compile()
+    if err != nil {
+        return nil, fmt.Errorf("Compilation error: %v", err)
+    }
+    program.Debug.File = filename
+    return program, nil
+}
+
+// loadBytecode decodes a compiled .fluxc file, taking the debug information
+// from its source map if the file has none. With lazy set the debug
+// section is only decoded once a source position is needed.
+func loadBytecode(filename string, data []byte, lazy bool) (*Program, error) {
+    decode := decodeBytecode
+    if lazy {
+        decode = decodeBytecodeLazily
+    }
+    program, err := decode(data)
+    if err != nil {
+        return nil, fmt.Errorf("Error loading bytecode: %v", err)
+    }
+    if program.Debug == nil && program.pendingDebug == nil {
+        loadSourceMap(program, filename)
+    }
+    return program, nil
+}
+
+// compileOptions holds the settings of 'flux compile'
+type compileOptions struct {
+    optLevel  int    // Optimization level (0 = none)
+    optReport bool   // Print what the optimizer did
+    output    string // Write a .fluxc file here instead of listing the bytecode
+    strip     bool   // Leave debug information out of the .fluxc file
+    asJSON    bool   // List the bytecode as JSON, annotated with accumulator ranges
+    sourceOptions
 }
 
-// compileFile compiles a Flux source file and displays the bytecode
-func compileFile(filename string) {
+// compileCommand implements 'flux compile'
+func compileCommand(args []string) {
+    var opts compileOptions
+    fs := commandFlags("compile")
+    registerOptFlags(fs, &opts.optLevel, &opts.optReport)
+    fs.StringVar(&opts.output, "o", "", "write the bytecode to a .fluxc `file` instead of listing it")
+    fs.BoolVar(&opts.strip, "strip", false, "leave source and debug information out of the .fluxc file")
+    fs.BoolVar(&opts.asJSON, "json", false, "list the bytecode as JSON, with the range of the accumulator at each instruction")
+    opts.sourceOptions.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to compile")
+        printUsage("compile")
+        return
+    }
+    compileFile(positional[0], opts)
+}
+
+// compileFile compiles a Flux source file and displays the bytecode, or
+// writes it to a .fluxc file when opts.output is set
+func compileFile(filename string, opts compileOptions) {
     data, err := os.ReadFile(filename)
     if err != nil {
         fmt.Printf("Error reading file '%s': %v\n", filename, err)
         return
     }
 
-    compiler := NewCompiler(string(data))
-    instructions, err := compiler.Compile()
+    program, err := loadProgram(filename, data, opts.sourceOptions)
     if err != nil {
-        fmt.Printf("Compilation error: %v\n", err)
+        fmt.Printf("%v\n", err)
+        return
+    }
+    source := program
+    program, report := Optimize(program, opts.optLevel)
+    if opts.asJSON {
+        printCompileListing(filename, source, program, opts.optLevel)
+        return
+    }
+    warnings := rangeWarnings(source)
+
+    if opts.output != "" {
+        if opts.optReport {
+            report.Print(os.Stdout, program.Debug)
+        }
+        mapPath := sourceMapPath(opts.output)
+        if program.Debug != nil && mapPath != opts.output {
+            if err := writeSourceMap(program, mapPath); err != nil {
+                fmt.Printf("Error writing file '%s': %v\n", mapPath, err)
+                return
+            }
+        } else {
+            mapPath = ""
+        }
+        if opts.strip {
+            program.Debug = nil
+        }
+        if err := os.WriteFile(opts.output, encodeBytecode(program), 0644); err != nil {
+            fmt.Printf("Error writing file '%s': %v\n", opts.output, err)
+            return
+        }
+        fmt.Printf("Compiled %s to %s (%d instructions, %d constants)\n", filename, opts.output, len(program.Instructions), program.Constants.Len())
+        printRangeWarnings(source, warnings)
+        if mapPath != "" {
+            fmt.Printf("Wrote source map %s\n", mapPath)
+        }
         return
     }
 
     fmt.Printf("Successfully compiled %s\n", filename)
-    fmt.Printf("Total instructions: %d\n\n", len(instructions))
+    fmt.Printf("Total instructions: %d\n\n", len(program.Instructions))
+    if len(warnings) > 0 {
+        printRangeWarnings(source, warnings)
+        fmt.Println()
+    }
+    if opts.optReport {
+        report.Print(os.Stdout, program.Debug)
+        fmt.Println()
+    }
     fmt.Println("Bytecode Listing:")
     fmt.Println("")
     fmt.Println("Addr  Opcode    Argument")
     fmt.Println("")
 
-    opNames := map[OpCode]string{
-        OpInc:    "INC",
-        OpDec:    "DEC",
-        OpPush:   "PUSH",
-        OpPop:    "POP",
-        OpLoop:   "LOOP",
-        OpEnd:    "END",
-        OpOut:    "OUT",
-        OpIn:     "IN",
-        OpOutNum: "OUTNUM",
-    }
-
-    for i, inst := range instructions {
-        opName := opNames[inst.Op]
-        if inst.Op == OpLoop || inst.Op == OpEnd {
+    for i, inst := range program.Instructions {
+        opName := inst.Op.String()
+        if hasJumpTarget(inst.Op) {
             fmt.Printf("%04d  %-8s  â %d\n", i, opName, inst.Arg)
+        } else if operand := valueOperand(inst, program.Constants); operand != "" {
+            fmt.Printf("%04d  %-8s  %s\n", i, opName, operand)
         } else {
             fmt.Printf("%04d  %s\n", i, opName)
         }
@@ -587,58 +2284,19 @@ func compileFile(filename string) {
     fmt.Println("")
 }
 
-// runInteractive starts an interactive REPL
-func runInteractive() {
-    fmt.Println("")
-    fmt.Println("                   FLUX INTERACTIVE MODE (REPL)                            ")
-    fmt.Println("")
-    fmt.Println("Enter Flux code and press Enter to execute.")
-    fmt.Println("Type 'exit' or 'quit' to leave, 'help' for quick reference.\n")
-
-    scanner := bufio.NewScanner(os.Stdin)
-
-    for {
-        fmt.Print("flux> ")
-        if !scanner.Scan() {
-            break
-        }
-
-        line := strings.TrimSpace(scanner.Text())
-
-        if line == "" {
-            continue
-        }
-
-        if line == "exit" || line == "quit" {
-            fmt.Println("Goodbye!")
-            break
-        }
-
-        if line == "help" {
-            fmt.Println("Quick Reference:")
-            fmt.Println("  +  Increment    *  Push      [  Loop start")
-            fmt.Println("  -  Decrement    /  Pop       ]  Loop end")
-            fmt.Println("  .  Output char  ,  Input     #  Output number")
-            continue
-        }
-
-        execute(line)
-        fmt.Println()
-    }
-}
-
 // execute compiles and runs Flux source code
 func execute(source string) {
     compiler := NewCompiler(source)
-    instructions, err := compiler.Compile()
+    program, err := compiler.Compile()
     if err != nil {
         fmt.Printf("Compilation error: %v\n", err)
         return
     }
 
-    vm := NewVM(instructions, os.Stdin, os.Stdout)
+    vm := NewVM(program, nil, nil)
+    vm.SetDevice(NewStdioDevice())
     err = vm.Run()
     if err != nil {
         fmt.Printf("\nRuntime error: %v\n", err)
     }
-}
\ No newline at end of file
+}
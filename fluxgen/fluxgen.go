@@ -0,0 +1,315 @@
+// Package fluxgen generates random well-formed Flux programs and shrinks
+// failing inputs, for property-based testing of Flux implementations.
+// It works on source text only, so it can test any compiler or VM.
+package fluxgen
+
+import (
+    "math/rand"
+    "strings"
+)
+
+// Generator produces random well-formed Flux programs for property-based
+// testing. Brackets are always balanced and every loop is bounded: the
+// generator tracks the range of values the accumulator can hold and only
+// opens a loop when that range guarantees the loop counts down to zero
+// within MaxTrip iterations. Loops that can never be entered (the
+// accumulator is known to be zero) may contain arbitrary code.
+type Generator struct {
+    MaxLen   int  // Approximate number of operators per program
+    MaxDepth int  // Maximum loop nesting
+    MaxTrip  int  // Maximum iterations of any generated loop
+    Input    bool // Whether programs may read input with ','
+    Noise    bool // Whether to sprinkle comment characters and whitespace
+
+    rand *rand.Rand
+    out  strings.Builder
+    left int // Operators still to emit
+}
+
+// NewGenerator creates a generator with sensible limits seeded with seed
+func NewGenerator(seed int64) *Generator {
+    return &Generator{
+        MaxLen:   120,
+        MaxDepth: 3,
+        MaxTrip:  12,
+        Input:    true,
+        Noise:    true,
+        rand:     rand.New(rand.NewSource(seed)),
+    }
+}
+
+// interval is the inclusive range of values a cell may hold
+type interval struct {
+    lo, hi int
+}
+
+// genState is the generator's abstract view of the machine
+type genState struct {
+    acc   interval
+    stack []interval
+    floor int // Pops may not go below this depth; -1 allows popping an empty stack
+}
+
+// Program returns a new random program
+func (g *Generator) Program() string {
+    g.out.Reset()
+    g.left = 1 + g.rand.Intn(g.MaxLen)
+    st := &genState{floor: -1}
+    g.block(st, 0)
+    return g.out.String()
+}
+
+// Bytes returns a random string over the Flux operators mixed with other
+// characters. Unlike Program, the result need not be well formed.
+func (g *Generator) Bytes(n int) string {
+    const alphabet = "+-*/[].,#+-*/[] \nab"
+    b := make([]byte, g.rand.Intn(n+1))
+    for i := range b {
+        if g.rand.Intn(20) == 0 {
+            b[i] = byte(g.rand.Intn(256))
+        } else {
+            b[i] = alphabet[g.rand.Intn(len(alphabet))]
+        }
+    }
+    return string(b)
+}
+
+// emit writes an operator, occasionally followed by noise
+func (g *Generator) emit(op byte) {
+    g.out.WriteByte(op)
+    g.left--
+    if g.Noise && g.rand.Intn(12) == 0 {
+        const noise = " \n\tabcxyz"
+        g.out.WriteByte(noise[g.rand.Intn(len(noise))])
+    }
+}
+
+// block emits a sequence of operations until the budget runs out or the
+// generator decides to close the current block
+func (g *Generator) block(st *genState, depth int) {
+    for g.left > 0 {
+        if depth > 0 && g.rand.Intn(6) == 0 {
+            return
+        }
+
+        switch r := g.rand.Intn(20); {
+        case r < 5:
+            g.emit('+')
+            st.acc = interval{st.acc.lo + 1, st.acc.hi + 1}
+        case r < 9:
+            g.emit('-')
+            st.acc = interval{st.acc.lo - 1, st.acc.hi - 1}
+        case r < 11:
+            g.emit('*')
+            st.stack = append(st.stack, st.acc)
+        case r < 13:
+            if st.floor >= 0 && len(st.stack) <= st.floor {
+                continue
+            }
+            g.emit('/')
+            if n := len(st.stack); n > 0 {
+                st.acc = st.stack[n-1]
+                st.stack = st.stack[:n-1]
+            } else {
+                st.acc = interval{0, 0}
+            }
+        case r < 14:
+            g.emit('.')
+        case r < 15:
+            g.emit('#')
+        case r < 16:
+            if !g.Input {
+                continue
+            }
+            g.emit(',')
+            st.acc = interval{0, 255}
+        default:
+            g.loop(st, depth)
+        }
+    }
+}
+
+// loop emits a loop if the accumulator's range allows a bounded one
+func (g *Generator) loop(st *genState, depth int) {
+    if depth >= g.MaxDepth {
+        return
+    }
+
+    if st.acc.lo == 0 && st.acc.hi == 0 {
+        // Never entered, so the body is free to do anything
+        g.emit('[')
+        g.out.WriteString(g.unchecked(1 + g.rand.Intn(8)))
+        g.emit(']')
+        return
+    }
+
+    step, entry, ok := g.countdown(st.acc)
+    if !ok {
+        return
+    }
+
+    // [ * body / step ] saves the counter, lets the body do what it likes
+    // above the saved value, restores the counter and moves it towards zero
+    g.emit('[')
+    g.emit('*')
+    body := &genState{
+        acc:   entry,
+        stack: append(append([]interval(nil), st.stack...), entry),
+    }
+    body.floor = len(body.stack)
+    g.block(body, depth+1)
+    for len(body.stack) > body.floor {
+        g.emit('/')
+        body.stack = body.stack[:len(body.stack)-1]
+    }
+    g.emit('/')
+    g.emit(step)
+    g.emit(']')
+
+    st.acc = interval{0, 0}
+}
+
+// countdown decides whether a loop entered with the accumulator in acc can
+// be bounded. It returns the operator that moves the counter towards zero
+// and the range the counter takes at the start of any iteration: later
+// iterations see every value between the entry value and zero.
+func (g *Generator) countdown(acc interval) (byte, interval, bool) {
+    switch {
+    case acc.lo >= 0 && acc.hi <= g.MaxTrip:
+        return '-', interval{1, acc.hi}, true
+    case acc.hi <= 0 && acc.lo >= -g.MaxTrip:
+        return '+', interval{acc.lo, -1}, true
+    }
+    return 0, interval{}, false
+}
+
+// Bounded reports whether src lies within the generator's language: every
+// loop is either provably never entered or has the bounded countdown shape
+// the generator emits. Shrinking uses it to keep counterexamples to
+// termination properties meaningful, since deleting characters from a
+// bounded program can easily produce one that legitimately runs forever.
+// Programs with unbalanced brackets are not bounded.
+func (g *Generator) Bounded(src string) bool {
+    var ops []byte
+    for i := 0; i < len(src); i++ {
+        if strings.IndexByte(operators, src[i]) >= 0 {
+            ops = append(ops, src[i])
+        }
+    }
+    match := make([]int, len(ops))
+    var open []int
+    for i, op := range ops {
+        switch op {
+        case '[':
+            open = append(open, i)
+        case ']':
+            if len(open) == 0 {
+                return false
+            }
+            match[i], match[open[len(open)-1]] = open[len(open)-1], i
+            open = open[:len(open)-1]
+        }
+    }
+    if len(open) > 0 {
+        return false
+    }
+    return g.boundedBlock(ops, match, 0, len(ops), &genState{floor: -1}, 0)
+}
+
+// operators holds the characters of the core language; everything else in
+// a program is a comment
+const operators = "+-*/[].,#"
+
+// boundedBlock checks ops[start:end] against the generator's rules. match
+// holds the position of the bracket matching each bracket.
+func (g *Generator) boundedBlock(ops []byte, match []int, start, end int, st *genState, depth int) bool {
+    for i := start; i < end; i++ {
+        switch ops[i] {
+        case '+':
+            st.acc = interval{st.acc.lo + 1, st.acc.hi + 1}
+        case '-':
+            st.acc = interval{st.acc.lo - 1, st.acc.hi - 1}
+        case '*':
+            st.stack = append(st.stack, st.acc)
+        case '/':
+            if st.floor >= 0 && len(st.stack) <= st.floor {
+                return false
+            }
+            if n := len(st.stack); n > 0 {
+                st.acc = st.stack[n-1]
+                st.stack = st.stack[:n-1]
+            } else {
+                st.acc = interval{0, 0}
+            }
+        case ',':
+            st.acc = interval{0, 255}
+        case '[':
+            close := match[i]
+            if st.acc.lo == 0 && st.acc.hi == 0 {
+                i = close
+                continue
+            }
+            step, entry, ok := g.countdown(st.acc)
+            if !ok || depth >= g.MaxDepth || close-i < 4 ||
+                ops[i+1] != '*' || ops[close-2] != '/' || ops[close-1] != step {
+                return false
+            }
+            body := &genState{
+                acc:   entry,
+                stack: append(append([]interval(nil), st.stack...), entry),
+            }
+            body.floor = len(body.stack)
+            if !g.boundedBlock(ops, match, i+2, close-2, body, depth+1) || len(body.stack) != body.floor {
+                return false
+            }
+            st.acc = interval{0, 0}
+            i = close
+        }
+    }
+    return true
+}
+
+// unchecked returns n random operators with balanced brackets but no other
+// guarantees, for code that is never executed
+func (g *Generator) unchecked(n int) string {
+    const ops = "+-*/.,#"
+    var b strings.Builder
+    open := 0
+    for i := 0; i < n; i++ {
+        switch r := g.rand.Intn(10); {
+        case r == 0:
+            b.WriteByte('[')
+            open++
+        case r == 1 && open > 0:
+            b.WriteByte(']')
+            open--
+        default:
+            b.WriteByte(ops[g.rand.Intn(len(ops))])
+        }
+    }
+    b.WriteString(strings.Repeat("]", open))
+    return b.String()
+}
+
+// Shrink reduces a failing input while failing keeps reporting true,
+// removing ever smaller chunks until no single character can be dropped.
+// The result is a local minimum, usually far easier to read than the
+// original counterexample.
+func Shrink(input string, failing func(string) bool) string {
+    for chunk := len(input) / 2; chunk >= 1; {
+        removed := false
+        for start := 0; start+chunk <= len(input); {
+            candidate := input[:start] + input[start+chunk:]
+            if failing(candidate) {
+                input = candidate
+                removed = true
+                continue
+            }
+            start += chunk
+        }
+        if !removed {
+            chunk /= 2
+        }
+    }
+    return input
+}
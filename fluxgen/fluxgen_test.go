@@ -0,0 +1,59 @@
+package fluxgen
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestGenerator(t *testing.T) {
+    a, b := NewGenerator(7), NewGenerator(7)
+    for range 20 {
+        if pa, pb := a.Program(), b.Program(); pa != pb {
+            t.Fatalf("generators with the same seed disagree: %q and %q", pa, pb)
+        }
+    }
+    g := NewGenerator(1)
+    for range 200 {
+        if src := g.Program(); !g.Bounded(src) {
+            t.Fatalf("generated program %q is not bounded", src)
+        }
+    }
+    tests := []struct {
+        source  string
+        bounded bool
+    }{
+        {"+++[*#/-]", true},
+        {"+++[*[*#/-]/-]", true},
+        {"--[*x/+] comment", true},
+        {"[+]", true},     // Never entered
+        {"+++[-]", false}, // Bounded, but not the generator's countdown
+        {"+[]", false},
+        {"+[*/+]", false},
+        {",[*/-]", false}, // Input may exceed MaxTrip
+        {"+[*/-", false},
+        {"]", false},
+    }
+    for _, tt := range tests {
+        if got := NewGenerator(0).Bounded(tt.source); got != tt.bounded {
+            t.Errorf("Bounded(%q) = %v, want %v", tt.source, got, tt.bounded)
+        }
+    }
+}
+
+func TestShrink(t *testing.T) {
+    tests := []struct {
+        input   string
+        failing func(string) bool
+        want    string
+    }{
+        {"+++[-]#*/.", func(s string) bool { return strings.Contains(s, "#") }, "#"},
+        {"ab+c-d", func(s string) bool { return strings.Count(s, "+") == 1 && strings.Contains(s, "-") }, "+-"},
+        {"[[+]]", func(s string) bool { return strings.Count(s, "[") == 2 }, "[["},
+        {"+", func(string) bool { return false }, "+"},
+    }
+    for _, tt := range tests {
+        if got := Shrink(tt.input, tt.failing); got != tt.want {
+            t.Errorf("Shrink(%q) = %q, want %q", tt.input, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,183 @@
+// Package fluxgrade grades Flux programs against test cases, for course
+// infrastructure. It runs programs through a Runner, so it can grade
+// them on any Flux implementation.
+package fluxgrade
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Verdicts of a graded test case, as programming contests give them
+const (
+    VerdictAccepted     = "AC"  // The output is the expected one
+    VerdictWrongAnswer  = "WA"  // The program ended normally with other output
+    VerdictTimeLimit    = "TLE" // It hit the step limit or ran out of time
+    VerdictRuntimeError = "RE"  // It failed with a runtime error
+    VerdictCompileError = "CE"  // It did not compile, so no case ran
+)
+
+// diffContext is how many lines around the first wrong one a diff shows
+const diffContext = 3
+
+// Runner compiles programs for a Grader
+type Runner interface {
+    // Compile compiles source, returning the compilation error if it
+    // does not compile
+    Compile(source string) (Program, error)
+}
+
+// Program is a program a Runner compiled
+type Program interface {
+    // Run runs the program on input within the Runner's limits
+    Run(ctx context.Context, input string) Run
+}
+
+// Run is how a run of a program went
+type Run struct {
+    Output    string        // The output kept
+    Truncated bool          // Output was cut short at the Runner's limit
+    Written   int64         // Bytes of output written, kept or not
+    Steps     int           // Instructions executed
+    Duration  time.Duration // Time spent running
+    Err       error         // The error the run ended with, if any
+    TimeLimit bool          // Err is the step limit or the run running out of time
+}
+
+// GradeCase is one test of a graded program: it is run with Input and
+// must print Expected
+type GradeCase struct {
+    Name     string `json:"name"`
+    Input    string `json:"input,omitempty"`
+    Expected string `json:"expected"`
+    Points   int    `json:"points,omitempty"` // Weight in the score; default 1
+}
+
+// Grader grades programs against test cases, the way 'flux test' checks
+// the spec suite, which grades each of its tests with one
+type Grader struct {
+    Runner Runner // Compiles and runs the programs, within its limits
+    Exact  bool   // Compare output byte for byte, rather than ignoring trailing whitespace
+}
+
+// CaseResult is the outcome of one case
+type CaseResult struct {
+    Name      string        `json:"name"`
+    Verdict   string        `json:"verdict"`
+    Points    int           `json:"points"`          // Points earned
+    Diff      string        `json:"diff,omitempty"`  // Where the output went wrong, for WA
+    Error     string        `json:"error,omitempty"` // The runtime error, for RE and TLE
+    Output    string        `json:"output"`
+    Truncated bool          `json:"truncated,omitempty"` // Output was cut short at the Runner's limit
+    Steps     int           `json:"steps"`
+    Duration  time.Duration `json:"duration_ns"`
+}
+
+// GradeReport is the outcome of grading a program
+type GradeReport struct {
+    Verdict  string       `json:"verdict"`                 // AC if every case passed, CE, or the first failing case's
+    Compile  string       `json:"compile_error,omitempty"` // The compilation error, for CE
+    Cases    []CaseResult `json:"cases"`
+    Score    int          `json:"score"`
+    MaxScore int          `json:"max_score"`
+}
+
+// Grade compiles source and runs it against each case in turn. It only
+// returns an error, along with the cases graded so far, if ctx is
+// canceled; a case running out of its own time is a TLE.
+func (g Grader) Grade(ctx context.Context, source string, cases []GradeCase) (GradeReport, error) {
+    report := GradeReport{Verdict: VerdictAccepted, Cases: []CaseResult{}}
+    for _, c := range cases {
+        report.MaxScore += c.points()
+    }
+    program, err := g.Runner.Compile(source)
+    if err != nil {
+        report.Verdict, report.Compile = VerdictCompileError, err.Error()
+        return report, nil
+    }
+
+    for _, c := range cases {
+        if err := ctx.Err(); err != nil {
+            return report, err
+        }
+        r := g.gradeCase(program.Run(ctx, c.Input), c)
+        if r.Verdict != VerdictAccepted && report.Verdict == VerdictAccepted {
+            report.Verdict = r.Verdict
+        }
+        report.Score += r.Points
+        report.Cases = append(report.Cases, r)
+    }
+    return report, ctx.Err()
+}
+
+// gradeCase gives the verdict on a run of one case
+func (g Grader) gradeCase(run Run, c GradeCase) CaseResult {
+    r := CaseResult{Name: c.Name, Output: run.Output, Truncated: run.Truncated, Steps: run.Steps, Duration: run.Duration}
+    switch {
+    case run.Err != nil && run.TimeLimit:
+        r.Verdict, r.Error = VerdictTimeLimit, run.Err.Error()
+    case run.Err != nil:
+        r.Verdict, r.Error = VerdictRuntimeError, run.Err.Error()
+    case run.Truncated:
+        r.Verdict = VerdictWrongAnswer
+        r.Diff = fmt.Sprintf("output of %d bytes, more than the %d kept", run.Written, len(run.Output))
+    default:
+        expected, got := c.Expected, r.Output
+        if !g.Exact {
+            expected, got = trimOutput(expected), trimOutput(got)
+        }
+        if expected == got {
+            r.Verdict, r.Points = VerdictAccepted, c.points()
+        } else {
+            r.Verdict, r.Diff = VerdictWrongAnswer, outputDiff(expected, got)
+        }
+    }
+    return r
+}
+
+func (c GradeCase) points() int {
+    if c.Points == 0 {
+        return 1
+    }
+    return c.Points
+}
+
+// trimOutput drops the whitespace at the ends of lines and the blank
+// lines at the end, which graders do not count against a program
+func trimOutput(s string) string {
+    lines := strings.Split(s, "\n")
+    for i, line := range lines {
+        lines[i] = strings.TrimRight(line, " \t\r")
+    }
+    return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// outputDiff shows the first line where got differs from expected, with
+// the lines around it: unchanged lines are indented, expected ones marked
+// "-" and actual ones "+"
+func outputDiff(expected, got string) string {
+    want, have := strings.Split(expected, "\n"), strings.Split(got, "\n")
+    at := 0
+    for at < len(want) && at < len(have) && want[at] == have[at] {
+        at++
+    }
+    var b strings.Builder
+    fmt.Fprintf(&b, "first difference at line %d\n", at+1)
+    for i := max(0, at-diffContext); i < at; i++ {
+        fmt.Fprintf(&b, "  %s\n", want[i])
+    }
+    for _, side := range []struct {
+        mark  string
+        lines []string
+    }{{"-", want}, {"+", have}} {
+        if at >= len(side.lines) {
+            fmt.Fprintf(&b, "%s <end of output>\n", side.mark)
+        }
+        for i := at; i < len(side.lines) && i <= at+diffContext; i++ {
+            fmt.Fprintf(&b, "%s %s\n", side.mark, side.lines[i])
+        }
+    }
+    return b.String()
+}
@@ -0,0 +1,66 @@
+package fluxgrade
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+)
+
+// fakeRunner compiles any source but "bad" to a program that prints the
+// source, or whose run fails if it is "fail" or "loop"
+type fakeRunner struct{}
+
+func (fakeRunner) Compile(source string) (Program, error) {
+    if source == "bad" {
+        return nil, errors.New("does not compile")
+    }
+    return fakeProgram(source), nil
+}
+
+type fakeProgram string
+
+func (p fakeProgram) Run(ctx context.Context, input string) Run {
+    switch p {
+    case "fail":
+        return Run{Err: errors.New("failed")}
+    case "loop":
+        return Run{Err: errors.New("out of time"), TimeLimit: true}
+    }
+    return Run{Output: string(p), Written: int64(len(p))}
+}
+
+func TestGrader(t *testing.T) {
+    cases := []GradeCase{{Name: "a", Expected: "ok"}, {Name: "b", Expected: "ok\n", Points: 2}}
+    tests := []struct {
+        source  string
+        verdict string
+        score   int
+    }{
+        {"ok", VerdictAccepted, 3},
+        {"no", VerdictWrongAnswer, 0},
+        {"fail", VerdictRuntimeError, 0},
+        {"loop", VerdictTimeLimit, 0},
+        {"bad", VerdictCompileError, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.source, func(t *testing.T) {
+            report, err := Grader{Runner: fakeRunner{}}.Grade(context.Background(), tt.source, cases)
+            if err != nil || report.Verdict != tt.verdict || report.Score != tt.score || report.MaxScore != 3 {
+                t.Errorf("report %+v, %v; want %s with %d of 3", report, err, tt.verdict, tt.score)
+            }
+        })
+    }
+}
+
+func TestOutputDiff(t *testing.T) {
+    diff := outputDiff("a\nb\nc", "a\nx\nc")
+    for _, want := range []string{"first difference at line 2", "  a\n", "- b\n", "+ x\n"} {
+        if !strings.Contains(diff, want) {
+            t.Errorf("diff does not have %q:\n%s", want, diff)
+        }
+    }
+    if diff := outputDiff("a\nb", "a"); !strings.Contains(diff, "+ <end of output>") {
+        t.Errorf("diff of short output does not mark its end:\n%s", diff)
+    }
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "./fluxgen"
+)
+
+// fuzzStepLimit bounds every run made while checking properties. Generated
+// programs stay far below it, so reaching it means a loop did not terminate.
+const fuzzStepLimit = 10000000
+
+// property is an invariant checked against generated inputs. check returns
+// nil when the invariant holds for the input. Properties that only hold for
+// bounded programs set bounded, so shrinking never leaves the generator's
+// language.
+type property struct {
+    name     string
+    generate func(g *fluxgen.Generator) string
+    check    func(src string, input []byte) error
+    bounded  bool
+}
+
+// fuzzProperties lists the invariants checked by 'flux fuzz'
+var fuzzProperties = []property{
+    {
+        name:     "compile-never-panics",
+        generate: func(g *fluxgen.Generator) string { return g.Bytes(64) },
+        check:    checkCompileWellFormed,
+    },
+    {
+        name:     "generated-compiles",
+        generate: func(g *fluxgen.Generator) string { return g.Program() },
+        check: func(src string, input []byte) error {
+            _, err := compileProtected(src)
+            return err
+        },
+    },
+    {
+        name:     "generated-is-bounded",
+        generate: func(g *fluxgen.Generator) string { return g.Program() },
+        check: func(src string, input []byte) error {
+            if !fluxgen.NewGenerator(0).Bounded(src) {
+                return fmt.Errorf("program has a loop the generator cannot bound")
+            }
+            return nil
+        },
+    },
+    {
+        name:     "bounded-terminates",
+        generate: func(g *fluxgen.Generator) string { return g.Program() },
+        check:    checkTerminates,
+        bounded:  true,
+    },
+    {
+        name:     "step-limit-enforced",
+        generate: func(g *fluxgen.Generator) string { return g.Program() },
+        check:    checkStepLimit,
+        bounded:  true,
+    },
+    {
+        name:     "optimizer-preserves",
+        generate: func(g *fluxgen.Generator) string { return g.Program() },
+        check:    checkOptimizer,
+        bounded:  true,
+    },
+}
+
+// fuzzCommand implements 'flux fuzz', which property-tests the compiler and
+// VM against randomly generated programs and shrinks any counterexample
+func fuzzCommand(args []string) {
+    fs := commandFlags("fuzz")
+    cases := fs.Int("n", 1000, "number of cases per property")
+    seed := fs.Int64("seed", 0, "random `seed` (0 = derive from the clock)")
+    if _, err := parseArgs(fs, args); err != nil {
+        return
+    }
+    if *seed == 0 {
+        *seed = time.Now().UnixNano()
+    }
+
+    fmt.Printf("Checking %d properties with %d cases each (seed %d)\n", len(fuzzProperties), *cases, *seed)
+    failed := false
+    for i, p := range fuzzProperties {
+        g := fluxgen.NewGenerator(*seed + int64(i))
+        input := []byte(g.Bytes(16))
+
+        var failure error
+        var counterexample string
+        for n := 0; n < *cases && failure == nil; n++ {
+            src := p.generate(g)
+            if err := p.check(src, input); err != nil {
+                failure = err
+                counterexample = fluxgen.Shrink(src, func(candidate string) bool {
+                    if p.bounded && !g.Bounded(candidate) {
+                        return false
+                    }
+                    return p.check(candidate, input) != nil
+                })
+                failure = p.check(counterexample, input)
+            }
+        }
+
+        if failure == nil {
+            fmt.Printf("  %-22s ok\n", p.name)
+            continue
+        }
+        failed = true
+        fmt.Printf("  %-22s FAILED: %v\n", p.name, failure)
+        fmt.Printf("  %-22s counterexample: %q (input %q)\n", "", counterexample, input)
+    }
+
+    if failed {
+        os.Exit(1)
+    }
+}
+
+// compileProtected compiles src, turning a panic into an error
+func compileProtected(src string) (program *Program, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("compiler panicked: %v", r)
+        }
+    }()
+    return NewCompiler(src).Compile()
+}
+
+// runProtected runs a program with a step limit, turning a panic into an
+// error, and returns the machine for inspection
+func runProtected(program *Program, input []byte, maxSteps int) (vm *VM, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("vm panicked: %v", r)
+        }
+    }()
+    vm = NewVM(program, nil, nil)
+    vm.SetDevice(NewBufferDevice(input))
+    vm.SetMaxSteps(maxSteps)
+    return vm, vm.Run()
+}
+
+// checkCompileWellFormed requires that compiling arbitrary text either
+// fails cleanly or yields loops whose jump targets point at each other
+func checkCompileWellFormed(src string, input []byte) error {
+    program, err := compileProtected(src)
+    if err != nil {
+        if strings.Contains(err.Error(), "panicked") {
+            return err
+        }
+        return nil
+    }
+    instructions := program.Instructions
+    for i, inst := range instructions {
+        switch inst.Op {
+        case OpLoop, OpEnd:
+            if inst.Arg < 0 || inst.Arg >= len(instructions) || instructions[inst.Arg].Arg != i {
+                return fmt.Errorf("jump at %04d targets %04d, which does not jump back", i, inst.Arg)
+            }
+        }
+    }
+    return nil
+}
+
+// checkTerminates requires a generated program to halt within the limit
+func checkTerminates(src string, input []byte) error {
+    program, err := compileProtected(src)
+    if err != nil {
+        return nil // Shrinking may produce unbalanced candidates; not this property's concern
+    }
+    vm, err := runProtected(program, input, fuzzStepLimit)
+    if err != nil {
+        return err
+    }
+    if !vm.Halted() {
+        return fmt.Errorf("Run returned without halting")
+    }
+    return nil
+}
+
+// checkStepLimit requires that a program needing n steps completes with a
+// limit of n and is stopped by a limit of n-1
+func checkStepLimit(src string, input []byte) error {
+    program, err := compileProtected(src)
+    if err != nil {
+        return nil
+    }
+    vm, err := runProtected(program, input, fuzzStepLimit)
+    if err != nil {
+        return nil // Covered by bounded-terminates
+    }
+    steps := vm.StepCount()
+
+    if _, err := runProtected(program, input, steps); err != nil && steps > 0 {
+        return fmt.Errorf("limit of %d steps rejected a program needing %d: %v", steps, steps, err)
+    }
+    if steps > 1 {
+        limited, err := runProtected(program, input, steps-1)
+        if err == nil {
+            return fmt.Errorf("limit of %d steps did not stop a program needing %d", steps-1, steps)
+        }
+        if limited.StepCount() != steps-1 {
+            return fmt.Errorf("limit of %d steps stopped after %d", steps-1, limited.StepCount())
+        }
+    }
+    return nil
+}
+
+// checkOptimizer requires every optimization level to produce the same
+// output as the unoptimized program, and -O1 to end in the same state
+// (-O2 may drop values the program never uses)
+func checkOptimizer(src string, input []byte) error {
+    program, err := NewCompiler(src).Compile()
+    if err != nil {
+        return nil
+    }
+    reference, err := runProtected(program, input, fuzzStepLimit)
+    if err != nil {
+        return nil // Covered by bounded-terminates
+    }
+    for level := 1; level <= 2; level++ {
+        optimized, _ := Optimize(program, level)
+        vm, err := runProtected(optimized, input, fuzzStepLimit)
+        switch {
+        case err != nil:
+            return fmt.Errorf("-O%d: %v", level, err)
+        case vm.Device().(*BufferDevice).String() != reference.Device().(*BufferDevice).String():
+            return fmt.Errorf("-O%d: output %q, want %q", level, vm.Device(), reference.Device())
+        case level >= 2:
+            continue
+        case vm.Accumulator() != reference.Accumulator():
+            return fmt.Errorf("-O%d: acc %d, want %d", level, vm.Accumulator(), reference.Accumulator())
+        case fmt.Sprint(vm.Stack()) != fmt.Sprint(reference.Stack()):
+            return fmt.Errorf("-O%d: stack %v, want %v", level, vm.Stack(), reference.Stack())
+        }
+    }
+    return nil
+}
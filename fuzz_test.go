@@ -0,0 +1,21 @@
+package main
+
+import (
+    "testing"
+
+    "./fluxgen"
+)
+
+func TestFuzzProperties(t *testing.T) {
+    for _, p := range fuzzProperties {
+        t.Run(p.name, func(t *testing.T) {
+            g := fluxgen.NewGenerator(1)
+            for range 200 {
+                src := p.generate(g)
+                if err := p.check(src, []byte("input")); err != nil {
+                    t.Fatalf("%q: %v", src, err)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "context"
+    "errors"
+
+    "./fluxgrade"
+)
+
+// GradeRunner compiles and runs programs for a fluxgrade.Grader on this
+// VM, each case on a fresh machine
+type GradeRunner struct {
+    Limits     RunLimits    // Bounds of every case's run
+    Extensions ExtensionSet // Extensions programs may use
+    Setup      func(*VM)    // Configures the machine of each case before it runs, if set
+}
+
+// Compile implements fluxgrade.Runner
+func (r GradeRunner) Compile(source string) (fluxgrade.Program, error) {
+    compiler := NewCompiler(source)
+    compiler.SetExtensions(r.Extensions)
+    program, err := compiler.Compile()
+    if err != nil {
+        return nil, err
+    }
+    return gradedProgram{r, program}, nil
+}
+
+// gradedProgram is a program compiled by a GradeRunner
+type gradedProgram struct {
+    runner  GradeRunner
+    program *Program
+}
+
+// Run implements fluxgrade.Program
+func (p gradedProgram) Run(ctx context.Context, input string) fluxgrade.Run {
+    vm, out, elapsed, err := runLimited(ctx, p.program, p.runner.Extensions, input, p.runner.Limits, p.runner.Setup, nil)
+    var stepLimit *StepLimitError
+    return fluxgrade.Run{
+        Output:    out.String(),
+        Truncated: out.Truncated(),
+        Written:   out.Written(),
+        Steps:     vm.StepCount(),
+        Duration:  elapsed,
+        Err:       err,
+        TimeLimit: errors.As(err, &stepLimit) || errors.Is(err, context.DeadlineExceeded),
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "./fluxgrade"
+)
+
+func TestGrade(t *testing.T) {
+    cases := []fluxgrade.GradeCase{
+        {Name: "one", Input: "1", Expected: "2"},
+        {Name: "five", Input: "5", Expected: "6", Points: 3},
+    }
+    tests := []struct {
+        name     string
+        runner   GradeRunner
+        source   string
+        verdict  string
+        verdicts []string // Of each case; none for CE
+        score    int
+    }{
+        {"accepted", GradeRunner{}, ",------------------------------------------------+#", fluxgrade.VerdictAccepted, []string{"AC", "AC"}, 4},
+        {"wrong answer", GradeRunner{}, "+++#", fluxgrade.VerdictWrongAnswer, []string{"WA", "WA"}, 0},
+        {"first failing case decides", GradeRunner{}, "++#", fluxgrade.VerdictWrongAnswer, []string{"AC", "WA"}, 1},
+        {"step limit", GradeRunner{Limits: RunLimits{MaxSteps: 1000}}, "+[]", fluxgrade.VerdictTimeLimit, []string{"TLE", "TLE"}, 0},
+        {"timeout", GradeRunner{Limits: RunLimits{Timeout: 20 * time.Millisecond}}, "+[]", fluxgrade.VerdictTimeLimit, []string{"TLE", "TLE"}, 0},
+        {"runtime error", GradeRunner{Extensions: ExtAssert}, "+*++A", fluxgrade.VerdictRuntimeError, []string{"RE", "RE"}, 0},
+        {"setup configures the machine", GradeRunner{Setup: func(vm *VM) { vm.SetStrictStack(true) }}, "/", fluxgrade.VerdictRuntimeError, []string{"RE", "RE"}, 0},
+        {"compile error", GradeRunner{}, "[", fluxgrade.VerdictCompileError, nil, 0},
+        {"extension not enabled", GradeRunner{}, "%requires ext:heap\n", fluxgrade.VerdictCompileError, nil, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            report, err := fluxgrade.Grader{Runner: tt.runner}.Grade(context.Background(), tt.source, cases)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if report.Verdict != tt.verdict {
+                t.Errorf("verdict %s, want %s", report.Verdict, tt.verdict)
+            }
+            if (report.Compile != "") != (tt.verdict == fluxgrade.VerdictCompileError) {
+                t.Errorf("compile error %q with verdict %s", report.Compile, report.Verdict)
+            }
+            if len(report.Cases) != len(tt.verdicts) {
+                t.Fatalf("%d cases graded, want %d", len(report.Cases), len(tt.verdicts))
+            }
+            for i, r := range report.Cases {
+                if r.Verdict != tt.verdicts[i] {
+                    t.Errorf("case %s: verdict %s, want %s", r.Name, r.Verdict, tt.verdicts[i])
+                }
+                if (r.Error != "") != (r.Verdict == fluxgrade.VerdictRuntimeError || r.Verdict == fluxgrade.VerdictTimeLimit) {
+                    t.Errorf("case %s: error %q with verdict %s", r.Name, r.Error, r.Verdict)
+                }
+                if (r.Diff != "") != (r.Verdict == fluxgrade.VerdictWrongAnswer) {
+                    t.Errorf("case %s: diff %q with verdict %s", r.Name, r.Diff, r.Verdict)
+                }
+            }
+            if report.Score != tt.score || report.MaxScore != 4 {
+                t.Errorf("score %d of %d, want %d of 4", report.Score, report.MaxScore, tt.score)
+            }
+        })
+    }
+}
+
+func TestGradeOutput(t *testing.T) {
+    tests := []struct {
+        name     string
+        runner   GradeRunner
+        exact    bool
+        source   string
+        expected string
+        verdict  string
+    }{
+        {"trailing whitespace ignored", GradeRunner{}, false, "+#+++++++++.", "1", fluxgrade.VerdictAccepted},
+        {"exact output", GradeRunner{}, true, "+#+++++++++.", "1", fluxgrade.VerdictWrongAnswer},
+        {"exact match", GradeRunner{}, true, "+#+++++++++.", "1\n", fluxgrade.VerdictAccepted},
+        {"leading whitespace counts", GradeRunner{}, false, "++++++++++.---------#", "1", fluxgrade.VerdictWrongAnswer},
+        {"truncated output", GradeRunner{Limits: RunLimits{MaxOutput: 3, MaxSteps: 10000}}, false, "+[#]", "111", fluxgrade.VerdictTimeLimit},
+        {"truncated before the end", GradeRunner{Limits: RunLimits{MaxOutput: 3}}, false, "+#+#+#+#", "1234", fluxgrade.VerdictWrongAnswer},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            report, err := fluxgrade.Grader{Runner: tt.runner, Exact: tt.exact}.Grade(context.Background(), tt.source, []fluxgrade.GradeCase{{Name: "case", Expected: tt.expected}})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if report.Verdict != tt.verdict {
+                t.Errorf("verdict %s, want %s (%+v)", report.Verdict, tt.verdict, report.Cases)
+            }
+        })
+    }
+}
+
+func TestGradeCanceled(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    report, err := fluxgrade.Grader{Runner: GradeRunner{}}.Grade(ctx, "+#", []fluxgrade.GradeCase{{Name: "a", Expected: "1"}})
+    if err == nil || len(report.Cases) != 0 {
+        t.Errorf("Grade with a canceled context = %d cases, %v; want none and an error", len(report.Cases), err)
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+// grammarFormats lists the editor formats 'flux grammar' writes
+var grammarFormats = map[string]func(g grammarChars) string{
+    "tmlanguage": tmLanguageGrammar,
+    "vim":        vimGrammar,
+    "emacs":      emacsGrammar,
+}
+
+// grammarCommand implements 'flux grammar', which writes a syntax
+// highlighting definition for an editor, generated from the operator
+// tables so that it covers every extension
+func grammarCommand(args []string) {
+    fs := commandFlags("grammar")
+    format := fs.String("format", "tmlanguage", "write the grammar for `editor`: tmlanguage (VS Code, Sublime Text, TextMate), vim or emacs")
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    generate, ok := grammarFormats[*format]
+    if len(positional) != 0 || !ok {
+        fmt.Println("Error: Please specify one of the formats tmlanguage, vim or emacs")
+        printUsage("grammar")
+        return
+    }
+    os.Stdout.WriteString(generate(grammarOperators()))
+}
+
+// grammarChars sorts the operator characters into the classes that are
+// highlighted differently. Everything else is a comment.
+type grammarChars struct {
+    control   string // Loops, conditionals, blocks, traps and jumps
+    operators string // Every other operator but the register ones
+    registers string // Operators followed by a register name
+}
+
+// all returns every operator character
+func (g grammarChars) all() string {
+    return g.control + g.operators + g.registers
+}
+
+// grammarOperators classifies the core operators and those of all
+// extensions
+func grammarOperators() grammarChars {
+    var control, operators, registers []byte
+    for i := 0; i < len(operatorChars); i++ {
+        if char := operatorChars[i]; char == '[' || char == ']' {
+            control = append(control, char)
+        } else {
+            operators = append(operators, char)
+        }
+    }
+    for char, e := range extensionOps {
+        switch e.op {
+        case OpIf, OpElse, OpEndIf, OpBreak, OpContinue, OpQuote, OpReturn, OpExec, OpTry, OpCatch, OpEndTry:
+            control = append(control, char)
+        case OpLoadReg, OpStoreReg:
+            registers = append(registers, char)
+        default:
+            operators = append(operators, char)
+        }
+    }
+    sorted := func(b []byte) string {
+        sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+        return string(b)
+    }
+    return grammarChars{control: sorted(control), operators: sorted(operators), registers: sorted(registers)}
+}
+
+// escapedClass returns a bracket expression matching the characters of
+// chars, or all others if negate is set, with the characters escape
+// lists preceded by a backslash
+func escapedClass(chars string, negate bool, escape string) string {
+    var b strings.Builder
+    b.WriteByte('[')
+    if negate {
+        b.WriteByte('^')
+    }
+    for i := 0; i < len(chars); i++ {
+        if strings.IndexByte(escape, chars[i]) >= 0 {
+            b.WriteByte('\\')
+        }
+        b.WriteByte(chars[i])
+    }
+    b.WriteByte(']')
+    return b.String()
+}
+
+// emacsClass returns an Emacs bracket expression, in which backslash is
+// not special: ']' must come first, '-' last and '^' anywhere but first.
+// '"' is escaped for the string literal the expression goes in, and the
+// text of extra goes in as it is, for escapes of the string literal.
+func emacsClass(chars string, negate bool, extra string) string {
+    var first, middle, last string
+    for i := 0; i < len(chars); i++ {
+        switch c := chars[i]; c {
+        case ']':
+            first = "]"
+        case '-':
+            last += "-"
+        case '^':
+            last = "^" + last
+        case '"':
+            middle += `\"`
+        default:
+            middle += string(c)
+        }
+    }
+    prefix := "["
+    if negate {
+        prefix = "[^"
+    }
+    return prefix + first + middle + extra + last + "]"
+}
+
+// tmLanguageGrammar writes a TextMate grammar in JSON, as used by VS Code
+// and Sublime Text
+func tmLanguageGrammar(g grammarChars) string {
+    class := func(chars string, negate bool) string { return escapedClass(chars, negate, `\[]^-`) }
+    type pattern struct {
+        Name  string `json:"name"`
+        Match string `json:"match"`
+    }
+    grammar := struct {
+        Name      string    `json:"name"`
+        ScopeName string    `json:"scopeName"`
+        FileTypes []string  `json:"fileTypes"`
+        Patterns  []pattern `json:"patterns"`
+    }{
+        Name:      "Flux",
+        ScopeName: "source.flux",
+        FileTypes: []string{"flux"},
+        Patterns: []pattern{
+            {"variable.other.register.flux", class(g.registers, false) + class(registerNames, false)},
+            {"keyword.control.flux", class(g.control, false)},
+            {"keyword.operator.flux", class(g.operators, false)},
+            {"comment.block.flux", strings.TrimSuffix(class(g.all(), true), "]") + `\s]+`},
+        },
+    }
+    var b strings.Builder
+    enc := json.NewEncoder(&b)
+    enc.SetEscapeHTML(false)
+    enc.SetIndent("", "  ")
+    enc.Encode(grammar)
+    return b.String()
+}
+
+// vimGrammar writes a Vim syntax file
+func vimGrammar(g grammarChars) string {
+    class := func(chars string, negate bool) string { return escapedClass(chars, negate, `\]^-"`) }
+    var b strings.Builder
+    b.WriteString(`" Vim syntax file for Flux, generated by 'flux grammar -format vim'
+" Install as ~/.vim/syntax/flux.vim and add to your vimrc:
+"   autocmd BufRead,BufNewFile *.flux setfiletype flux
+
+if exists("b:current_syntax")
+  finish
+endif
+
+`)
+    fmt.Fprintf(&b, "syn match fluxComment \"%s \\t]\\+\"\n", strings.TrimSuffix(class(g.all(), true), "]"))
+    fmt.Fprintf(&b, "syn match fluxOperator \"%s\"\n", class(g.operators, false))
+    fmt.Fprintf(&b, "syn match fluxControl \"%s\"\n", class(g.control, false))
+    fmt.Fprintf(&b, "syn match fluxRegister \"%s%s\"\n", class(g.registers, false), class(registerNames, false))
+    b.WriteString(`
+hi def link fluxComment Comment
+hi def link fluxOperator Operator
+hi def link fluxControl Keyword
+hi def link fluxRegister Identifier
+
+let b:current_syntax = "flux"
+`)
+    return b.String()
+}
+
+// emacsGrammar writes an Emacs major mode
+func emacsGrammar(g grammarChars) string {
+    var b strings.Builder
+    b.WriteString(`;;; flux-mode.el --- Major mode for Flux programs -*- lexical-binding: t -*-
+
+;; Generated by 'flux grammar -format emacs'. Load it from your init file:
+;;   (load "/path/to/flux-mode.el")
+
+;;; Code:
+
+(defconst flux-font-lock-keywords
+`)
+    fmt.Fprintf(&b, "  '((\"%s%s\" . font-lock-variable-name-face)\n", emacsClass(g.registers, false, ""), emacsClass(registerNames, false, ""))
+    fmt.Fprintf(&b, "    (\"%s\" . font-lock-keyword-face)\n", emacsClass(g.control, false, ""))
+    fmt.Fprintf(&b, "    (\"%s\" . font-lock-builtin-face)\n", emacsClass(g.operators, false, ""))
+    fmt.Fprintf(&b, "    (\"%s+\" . font-lock-comment-face))\n", emacsClass(g.all(), true, ` \t\n`))
+    b.WriteString(`  "Highlighting for Flux: operators, control operators, registers and
+everything else as a comment.")
+
+;;;###autoload
+(define-derived-mode flux-mode prog-mode "Flux"
+  "Major mode for editing Flux programs."
+  (setq font-lock-defaults '(flux-font-lock-keywords)))
+
+;;;###autoload
+(add-to-list 'auto-mode-alist '("\\.flux\\'" . flux-mode))
+
+(provide 'flux-mode)
+
+;;; flux-mode.el ends here
+`)
+    return b.String()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "slices"
+    "strings"
+)
+
+// haltUnsupported lists the extensions whose effect depends on the world
+// outside the machine, or on state a Snapshot does not capture, so that a
+// run is not decided by the machine state alone
+const haltUnsupported = ExtProbe | ExtSleep | ExtClock | ExtFS | ExtCoroutine | ExtEnv | ExtNet
+
+// haltKind is the answer of the termination check
+type haltKind int
+
+const (
+    haltHalts   haltKind = iota // The program ends, possibly with an error
+    haltLoops                   // The program returns to an earlier state, so it runs forever
+    haltUnknown                 // Neither happened within the state limit
+)
+
+// haltResult is the outcome of checking whether a program halts
+type haltResult struct {
+    kind   haltKind
+    steps  int   // Steps until the program ended, the state recurred, or the limit
+    err    error // The error the program ended with, if any
+    from   int   // With haltLoops, the step after which the recurring state was seen
+    period int   // With haltLoops, the steps between recurrences
+    pc     int   // With haltLoops, the address of the next instruction in the recurring state
+}
+
+// runState is all that decides what a machine that reads no input
+// does next
+type runState struct {
+    snapshot Snapshot
+    steps    int // Steps executed when the state was captured
+}
+
+func captureState(vm *VM) runState {
+    return runState{snapshot: vm.Snapshot(), steps: vm.steps}
+}
+
+// matches reports whether vm is in state s
+func (s *runState) matches(vm *VM) bool {
+    return vm.pc == s.snapshot.PC && vm.accumulator == s.snapshot.Accumulator &&
+        slices.Equal(vm.stack, s.snapshot.Stack) && vm.registers == s.snapshot.Registers &&
+        slices.Equal(vm.heap, s.snapshot.Heap) && slices.Equal(vm.calls, s.snapshot.Calls) &&
+        slices.Equal(vm.traps, s.snapshot.Traps)
+}
+
+// checkHalting runs program for up to maxStates steps to decide whether it
+// halts. A program that reads no input is deterministic, so if it ever
+// comes back to a state it was in, it runs in that cycle forever. States
+// are compared with Brent's method: the state is saved after 1, 2, 4, 8
+// and so on steps and each step is compared with the last one saved,
+// which finds every cycle shorter than half the steps run and costs one
+// comparison, usually decided by the program counter, per step.
+func checkHalting(program *Program, extensions ExtensionSet, maxStates int) (haltResult, error) {
+    for pc, inst := range program.Instructions {
+        if inst.Op == OpIn {
+            return haltResult{}, fmt.Errorf("it reads input at %s", program.Location(pc))
+        }
+    }
+    if uses := requiredExtensions(program.Instructions) & haltUnsupported; uses != 0 {
+        return haltResult{}, fmt.Errorf("it uses the %s extension(s)", uses)
+    }
+
+    vm := NewVM(program, strings.NewReader(""), io.Discard)
+    vm.SetExtensions(extensions)
+    vm.SetDumpOutput(io.Discard)
+    saved := captureState(vm)
+    for power := 1; !vm.Halted(); {
+        if vm.steps >= maxStates {
+            return haltResult{kind: haltUnknown, steps: vm.steps}, nil
+        }
+        if err := vm.Step(); err != nil {
+            return haltResult{kind: haltHalts, steps: vm.steps, err: err}, nil
+        }
+        if saved.matches(vm) {
+            return haltResult{kind: haltLoops, steps: vm.steps, from: saved.steps, period: vm.steps - saved.steps, pc: vm.pc}, nil
+        }
+        if vm.steps-saved.steps == power {
+            saved = captureState(vm)
+            power *= 2
+        }
+    }
+    return haltResult{kind: haltHalts, steps: vm.steps}, nil
+}
+
+// printHalting prints whether the program halts and returns the exit
+// status of 'flux analyze halt': 0 if it halts, 1 if it runs forever and
+// 2 if that could not be decided
+func printHalting(filename string, program *Program, extensions ExtensionSet, maxStates int) int {
+    r, err := checkHalting(program, extensions, maxStates)
+    if err != nil {
+        fmt.Printf("unknown: %s cannot be checked, since %v\n", filename, err)
+        return 2
+    }
+    switch r.kind {
+    case haltHalts:
+        if r.err != nil {
+            fmt.Printf("halts within %d step(s), with an error: %v\n", r.steps, r.err)
+        } else {
+            fmt.Printf("halts within %d step(s)\n", r.steps)
+        }
+        return 0
+    case haltLoops:
+        fmt.Printf("definitely loops: the state after %d step(s), at %s, recurs every %d step(s)\n", r.from, program.Location(r.pc), r.period)
+        return 1
+    }
+    fmt.Printf("unknown: neither halts nor repeats a state within %d step(s) (raise -max-states)\n", r.steps)
+    return 2
+}
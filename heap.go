@@ -0,0 +1,51 @@
+package main
+
+// DefaultMaxHeap is how many heap cells a program may allocate unless the
+// VM is configured otherwise
+const DefaultMaxHeap = 1 << 20
+
+// SetMaxHeap limits how many heap cells the program may allocate in all;
+// zero removes the limit
+func (vm *VM) SetMaxHeap(n int) {
+    vm.maxHeap = n
+}
+
+// Heap returns a copy of the heap cells, the data blocks and those the
+// program has allocated, the cell at address 1 first
+func (vm *VM) Heap() []int {
+    return append([]int(nil), vm.heap...)
+}
+
+// alloc allocates as many zeroed heap cells as the accumulator holds and
+// loads the address of the first
+func (vm *VM) alloc() error {
+    n := vm.accumulator
+    if n < 0 {
+        return fault(FaultOperand, "cannot allocate %d heap cells at %s", n, vm.program.Location(vm.pc))
+    }
+    if vm.maxHeap > 0 && n > vm.maxHeap-len(vm.heap) {
+        return fault(FaultLimit, "heap limit of %d cells exceeded at %s", vm.maxHeap, vm.program.Location(vm.pc))
+    }
+    vm.accumulator = len(vm.heap) + 1
+    vm.heap = append(vm.heap, make([]int, n)...)
+    return nil
+}
+
+// cell pops an index and then an address and returns the position in the
+// heap of the cell that far past the address. Addresses start at 1, so 0
+// can stand for no cell.
+func (vm *VM) cell() (int, error) {
+    index, err := vm.pop()
+    if err != nil {
+        return 0, err
+    }
+    addr, err := vm.pop()
+    if err != nil {
+        return 0, err
+    }
+    i := addr + index - 1
+    if addr < 1 || index < 0 || i >= len(vm.heap) {
+        return 0, fault(FaultOperand, "no heap cell at address %d index %d at %s", addr, index, vm.program.Location(vm.pc))
+    }
+    return i, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "net/netip"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// APIError is the JSON body of an error response of an HTTP front end:
+//
+//	{"error": {"status": 429, "code": "rate_limited", "message": "...", "retry_after": 1.5}}
+type APIError struct {
+    Status     int     `json:"status"`                // HTTP status code
+    Code       string  `json:"code"`                  // Stable identifier for programs, such as "source_too_large"
+    Message    string  `json:"message"`               // Explanation for people
+    RetryAfter float64 `json:"retry_after,omitempty"` // Seconds to wait before trying again, for 429
+}
+
+func (e *APIError) Error() string {
+    return e.Message
+}
+
+// WriteAPIError sends e as the response, with a Retry-After header if it
+// says when to retry
+func WriteAPIError(w http.ResponseWriter, e *APIError) {
+    w.Header().Set("Content-Type", "application/json")
+    if e.RetryAfter > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter))))
+    }
+    w.WriteHeader(e.Status)
+    json.NewEncoder(w).Encode(struct {
+        Error *APIError `json:"error"`
+    }{e})
+}
+
+// RequestLimits protects a public HTTP front end, such as a playground,
+// from abuse. Zero fields impose no limit.
+type RequestLimits struct {
+    Rate       float64 // Requests per second a client IP may make on average
+    Burst      int     // Requests a client may make at once; default the rate rounded up
+    MaxBody    int64   // Most bytes in a request body
+    MaxSource  int     // Most bytes of program source, checked with CheckSizes
+    MaxStdin   int     // Most bytes of program input, checked with CheckSizes
+    TrustProxy bool    // Take the client IP from X-Forwarded-For, behind a reverse proxy
+
+    // Proxies in front of the reverse proxy, such as a CDN, whose
+    // addresses in X-Forwarded-For are passed over, with TrustProxy
+    TrustedProxies []netip.Prefix
+}
+
+// CheckSizes returns the error to send if source or stdin is larger than
+// the limits allow, or nil. Handlers call it once they have decoded a
+// request.
+func (l RequestLimits) CheckSizes(source, stdin string) *APIError {
+    if l.MaxSource > 0 && len(source) > l.MaxSource {
+        return &APIError{Status: http.StatusRequestEntityTooLarge, Code: "source_too_large",
+            Message: fmt.Sprintf("source of %d bytes exceeds the limit of %d", len(source), l.MaxSource)}
+    }
+    if l.MaxStdin > 0 && len(stdin) > l.MaxStdin {
+        return &APIError{Status: http.StatusRequestEntityTooLarge, Code: "stdin_too_large",
+            Message: fmt.Sprintf("input of %d bytes exceeds the limit of %d", len(stdin), l.MaxStdin)}
+    }
+    return nil
+}
+
+// LimitRequests wraps h so that a client IP making requests faster than
+// the rate gets 429 responses, and a body larger than MaxBody, as
+// declared or as read, gets a 413
+func LimitRequests(h http.Handler, l RequestLimits) http.Handler {
+    limiter := newRateLimiter(l.Rate, l.Burst)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if limiter != nil {
+            if wait := limiter.take(l.clientIP(r), time.Now()); wait > 0 {
+                WriteAPIError(w, &APIError{Status: http.StatusTooManyRequests, Code: "rate_limited",
+                    Message: "too many requests; slow down", RetryAfter: wait.Seconds()})
+                return
+            }
+        }
+        if l.MaxBody > 0 {
+            if r.ContentLength > l.MaxBody {
+                WriteAPIError(w, &APIError{Status: http.StatusRequestEntityTooLarge, Code: "body_too_large",
+                    Message: fmt.Sprintf("request body of %d bytes exceeds the limit of %d", r.ContentLength, l.MaxBody)})
+                return
+            }
+            // Bodies of unknown length fail as they are read past the limit
+            r.Body = http.MaxBytesReader(w, r.Body, l.MaxBody)
+        }
+        h.ServeHTTP(w, r)
+    })
+}
+
+// clientIP returns the address a request came from. Behind a proxy that
+// is the rightmost X-Forwarded-For entry that is not a trusted proxy:
+// the proxy appends the address it got the request from, and anything
+// to the left of it is whatever the client sent, which it can forge.
+func (l RequestLimits) clientIP(r *http.Request) string {
+    if l.TrustProxy {
+        entries := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+        for i := len(entries) - 1; i >= 0; i-- {
+            entry := strings.TrimSpace(entries[i])
+            if entry == "" {
+                continue
+            }
+            if addr, err := netip.ParseAddr(entry); err != nil || i == 0 || !l.trustedProxy(addr) {
+                return entry
+            }
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// trustedProxy reports whether addr belongs to one of the TrustedProxies
+func (l RequestLimits) trustedProxy(addr netip.Addr) bool {
+    for _, p := range l.TrustedProxies {
+        if p.Contains(addr.Unmap()) {
+            return true
+        }
+    }
+    return false
+}
+
+// rateLimiter keeps a token bucket per client: each holds up to burst
+// tokens, refills at rate tokens per second, and a request takes one
+type rateLimiter struct {
+    rate    float64
+    burst   float64
+    mu      sync.Mutex
+    buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// rateLimiterSweep is how many buckets a limiter holds before it drops
+// those that have refilled, which are the same as none
+const rateLimiterSweep = 10000
+
+// newRateLimiter returns a limiter, or nil if rate is not positive
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+    if rate <= 0 {
+        return nil
+    }
+    if burst <= 0 {
+        burst = int(math.Ceil(rate))
+    }
+    return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// take takes a token for the client and returns zero, or, if there is
+// none, how long until there is one
+func (l *rateLimiter) take(client string, now time.Time) time.Duration {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    b, ok := l.buckets[client]
+    if !ok {
+        if len(l.buckets) >= rateLimiterSweep {
+            l.sweep(now)
+        }
+        b = &tokenBucket{tokens: l.burst, last: now}
+        l.buckets[client] = b
+    }
+    b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+    b.last = now
+    if b.tokens < 1 {
+        return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+    }
+    b.tokens--
+    return 0
+}
+
+// sweep drops the buckets that have refilled
+func (l *rateLimiter) sweep(now time.Time) {
+    for client, b := range l.buckets {
+        if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+            delete(l.buckets, client)
+        }
+    }
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "net/http/httptest"
+    "net/netip"
+    "testing"
+    "time"
+)
+
+func TestClientIP(t *testing.T) {
+    cdn := []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+    tests := []struct {
+        name    string
+        limits  RequestLimits
+        forward []string // X-Forwarded-For headers
+        want    string
+    }{
+        {"remote address", RequestLimits{}, nil, "192.0.2.1"},
+        {"header ignored unless trusted", RequestLimits{}, []string{"198.51.100.7"}, "192.0.2.1"},
+        {"no header", RequestLimits{TrustProxy: true}, nil, "192.0.2.1"},
+        {"single entry", RequestLimits{TrustProxy: true}, []string{"198.51.100.7"}, "198.51.100.7"},
+        {"forged entries are passed over", RequestLimits{TrustProxy: true}, []string{"10.0.0.1, 198.51.100.7"}, "198.51.100.7"},
+        {"last of several headers", RequestLimits{TrustProxy: true}, []string{"10.0.0.1", "198.51.100.7"}, "198.51.100.7"},
+        {"trusted proxies are skipped", RequestLimits{TrustProxy: true, TrustedProxies: cdn}, []string{"10.0.0.1, 198.51.100.7, 203.0.113.9"}, "198.51.100.7"},
+        {"only trusted proxies", RequestLimits{TrustProxy: true, TrustedProxies: cdn}, []string{"203.0.113.5, 203.0.113.9"}, "203.0.113.5"},
+        {"untrusted proxy stops the search", RequestLimits{TrustProxy: true}, []string{"198.51.100.7, 203.0.113.9"}, "203.0.113.9"},
+        {"garbage is the client", RequestLimits{TrustProxy: true, TrustedProxies: cdn}, []string{"198.51.100.7, junk, 203.0.113.9"}, "junk"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/", nil)
+            r.RemoteAddr = "192.0.2.1:4321"
+            for _, v := range tt.forward {
+                r.Header.Add("X-Forwarded-For", v)
+            }
+            if got := tt.limits.clientIP(r); got != tt.want {
+                t.Errorf("clientIP = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRateLimiter(t *testing.T) {
+    start := time.Unix(1000, 0)
+    l := newRateLimiter(2, 3)
+    tests := []struct {
+        client string
+        at     time.Duration // Since start
+        want   time.Duration // Wait returned by take
+    }{
+        {"a", 0, 0},
+        {"a", 0, 0},
+        {"a", 0, 0},
+        {"a", 0, 500 * time.Millisecond}, // Burst used up
+        {"b", 0, 0},                      // Clients have their own buckets
+        {"a", 250 * time.Millisecond, 250 * time.Millisecond},
+        {"a", 500 * time.Millisecond, 0}, // A token refilled
+        {"a", 500 * time.Millisecond, 500 * time.Millisecond},
+        {"a", 10 * time.Second, 0}, // Refilled to the burst, no further
+        {"a", 10 * time.Second, 0},
+        {"a", 10 * time.Second, 0},
+        {"a", 10 * time.Second, 500 * time.Millisecond},
+    }
+    for i, tt := range tests {
+        if got := l.take(tt.client, start.Add(tt.at)); got != tt.want {
+            t.Errorf("take %d (%s at %v) = %v, want %v", i, tt.client, tt.at, got, tt.want)
+        }
+    }
+    if newRateLimiter(0, 5) != nil {
+        t.Errorf("newRateLimiter(0, 5) is not nil")
+    }
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "bufio"
+    "io"
+    "os"
+)
+
+// inputReady reports whether reading from r would return data without
+// blocking. Inputs that cannot tell, and inputs at end of file, report
+// false.
+func inputReady(r io.Reader) bool {
+    switch r := r.(type) {
+    case interface{ Ready() bool }:
+        return r.Ready()
+    case interface{ Len() int }: // bytes.Reader, strings.Reader, bytes.Buffer
+        return r.Len() > 0
+    }
+    return false
+}
+
+// pollingReader reads from an underlying reader in the background, so that
+// Ready can say without blocking whether input has arrived
+type pollingReader struct {
+    chunks  chan []byte // Data read by the background goroutine; closed at the end
+    pending []byte      // Data received but not yet returned by Read
+    err     error       // Error that ended the input, reported once pending is empty
+    done    bool        // Whether chunks has been closed
+}
+
+// newPollingReader starts reading r in the background
+func newPollingReader(r io.Reader) *pollingReader {
+    p := &pollingReader{chunks: make(chan []byte)}
+    go func() {
+        defer close(p.chunks)
+        for {
+            buf := make([]byte, 4096)
+            n, err := r.Read(buf)
+            if n > 0 {
+                p.chunks <- buf[:n]
+            }
+            if err != nil {
+                if err != io.EOF {
+                    p.err = err // Published to the reader by closing chunks
+                }
+                return
+            }
+        }
+    }()
+    return p
+}
+
+// receive moves the next chunk into pending, waiting for it if wait is set
+func (p *pollingReader) receive(wait bool) {
+    if p.done || len(p.pending) > 0 {
+        return
+    }
+    var chunk []byte
+    var ok bool
+    if wait {
+        chunk, ok = <-p.chunks
+    } else {
+        select {
+        case chunk, ok = <-p.chunks:
+        default:
+            return
+        }
+    }
+    p.pending = chunk
+    p.done = !ok
+}
+
+// Ready reports whether Read would return data immediately
+func (p *pollingReader) Ready() bool {
+    p.receive(false)
+    return len(p.pending) > 0
+}
+
+// Read returns buffered input, waiting for more if there is none
+func (p *pollingReader) Read(b []byte) (int, error) {
+    p.receive(true)
+    if len(p.pending) == 0 {
+        if p.err != nil {
+            return 0, p.err
+        }
+        return 0, io.EOF
+    }
+    n := copy(b, p.pending)
+    p.pending = p.pending[n:]
+    return n, nil
+}
+
+// defaultInputPrompt is what 'flux run' shows when a program waits for
+// input typed at a terminal, so that it does not look stuck
+const defaultInputPrompt = "> "
+
+// promptingReader reads a program's input from a terminal a line at a
+// time with the line editor, so that what is typed can be corrected and
+// earlier lines recalled. Whenever the program reads and the last line is
+// used up, it shows a dimmed prompt. The line, with its newline, then
+// feeds the program's reads until it is used up in turn.
+type promptingReader struct {
+    editor  *lineEditor
+    prompt  string
+    pending []byte // Rest of the last line, not yet read
+}
+
+// newPromptingReader reads from the terminal term. The prompt and the
+// echo of what is typed go to standard output if it is the terminal too,
+// and to standard error if the output is redirected.
+func newPromptingReader(term *os.File, prompt string) *promptingReader {
+    out := os.Stdout
+    if !isTerminal(out) {
+        out = os.Stderr
+    }
+    editor := newLineEditor(bufio.NewReader(term), out, term)
+    return &promptingReader{editor: editor, prompt: "\x1b[2m" + prompt + "\x1b[0m"}
+}
+
+// Ready reports whether part of the last line is left to read
+func (p *promptingReader) Ready() bool {
+    return len(p.pending) > 0
+}
+
+// Read returns the rest of the last line, prompting for a new one if
+// there is none. Ctrl-D on an empty line ends the input; Ctrl-C is
+// reported as an error, which stops the program.
+func (p *promptingReader) Read(b []byte) (int, error) {
+    if len(p.pending) == 0 {
+        line, err := p.editor.ReadLine(p.prompt)
+        if err != nil {
+            return 0, err
+        }
+        p.pending = []byte(line + "\n")
+    }
+    n := copy(b, p.pending)
+    p.pending = p.pending[n:]
+    return n, nil
+}
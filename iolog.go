@@ -0,0 +1,109 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "time"
+)
+
+// ioLog records what a running program reads and writes, each with the
+// time since the log started, the instruction responsible and, if the
+// program has debug information, its source location. Input and output
+// share one log, so it shows how they interleaved:
+//
+//	0.000012  out  0007  "Name? "  prog.flux:1:9
+//	2.391520  in   0012  "A"  prog.flux:2:1
+//	2.391544  in   0012  EOF  prog.flux:2:1
+type ioLog struct {
+    vm    *VM
+    w     *bufio.Writer
+    start time.Time
+    err   error // First error writing the log; the program runs on regardless
+}
+
+// LogIO makes the machine log every byte the program reads from its
+// input or writes to its output to w, as 'flux run -io-log' does.
+// StopIOLog finishes the log. Call SetIO or SetDevice before LogIO, not
+// after.
+func (vm *VM) LogIO(w io.Writer) {
+    l := &ioLog{vm: vm, w: bufio.NewWriter(w), start: time.Now()}
+    vm.device = &ioLogDevice{log: l, d: vm.device}
+    vm.ioLog = l
+}
+
+// StopIOLog stops logging and writes out the rest of the log, reporting
+// the first error writing it
+func (vm *VM) StopIOLog() error {
+    l := vm.ioLog
+    if l == nil {
+        return nil
+    }
+    vm.ioLog = nil
+    if d, ok := vm.device.(*ioLogDevice); ok {
+        vm.device = d.d
+    }
+    if err := l.w.Flush(); l.err == nil {
+        l.err = err
+    }
+    return l.err
+}
+
+// record adds an entry for data read or written by the instruction at the
+// program counter
+func (l *ioLog) record(dir string, data []byte, eof bool) {
+    text := fmt.Sprintf("%q", data)
+    if eof {
+        text = "EOF"
+    }
+    if _, ok := l.vm.program.Position(l.vm.pc); ok {
+        text += "  " + l.vm.program.Location(l.vm.pc)
+    }
+    _, err := fmt.Fprintf(l.w, "%9.6f  %-3s  %04d  %s\n", time.Since(l.start).Seconds(), dir, l.vm.pc, text)
+    if err != nil && l.err == nil {
+        l.err = err
+    }
+}
+
+// ioLogDevice logs what the program reads and writes through a device
+type ioLogDevice struct {
+    log *ioLog
+    d   Device
+}
+
+func (d *ioLogDevice) ReadByte() (byte, error) {
+    c, err := d.d.ReadByte()
+    if err == nil {
+        d.log.record("in", []byte{c}, false)
+    } else if err == io.EOF {
+        d.log.record("in", nil, true)
+    }
+    return c, err
+}
+
+func (d *ioLogDevice) WriteByte(c byte) error {
+    d.log.record("out", []byte{c}, false)
+    return d.d.WriteByte(c)
+}
+
+func (d *ioLogDevice) WriteString(s string) (int, error) {
+    d.log.record("out", []byte(s), false)
+    return d.d.WriteString(s)
+}
+
+func (d *ioLogDevice) Write(b []byte) (int, error) {
+    d.log.record("out", b, false)
+    if err := writeBytes(d.d, b); err != nil {
+        return 0, err
+    }
+    return len(b), nil
+}
+
+func (d *ioLogDevice) Flush() error {
+    return d.d.Flush()
+}
+
+// Ready lets the probe extension see through the log
+func (d *ioLogDevice) Ready() bool {
+    return deviceReady(d.d)
+}
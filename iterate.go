@@ -0,0 +1,49 @@
+package main
+
+import "iter"
+
+// StepInfo describes an instruction the machine has executed
+type StepInfo struct {
+    Step        int    // Instructions executed so far, this one included
+    PC          int    // Address of the instruction
+    Op          OpCode // The instruction's operation
+    Arg         int    // The instruction's operand
+    Accumulator int    // Accumulator after execution
+    Depth       int    // Stack depth after execution
+    Err         error  // Error the instruction failed with, which ends the sequence
+}
+
+// Steps returns an iterator that executes the program an instruction
+// at a time as it is ranged over, yielding each instruction executed:
+//
+//	for s := range vm.Steps() {
+//		if s.Op == OpOut && s.Accumulator == '\n' {
+//			break
+//		}
+//	}
+//
+// The sequence ends when the program does; a failing instruction is
+// yielded with its error and ends it too. Output is flushed when the
+// program ends, as with Run. Breaking out of the loop leaves the machine
+// paused before the next instruction, to be continued with Run, RunSteps
+// or another range over Steps.
+func (vm *VM) Steps() iter.Seq[StepInfo] {
+    return func(yield func(StepInfo) bool) {
+        for !vm.Halted() {
+            inst := vm.instructions[vm.pc]
+            info := StepInfo{PC: vm.pc, Op: inst.Op, Arg: inst.Arg}
+            info.Err = vm.Step()
+            if info.Err != nil {
+                vm.Flush() // Keep the output that led up to the error
+            } else if vm.Halted() {
+                info.Err = vm.Flush()
+            }
+            info.Step = vm.steps
+            info.Accumulator = vm.accumulator
+            info.Depth = len(vm.stack)
+            if !yield(info) || info.Err != nil {
+                return
+            }
+        }
+    }
+}
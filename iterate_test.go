@@ -0,0 +1,67 @@
+package main
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestSteps(t *testing.T) {
+    vm, out := newTestVM(t, "++[#-]", 0, 0)
+    var ops []OpCode
+    var accs []int
+    for s := range vm.Steps() {
+        if s.Step != len(ops)+1 || s.Err != nil {
+            t.Fatalf("step %+v after %d", s, len(ops))
+        }
+        ops = append(ops, s.Op)
+        accs = append(accs, s.Accumulator)
+    }
+    want := []OpCode{OpInc, OpInc, OpLoop, OpOutNum, OpDec, OpEnd, OpLoop, OpOutNum, OpDec, OpEnd}
+    if len(ops) != len(want) {
+        t.Fatalf("executed %v, want %v", ops, want)
+    }
+    for i := range ops {
+        if ops[i] != want[i] {
+            t.Errorf("instruction %d is %s, want %s", i, ops[i], want[i])
+        }
+    }
+    if accs[1] != 2 || accs[len(accs)-1] != 0 {
+        t.Errorf("accumulators %v", accs)
+    }
+    if !vm.Halted() || out.String() != "21" {
+        t.Errorf("halted %v, output %q; want true, \"21\"", vm.Halted(), out.String())
+    }
+}
+
+func TestStepsBreak(t *testing.T) {
+    vm, out := newTestVM(t, "+++[#-]", 0, 0)
+    for s := range vm.Steps() {
+        if s.Op == OpOutNum {
+            break
+        }
+    }
+    if vm.Halted() || vm.StepCount() != 5 {
+        t.Fatalf("halted %v after %d steps, want paused after 5", vm.Halted(), vm.StepCount())
+    }
+    // The machine carries on from where the loop left it
+    if err := vm.Run(); err != nil || out.String() != "321" {
+        t.Errorf("output %q, %v after resuming, want \"321\"", out.String(), err)
+    }
+}
+
+func TestStepsError(t *testing.T) {
+    vm, out := newTestVM(t, "+#+[]", 0, 10)
+    var last StepInfo
+    n := 0
+    for s := range vm.Steps() {
+        last = s
+        n++
+    }
+    var stepLimit *StepLimitError
+    if !errors.As(last.Err, &stepLimit) || n != 11 {
+        t.Errorf("last of %d steps %+v, want the step limit error as the 11th", n, last)
+    }
+    if out.String() != "1" {
+        t.Errorf("output %q before the error, want \"1\"", out.String())
+    }
+}
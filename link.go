@@ -0,0 +1,120 @@
+package main
+
+import (
+    "crypto/sha256"
+    "fmt"
+    "os"
+    "runtime"
+    "sync"
+)
+
+// linkCommand implements 'flux link', which joins compiled programs into
+// one that runs them in turn
+func linkCommand(args []string) {
+    fs := commandFlags("link")
+    output := fs.String("o", "", "write the linked program to the .fluxc `file`")
+    workers := fs.Int("p", runtime.GOMAXPROCS(0), "load `n` units at a time")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) == 0 || *output == "" || *workers < 1 {
+        fmt.Println("Error: Please specify the programs to link and an output file")
+        printUsage("link")
+        return
+    }
+
+    units, errs := loadUnits(positional, source, *workers)
+    failed := false
+    for _, err := range errs {
+        if err != nil {
+            fmt.Println(err)
+            failed = true
+        }
+    }
+    if failed {
+        return
+    }
+
+    program := linkPrograms(units)
+    if err := os.WriteFile(*output, encodeBytecode(program), 0644); err != nil {
+        fmt.Printf("Error writing file '%s': %v\n", *output, err)
+        return
+    }
+    fmt.Printf("Linked %d programs to %s (%d instructions, %d constants)\n", len(units), *output, len(program.Instructions), program.Constants.Len())
+}
+
+// loadUnits reads and compiles or decodes the files to link on the given
+// number of goroutines, since units do not depend on each other until they
+// are joined. The programs and errors come back in the order of the files,
+// so the diagnostics of a failed link read the same on every run.
+func loadUnits(filenames []string, source sourceOptions, workers int) ([]*Program, []error) {
+    units := make([]*Program, len(filenames))
+    errs := make([]error, len(filenames))
+    next := make(chan int)
+    var wg sync.WaitGroup
+    for range min(workers, len(filenames)) {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range next {
+                data, err := os.ReadFile(filenames[i])
+                if err != nil {
+                    errs[i] = fmt.Errorf("Error reading file '%s': %v", filenames[i], err)
+                    continue
+                }
+                if units[i], err = loadProgram(filenames[i], data, source); err != nil {
+                    errs[i] = fmt.Errorf("%s: %v", filenames[i], err)
+                }
+            }
+        }()
+    }
+    for i := range filenames {
+        next <- i
+    }
+    close(next)
+    wg.Wait()
+    return units, errs
+}
+
+// linkPrograms joins units into a program that runs each in turn on the
+// same machine, so a unit starts with the accumulator, stack and registers
+// the one before it left. Blocks are renumbered to stay distinct, which
+// lets a library unit that quotes its blocks hand them on the stack to the
+// units after it; constants are merged into one pool and data blocks into
+// one data segment. The result has no debug information, which describes
+// a single source file.
+func linkPrograms(units []*Program) *Program {
+    program := NewProgram(nil)
+    hash := sha256.New()
+    blocks := 0 // Highest block number so far
+    for _, unit := range units {
+        hash.Write(unit.SourceHash[:])
+        program.ISA = max(program.ISA, unit.ISA)
+        program.Extensions |= unit.Extensions
+        last, data := blocks, len(program.Data)
+        program.Data = append(program.Data, unit.Data...)
+        for _, inst := range unit.Instructions {
+            switch info, _ := inst.Op.Info(); info.Operand {
+            case OperandBlock:
+                inst.Arg += last
+                blocks = max(blocks, inst.Arg)
+            case OperandData:
+                inst.Arg += data
+            case OperandConstant:
+                c, _ := unit.Constants.At(inst.Arg)
+                if c.IsInt() {
+                    inst.Arg = program.Constants.AddInt(c.Int)
+                } else {
+                    inst.Arg = program.Constants.AddBytes(c.Bytes)
+                }
+            }
+            program.Instructions = append(program.Instructions, inst)
+        }
+    }
+    relink(program.Instructions)
+    copy(program.SourceHash[:], hash.Sum(nil))
+    return program
+}
@@ -0,0 +1,40 @@
+package main
+
+import "os"
+
+// mapMinSize is the size from which 'flux run' maps a file into memory
+// rather than reading it. Below it reading is as quick and holds no
+// mapping open.
+const mapMinSize = 1 << 20
+
+// readProgramFile returns the contents of a program file. A large compiled
+// program is mapped read-only into memory instead of read, so that only
+// the pages decoding touches are loaded: with decodeBytecodeLazily, the
+// instructions and constants but not the source in the debug section.
+// The mapping is never released; it lives as long as the program that may
+// still decode its debug section from it, which is until flux exits.
+func readProgramFile(filename string) ([]byte, error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    size := info.Size()
+    if size < mapMinSize || int64(int(size)) != size || !info.Mode().IsRegular() {
+        return os.ReadFile(filename)
+    }
+    header := make([]byte, len(bytecodeMagic))
+    if _, err := f.ReadAt(header, 0); err != nil || !isBytecode(header) {
+        // Source is copied into a string to compile it anyway
+        return os.ReadFile(filename)
+    }
+    data, err := mapFile(f, int(size))
+    if err != nil {
+        return os.ReadFile(filename) // File systems that cannot map files can still be read
+    }
+    return data, nil
+}
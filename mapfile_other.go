@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapFile reads the file instead on systems without mmap
+func mapFile(f *os.File, size int) ([]byte, error) {
+    return os.ReadFile(f.Name())
+}
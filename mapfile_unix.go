@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import (
+    "os"
+    "syscall"
+)
+
+// mapFile maps the first size bytes of f read-only into memory
+func mapFile(f *os.File, size int) ([]byte, error) {
+    return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Metadata is what a program's header says about it. The header is the
+// run of lines at the top of the source, after any "#!" line, that start
+// with '%' and the name of one of the headerFields:
+//
+//	%name Collatz
+//	%author Ada Lovelace
+//	%requires ext:heap ext:clock
+//	%stdin-hint a number in decimal
+//	%data g "Hello, world!\n"
+//	%data p 2 3 5 7 11
+//
+// The header is a comment to the compiler, although '%' is an operator
+// of the ansi extension, but it checks that the extensions the program
+// requires are enabled, and it lays out the data blocks: each %data line
+// declares a block of heap cells, labelled by a lowercase letter, that
+// holds the bytes of a quoted string or the integers listed.
+type Metadata struct {
+    Name      string
+    Author    string
+    Requires  ExtensionSet // Extensions the program says it needs
+    StdinHint string       // What the program expects as input
+    Data      []DataBlock  // Declared data blocks, in header order
+}
+
+// DataBlock is an initialized block of heap cells declared by the header
+type DataBlock struct {
+    Label byte  // The letter '"' names the block by
+    Cells []int // Initial contents
+}
+
+// MarshalJSON writes the required extensions by name, as spec tests
+// list them
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+    var requires string
+    if m.Requires != 0 {
+        requires = m.Requires.String()
+    }
+    var data map[string]int // Size of each data block by label
+    for _, block := range m.Data {
+        if data == nil {
+            data = make(map[string]int)
+        }
+        data[string(block.Label)] = len(block.Cells)
+    }
+    return json.Marshal(struct {
+        Name      string         `json:"name,omitempty"`
+        Author    string         `json:"author,omitempty"`
+        Requires  string         `json:"requires,omitempty"`
+        StdinHint string         `json:"stdin_hint,omitempty"`
+        Data      map[string]int `json:"data,omitempty"`
+    }{m.Name, m.Author, requires, m.StdinHint, data})
+}
+
+// headerFields lists the fields a header line may have. A line starting
+// with '%' and any other word is not part of the header but source, as it
+// was before there were headers, so older programs keep their meaning.
+var headerFields = []string{"name", "author", "requires", "stdin-hint", "data"}
+
+// isHeaderLine reports whether the line at the start of source is a
+// header line: '%' followed by a field name and the end of the word
+func isHeaderLine[S string | []byte](source S) bool {
+    if len(source) < 2 || source[0] != '%' {
+        return false
+    }
+    for _, field := range headerFields {
+        if n := len(field) + 1; len(source) >= n && string(source[1:n]) == field &&
+            (len(source) == n || strings.IndexByte(" \t\r\n", source[n]) >= 0) {
+            return true
+        }
+    }
+    return false
+}
+
+// headerLength returns the length of the "#!" line and the header at the
+// start of source, which the compiler skips
+func headerLength[S string | []byte](source S) int {
+    n := shebangLength(source)
+    for isHeaderLine(source[n:]) {
+        end := n
+        for end < len(source) && source[end] != '\n' {
+            end++
+        }
+        if end < len(source) {
+            end++
+        }
+        n = end
+    }
+    return n
+}
+
+// parseHeader reads the header of source, returning nil if it has none.
+// An error is a CompileError at the line at fault.
+func parseHeader(source []byte) (*Metadata, error) {
+    start, end := shebangLength(source), headerLength(source)
+    if start == end {
+        return nil, nil
+    }
+    m := &Metadata{}
+    for pos := start; pos < end; {
+        line, _, _ := strings.Cut(string(source[pos:end]), "\n")
+        key, value := strings.TrimRight(line[1:], "\r"), ""
+        if i := strings.IndexAny(key, " \t"); i >= 0 {
+            key, value = key[:i], strings.TrimSpace(key[i:])
+        }
+        switch key {
+        case "name":
+            m.Name = value
+        case "author":
+            m.Author = value
+        case "stdin-hint":
+            m.StdinHint = value
+        case "requires":
+            for _, req := range strings.Fields(value) {
+                name, ok := strings.CutPrefix(req, "ext:")
+                if !ok {
+                    return nil, &CompileError{Pos: pos, Msg: fmt.Sprintf("%%requires: unknown requirement %q, expected ext:<extension> at position %d", req, pos)}
+                }
+                ext, err := parseExtensions(name)
+                if err != nil {
+                    return nil, &CompileError{Pos: pos, Msg: fmt.Sprintf("%%requires: %v at position %d", err, pos)}
+                }
+                m.Requires |= ext
+            }
+        case "data":
+            block, err := parseDataBlock(value, m.Data)
+            if err != nil {
+                return nil, &CompileError{Pos: pos, Msg: fmt.Sprintf("%%data: %v at position %d", err, pos)}
+            }
+            m.Data = append(m.Data, block)
+        }
+        pos += len(line) + 1
+    }
+    return m, nil
+}
+
+// parseDataBlock parses the value of a %data line, a label followed by a
+// quoted string or by integers, given the blocks declared before it
+func parseDataBlock(value string, declared []DataBlock) (DataBlock, error) {
+    label, contents := value, ""
+    if i := strings.IndexAny(value, " \t"); i >= 0 {
+        label, contents = value[:i], value[i:]
+    }
+    if len(label) != 1 || label[0] < 'a' || label[0] > 'z' {
+        return DataBlock{}, fmt.Errorf("label %q is not a lowercase letter", label)
+    }
+    for _, block := range declared {
+        if block.Label == label[0] {
+            return DataBlock{}, fmt.Errorf("block %s is declared twice", label)
+        }
+    }
+    block := DataBlock{Label: label[0], Cells: []int{}}
+    contents = strings.TrimSpace(contents)
+    if strings.HasPrefix(contents, `"`) {
+        text, err := strconv.Unquote(contents)
+        if err != nil {
+            return DataBlock{}, fmt.Errorf("block %s has an invalid string %s", label, contents)
+        }
+        for i := 0; i < len(text); i++ {
+            block.Cells = append(block.Cells, int(text[i]))
+        }
+        return block, nil
+    }
+    for _, field := range strings.Fields(contents) {
+        v, err := strconv.Atoi(field)
+        if err != nil {
+            return DataBlock{}, fmt.Errorf("block %s has %q, which is neither an integer nor a quoted string", label, field)
+        }
+        block.Cells = append(block.Cells, v)
+    }
+    return block, nil
+}
+
+// requires returns the extensions m requires, none if m is nil
+func (m *Metadata) requires() ExtensionSet {
+    if m == nil {
+        return 0
+    }
+    return m.Requires
+}
+
+// data returns the data blocks m declares, none if m is nil
+func (m *Metadata) data() []DataBlock {
+    if m == nil {
+        return nil
+    }
+    return m.Data
+}
+
+// Metadata returns what the header of the program's source says, or nil
+// if it has none or the source was stripped
+func (p *Program) Metadata() *Metadata {
+    if p.decodeDebug() != nil || p.Debug == nil {
+        return nil
+    }
+    m, _ := parseHeader(p.Debug.Source)
+    return m
+}
+
+// printMetadata prints the header fields of program that are set, for
+// 'flux stats'
+func printMetadata(m *Metadata) {
+    if m == nil {
+        return
+    }
+    for _, field := range []struct{ label, value string }{
+        {"Name", m.Name},
+        {"Author", m.Author},
+        {"Input", m.StdinHint},
+    } {
+        if field.value != "" {
+            fmt.Printf("  %-14s %s\n", field.label+":", field.value)
+        }
+    }
+    if m.Requires != 0 {
+        fmt.Printf("  %-14s %s\n", "Requires:", m.Requires)
+    }
+}
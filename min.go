@@ -0,0 +1,136 @@
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "os"
+    "strings"
+    "time"
+)
+
+// operatorChars lists every character the core language gives a meaning to
+const operatorChars = "+-*/[].,#"
+
+// decoyChars are inserted by 'flux min -decoy'. None of them is an
+// operator, in the core language or any extension, so they compile to
+// nothing.
+const decoyChars = "abcefghjkmnpquvyBJXZ0123456789"
+
+// isOperator reports whether the compiler gives b a meaning when the
+// extensions in exts are enabled
+func isOperator(b byte, exts ExtensionSet) bool {
+    if e, ok := extensionOps[b]; ok && exts&e.ext != 0 {
+        return true
+    }
+    return strings.IndexByte(operatorChars, b) >= 0
+}
+
+// takesName reports whether the operator b is followed by the name of a
+// register or the label of a data block when the extensions in exts are
+// enabled
+func takesName(b byte, exts ExtensionSet) bool {
+    e, ok := extensionOps[b]
+    return ok && exts&e.ext != 0 && (e.op == OpLoadReg || e.op == OpStoreReg || e.op == OpData)
+}
+
+// minify strips everything but operators from source and returns them as
+// tokens, which keep an operator together with the register or data block
+// it names. The shebang line and the header are left out; see minCommand.
+func minify(source string, exts ExtensionSet) []string {
+    var tokens []string
+    for i := headerLength(source); i < len(source); i++ {
+        if !isOperator(source[i], exts) {
+            continue
+        }
+        n := 1
+        if takesName(source[i], exts) && i+1 < len(source) {
+            n = 2
+        }
+        tokens = append(tokens, source[i:i+n])
+        i += n - 1
+    }
+    return tokens
+}
+
+// addDecoys mixes comment characters between tokens. Roughly one in two
+// tokens of the result is noise.
+func addDecoys(tokens []string, r *rand.Rand) []string {
+    var out []string
+    for _, t := range tokens {
+        for r.Intn(2) == 0 {
+            out = append(out, string(decoyChars[r.Intn(len(decoyChars))]))
+        }
+        out = append(out, t)
+    }
+    return out
+}
+
+// wrap joins tokens into lines of at most width characters, never
+// splitting a token
+func wrap(tokens []string, width int) string {
+    var b strings.Builder
+    col := 0
+    for _, t := range tokens {
+        if width > 0 && col > 0 && col+len(t) > width {
+            b.WriteByte('\n')
+            col = 0
+        }
+        b.WriteString(t)
+        col += len(t)
+    }
+    return b.String()
+}
+
+// minCommand implements 'flux min'
+func minCommand(args []string) {
+    fs := commandFlags("min")
+    width := fs.Int("w", 0, "wrap the output at `n` columns (0 = a single line)")
+    decoy := fs.Bool("decoy", false, "inject random comment characters between operators")
+    seed := fs.Int64("seed", 0, "random `seed` for -decoy (0 = derive from the clock)")
+    output := fs.String("o", "", "write the result to `file` instead of standard output")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to minify")
+        printUsage("min")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+
+    // Refuse to minify programs that do not compile: stripping would hide
+    // where the unbalanced bracket was
+    if _, err := source.compiler(string(data)).Compile(); err != nil {
+        fmt.Printf("Compilation error: %v\n", err)
+        return
+    }
+
+    tokens := minify(string(data), source.extensions)
+    if *decoy {
+        if *seed == 0 {
+            *seed = time.Now().UnixNano()
+        }
+        tokens = addDecoys(tokens, rand.New(rand.NewSource(*seed)))
+    }
+    // The shebang line stays, so the result still runs directly, and so
+    // does the header, since it lays out the data blocks and the compiler
+    // checks its requirements
+    code := string(data[:headerLength(data)]) + wrap(tokens, *width) + "\n"
+
+    if *output == "" {
+        fmt.Print(code)
+        return
+    }
+    if err := os.WriteFile(*output, []byte(code), 0644); err != nil {
+        fmt.Printf("Error writing file '%s': %v\n", *output, err)
+    }
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+)
+
+// netConn is the TCP connection accepted by a program
+type netConn struct {
+    conn   net.Conn
+    reader *bufio.Reader
+}
+
+// SetNetAccess lets the net extension accept one TCP connection on addr,
+// such as ":8080"; the empty address, the default, refuses network access
+func (vm *VM) SetNetAccess(addr string) {
+    vm.netAddr = addr
+}
+
+// netAccept implements ACCEPT: it listens on the allowed address, waits
+// for a single connection and stops listening. The accumulator is set to
+// 1 once connected.
+func (vm *VM) netAccept() error {
+    if vm.netAddr == "" {
+        return fmt.Errorf("network access is disabled at %s (run with -allow-net :port)", vm.program.Location(vm.pc))
+    }
+    if vm.conn != nil {
+        return fmt.Errorf("ACCEPT at %s: a program may accept only one connection", vm.program.Location(vm.pc))
+    }
+    var lc net.ListenConfig
+    ln, err := lc.Listen(vm.ctx, "tcp", vm.netAddr)
+    if err != nil {
+        return fmt.Errorf("ACCEPT at %s: %v", vm.program.Location(vm.pc), err)
+    }
+    defer ln.Close()
+
+    // Closing the listener is the only way to abandon a blocked Accept
+    stop := make(chan struct{})
+    defer close(stop)
+    go func() {
+        select {
+        case <-vm.ctx.Done():
+            ln.Close()
+        case <-stop:
+        }
+    }()
+    conn, err := ln.Accept()
+    if err != nil {
+        if vm.ctx.Err() != nil {
+            err = vm.ctx.Err()
+        }
+        return fmt.Errorf("interrupted during ACCEPT at %s: %v", vm.program.Location(vm.pc), err)
+    }
+    vm.conn = &netConn{conn: conn, reader: bufio.NewReader(conn)}
+    vm.accumulator = 1
+    return nil
+}
+
+// connection returns the accepted connection, or an error naming op if
+// there is none
+func (vm *VM) connection(op OpCode) (*netConn, error) {
+    if vm.conn == nil {
+        return nil, fmt.Errorf("%s at %s: no connection has been accepted", op, vm.program.Location(vm.pc))
+    }
+    return vm.conn, nil
+}
+
+// netRead implements NREAD: it reads a byte from the connection into the
+// accumulator, or -1 once the peer has closed it
+func (vm *VM) netRead() error {
+    c, err := vm.connection(OpNetRead)
+    if err != nil {
+        return err
+    }
+    b, err := c.reader.ReadByte()
+    if err != nil {
+        vm.accumulator = -1
+        return nil
+    }
+    vm.accumulator = int(b)
+    return nil
+}
+
+// netWrite implements NWRITE: it sends the accumulator modulo 256 on the
+// connection
+func (vm *VM) netWrite() error {
+    c, err := vm.connection(OpNetWrite)
+    if err != nil {
+        return err
+    }
+    if _, err := c.conn.Write([]byte{byte(vm.accumulator % 256)}); err != nil {
+        return fmt.Errorf("NWRITE at %s: %v", vm.program.Location(vm.pc), err)
+    }
+    return nil
+}
+
+// closeConn closes the accepted connection, if any
+func (vm *VM) closeConn() error {
+    if vm.conn == nil {
+        return nil
+    }
+    err := vm.conn.conn.Close()
+    vm.conn = nil
+    return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+)
+
+// OperandKind says what the Arg of an instruction holds
+type OperandKind int
+
+const (
+    OperandNone     OperandKind = iota // Arg is unused
+    OperandTarget                      // Address of the instruction it jumps to
+    OperandNumber                      // A number to add to the accumulator
+    OperandConstant                    // Index into the constant pool
+    OperandRegister                    // Register number
+    OperandBlock                       // Number of the block it returns from
+    OperandData                        // Offset of a data block in the program's data
+)
+
+// operandKindNames holds the name of each operand kind, for listings and JSON
+var operandKindNames = [...]string{
+    OperandNone:     "none",
+    OperandTarget:   "target",
+    OperandNumber:   "number",
+    OperandConstant: "constant",
+    OperandRegister: "register",
+    OperandBlock:    "block",
+    OperandData:     "data",
+}
+
+// String returns the name of the operand kind
+func (k OperandKind) String() string {
+    if k >= 0 && int(k) < len(operandKindNames) {
+        return operandKindNames[k]
+    }
+    return fmt.Sprintf("OperandKind(%d)", int(k))
+}
+
+// OpInfo describes an opcode. The compiler, the disassembler, traces, the
+// debugger, the bytecode loader and 'flux opcodes' all take what they
+// know about opcodes from opTable.
+type OpInfo struct {
+    Mnemonic  string       // Name in listings and traces, such as "INC"
+    Operator  byte         // Source character it compiles from, or 0 if only the optimizer emits it
+    Operand   OperandKind  // What Arg holds
+    Extension ExtensionSet // Extension it belongs to, or 0 for the core language
+    Summary   string       // What it does, in a few words
+}
+
+// opTable describes every opcode, indexed by opcode. '#' compiles to
+// OUTF instead of OUTNUM when the float extension is enabled.
+var opTable = [...]OpInfo{
+    OpInc:       {"INC", '+', OperandNone, 0, "Increment accumulator"},
+    OpDec:       {"DEC", '-', OperandNone, 0, "Decrement accumulator"},
+    OpPush:      {"PUSH", '*', OperandNone, 0, "Push accumulator to stack"},
+    OpPop:       {"POP", '/', OperandNone, 0, "Pop stack to accumulator"},
+    OpLoop:      {"LOOP", '[', OperandTarget, 0, "Begin loop"},
+    OpEnd:       {"END", ']', OperandTarget, 0, "End loop"},
+    OpOut:       {"OUT", '.', OperandNone, 0, "Output as ASCII"},
+    OpIn:        {"IN", ',', OperandNone, 0, "Input character"},
+    OpOutNum:    {"OUTNUM", '#', OperandNone, 0, "Output as number"},
+    OpAdd:       {"ADD", 0, OperandNumber, 0, "Add Arg to accumulator"},
+    OpSet:       {"SET", 0, OperandConstant, 0, "Set accumulator to integer constant Arg"},
+    OpEmitBytes: {"EMIT", 0, OperandConstant, 0, "Write byte string constant Arg to output"},
+    OpProbe:     {"PROBE", '~', OperandNone, ExtProbe, "Set accumulator to 1 if input is ready, else 0"},
+    OpSleep:     {"SLEEP", 'z', OperandNone, ExtSleep, "Pause for accumulator milliseconds"},
+    OpClock:     {"CLOCK", 't', OperandNone, ExtClock, "Load milliseconds since the program started"},
+    OpTime:      {"TIME", 'T', OperandNone, ExtClock, "Load the Unix time in seconds"},
+    OpFileOpen:  {"OPEN", 'O', OperandNone, ExtFS, "Open the file named on the stack"},
+    OpFileRead:  {"READ", 'R', OperandNone, ExtFS, "Read a byte from the file on top of the stack"},
+    OpFileWrite: {"WRITE", 'W', OperandNone, ExtFS, "Write a byte to the file on top of the stack"},
+    OpFileClose: {"CLOSE", 'C', OperandNone, ExtFS, "Close the file on top of the stack"},
+    OpAnd:       {"AND", '&', OperandNone, ExtBitwise, "Accumulator AND popped value"},
+    OpOr:        {"OR", '|', OperandNone, ExtBitwise, "Accumulator OR popped value"},
+    OpXor:       {"XOR", '^', OperandNone, ExtBitwise, "Accumulator XOR popped value"},
+    OpShl:       {"SHL", '<', OperandNone, ExtBitwise, "Shift accumulator left by popped value"},
+    OpShr:       {"SHR", '>', OperandNone, ExtBitwise, "Shift accumulator right by popped value"},
+    OpIf:        {"IF", '(', OperandTarget, ExtIf, "Jump past the matching ELSE or ENDIF if acc == 0"},
+    OpElse:      {"ELSE", ':', OperandTarget, ExtIf, "Jump past the matching ENDIF"},
+    OpEndIf:     {"ENDIF", ')', OperandNone, ExtIf, "End of a conditional"},
+    OpBreak:     {"BREAK", '!', OperandTarget, ExtBreak, "Jump past the innermost loop's END"},
+    OpContinue:  {"CONTINUE", ';', OperandTarget, ExtBreak, "Jump to the innermost loop's END"},
+    OpPeek:      {"PEEK", 'L', OperandNone, ExtHeap, "Load the heap cell at the popped address and index"},
+    OpData:      {"DATA", '"', OperandData, ExtHeap, "Load the address of the data block at offset Arg"},
+    OpLoadReg:   {"LOAD", '$', OperandRegister, ExtRegisters, "Load register Arg into the accumulator"},
+    OpStoreReg:  {"STORE", '=', OperandRegister, ExtRegisters, "Store the accumulator in register Arg"},
+    OpDup:       {"DUP", 'd', OperandNone, ExtStack, "Duplicate the top of the stack"},
+    OpSwap:      {"SWAP", 's', OperandNone, ExtStack, "Swap the top two stack entries"},
+    OpRot:       {"ROT", 'r', OperandNone, ExtStack, "Rotate the third stack entry to the top"},
+    OpOver:      {"OVER", 'o', OperandNone, ExtStack, "Copy the second stack entry to the top"},
+    OpDepth:     {"DEPTH", '@', OperandNone, ExtStack, "Load the stack depth"},
+    OpDump:      {"DUMP", '?', OperandNone, ExtDump, "Write the machine state to the dump output"},
+    OpAssert:    {"ASSERT", 'A', OperandNone, ExtAssert, "Fail unless acc equals the popped value"},
+    OpQuote:     {"QUOTE", '{', OperandTarget, ExtEval, "Push the block's number and jump past its RET"},
+    OpReturn:    {"RET", '}', OperandBlock, ExtEval, "Return from block number Arg"},
+    OpExec:      {"EXEC", 'x', OperandNone, ExtEval, "Call the block whose number is popped"},
+    OpSpawn:     {"SPAWN", 'P', OperandNone, ExtCoroutine, "Start the popped block as a coroutine"},
+    OpSend:      {"SEND", 'S', OperandNone, ExtCoroutine, "Send acc to the popped coroutine and yield"},
+    OpReceive:   {"RECV", 'G', OperandNone, ExtCoroutine, "Receive a value, waiting for one if need be"},
+    OpTry:       {"TRY", 'Y', OperandTarget, ExtTrap, "Install a handler past the matching CATCH"},
+    OpCatch:     {"CATCH", 'H', OperandTarget, ExtTrap, "Remove the handler and jump past the matching ENDTRY"},
+    OpEndTry:    {"ENDTRY", 'E', OperandNone, ExtTrap, "End of a trap"},
+    OpAlloc:     {"ALLOC", 'N', OperandNone, ExtHeap, "Allocate acc heap cells and load the first's address"},
+    OpPoke:      {"POKE", 'K', OperandNone, ExtHeap, "Store acc in the heap cell at the popped address and index"},
+    OpToFloat:   {"FLOAT", 'F', OperandNone, ExtFloat, "Convert acc to a float"},
+    OpToInt:     {"INT", 'I', OperandNone, ExtFloat, "Convert acc to an integer, truncating"},
+    OpFAdd:      {"FADD", 'U', OperandNone, ExtFloat, "Add the popped float to acc"},
+    OpFSub:      {"FSUB", 'V', OperandNone, ExtFloat, "Subtract the popped float from acc"},
+    OpFMul:      {"FMUL", 'M', OperandNone, ExtFloat, "Multiply acc by the popped float"},
+    OpFDiv:      {"FDIV", 'D', OperandNone, ExtFloat, "Divide acc by the popped float"},
+    OpOutFloat:  {"OUTF", '#', OperandNone, ExtFloat, "Output acc as a float"},
+    OpAnsi:      {"ANSI", '%', OperandNone, ExtAnsi, "Output the terminal control acc selects"},
+    OpGetenv:    {"GETENV", 'Q', OperandNone, ExtEnv, "Push the value of the environment variable named on the stack"},
+    OpAccept:    {"ACCEPT", 'l', OperandNone, ExtNet, "Wait for a TCP connection"},
+    OpNetRead:   {"NREAD", 'i', OperandNone, ExtNet, "Read a byte from the connection"},
+    OpNetWrite:  {"NWRITE", 'w', OperandNone, ExtNet, "Write acc to the connection"},
+}
+
+// Info returns the description of the opcode, and false for a byte that
+// is not an opcode
+func (op OpCode) Info() (OpInfo, bool) {
+    if int(op) >= len(opTable) {
+        return OpInfo{}, false
+    }
+    return opTable[op], true
+}
+
+// Opcodes returns the description of every opcode, in opcode order
+func Opcodes() []OpInfo {
+    return append([]OpInfo(nil), opTable[:]...)
+}
+
+// String returns the mnemonic of the opcode
+func (op OpCode) String() string {
+    if info, ok := op.Info(); ok {
+        return info.Mnemonic
+    }
+    return fmt.Sprintf("OP(%d)", byte(op))
+}
+
+// opcodeByName looks up an opcode by its mnemonic
+func opcodeByName(name string) (OpCode, bool) {
+    for op, info := range opTable {
+        if info.Mnemonic == name {
+            return OpCode(op), true
+        }
+    }
+    return 0, false
+}
+
+// hasJumpTarget reports whether an instruction's Arg is the address of
+// another instruction
+func hasJumpTarget(op OpCode) bool {
+    info, _ := op.Info()
+    return info.Operand == OperandTarget
+}
+
+// valueOperand formats the value an instruction carries for listings,
+// looking constants up in pool, or returns "" for instructions without one
+func valueOperand(inst Instruction, pool *ConstPool) string {
+    info, _ := inst.Op.Info()
+    switch info.Operand {
+    case OperandNumber, OperandBlock, OperandData:
+        return fmt.Sprint(inst.Arg)
+    case OperandConstant:
+        c, err := pool.At(inst.Arg)
+        if err != nil {
+            return fmt.Sprintf("#%d (invalid)", inst.Arg)
+        }
+        return c.String()
+    case OperandRegister:
+        if inst.Arg < 0 || inst.Arg >= NumRegisters {
+            return fmt.Sprintf("%d (invalid)", inst.Arg)
+        }
+        return registerNames[inst.Arg : inst.Arg+1]
+    }
+    return ""
+}
+
+// opcodesCommand implements 'flux opcodes', which lists the instruction
+// set from opTable, as a table or as JSON for other tools
+func opcodesCommand(args []string) {
+    fs := commandFlags("opcodes")
+    asJSON := fs.Bool("json", false, "print the opcodes as JSON")
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) > 0 {
+        fmt.Println("Error: Please specify no arguments")
+        printUsage("opcodes")
+        return
+    }
+
+    if *asJSON {
+        type listedOpcode struct {
+            Code      int    `json:"code"`
+            Mnemonic  string `json:"mnemonic"`
+            Operator  string `json:"operator,omitempty"` // Absent for opcodes only the optimizer emits
+            Operand   string `json:"operand"`
+            Extension string `json:"extension,omitempty"` // Absent for the core language
+            Summary   string `json:"summary"`
+        }
+        list := []listedOpcode{}
+        for op, info := range opTable {
+            l := listedOpcode{Code: op, Mnemonic: info.Mnemonic, Operand: info.Operand.String(), Summary: info.Summary}
+            if info.Operator != 0 {
+                l.Operator = string(info.Operator)
+            }
+            if info.Extension != 0 {
+                l.Extension = info.Extension.String()
+            }
+            list = append(list, l)
+        }
+        out, _ := json.MarshalIndent(list, "", "  ")
+        fmt.Println(string(out))
+        return
+    }
+
+    fmt.Println("Code  Mnemonic  Char  Operand   Extension   Summary")
+    for op, info := range opTable {
+        char, ext := "", "-"
+        if info.Operator != 0 {
+            char = string(info.Operator)
+        }
+        if info.Extension != 0 {
+            ext = info.Extension.String()
+        }
+        fmt.Printf("%4d  %-8s  %-4s  %-8s  %-10s  %s\n", op, info.Mnemonic, char, info.Operand, ext, info.Summary)
+    }
+}
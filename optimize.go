@@ -0,0 +1,711 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "math/big"
+    "strconv"
+)
+
+// bulkOutputMin is how many instructions a stretch of known output must
+// span to be fused at -O0
+const bulkOutputMin = 256
+
+// unrollGrowthLimit caps how many instructions unrolling a single loop may
+// add to the program
+const unrollGrowthLimit = 256
+
+// OptNote records one change made by an optimization pass
+type OptNote struct {
+    Pass    string // Name of the pass
+    Pos     int    // Source offset the change applies to, or -1
+    Message string // What was done
+}
+
+// OptReport summarizes what the optimizer did to a program
+type OptReport struct {
+    Level  int       // Optimization level that was applied
+    Before int       // Instruction count before optimization
+    After  int       // Instruction count after optimization
+    Notes  []OptNote // Changes in the order they were made
+}
+
+// note adds an entry to the report
+func (r *OptReport) note(pass string, pos int, format string, args ...interface{}) {
+    r.Notes = append(r.Notes, OptNote{Pass: pass, Pos: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+// Print writes the report to w, locating notes in the source recorded in
+// debug, if any
+func (r *OptReport) Print(w io.Writer, debug *DebugInfo) {
+    fmt.Fprintf(w, "Optimization report (-O%d): %d → %d instructions\n", r.Level, r.Before, r.After)
+    for _, n := range r.Notes {
+        where := ""
+        if n.Pos >= 0 && debug != nil {
+            line, col := lineCol(debug.Source, n.Pos)
+            where = fmt.Sprintf("%d:%d", line, col)
+        }
+        fmt.Fprintf(w, "  %-8s %-8s %s\n", n.Pass, where, n.Message)
+    }
+}
+
+// optimizer holds a program while the passes rewrite it. Every pass keeps
+// positions aligned with instructions, so listings, traces and core files
+// of optimized programs still point at the right source.
+type optimizer struct {
+    instructions []Instruction
+    positions    []int
+    pool         *ConstPool // Receives the constants of new SET and EMIT instructions
+    report       *OptReport
+}
+
+// optPass is one rewrite, enabled from the given optimization level up
+type optPass struct {
+    name  string
+    level int
+    run   func(o *optimizer)
+}
+
+// optPasses lists the passes in the order they run
+var optPasses = []optPass{
+    {"bulk", 0, (*optimizer).fuseBulkOutput},
+    {"fold", 1, (*optimizer).fold},
+    {"clear", 1, (*optimizer).clearLoops},
+    {"unroll", 2, (*optimizer).unroll},
+    {"dce", 2, (*optimizer).eliminateDeadCode},
+    {"once", 2, (*optimizer).unwrapOnce},
+    {"const", 1, (*optimizer).propagate},
+    {"emit", 1, (*optimizer).fuseOutput},
+    {"dce", 2, (*optimizer).eliminateDeadCode}, // Again, for arithmetic left behind by fusion
+}
+
+// Optimize rewrites a program into an equivalent one at the given level:
+// 0 only fuses long stretches of known output, 1 folds arithmetic, recognizes clear loops,
+// propagates constants and fuses constant output, 2 also unrolls loops
+// with a known trip count, removes dead code and unwraps loops that run
+// exactly once. The result shares the
+// original's constant pool, which receives the constants new instructions
+// need. Programs produce identical output; at level 1 they also end in the
+// same state, while level 2 may drop values that are never used.
+func Optimize(program *Program, level int) (*Program, *OptReport) {
+    o := &optimizer{
+        instructions: append([]Instruction(nil), program.Instructions...),
+        pool:         program.Constants,
+        report:       &OptReport{Level: level, Before: len(program.Instructions)},
+    }
+    program.decodeDebug()
+    if program.Debug != nil {
+        o.positions = append([]int(nil), program.Debug.Positions...)
+    } else {
+        o.positions = make([]int, len(program.Instructions)) // Passes keep this aligned, but it is discarded
+    }
+    for _, pass := range optPasses {
+        if level >= pass.level {
+            pass.run(o)
+            relink(o.instructions)
+        }
+    }
+    o.report.After = len(o.instructions)
+
+    optimized := *program
+    optimized.Instructions = o.instructions
+    if program.Debug != nil {
+        debug := *program.Debug
+        debug.Positions = o.positions
+        optimized.Debug = &debug
+    }
+    return &optimized, o.report
+}
+
+// set returns an instruction that loads v into the accumulator
+func (o *optimizer) set(v int) Instruction {
+    return Instruction{Op: OpSet, Arg: o.pool.AddInt(big.NewInt(int64(v)))}
+}
+
+// fold replaces runs of increments and decrements with a single ADD, or
+// with nothing when they cancel out
+func (o *optimizer) fold() {
+    var out []Instruction
+    var pos []int
+    folded := 0
+    for i := 0; i < len(o.instructions); i++ {
+        start, delta := i, 0
+        for ; i < len(o.instructions); i++ {
+            if d, ok := accDelta(o.instructions[i]); ok {
+                delta += d
+            } else {
+                break
+            }
+        }
+        if i-start > 1 {
+            folded++
+            if delta != 0 {
+                out = append(out, Instruction{Op: OpAdd, Arg: delta})
+                pos = append(pos, o.positions[start])
+            }
+        } else if i > start {
+            out = append(out, o.instructions[start])
+            pos = append(pos, o.positions[start])
+        }
+        if i < len(o.instructions) {
+            out = append(out, o.instructions[i])
+            pos = append(pos, o.positions[i])
+        }
+    }
+    if folded > 0 {
+        o.report.note("fold", -1, "%d run(s) of +/- folded into ADD", folded)
+    }
+    o.instructions, o.positions = out, pos
+}
+
+// accDelta reports how much an instruction adds to the accumulator, if it
+// only adds a constant
+func accDelta(inst Instruction) (int, bool) {
+    switch inst.Op {
+    case OpInc:
+        return 1, true
+    case OpDec:
+        return -1, true
+    case OpAdd:
+        return inst.Arg, true
+    }
+    return 0, false
+}
+
+// coreOp reports whether op is one of the instructions the optimizer
+// understands. Extension instructions may read and change the accumulator
+// and the stack in ways it cannot see, so every pass treats them as
+// barriers.
+func coreOp(op OpCode) bool {
+    switch op {
+    case OpInc, OpDec, OpPush, OpPop, OpLoop, OpEnd, OpOut, OpIn, OpOutNum, OpAdd, OpSet, OpEmitBytes:
+        return true
+    }
+    return false
+}
+
+// mayPop reports whether an instruction may take a value off the stack
+func mayPop(op OpCode) bool {
+    return op == OpPop || !coreOp(op)
+}
+
+// clearLoops replaces [-] and [+], which only run the accumulator down to
+// zero, with SET 0
+func (o *optimizer) clearLoops() {
+    var out []Instruction
+    var pos []int
+    for i := 0; i < len(o.instructions); i++ {
+        if _, ok := clearLoopStep(o.instructions, i); ok {
+            o.report.note("clear", o.positions[i], "clear loop replaced with SET 0")
+            out = append(out, o.set(0))
+            pos = append(pos, o.positions[i])
+            i += 2
+            continue
+        }
+        out = append(out, o.instructions[i])
+        pos = append(pos, o.positions[i])
+    }
+    o.instructions, o.positions = out, pos
+}
+
+// clearLoopStep reports whether the instructions at i are a clear loop,
+// [-] or [+], and returns what its body adds
+func clearLoopStep(instructions []Instruction, i int) (int, bool) {
+    if i+2 < len(instructions) && instructions[i].Op == OpLoop && instructions[i+2].Op == OpEnd {
+        if d, ok := accDelta(instructions[i+1]); ok && (d == 1 || d == -1) {
+            return d, true
+        }
+    }
+    return 0, false
+}
+
+// accState is what the optimizer knows about one value: the accumulator
+// or a stack entry
+type accState struct {
+    known bool
+    value int
+}
+
+// machineState is the optimizer's view of the machine between instructions
+type machineState struct {
+    acc   accState
+    stack []accState // Entries known to be on top of the stack, bottom first
+    floor bool       // Whether the stack below those entries is known to be empty
+}
+
+// clone returns a copy that can be changed independently
+func (m machineState) clone() machineState {
+    m.stack = append([]accState(nil), m.stack...)
+    return m
+}
+
+// knownAcc propagates constants through the program and returns the
+// accumulator's state before each instruction. Values are known at the
+// start of the program, after SET, after arithmetic on a known value and
+// after a pop of a known stack entry; every loop exits with zero unless
+// it breaks out, which makes the whole state unknown. The stack is
+// tracked too, and survives loops whose bodies leave it balanced. Input
+// and loop bodies, which may be reached again from the loop's end, make
+// the accumulator unknown.
+func knownAcc(instructions []Instruction, pool *ConstPool) []accState {
+    states := make([]accState, len(instructions))
+    st := machineState{acc: accState{known: true}, floor: true}
+    var saved []machineState // State on entry to each open loop
+    for i, inst := range instructions {
+        states[i] = st.acc
+        switch inst.Op {
+        case OpInc, OpDec, OpAdd:
+            d, _ := accDelta(inst)
+            st.acc.value += d
+        case OpSet:
+            v, err := pool.IntValue(inst.Arg)
+            st.acc = accState{known: err == nil, value: v}
+        case OpPush:
+            st.stack = append(st.stack, st.acc)
+        case OpPop:
+            if n := len(st.stack); n > 0 {
+                st.acc = st.stack[n-1]
+                st.stack = st.stack[:n-1]
+            } else {
+                st.acc = accState{known: st.floor} // Popping an empty stack yields zero
+            }
+        case OpIn:
+            st.acc = accState{}
+        case OpLoop:
+            saved = append(saved, st.clone())
+            if !stackBalanced(instructions, i) {
+                st.stack, st.floor = nil, false
+            }
+            st.acc = accState{}
+        case OpEnd:
+            entry := saved[len(saved)-1]
+            saved = saved[:len(saved)-1]
+            if entry.acc.known && entry.acc.value == 0 || stackBalanced(instructions, inst.Arg) {
+                st = entry
+            } else {
+                st.stack, st.floor = nil, false
+            }
+            st.acc = accState{known: true}
+            if hasBreak(instructions, inst.Arg) {
+                st = machineState{}
+            }
+        default:
+            if !coreOp(inst.Op) {
+                st = machineState{}
+            }
+        }
+    }
+    return states
+}
+
+// hasBlock reports whether the loop at start contains a block of the eval
+// extension
+func hasBlock(instructions []Instruction, start int) bool {
+    for i := start + 1; i < instructions[start].Arg; i++ {
+        if instructions[i].Op == OpQuote {
+            return true
+        }
+    }
+    return false
+}
+
+// hasBreak reports whether the loop at start has a BREAK of its own, as
+// opposed to one of a loop nested in it
+func hasBreak(instructions []Instruction, start int) bool {
+    return hasLoopExit(instructions, start, OpBreak)
+}
+
+// hasContinue reports whether the loop at start has a CONTINUE of its own
+func hasContinue(instructions []Instruction, start int) bool {
+    return hasLoopExit(instructions, start, OpContinue)
+}
+
+// hasLoopExit reports whether the loop at start has an op, BREAK or
+// CONTINUE, of its own
+func hasLoopExit(instructions []Instruction, start int, op OpCode) bool {
+    for i := start + 1; i < instructions[start].Arg; i++ {
+        switch instructions[i].Op {
+        case OpLoop:
+            i = instructions[i].Arg
+        case op:
+            return true
+        }
+    }
+    return false
+}
+
+// stackBalanced reports whether the body of the loop at start leaves the
+// stack as deep as it found it and never pops below that depth, so the
+// entries beneath are untouched however often it runs
+func stackBalanced(instructions []Instruction, start int) bool {
+    depth := 0
+    for i := start + 1; i < instructions[start].Arg; i++ {
+        switch instructions[i].Op {
+        case OpPush:
+            depth++
+        case OpPop:
+            depth--
+            if depth < 0 {
+                return false
+            }
+        case OpLoop:
+            if !stackBalanced(instructions, i) {
+                return false
+            }
+            i = instructions[i].Arg
+        default:
+            if !coreOp(instructions[i].Op) {
+                return false
+            }
+        }
+    }
+    return depth == 0
+}
+
+// propagate rewrites runs of arithmetic whose result is known at compile
+// time into a single SET, and drops runs that leave a known accumulator
+// unchanged
+func (o *optimizer) propagate() {
+    var out []Instruction
+    var pos []int
+    states := knownAcc(o.instructions, o.pool)
+    folded, dropped := 0, 0
+    for i := 0; i < len(o.instructions); i++ {
+        start := i
+        st := states[i]
+        for ; i < len(o.instructions); i++ {
+            inst := o.instructions[i]
+            if d, ok := accDelta(inst); ok {
+                st.value += d
+            } else if inst.Op == OpSet {
+                v, err := o.pool.IntValue(inst.Arg)
+                st = accState{known: err == nil, value: v}
+            } else {
+                break
+            }
+        }
+
+        switch {
+        case i == start:
+        case st.known && states[start].known && st.value == states[start].value:
+            dropped++
+        case st.known && i-start > 1:
+            folded++
+            out = append(out, o.set(st.value))
+            pos = append(pos, o.positions[start])
+        default:
+            out = append(out, o.instructions[start:i]...)
+            pos = append(pos, o.positions[start:i]...)
+        }
+        if i < len(o.instructions) {
+            out = append(out, o.instructions[i])
+            pos = append(pos, o.positions[i])
+        }
+    }
+    if folded > 0 {
+        o.report.note("const", -1, "%d run(s) of arithmetic with a known result folded into SET", folded)
+    }
+    if dropped > 0 {
+        o.report.note("const", -1, "%d run(s) of arithmetic that leave the accumulator unchanged removed", dropped)
+    }
+    o.instructions, o.positions = out, pos
+}
+
+// unroll replaces loops whose trip count is known at compile time with
+// that many copies of their body. A loop qualifies when it is entered with
+// a known accumulator, its body reads no input, contains no loops and
+// leaves the stack as it found it, and the copies stay within
+// unrollGrowthLimit.
+func (o *optimizer) unroll() {
+    var out []Instruction
+    var pos []int
+    states := knownAcc(o.instructions, o.pool)
+    for i := 0; i < len(o.instructions); i++ {
+        inst := o.instructions[i]
+        if st := states[i]; inst.Op == OpLoop && st.known && st.value != 0 {
+            if trips, ok := o.tripCount(i, st.value); ok {
+                end := inst.Arg
+                for t := 0; t < trips; t++ {
+                    out = append(out, o.instructions[i+1:end]...)
+                    pos = append(pos, o.positions[i+1:end]...)
+                }
+                o.report.note("unroll", o.positions[i], "loop unrolled %d time(s) (%+d instructions)",
+                    trips, trips*(end-i-1)-(end-i+1))
+                i = end
+                continue
+            }
+        }
+        out = append(out, inst)
+        pos = append(pos, o.positions[i])
+    }
+    o.instructions, o.positions = out, pos
+}
+
+// tripCount runs the body of the loop at start with the accumulator set to
+// acc and returns how many iterations it takes to exit, if the loop
+// qualifies for unrolling
+func (o *optimizer) tripCount(start, acc int) (int, bool) {
+    body := o.instructions[start+1 : o.instructions[start].Arg]
+    if len(body) == 0 {
+        return 0, false
+    }
+    for _, inst := range body {
+        switch inst.Op {
+        case OpLoop, OpEnd, OpIn:
+            return 0, false
+        }
+        if !coreOp(inst.Op) {
+            return 0, false
+        }
+    }
+
+    trips := 0
+    for acc != 0 {
+        if (trips+1)*len(body)-(len(body)+2) > unrollGrowthLimit {
+            return 0, false
+        }
+        var stack []int
+        for _, inst := range body {
+            switch inst.Op {
+            case OpInc, OpDec, OpAdd:
+                d, _ := accDelta(inst)
+                acc += d
+            case OpSet:
+                v, err := o.pool.IntValue(inst.Arg)
+                if err != nil {
+                    return 0, false
+                }
+                acc = v
+            case OpPush:
+                stack = append(stack, acc)
+            case OpPop:
+                if len(stack) == 0 {
+                    return 0, false // Reaches below the loop's own values
+                }
+                acc = stack[len(stack)-1]
+                stack = stack[:len(stack)-1]
+            }
+        }
+        if len(stack) != 0 {
+            return 0, false
+        }
+        trips++
+    }
+    return trips, true
+}
+
+// eliminateDeadCode removes instructions that cannot affect the program's
+// output: loops that are never entered because the accumulator is known to
+// be zero, pushes whose value is never popped, and trailing arithmetic
+// after the last input or output
+func (o *optimizer) eliminateDeadCode() {
+    dead := make([]bool, len(o.instructions))
+
+    // Loops entered with a zero accumulator jump straight past their end,
+    // but blocks of the eval extension in them may still be executed by
+    // number
+    states := knownAcc(o.instructions, o.pool)
+    loops := 0
+    for i := 0; i < len(o.instructions); i++ {
+        if inst := o.instructions[i]; inst.Op == OpLoop && states[i].known && states[i].value == 0 && !hasBlock(o.instructions, i) {
+            for j := i; j <= inst.Arg; j++ {
+                dead[j] = true
+            }
+            o.report.note("dce", o.positions[i], "removed loop that is never entered (%d instructions)", inst.Arg-i+1)
+            loops++
+            i = inst.Arg
+        }
+    }
+
+    // A push is dead if no pop can execute after it: none follows it in the
+    // program and none precedes it in an enclosing loop, which could run
+    // again on the next iteration
+    pops := 0
+    for i, inst := range o.instructions {
+        if mayPop(inst.Op) && !dead[i] {
+            pops++
+        }
+    }
+    var open []int
+    pushes := 0
+    for i, inst := range o.instructions {
+        if dead[i] {
+            continue
+        }
+        switch inst.Op {
+        case OpLoop:
+            open = append(open, i)
+        case OpEnd:
+            open = open[:len(open)-1]
+        case OpPush:
+            if pops > 0 || loopHasPop(o.instructions, dead, open) {
+                continue
+            }
+            dead[i] = true
+            pushes++
+        default:
+            if mayPop(inst.Op) {
+                pops--
+            }
+        }
+    }
+    if pushes > 0 {
+        o.report.note("dce", -1, "removed %d push(es) whose value is never popped", pushes)
+    }
+
+    // Arithmetic after the last input or output has no visible effect
+    trailing := 0
+    for i := len(o.instructions) - 1; i >= 0; i-- {
+        if dead[i] {
+            continue
+        }
+        switch o.instructions[i].Op {
+        case OpInc, OpDec, OpAdd, OpSet, OpPush:
+            dead[i] = true
+            trailing++
+            continue
+        }
+        break
+    }
+    if trailing > 0 {
+        o.report.note("dce", -1, "removed %d trailing instruction(s) with no visible effect", trailing)
+    }
+
+    var out []Instruction
+    var pos []int
+    for i, inst := range o.instructions {
+        if !dead[i] {
+            out = append(out, inst)
+            pos = append(pos, o.positions[i])
+        }
+    }
+    o.instructions, o.positions = out, pos
+}
+
+// unwrapOnce replaces loops that run exactly once by their body: the
+// accumulator ranges show that it is never 0 on entry and always 0 at the
+// loop's end, as in a body that ends by clearing it. A loop with a BREAK
+// or CONTINUE of its own keeps its END, which they jump to.
+func (o *optimizer) unwrapOnce() {
+    ranges := accRanges(o.instructions, o.pool)
+    unwrap := make([]bool, len(o.instructions))
+    for i, inst := range o.instructions {
+        if inst.Op == OpLoop && !ranges[i].empty() && !ranges[i].contains(0) &&
+            ranges[inst.Arg] == pointRange(0) && !hasBreak(o.instructions, i) && !hasContinue(o.instructions, i) {
+            unwrap[i], unwrap[inst.Arg] = true, true
+            o.report.note("once", o.positions[i], "unwrapped loop that runs exactly once")
+        }
+    }
+    var out []Instruction
+    var pos []int
+    for i, inst := range o.instructions {
+        if !unwrap[i] {
+            out = append(out, inst)
+            pos = append(pos, o.positions[i])
+        }
+    }
+    o.instructions, o.positions = out, pos
+}
+
+// loopHasPop reports whether any of the loops starting at open contains a
+// pop that has not been eliminated
+func loopHasPop(instructions []Instruction, dead []bool, open []int) bool {
+    for _, start := range open {
+        for i := start; i < instructions[start].Arg; i++ {
+            if mayPop(instructions[i].Op) && !dead[i] {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// fuseOutput replaces stretches of code that write values known at compile
+// time, together with the arithmetic between them, by a single EMIT of the
+// bytes they produce, followed by a SET of the accumulator they leave
+// behind when it differs from the value they started with
+func (o *optimizer) fuseOutput() {
+    o.fuse("emit", 0)
+}
+
+// fuseBulkOutput fuses only stretches of at least bulkOutputMin
+// instructions. It runs at every level, since the programs generators
+// write to print a banner or a page of text spell each character out in
+// + and - and take hundreds of thousands of steps for static output.
+func (o *optimizer) fuseBulkOutput() {
+    o.fuse("bulk", bulkOutputMin)
+}
+
+// fuse replaces the stretches of known output that span at least minLen
+// instructions, for fuseOutput and fuseBulkOutput. A stretch may start
+// at a SET in an unknown state, and passes clear loops, which leave 0.
+func (o *optimizer) fuse(pass string, minLen int) {
+    var out []Instruction
+    var pos []int
+    states := knownAcc(o.instructions, o.pool)
+    for i := 0; i < len(o.instructions); i++ {
+        start, acc := i, states[i].value
+        known := states[i].known || o.instructions[i].Op == OpSet
+        var data []byte
+        last, lastAcc := -1, 0 // Last output in the stretch and the accumulator there
+    scan:
+        for j := i; j < len(o.instructions) && known; j++ {
+            inst := o.instructions[j]
+            if d, ok := accDelta(inst); ok {
+                acc += d
+                continue
+            }
+            switch inst.Op {
+            case OpSet:
+                v, err := o.pool.IntValue(inst.Arg)
+                if err != nil {
+                    break scan
+                }
+                acc = v
+                continue
+            case OpLoop:
+                // Only a clear loop that counts toward 0, rather than the
+                // long way round
+                if d, ok := clearLoopStep(o.instructions, j); !ok || acc*d > 0 {
+                    break scan
+                }
+                acc = 0
+                j += 2
+                continue
+            case OpOut:
+                data = append(data, byte(acc%256))
+            case OpOutNum:
+                data = strconv.AppendInt(data, int64(acc), 10)
+            case OpEmitBytes:
+                c, err := o.pool.At(inst.Arg)
+                if err != nil || c.IsInt() {
+                    break scan
+                }
+                data = append(data, c.Bytes...)
+            default:
+                break scan
+            }
+            last, lastAcc = j, acc
+        }
+
+        size := 1
+        if !states[start].known || lastAcc != states[start].value {
+            size++
+        }
+        if last < 0 || size >= last-start+1 || last-start+1 < minLen {
+            out = append(out, o.instructions[i])
+            pos = append(pos, o.positions[i])
+            continue
+        }
+
+        out = append(out, Instruction{Op: OpEmitBytes, Arg: o.pool.AddBytes(data)})
+        pos = append(pos, o.positions[start])
+        if size > 1 {
+            out = append(out, o.set(lastAcc))
+            pos = append(pos, o.positions[last])
+        }
+        o.report.note(pass, o.positions[start], "%d instruction(s) fused into EMIT %q", last-start+1, data)
+        i = last
+    }
+    o.instructions, o.positions = out, pos
+}
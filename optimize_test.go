@@ -0,0 +1,126 @@
+package main
+
+import (
+    "bytes"
+    "slices"
+    "strings"
+    "testing"
+)
+
+// runOptimized compiles source, optimizes it at level and runs it on input
+func runOptimized(t *testing.T, source string, exts ExtensionSet, level int, input string) (*VM, string, error) {
+    t.Helper()
+    compiler := NewCompiler(source)
+    compiler.SetExtensions(exts)
+    program, err := compiler.Compile()
+    if err != nil {
+        t.Fatal(err)
+    }
+    program, _ = Optimize(program, level)
+    var out bytes.Buffer
+    vm := NewVM(program, strings.NewReader(input), &out)
+    vm.SetExtensions(exts)
+    vm.SetMaxSteps(100000)
+    err = vm.Run()
+    return vm, out.String(), err
+}
+
+func TestOptimize(t *testing.T) {
+    var ascending []byte // Written by the bulk output case
+    for i := 1; i <= 130; i++ {
+        ascending = append(ascending, byte(i))
+    }
+    tests := []struct {
+        name   string
+        source string
+        exts   ExtensionSet
+        input  string
+        output string
+    }{
+        {"fold", "+++--#", 0, "", "1"},
+        {"clear loop", "+++[-]#-[+]#", 0, "", "00"},
+        {"clear loop of input", ",[-]+#", 0, "A", "1"},
+        {"unrolled countdown", "+++[#-]", 0, "", "321"},
+        {"loop run once", "+[#-]", 0, "", "1"},
+        {"known output", strings.Repeat("+", 48) + ".+.+.", 0, "", "012"},
+        {"bulk output", strings.Repeat("+.", 130), 0, "", string(ascending)},
+        {"loop left on input", ",[#-]", 0, "\x03", "321"},
+        {"stack survives a clear loop", "+++*[-]/#", 0, "", "3"},
+        {"constant through the stack", "++*---/#*/-#", 0, "", "21"},
+        {"dead arithmetic before a push", "++[-]+++*-/#", 0, "", "3"},
+        {"nested countdown", "++[*++[#-]/-]", 0, "", "4321321"},
+        {"break in a countdown", "+++[-#!]", ExtBreak, "", "2"},
+        {"continue past a push", "---[#+-+-+;-/[]]", ExtBreak, "", "-3-2-1"},
+        {"continue in a nested loop", "+[+[-#;[+*#/+]]]", ExtBreak, "", "10"},
+        {"block called in a loop", "+{#}*x-[{+#}*x]", ExtEval, "", "1"},
+        {"loop with a block", "+*x[-][{-#}]", ExtEval, "", "0"},
+        {"conditional in a loop", "+++[(#:)-]", ExtIf, "", "321"},
+        {"registers across a loop", "+++=a[-]$a#", ExtRegisters, "", "3"},
+        {"data block", "%data a \"Hi\"\n\"a*[-]*L.\"a*[-]+*L.", ExtHeap, "", "Hi"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            reference, _, _ := runOptimized(t, tt.source, tt.exts, 0, tt.input)
+            for level := 0; level <= 2; level++ {
+                vm, output, err := runOptimized(t, tt.source, tt.exts, level, tt.input)
+                if err != nil {
+                    t.Fatalf("-O%d: %v", level, err)
+                }
+                if output != tt.output {
+                    t.Errorf("-O%d: output %q, want %q", level, output, tt.output)
+                }
+                // -O2 may drop values the program never uses
+                if level < 2 && vm.Accumulator() != reference.Accumulator() || !slices.Equal(vm.Stack(), reference.Stack()) {
+                    t.Errorf("-O%d: acc %d, stack %v; want %d, %v", level, vm.Accumulator(), vm.Stack(), reference.Accumulator(), reference.Stack())
+                }
+            }
+        })
+    }
+}
+
+func TestOptimizePasses(t *testing.T) {
+    tests := []struct {
+        source string
+        level  int
+        passes []string // Passes noted in the report, in order
+        after  int      // Instructions left
+    }{
+        {"+++--#", 0, nil, 6},
+        {"+++--#", 1, []string{"fold"}, 2},
+        {"+++[-]#", 1, []string{"fold", "clear", "const"}, 1},
+        {",[-]+#", 1, []string{"clear", "const"}, 3},
+        {"+++[#-]", 1, []string{"fold"}, 5},
+        {"+++[#-]", 2, []string{"fold", "unroll", "dce", "emit", "dce"}, 1},
+        {"+[#-]", 1, nil, 5},
+        {"+[#-]", 2, []string{"unroll", "dce"}, 2},
+        {"+++[-]++", 2, []string{"fold", "clear", "dce"}, 0},
+        {"+++*[-]/#", 2, []string{"fold", "clear"}, 5},
+        {"+*/-#", 2, nil, 5},
+    }
+    for _, tt := range tests {
+        t.Run(tt.source, func(t *testing.T) {
+            program, err := NewCompiler(tt.source).Compile()
+            if err != nil {
+                t.Fatal(err)
+            }
+            optimized, report := Optimize(program, tt.level)
+            var passes []string
+            for _, n := range report.Notes {
+                passes = append(passes, n.Pass)
+            }
+            if !slices.Equal(passes, tt.passes) {
+                t.Errorf("-O%d: passes %v, want %v", tt.level, passes, tt.passes)
+            }
+            if len(optimized.Instructions) != tt.after || report.After != tt.after || report.Before != len(program.Instructions) {
+                t.Errorf("-O%d: %d → %d instructions (report %d → %d), want %d after", tt.level,
+                    len(program.Instructions), len(optimized.Instructions), report.Before, report.After, tt.after)
+            }
+            if optimized.Debug == nil || len(optimized.Debug.Positions) != len(optimized.Instructions) {
+                t.Errorf("positions not kept aligned with the instructions")
+            }
+            if len(program.Instructions) != report.Before {
+                t.Errorf("Optimize changed the program it was given")
+            }
+        })
+    }
+}
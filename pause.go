@@ -0,0 +1,57 @@
+package main
+
+import "fmt"
+
+// Pause asks the running program to stop until Resume is called. It is
+// safe to call from any goroutine and returns at once; the machine stops
+// at its next check of its context, within a few instructions, and
+// Paused then reports true. Under Start an EventPause is sent when it
+// does, after which the machine's state can be inspected.
+func (vm *VM) Pause() {
+    vm.pauseMu.Lock()
+    defer vm.pauseMu.Unlock()
+    if vm.resume == nil {
+        vm.resume = make(chan struct{})
+    }
+}
+
+// Resume lets a paused program continue, or withdraws a pause that has
+// not taken effect yet. It is safe to call from any goroutine.
+func (vm *VM) Resume() {
+    vm.pauseMu.Lock()
+    defer vm.pauseMu.Unlock()
+    if vm.resume != nil {
+        close(vm.resume)
+        vm.resume = nil
+    }
+}
+
+// Paused reports whether the program has stopped at a pause
+func (vm *VM) Paused() bool {
+    return vm.paused.Load()
+}
+
+// checkpoint is where the running program notices a cancelled context or
+// a requested pause. A paused program waits here until it is resumed or
+// its context is cancelled.
+func (vm *VM) checkpoint() error {
+    vm.pauseMu.Lock()
+    resume := vm.resume
+    vm.pauseMu.Unlock()
+    if resume != nil {
+        vm.Flush() // Show the output that led up to the pause
+        vm.paused.Store(true)
+        if vm.onPause != nil {
+            vm.onPause()
+        }
+        select {
+        case <-resume:
+        case <-vm.ctx.Done():
+        }
+        vm.paused.Store(false)
+    }
+    if err := vm.ctx.Err(); err != nil {
+        return fmt.Errorf("interrupted at %s: %w", vm.program.Location(vm.pc), err)
+    }
+    return nil
+}
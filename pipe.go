@@ -0,0 +1,136 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "sync"
+    "sync/atomic"
+    "syscall"
+)
+
+// pipeCommand implements 'flux pipe', which runs programs side by side
+// with the output of each feeding the input of the next
+func pipeCommand(args []string) {
+    var opts runOptions
+    fs := commandFlags("pipe")
+    opts.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) < 2 {
+        fmt.Println("Error: Please specify at least two programs to connect")
+        printUsage("pipe")
+        return
+    }
+    if opts.coreFile != "" || opts.digest || opts.traceFile != "" || opts.profile != 0 {
+        fmt.Println("Error: -core, -digest, -record-trace and -profile apply to a single program; use 'flux run'")
+        return
+    }
+    runPipeline(positional, opts)
+}
+
+// pipeStage is one program of a pipeline
+type pipeStage struct {
+    name     string
+    vm       *VM
+    input    *io.PipeReader // Output of the stage before, or nil for the first
+    output   *PipeDevice    // Device feeding the stage after, or nil for the last
+    consumed atomic.Bool    // Whether the stage after has stopped reading
+    err      error
+}
+
+// runPipeline runs the programs concurrently, the first reading standard
+// input and the last writing standard output. A stage whose output is no
+// longer read, because the stage after it has finished, is stopped
+// quietly, like a Unix process killed by SIGPIPE.
+func runPipeline(filenames []string, opts runOptions) {
+    stages := make([]*pipeStage, len(filenames))
+    for i, filename := range filenames {
+        data, err := os.ReadFile(filename)
+        if err != nil {
+            fmt.Printf("Error reading file '%s': %v\n", filename, err)
+            return
+        }
+        program, err := loadProgram(filename, data, opts.sourceOptions)
+        if err != nil {
+            fmt.Printf("%s: %v\n", filename, err)
+            return
+        }
+        program, report := Optimize(program, opts.optLevel)
+        if opts.optReport {
+            fmt.Printf("%s:\n", filename)
+            report.Print(os.Stdout, program.Debug)
+            fmt.Println()
+        }
+        stages[i] = &pipeStage{name: filename, vm: NewVM(program, nil, nil)}
+    }
+
+    // The first interrupt stops every program cleanly, as in 'flux run'
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        stop()
+    }()
+    var input io.Reader = os.Stdin
+    for i, s := range stages {
+        if i < len(stages)-1 {
+            s.output = NewPipeDevice(input)
+            s.vm.SetDevice(s.output)
+            stages[i+1].input = s.output.Reader()
+            input = stages[i+1].input
+        } else {
+            s.vm.SetIO(input, bufio.NewWriter(os.Stdout))
+        }
+        s.vm.SetContext(ctx)
+        if err := opts.apply(s.vm); err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+    }
+
+    var wg sync.WaitGroup
+    for i, s := range stages {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            s.err = s.vm.Run()
+            if cerr := s.vm.CloseFiles(); s.err == nil && cerr != nil {
+                s.err = fmt.Errorf("closing files: %v", cerr)
+            }
+            if s.output != nil {
+                s.output.Close() // The next stage reads end of input
+            }
+            if s.input != nil {
+                // Writes from the stage before now fail instead of blocking
+                stages[i-1].consumed.Store(true)
+                s.input.Close()
+            }
+        }()
+    }
+    wg.Wait()
+
+    fmt.Println()
+    var total Stats
+    for _, s := range stages {
+        if s.err != nil && !s.consumed.Load() {
+            fmt.Printf("Runtime error in %s: %v\n", s.name, s.err)
+        }
+        stats := s.vm.Stats()
+        total.Steps += stats.Steps
+        total.MaxStackDepth = max(total.MaxStackDepth, stats.MaxStackDepth)
+        total.HeapCells += stats.HeapCells
+        total.Memory += stats.Memory
+        if opts.stats {
+            fmt.Printf("%s: %d steps\n", s.name, stats.Steps)
+        }
+    }
+    if opts.stats {
+        total.Print(os.Stdout)
+    }
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+// profileTop is how many instructions and lines a profile lists
+const profileTop = 10
+
+// sampler is a statistical profiler: a background goroutine counts clock
+// ticks, and the machine charges the ticks that arrived to the instruction
+// that was executing, which costs a step one atomic load. A run that waits
+// in one instruction, for input or a SLEEP, charges it every tick it waits.
+type sampler struct {
+    pending atomic.Int64  // Ticks not yet charged to an instruction
+    last    int           // Address of the instruction executing
+    counts  map[int]int64 // Samples by address
+    every   time.Duration // Time between ticks
+    start   time.Time
+    stop    chan struct{}
+    done    chan struct{}
+}
+
+// Profile is the result of sampling a run
+type Profile struct {
+    Interval time.Duration // Time between samples
+    Elapsed  time.Duration // How long the machine was sampled
+    Samples  int64         // Samples taken
+    Counts   map[int]int64 // Samples by instruction address
+}
+
+// StartSampling starts sampling the instruction the machine is executing
+// every interval, until StopSampling. The overhead is low enough for long
+// runs that full tracing would slow down too much, at the price of the
+// counts being approximate.
+func (vm *VM) StartSampling(interval time.Duration) error {
+    if interval <= 0 {
+        return fmt.Errorf("sampling interval must be positive, not %v", interval)
+    }
+    if vm.sampler != nil {
+        return fmt.Errorf("the machine is already being sampled")
+    }
+    s := &sampler{
+        last:   vm.pc,
+        counts: make(map[int]int64),
+        every:  interval,
+        start:  time.Now(),
+        stop:   make(chan struct{}),
+        done:   make(chan struct{}),
+    }
+    go func() {
+        defer close(s.done)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        ticks := int64(0)
+        for {
+            select {
+            case now := <-ticker.C:
+                // Ticks are dropped while the machine keeps the goroutine
+                // from running, on a single CPU, so count elapsed intervals
+                elapsed := int64(now.Sub(s.start) / interval)
+                s.pending.Add(max(elapsed-ticks, 1))
+                ticks = max(elapsed, ticks+1)
+            case <-s.stop:
+                return
+            }
+        }
+    }()
+    vm.sampler = s
+    return nil
+}
+
+// StopSampling stops sampling and returns the profile taken, or nil if
+// the machine was not being sampled. It must not be called while the
+// machine is running.
+func (vm *VM) StopSampling() *Profile {
+    s := vm.sampler
+    if s == nil {
+        return nil
+    }
+    vm.sampler = nil
+    close(s.stop)
+    <-s.done
+    s.sample(s.last)
+    p := &Profile{Interval: s.every, Elapsed: time.Since(s.start), Counts: s.counts}
+    for _, n := range s.counts {
+        p.Samples += n
+    }
+    return p
+}
+
+// sample charges the ticks since the last step to the instruction that
+// was executing and notes that pc executes next
+func (s *sampler) sample(pc int) {
+    if n := s.pending.Load(); n > 0 {
+        s.pending.Add(-n)
+        s.counts[s.last] += n
+    }
+    s.last = pc
+}
+
+// Print writes the instructions and source lines the most samples fell
+// in to w, for 'flux run -profile'
+func (p *Profile) Print(w io.Writer, program *Program) {
+    fmt.Fprintf(w, "Profile: %d samples, one every %v over %v\n", p.Samples, p.Interval, p.Elapsed.Round(time.Millisecond))
+    if p.Samples == 0 {
+        fmt.Fprintln(w, "  (the run ended before the first sample; use a shorter interval)")
+        return
+    }
+    percent := func(n int64) float64 { return 100 * float64(n) / float64(p.Samples) }
+
+    hot := make([]int, 0, len(p.Counts))
+    for pc := range p.Counts {
+        hot = append(hot, pc)
+    }
+    sort.Slice(hot, func(i, j int) bool {
+        if p.Counts[hot[i]] != p.Counts[hot[j]] {
+            return p.Counts[hot[i]] > p.Counts[hot[j]]
+        }
+        return hot[i] < hot[j]
+    })
+    fmt.Fprintln(w, "  Hottest instructions:")
+    for _, pc := range hot[:min(len(hot), profileTop)] {
+        op := "-" // Sampled as the program ended
+        if pc < len(program.Instructions) {
+            op = program.Instructions[pc].Op.String()
+        }
+        fmt.Fprintf(w, "    %04d  %-8s %5.1f%%  %s\n", pc, op, percent(p.Counts[pc]), program.Location(pc))
+    }
+
+    if program.decodeDebug(); program.Debug == nil {
+        return
+    }
+    lines := make(map[int]int64)
+    starts := lineStarts(program.Debug.Source)
+    for pc, n := range p.Counts {
+        if pos, ok := program.Position(pc); ok {
+            line, _ := lineColAt(starts, pos)
+            lines[line] += n
+        }
+    }
+    byLine := make([]int, 0, len(lines))
+    for line := range lines {
+        byLine = append(byLine, line)
+    }
+    sort.Slice(byLine, func(i, j int) bool {
+        if lines[byLine[i]] != lines[byLine[j]] {
+            return lines[byLine[i]] > lines[byLine[j]]
+        }
+        return byLine[i] < byLine[j]
+    })
+    fmt.Fprintln(w, "  Hottest lines:")
+    for _, line := range byLine[:min(len(byLine), profileTop)] {
+        fmt.Fprintf(w, "    %s:%-6d %5.1f%%\n", program.Debug.File, line, percent(lines[line]))
+    }
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+    "crypto/sha256"
+    "flag"
+    "fmt"
+    "math/bits"
+    "sort"
+    "strings"
+)
+
+// ISAVersion is the version of the instruction set this implementation
+// executes. It goes up whenever an opcode is added or changes meaning, so
+// an older VM can refuse bytecode it would misinterpret.
+const ISAVersion = 2
+
+// ExtensionSet is a bitset of opt-in language extensions
+type ExtensionSet uint64
+
+// The known extensions. Each is one bit of an ExtensionSet; the bits are
+// stored in compiled programs, so they must never be renumbered.
+const (
+    ExtProbe     ExtensionSet = 1 << iota // ~ : non-blocking input probe
+    ExtSleep                              // z : pause for acc milliseconds
+    ExtClock                              // t T : read the clock
+    ExtFS                                 // O R W C : sandboxed file access
+    ExtBitwise                            // & | ^ < > : bitwise operations
+    ExtIf                                 // ( : ) : if/else
+    ExtBreak                              // ! ; : break and continue
+    ExtHeap                               // N L K " : heap cells
+    ExtRegisters                          // $x =x : named registers
+    ExtStack                              // d s r o @ : stack manipulation
+    ExtDump                               // ? : debug dump
+    ExtAssert                             // A : assertions
+    ExtEval                               // { } x : code blocks
+    ExtCoroutine                          // P S G : coroutines
+    ExtTrap                               // Y H E : fault handlers
+    ExtFloat                              // F I U V M D : float arithmetic
+    ExtAnsi                               // % : terminal control
+    ExtEnv                                // Q : environment variables
+    ExtNet                                // l i w : a TCP connection
+)
+
+// extensionNames maps each known extension bit to the name used on the
+// command line
+var extensionNames = map[ExtensionSet]string{
+    ExtProbe:     "probe",
+    ExtSleep:     "sleep",
+    ExtClock:     "clock",
+    ExtFS:        "fs",
+    ExtBitwise:   "bitwise",
+    ExtIf:        "if",
+    ExtBreak:     "break",
+    ExtHeap:      "heap",
+    ExtRegisters: "registers",
+    ExtStack:     "stack",
+    ExtDump:      "dump",
+    ExtAssert:    "assert",
+    ExtEval:      "eval",
+    ExtCoroutine: "coroutine",
+    ExtTrap:      "trap",
+    ExtFloat:     "float",
+    ExtAnsi:      "ansi",
+    ExtEnv:       "env",
+    ExtNet:       "net",
+}
+
+// extensionSummaries describes each extension's operators for
+// 'flux extensions'
+var extensionSummaries = map[ExtensionSet]string{
+    ExtProbe:     "~ sets the accumulator to 1 if input is waiting, else 0",
+    ExtSleep:     "z pauses for as many milliseconds as the accumulator holds",
+    ExtClock:     "t loads milliseconds since the program started, T the Unix time in seconds",
+    ExtFS:        "O opens, R reads, W writes and C closes files (needs -allow-fs)",
+    ExtBitwise:   "& | ^ < > combine the accumulator with the popped top of the stack",
+    ExtIf:        "( then : else ) branches on whether the accumulator is nonzero",
+    ExtBreak:     "! leaves the innermost loop and ; jumps to its condition check",
+    ExtHeap:      "N allocates heap cells, L loads and K stores the cell at a popped address and index, \"x loads the address of data block x",
+    ExtRegisters: "$a to $h load a register into the accumulator, =a to =h store it",
+    ExtStack:     "d duplicates, s swaps, r rotates and o copies over the top of the stack; @ loads its depth",
+    ExtDump:      "? writes the accumulator and the stack to standard error",
+    ExtAssert:    "A stops with an error unless the accumulator equals the popped value",
+    ExtEval:      "{ code } pushes a block and x pops one and executes it",
+    ExtCoroutine: "P runs a block as a coroutine, S sends it the accumulator and G receives (needs eval)",
+    ExtTrap:      "Y body H handler E runs the handler with a fault code if the body faults",
+    ExtFloat:     "F and I convert between integer and float, U V M D do float arithmetic, # prints floats",
+    ExtAnsi:      "% clears the screen, moves the cursor or sets colors, as the accumulator selects",
+    ExtEnv:       "Q reads an environment variable named on the stack (needs -allow-env)",
+    ExtNet:       "l accepts a TCP connection, i reads a byte from it and w writes one (needs -allow-net)",
+}
+
+// requiredExtensions returns the extensions needed to execute instructions
+func requiredExtensions(instructions []Instruction) ExtensionSet {
+    var set ExtensionSet
+    for _, inst := range instructions {
+        info, _ := inst.Op.Info()
+        set |= info.Extension
+    }
+    return set
+}
+
+// allExtensions returns the set of every known extension
+func allExtensions() ExtensionSet {
+    var all ExtensionSet
+    for ext := range extensionNames {
+        all |= ext
+    }
+    return all
+}
+
+// String lists the extensions in the set by name, comma-separated
+func (s ExtensionSet) String() string {
+    if s == 0 {
+        return "none"
+    }
+    var names []string
+    for s != 0 {
+        bit := ExtensionSet(1) << bits.TrailingZeros64(uint64(s))
+        if name, ok := extensionNames[bit]; ok {
+            names = append(names, name)
+        } else {
+            names = append(names, fmt.Sprintf("unknown(%d)", bits.TrailingZeros64(uint64(s))))
+        }
+        s &^= bit
+    }
+    return strings.Join(names, ",")
+}
+
+// parseExtensions parses a comma-separated list of extension names; "all"
+// stands for every known extension and "none" or "" for the empty set
+func parseExtensions(list string) (ExtensionSet, error) {
+    var set ExtensionSet
+    for _, name := range strings.Split(list, ",") {
+        name = strings.TrimSpace(name)
+        switch name {
+        case "", "none":
+            continue
+        case "all":
+            set |= allExtensions()
+            continue
+        }
+        found := false
+        for ext, n := range extensionNames {
+            if n == name {
+                set |= ext
+                found = true
+            }
+        }
+        if !found {
+            return 0, fmt.Errorf("unknown extension %q (known: %s)", name, knownExtensions())
+        }
+    }
+    return set, nil
+}
+
+// knownExtensions lists the names of every known extension for messages
+func knownExtensions() string {
+    if len(extensionNames) == 0 {
+        return "none"
+    }
+    var names []string
+    for _, name := range extensionNames {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ", ")
+}
+
+// registerExtFlag adds the -ext flag, which enables extensions on the
+// machine, to fs
+func registerExtFlag(fs *flag.FlagSet, set *ExtensionSet) {
+    fs.Func("ext", "enable the extensions in `list` (comma-separated, or 'all')", func(list string) error {
+        s, err := parseExtensions(list)
+        *set |= s
+        return err
+    })
+}
+
+// Program is a compiled Flux program: the instructions together with
+// everything needed to run, inspect and serialize them
+type Program struct {
+    Instructions []Instruction
+    Constants    *ConstPool        // Constants referred to by SET and EMIT
+    Data         []int             // Cells of the data blocks DATA refers to, loaded into the heap
+    Debug        *DebugInfo        // Source mapping, or nil if stripped
+    SourceHash   [sha256.Size]byte // SHA-256 of the source the program was compiled from
+    ISA          int               // Instruction set version the program was compiled for
+    Extensions   ExtensionSet      // Extensions the program needs
+
+    pendingDebug []byte // Debug section of a lazily decoded .fluxc file, until it is needed
+}
+
+// DebugInfo maps instructions back to the source they were compiled from
+type DebugInfo struct {
+    File      string // Name of the source file, if known
+    Source    []byte // The source text
+    Positions []int  // Source offset of each instruction
+
+    lines []int // Start of each line of Source, once Location needs them
+}
+
+// NewProgram wraps bare instructions in a program with an empty constant
+// pool and no debug information
+func NewProgram(instructions []Instruction) *Program {
+    return &Program{Instructions: instructions, Constants: NewConstPool(), ISA: ISAVersion}
+}
+
+// Position returns the source offset of the instruction at pc, if known
+func (p *Program) Position(pc int) (int, bool) {
+    p.decodeDebug()
+    if p.Debug == nil || pc < 0 || pc >= len(p.Debug.Positions) {
+        return 0, false
+    }
+    return p.Debug.Positions[pc], true
+}
+
+// Location describes where the instruction at pc came from as
+// file:line:col, or just its address when there is no debug information
+func (p *Program) Location(pc int) string {
+    offset, ok := p.Position(pc)
+    if !ok {
+        return fmt.Sprintf("%04d", pc)
+    }
+    if p.Debug.lines == nil {
+        p.Debug.lines = lineStarts(p.Debug.Source)
+    }
+    line, col := lineColAt(p.Debug.lines, offset)
+    return fmt.Sprintf("%s:%d:%d", p.Debug.File, line, col)
+}
+
+// checkRunnable returns an error if a machine with the enabled extensions
+// cannot execute the program
+func (p *Program) checkRunnable(enabled ExtensionSet) error {
+    if p.ISA > ISAVersion {
+        return fmt.Errorf("program needs instruction set version %d, but this VM implements version %d", p.ISA, ISAVersion)
+    }
+    if missing := p.Extensions &^ enabled; missing != 0 {
+        return fmt.Errorf("program needs extension(s) %s, which this VM was not configured with (enable them with -ext %s)", missing, missing)
+    }
+    return nil
+}
+
+// nondeterministicExtensions lists the extensions whose results depend on
+// when a program runs or on the world outside it, which deterministic
+// mode refuses
+const nondeterministicExtensions = ExtProbe | ExtClock | ExtFS | ExtEnv | ExtNet
+
+// checkDeterministic returns an error unless the program's output is
+// decided by its input alone, the same on every run and platform: it may
+// not use the extensions above, and the accumulator must be 64 bits wide,
+// since arithmetic wraps at its width. At the end of input ',' reads 0
+// everywhere.
+func (p *Program) checkDeterministic() error {
+    if uses := p.Extensions & nondeterministicExtensions; uses != 0 {
+        return fmt.Errorf("program uses extension(s) %s, whose results vary from run to run, which deterministic mode refuses", uses)
+    }
+    if bits.UintSize != 64 {
+        return fmt.Errorf("deterministic mode needs a 64-bit accumulator, but this build of flux has %d bits", bits.UintSize)
+    }
+    return nil
+}
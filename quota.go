@@ -0,0 +1,129 @@
+package main
+
+import (
+    "fmt"
+    "time"
+)
+
+// Quota sets how much of each resource a run may use before the machine
+// reports it to a QuotaFunc. A zero field is not watched.
+type Quota struct {
+    Steps       int           // Instructions executed
+    OutputBytes int64         // Bytes written to the output
+    StackCells  int           // Values on the stack at once
+    WallTime    time.Duration // Time since the run's first instruction
+}
+
+// Resource is one of the resources a Quota limits
+type Resource int
+
+const (
+    ResourceSteps Resource = iota
+    ResourceOutput
+    ResourceStack
+    ResourceWallTime
+)
+
+// resourceNames maps each resource to its name
+var resourceNames = map[Resource]string{
+    ResourceSteps:    "steps",
+    ResourceOutput:   "output bytes",
+    ResourceStack:    "stack cells",
+    ResourceWallTime: "wall time",
+}
+
+// String returns the name of the resource
+func (r Resource) String() string {
+    return resourceNames[r]
+}
+
+// Usage is how much of each resource a run has used
+type Usage struct {
+    Steps       int           // Instructions executed
+    OutputBytes int64         // Bytes written to the output
+    StackCells  int           // Most values the stack has held at once
+    WallTime    time.Duration // Time since the run's first instruction
+}
+
+// QuotaFunc is called when a run reaches a threshold of its Quota, with
+// the resource and the usage at that moment. Returning an error stops the
+// program with that error; returning nil lets it go on, for a host that
+// bills usage rather than capping it.
+type QuotaFunc func(r Resource, u Usage) error
+
+// quota is the quota of a machine and which thresholds it has reached
+type quota struct {
+    limits  Quota
+    onReach QuotaFunc
+    start   time.Time // When the run's first instruction was checked; zero before
+    reached [4]bool   // By resource, whether the threshold has been reported
+}
+
+// SetQuota makes the machine call f the first time a run reaches each
+// threshold of q. Thresholds are checked before each instruction, wall
+// time every 1024 instructions, so a program waiting for input is not
+// noticed until it resumes. f runs on the goroutine running the program
+// and may call SetQuota to move the thresholds, say to the next billing
+// tier; they are then reported again. Reset starts the accounting over
+// for the next run. A zero Quota or a nil f stops the accounting.
+func (vm *VM) SetQuota(q Quota, f QuotaFunc) {
+    if q == (Quota{}) || f == nil {
+        vm.quota = nil
+        return
+    }
+    start := time.Time{}
+    if vm.quota != nil {
+        start = vm.quota.start // Moving the thresholds does not restart the clock
+    }
+    vm.quota = &quota{limits: q, onReach: f, start: start}
+}
+
+// Usage reports the resources the machine has used in the current run.
+// Wall time is only measured while a quota is set.
+func (vm *VM) Usage() Usage {
+    u := Usage{Steps: vm.steps, OutputBytes: vm.outputBytes, StackCells: vm.maxDepth}
+    if vm.quota != nil && !vm.quota.start.IsZero() {
+        u.WallTime = time.Since(vm.quota.start)
+    }
+    return u
+}
+
+// rearm forgets the thresholds reached, for a new run
+func (q *quota) rearm() {
+    q.start = time.Time{}
+    q.reached = [4]bool{}
+}
+
+// checkQuota reports every threshold the run has newly reached
+func (vm *VM) checkQuota() error {
+    q := vm.quota
+    if q.start.IsZero() {
+        q.start = time.Now()
+    }
+    u := Usage{Steps: vm.steps, OutputBytes: vm.outputBytes, StackCells: vm.maxDepth}
+    if vm.steps%interruptInterval == 0 {
+        u.WallTime = time.Since(q.start)
+    }
+    over := [4]bool{
+        ResourceSteps:    q.limits.Steps > 0 && u.Steps >= q.limits.Steps,
+        ResourceOutput:   q.limits.OutputBytes > 0 && u.OutputBytes >= q.limits.OutputBytes,
+        ResourceStack:    q.limits.StackCells > 0 && u.StackCells >= q.limits.StackCells,
+        ResourceWallTime: q.limits.WallTime > 0 && u.WallTime >= q.limits.WallTime,
+    }
+    for r, reached := range over {
+        if !reached || q.reached[r] {
+            continue
+        }
+        q.reached[r] = true
+        if u.WallTime == 0 {
+            u.WallTime = time.Since(q.start)
+        }
+        if err := q.onReach(Resource(r), u); err != nil {
+            return fmt.Errorf("%w at %s", err, vm.program.Location(vm.pc))
+        }
+        if vm.quota != q {
+            return nil // The callback set a new quota; check it from the next instruction
+        }
+    }
+    return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestQuota(t *testing.T) {
+    errOver := errors.New("over quota")
+    tests := []struct {
+        name    string
+        quota   Quota
+        stop    bool // Whether the callback returns an error
+        tier    int  // Steps the callback moves the threshold on by
+        reports []Resource
+        steps   int // Instructions executed
+    }{
+        {"reported once", Quota{Steps: 100}, false, 0, []Resource{ResourceSteps}, 1000},
+        {"error stops the run", Quota{Steps: 100}, true, 0, []Resource{ResourceSteps}, 100},
+        {"moved thresholds are reported again", Quota{Steps: 100}, false, 300, []Resource{ResourceSteps, ResourceSteps, ResourceSteps}, 1000},
+        {"output", Quota{OutputBytes: 10}, false, 0, []Resource{ResourceOutput}, 1000},
+        {"each resource", Quota{Steps: 50, OutputBytes: 10}, false, 0, []Resource{ResourceOutput, ResourceSteps}, 1000},
+        {"not reached", Quota{Steps: 5000}, false, 0, nil, 1000},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            vm, _ := newTestVM(t, "+[+#-]", 0, 1000)
+            var reports []Resource
+            var f QuotaFunc
+            f = func(r Resource, u Usage) error {
+                reports = append(reports, r)
+                if r == ResourceSteps && u.Steps != vm.Stats().Steps {
+                    t.Errorf("usage of %d steps reported after %d", u.Steps, vm.Stats().Steps)
+                }
+                if tt.stop {
+                    return errOver
+                }
+                if tt.tier > 0 {
+                    vm.SetQuota(Quota{Steps: u.Steps + tt.tier}, f)
+                }
+                return nil
+            }
+            vm.SetQuota(tt.quota, f)
+            err := vm.Run()
+            if tt.stop != errors.Is(err, errOver) {
+                t.Errorf("run ended with %v", err)
+            }
+            if len(reports) != len(tt.reports) {
+                t.Fatalf("reported %v, want %v", reports, tt.reports)
+            }
+            for i := range reports {
+                if reports[i] != tt.reports[i] {
+                    t.Errorf("reported %v, want %v", reports, tt.reports)
+                }
+            }
+            if steps := vm.Stats().Steps; steps != tt.steps {
+                t.Errorf("%d steps executed, want %d", steps, tt.steps)
+            }
+        })
+    }
+}
+
+func TestQuotaReset(t *testing.T) {
+    vm, _ := newTestVM(t, "+[+#-]", 0, 200)
+    reports := 0
+    vm.SetQuota(Quota{Steps: 100}, func(Resource, Usage) error {
+        reports++
+        return nil
+    })
+    vm.Run()
+    vm.Reset(vm.program)
+    vm.Run()
+    if reports != 2 {
+        t.Errorf("threshold reported %d times over two runs, want 2", reports)
+    }
+    vm.SetQuota(Quota{}, nil)
+    vm.Reset(vm.program)
+    vm.Run()
+    if reports != 2 {
+        t.Errorf("threshold reported after the quota was removed")
+    }
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+)
+
+// rangeBudget is how many instructions the range analysis visits before it
+// stops iterating loops to a fixed point, which deeply nested loops would
+// make exponential, and assumes any accumulator on loop entry instead
+const rangeBudget = 1000000
+
+// rangeWidenAfter is how many times a loop is analyzed before a bound that
+// keeps growing is taken to be unbounded
+const rangeWidenAfter = 3
+
+// interval is the inclusive range of values a cell may hold. An interval
+// with lo above hi is empty: its instruction is never reached.
+type interval struct {
+    lo, hi int
+}
+
+var (
+    fullRange  = interval{math.MinInt, math.MaxInt}
+    emptyRange = interval{1, 0}
+)
+
+// pointRange returns the range holding only v
+func pointRange(v int) interval {
+    return interval{v, v}
+}
+
+func (r interval) empty() bool {
+    return r.lo > r.hi
+}
+
+func (r interval) contains(v int) bool {
+    return r.lo <= v && v <= r.hi
+}
+
+// join returns the smallest range holding both ranges
+func (r interval) join(s interval) interval {
+    switch {
+    case r.empty():
+        return s
+    case s.empty():
+        return r
+    }
+    return interval{min(r.lo, s.lo), max(r.hi, s.hi)}
+}
+
+// shift returns the range of values in r plus d. Values that wrap around
+// could be anything.
+func (r interval) shift(d int) interval {
+    if r.empty() {
+        return r
+    }
+    if d > 0 && r.hi > math.MaxInt-d || d < 0 && r.lo < math.MinInt-d {
+        return fullRange
+    }
+    return interval{r.lo + d, r.hi + d}
+}
+
+// nonzero returns r without 0, as far as an interval can leave it out
+func (r interval) nonzero() interval {
+    switch {
+    case r.lo == 0 && r.hi == 0:
+        return emptyRange
+    case r.lo == 0:
+        r.lo = 1
+    case r.hi == 0:
+        r.hi = -1
+    }
+    return r
+}
+
+// String describes the range for listings and warnings
+func (r interval) String() string {
+    switch {
+    case r.empty():
+        return "unreached"
+    case r == fullRange:
+        return "any"
+    case r.lo == r.hi:
+        return fmt.Sprint(r.lo)
+    case r.lo == math.MinInt:
+        return fmt.Sprintf("<= %d", r.hi)
+    case r.hi == math.MaxInt:
+        return fmt.Sprintf(">= %d", r.lo)
+    }
+    return fmt.Sprintf("%d..%d", r.lo, r.hi)
+}
+
+// rangeState is what the range analysis knows between instructions
+type rangeState struct {
+    acc   interval
+    stack []interval // Entries known to be on top of the stack, bottom first
+    floor bool       // Whether the stack below those entries is known to be empty
+}
+
+// rangeAnalysis computes the range of the accumulator before every
+// instruction by abstract interpretation: it follows the program with
+// intervals instead of values, analyzes each loop until the range on
+// entry to its body stops changing and takes bounds that keep growing to
+// be unbounded. Like knownAcc it follows the core instructions only; any
+// other instruction makes the whole state unknown, which also covers the
+// places it may jump to. The exception is CONTINUE, whose accumulator
+// joins the range at its loop's END.
+type rangeAnalysis struct {
+    instructions []Instruction
+    pool         *ConstPool
+    ranges       []interval
+    continued    map[int]interval // Range at the CONTINUEs of the loop ending at each END
+    work         int              // Instructions visited, against rangeBudget
+}
+
+// accRanges returns the range of the accumulator before each instruction
+func accRanges(instructions []Instruction, pool *ConstPool) []interval {
+    a := &rangeAnalysis{instructions: instructions, pool: pool, ranges: make([]interval, len(instructions)), continued: make(map[int]interval)}
+    a.run(0, len(instructions), rangeState{acc: pointRange(0), floor: true})
+    return a.ranges
+}
+
+// run follows the instructions from up to to, starting in state st, and
+// returns the state at to
+func (a *rangeAnalysis) run(from, to int, st rangeState) rangeState {
+    for i := from; i < to; i++ {
+        a.work++
+        inst := a.instructions[i]
+        a.ranges[i] = st.acc
+        if st.acc.empty() && coreOp(inst.Op) {
+            // Unreached, unless an instruction that jumps leads here
+            if inst.Op == OpLoop {
+                a.loop(i, st)
+                i = inst.Arg
+            }
+            continue
+        }
+        if d, ok := accDelta(inst); ok {
+            st.acc = st.acc.shift(d)
+            continue
+        }
+        switch inst.Op {
+        case OpSet:
+            v, err := a.pool.IntValue(inst.Arg)
+            st.acc = pointRange(v)
+            if err != nil {
+                st.acc = fullRange
+            }
+        case OpPush:
+            st.stack = append(st.stack[:len(st.stack):len(st.stack)], st.acc)
+        case OpPop:
+            if n := len(st.stack); n > 0 {
+                st.acc = st.stack[n-1]
+                st.stack = st.stack[:n-1]
+            } else if st.floor {
+                st.acc = pointRange(0) // Popping an empty stack yields zero
+            } else {
+                st.acc = fullRange
+            }
+        case OpIn:
+            st.acc = interval{0, 255}
+        case OpOut, OpOutNum, OpEmitBytes:
+        case OpLoop:
+            st = a.loop(i, st)
+            i = inst.Arg
+        case OpContinue:
+            // Execution goes on at the END, not at the next instruction
+            if r, ok := a.continued[inst.Arg]; ok {
+                st.acc = st.acc.join(r)
+            }
+            a.continued[inst.Arg] = st.acc
+            st = rangeState{acc: emptyRange}
+        default:
+            st = rangeState{acc: fullRange}
+        }
+    }
+    return st
+}
+
+// loop analyzes the loop at start, reached in state entry, and returns the
+// state after it. LOOP jumps to END when the accumulator is 0, and END
+// back to LOOP when it is not.
+func (a *rangeAnalysis) loop(start int, entry rangeState) rangeState {
+    end := a.instructions[start].Arg
+    if entry.acc.empty() {
+        for i := start; i <= end; i++ {
+            a.ranges[i] = emptyRange
+        }
+        return entry
+    }
+    in := entry
+    if !stackBalanced(a.instructions, start) {
+        in.stack, in.floor = nil, false
+    }
+    head := entry.acc // Range at LOOP
+    if a.work > rangeBudget && !head.empty() {
+        head = fullRange
+    }
+    var out rangeState
+    for pass := 0; ; pass++ {
+        in.acc = head.nonzero()
+        delete(a.continued, end)
+        out = a.run(start+1, end, in)
+        if r, ok := a.continued[end]; ok {
+            out.acc = out.acc.join(r)
+        }
+        next := head.join(out.acc.nonzero())
+        if next == head {
+            break
+        }
+        if pass >= rangeWidenAfter || a.work > rangeBudget {
+            if next.lo < head.lo {
+                next.lo = math.MinInt
+            }
+            if next.hi > head.hi {
+                next.hi = math.MaxInt
+            }
+        }
+        head = next
+    }
+    a.ranges[start] = head
+    if head.contains(0) {
+        out.acc = out.acc.join(pointRange(0))
+    }
+    a.ranges[end] = out.acc
+
+    if hasBreak(a.instructions, start) {
+        return rangeState{acc: fullRange}
+    }
+    after := entry
+    if !stackBalanced(a.instructions, start) {
+        after.stack, after.floor = nil, false
+    }
+    after.acc = emptyRange
+    if out.acc.contains(0) {
+        after.acc = pointRange(0)
+    }
+    return after
+}
+
+// rangeWarning is a problem the range analysis proves about an instruction
+type rangeWarning struct {
+    pc      int
+    message string
+}
+
+// rangeWarnings returns the problems the accumulator ranges of program
+// prove: output that cannot be a character, and loops that are never
+// entered or never left
+func rangeWarnings(program *Program) []rangeWarning {
+    ranges := accRanges(program.Instructions, program.Constants)
+    var warnings []rangeWarning
+    for pc, inst := range program.Instructions {
+        r := ranges[pc]
+        if r.empty() {
+            continue
+        }
+        switch {
+        case inst.Op == OpOut && r.hi < 0:
+            warnings = append(warnings, rangeWarning{pc, fmt.Sprintf("'.' outputs a negative value (the accumulator is %v), which wraps around to a byte", r)})
+        case inst.Op == OpOut && r.lo > 255:
+            warnings = append(warnings, rangeWarning{pc, fmt.Sprintf("'.' outputs a value above 255 (the accumulator is %v), which wraps around to a byte", r)})
+        case inst.Op == OpLoop && r == pointRange(0):
+            warnings = append(warnings, rangeWarning{pc, "loop is never entered: the accumulator is always 0 here"})
+        case inst.Op == OpEnd && !r.contains(0) && !hasBreak(program.Instructions, inst.Arg):
+            warnings = append(warnings, rangeWarning{inst.Arg, fmt.Sprintf("loop never ends: the accumulator at ']' is %v", r)})
+        }
+    }
+    return warnings
+}
+
+// compileListing is what 'flux compile -json' writes: the bytecode, each
+// instruction annotated with the range of the accumulator before it, and
+// the warnings the ranges of the unoptimized program prove
+type compileListing struct {
+    File         string              `json:"file"`
+    Level        int                 `json:"level"` // Optimization level of the bytecode
+    Instructions []listedInstruction `json:"instructions"`
+    Warnings     []listedWarning     `json:"warnings"`
+    Metadata     *Metadata           `json:"metadata,omitempty"` // The source's header, if it has one
+}
+
+// listedInstruction is one instruction of a compileListing
+type listedInstruction struct {
+    Addr    int        `json:"addr"`
+    Op      string     `json:"op"`
+    Arg     int        `json:"arg,omitempty"`
+    Operand string     `json:"operand,omitempty"` // The value the instruction carries, as in listings
+    Line    int        `json:"line,omitempty"`
+    Column  int        `json:"column,omitempty"`
+    Acc     *jsonRange `json:"acc"` // Null if the instruction is never reached
+}
+
+// jsonRange is an interval in JSON, with null for an unbounded side
+type jsonRange struct {
+    Min *int `json:"min"`
+    Max *int `json:"max"`
+}
+
+// listedWarning is one warning of a compileListing
+type listedWarning struct {
+    Location string `json:"location"`
+    Message  string `json:"message"`
+}
+
+// printCompileListing writes the JSON listing of program, compiled from
+// source at the given optimization level
+func printCompileListing(filename string, source, program *Program, level int) {
+    listing := compileListing{File: filename, Level: level, Instructions: []listedInstruction{}, Warnings: []listedWarning{}, Metadata: source.Metadata()}
+    ranges := accRanges(program.Instructions, program.Constants)
+    var lines []int
+    if program.Debug != nil {
+        lines = lineStarts(program.Debug.Source)
+    }
+    for pc, inst := range program.Instructions {
+        li := listedInstruction{Addr: pc, Op: inst.Op.String(), Arg: inst.Arg, Operand: valueOperand(inst, program.Constants)}
+        if pos, ok := program.Position(pc); ok {
+            li.Line, li.Column = lineColAt(lines, pos)
+        }
+        if r := ranges[pc]; !r.empty() {
+            li.Acc = &jsonRange{}
+            if r.lo != math.MinInt {
+                li.Acc.Min = &r.lo
+            }
+            if r.hi != math.MaxInt {
+                li.Acc.Max = &r.hi
+            }
+        }
+        listing.Instructions = append(listing.Instructions, li)
+    }
+    for _, w := range rangeWarnings(source) {
+        listing.Warnings = append(listing.Warnings, listedWarning{source.Location(w.pc), w.message})
+    }
+    out, _ := json.MarshalIndent(listing, "", "  ")
+    fmt.Println(string(out))
+}
+
+// printRangeWarnings prints the warnings about program
+func printRangeWarnings(program *Program, warnings []rangeWarning) {
+    for _, w := range warnings {
+        fmt.Printf("Warning: %s: %s\n", program.Location(w.pc), w.message)
+    }
+}
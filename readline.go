@@ -0,0 +1,300 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// errInterrupted is returned by ReadLine when the user presses Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// completer proposes completions for the text before the cursor. It returns
+// the index where the replaced word starts and the candidate replacements.
+type completer func(line string) (start int, candidates []string)
+
+// lineEditor reads lines from a terminal with basic editing, history and tab
+// completion. When the input is not a terminal it falls back to reading
+// plain lines, so piped sessions behave exactly as before.
+type lineEditor struct {
+    in       *bufio.Reader
+    out      io.Writer
+    term     *os.File  // Terminal switched to raw mode while editing
+    history  []string  // Previously entered lines, oldest first
+    complete completer // Tab completion, nil to disable
+}
+
+// newLineEditor creates an editor reading from in, which must wrap the
+// terminal term for editing to be enabled
+func newLineEditor(in *bufio.Reader, out io.Writer, term *os.File) *lineEditor {
+    return &lineEditor{in: in, out: out, term: term}
+}
+
+// ReadLine prints the prompt and returns the next line without its newline
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+    if !isTerminal(e.term) {
+        fmt.Fprint(e.out, prompt)
+        line, err := e.in.ReadString('\n')
+        if err != nil && line == "" {
+            return "", err
+        }
+        return strings.TrimRight(line, "\r\n"), nil
+    }
+
+    state, err := makeRaw(e.term)
+    if err != nil {
+        fmt.Fprint(e.out, prompt)
+        line, err := e.in.ReadString('\n')
+        if err != nil && line == "" {
+            return "", err
+        }
+        return strings.TrimRight(line, "\r\n"), nil
+    }
+    defer restoreTerminal(e.term, state)
+
+    line, err := e.edit(prompt)
+    if err == nil && strings.TrimSpace(line) != "" {
+        e.history = append(e.history, line)
+    }
+    return line, err
+}
+
+// edit runs the key loop for one line in raw mode
+func (e *lineEditor) edit(prompt string) (string, error) {
+    var buf []rune
+    pos := 0
+    hist := len(e.history)
+    pending := "" // Line being typed before browsing history
+
+    refresh := func() {
+        fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+        if back := len(buf) - pos; back > 0 {
+            fmt.Fprintf(e.out, "\x1b[%dD", back)
+        }
+    }
+    refresh()
+
+    for {
+        r, _, err := e.in.ReadRune()
+        if err != nil {
+            return "", err
+        }
+
+        switch r {
+        case '\r', '\n':
+            fmt.Fprint(e.out, "\r\n")
+            return string(buf), nil
+
+        case 3: // Ctrl-C
+            fmt.Fprint(e.out, "^C\r\n")
+            return "", errInterrupted
+
+        case 4: // Ctrl-D
+            if len(buf) == 0 {
+                fmt.Fprint(e.out, "\r\n")
+                return "", io.EOF
+            }
+            if pos < len(buf) {
+                buf = append(buf[:pos], buf[pos+1:]...)
+            }
+
+        case 127, 8: // Backspace
+            if pos > 0 {
+                buf = append(buf[:pos-1], buf[pos:]...)
+                pos--
+            }
+
+        case 1: // Ctrl-A
+            pos = 0
+
+        case 5: // Ctrl-E
+            pos = len(buf)
+
+        case 2: // Ctrl-B
+            if pos > 0 {
+                pos--
+            }
+
+        case 6: // Ctrl-F
+            if pos < len(buf) {
+                pos++
+            }
+
+        case 11: // Ctrl-K
+            buf = buf[:pos]
+
+        case 21: // Ctrl-U
+            buf = append([]rune(nil), buf[pos:]...)
+            pos = 0
+
+        case '\t':
+            buf, pos = e.completeAt(prompt, buf, pos)
+
+        case 27: // Escape sequence
+            key := e.readEscape()
+            switch key {
+            case 'A', 'B':
+                if key == 'A' && hist > 0 {
+                    if hist == len(e.history) {
+                        pending = string(buf)
+                    }
+                    hist--
+                } else if key == 'B' && hist < len(e.history) {
+                    hist++
+                } else {
+                    continue
+                }
+                if hist == len(e.history) {
+                    buf = []rune(pending)
+                } else {
+                    buf = []rune(e.history[hist])
+                }
+                pos = len(buf)
+            case 'C':
+                if pos < len(buf) {
+                    pos++
+                }
+            case 'D':
+                if pos > 0 {
+                    pos--
+                }
+            case 'H':
+                pos = 0
+            case 'F':
+                pos = len(buf)
+            case '~': // Delete
+                if pos < len(buf) {
+                    buf = append(buf[:pos], buf[pos+1:]...)
+                }
+            }
+
+        default:
+            if r < 32 {
+                continue
+            }
+            buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+            pos++
+        }
+
+        refresh()
+    }
+}
+
+// readEscape consumes the rest of a CSI escape sequence and returns its
+// final byte ('A'-'D' for arrows, 'H'/'F' for Home/End, '~' for Delete)
+func (e *lineEditor) readEscape() byte {
+    b, err := e.in.ReadByte()
+    if err != nil || (b != '[' && b != 'O') {
+        return 0
+    }
+    for {
+        b, err = e.in.ReadByte()
+        if err != nil {
+            return 0
+        }
+        if b >= 0x40 && b <= 0x7e {
+            return b
+        }
+    }
+}
+
+// completeAt applies tab completion at the cursor. A single candidate is
+// inserted outright; several candidates extend the word to their common
+// prefix, or are listed below the prompt when no progress can be made.
+func (e *lineEditor) completeAt(prompt string, buf []rune, pos int) ([]rune, int) {
+    if e.complete == nil {
+        return buf, pos
+    }
+
+    head := string(buf[:pos])
+    start, candidates := e.complete(head)
+    if len(candidates) == 0 {
+        return buf, pos
+    }
+
+    word := head[start:]
+    insert := candidates[0]
+    if len(candidates) > 1 {
+        insert = commonPrefix(candidates)
+        if len(insert) <= len(word) {
+            fmt.Fprint(e.out, "\r\n")
+            for _, c := range candidates {
+                fmt.Fprintf(e.out, "%s  ", c)
+            }
+            fmt.Fprint(e.out, "\r\n")
+            return buf, pos
+        }
+    } else if !strings.HasSuffix(insert, "/") {
+        insert += " "
+    }
+
+    tail := buf[pos:]
+    line := []rune(head[:start] + insert)
+    newPos := len(line)
+    return append(line, tail...), newPos
+}
+
+// commonPrefix returns the longest prefix shared by all strings
+func commonPrefix(values []string) string {
+    prefix := values[0]
+    for _, v := range values[1:] {
+        for !strings.HasPrefix(v, prefix) {
+            prefix = prefix[:len(prefix)-1]
+        }
+    }
+    return prefix
+}
+
+// completeWord returns the options that start with word, sorted
+func completeWord(word string, options []string) []string {
+    var matches []string
+    for _, opt := range options {
+        if strings.HasPrefix(opt, word) {
+            matches = append(matches, opt)
+        }
+    }
+    sort.Strings(matches)
+    return matches
+}
+
+// completePath returns filesystem entries matching a partially typed path.
+// Directories get a trailing slash so completion can continue into them.
+func completePath(word string) []string {
+    dir, base := filepath.Split(word)
+
+    lookup := dir
+    if lookup == "" {
+        lookup = "."
+    } else if strings.HasPrefix(lookup, "~/") {
+        if home, err := os.UserHomeDir(); err == nil {
+            lookup = filepath.Join(home, lookup[2:])
+        }
+    }
+
+    entries, err := os.ReadDir(lookup)
+    if err != nil {
+        return nil
+    }
+
+    var matches []string
+    for _, entry := range entries {
+        name := entry.Name()
+        if !strings.HasPrefix(name, base) {
+            continue
+        }
+        if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+            continue
+        }
+        if entry.IsDir() {
+            name += "/"
+        }
+        matches = append(matches, dir+name)
+    }
+    sort.Strings(matches)
+    return matches
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// reduceCommand implements 'flux reduce', which shrinks a program as far
+// as it can while a check command keeps succeeding on it, to turn a
+// program that shows a bug into a minimal report
+func reduceCommand(args []string) {
+    fs := commandFlags("reduce")
+    check := fs.String("check", "", "shell `command` that succeeds (exits 0) while the program shows the failure; {} is replaced by the program's file")
+    output := fs.String("o", "", "write the reduced program to `file` instead of standard output")
+    timeout := fs.Duration("timeout", 10*time.Second, "count a check running longer than `duration` as failing")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 || !strings.Contains(*check, "{}") {
+        fmt.Println("Error: Please specify a file to reduce and a check command containing {}")
+        printUsage("reduce")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    dir, err := os.MkdirTemp("", "flux-reduce-")
+    if err != nil {
+        fmt.Printf("Error creating work directory: %v\n", err)
+        return
+    }
+    defer os.RemoveAll(dir)
+
+    r := &reducer{
+        check:   *check,
+        timeout: *timeout,
+        source:  source,
+        file:    filepath.Join(dir, filepath.Base(filename)),
+        tried:   make(map[string]bool),
+    }
+    ok, err := r.interesting(string(data), false)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if !ok {
+        fmt.Println("Error: the check does not succeed on the original program, so there is nothing to preserve")
+        os.Exit(1)
+    }
+    tokens := minify(string(data), source.extensions)
+    if !r.passes(tokens) {
+        fmt.Println("Error: the check no longer succeeds once comments are removed")
+        os.Exit(1)
+    }
+    fmt.Fprintf(os.Stderr, "Reducing %s: %d operators\n", filename, len(tokens))
+    tokens = r.reduce(tokens)
+    fmt.Fprintf(os.Stderr, "Reduced to %d operators after %d checks\n", len(tokens), r.checks)
+
+    code := strings.Join(tokens, "") + "\n"
+    if *output == "" {
+        fmt.Print(code)
+        return
+    }
+    if err := os.WriteFile(*output, []byte(code), 0644); err != nil {
+        fmt.Printf("Error writing file '%s': %v\n", *output, err)
+    }
+}
+
+// reducer shrinks a program by delta debugging: it removes ever smaller
+// runs of operators, keeping each removal after which the program still
+// compiles and the check still succeeds
+type reducer struct {
+    check   string          // Shell command, with {} for the program's file
+    timeout time.Duration   // Longest a check may take
+    source  sourceOptions   // How candidates are compiled
+    file    string          // Where candidates are written for the check
+    tried   map[string]bool // Candidates checked, and whether they passed
+    checks  int             // Checks run
+}
+
+// reduce returns the smallest program it finds among those made of a
+// subsequence of tokens for which the check succeeds. tokens must pass.
+func (r *reducer) reduce(tokens []string) []string {
+    for {
+        before := len(tokens)
+        for size := len(tokens) / 2; size >= 1; size /= 2 {
+            for i := 0; i+size <= len(tokens); {
+                candidate := append(append([]string(nil), tokens[:i]...), tokens[i+size:]...)
+                if r.passes(candidate) {
+                    tokens = candidate
+                    continue // The next run now starts at i
+                }
+                i += size
+            }
+        }
+        tokens = r.unwrapLoops(tokens)
+        if len(tokens) == before {
+            return tokens
+        }
+    }
+}
+
+// unwrapLoops tries replacing each loop by its body, which removing runs
+// cannot do since it never leaves the brackets unbalanced
+func (r *reducer) unwrapLoops(tokens []string) []string {
+    for i := 0; i < len(tokens); i++ {
+        if tokens[i] != "[" {
+            continue
+        }
+        depth, end := 0, -1
+        for j := i; j < len(tokens) && end < 0; j++ {
+            switch tokens[j] {
+            case "[":
+                depth++
+            case "]":
+                if depth--; depth == 0 {
+                    end = j
+                }
+            }
+        }
+        if end < 0 {
+            continue
+        }
+        candidate := append(append(append([]string(nil), tokens[:i]...), tokens[i+1:end]...), tokens[end+1:]...)
+        if r.passes(candidate) {
+            tokens = candidate
+            i--
+        }
+    }
+    return tokens
+}
+
+// passes reports whether a candidate compiles and the check succeeds on
+// it. Each candidate is checked once.
+func (r *reducer) passes(tokens []string) bool {
+    code := strings.Join(tokens, "")
+    if passed, ok := r.tried[code]; ok {
+        return passed
+    }
+    ok, err := r.interesting(code, true)
+    r.tried[code] = ok && err == nil
+    return r.tried[code]
+}
+
+// interesting writes code to the work file and runs the check on it. With
+// compile set, code that does not compile fails without a check.
+func (r *reducer) interesting(code string, compile bool) (bool, error) {
+    if compile {
+        if _, err := r.source.compiler(code).Compile(); err != nil {
+            return false, nil
+        }
+    }
+    if err := os.WriteFile(r.file, []byte(code+"\n"), 0644); err != nil {
+        return false, err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+    defer cancel()
+    quoted := "'" + strings.ReplaceAll(r.file, "'", `'\''`) + "'"
+    cmd := exec.CommandContext(ctx, "sh", "-c", strings.ReplaceAll(r.check, "{}", quoted))
+    r.checks++
+    err := cmd.Run()
+    var exit *exec.ExitError
+    if err != nil && !errors.As(err, &exit) {
+        return false, fmt.Errorf("running the check: %v", err)
+    }
+    return err == nil, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// replSession holds the state of an interactive session. Unlike 'flux run',
+// the machine persists between lines, so values built up on one line are
+// still in the accumulator and on the stack for the next one.
+type replSession struct {
+    vm         *VM           // Machine shared by every line of the session
+    in         *bufio.Reader // Shared by the line reader and the ',' operation
+    out        io.Writer     // Terminal output
+    editor     *lineEditor   // Line input with history and completion
+    transcript *transcript   // Active transcript, nil when not recording
+    entries    int           // Number of inputs executed so far
+    history    []string      // Inputs that compiled, replayable with ':save'
+    prompt     string        // Prompt format, see renderPrompt
+}
+
+// defaultPrompt is used until the session or startup file sets another
+const defaultPrompt = "flux> "
+
+// startupFile is the name, relative to the home directory, of the file run
+// when the REPL starts
+const startupFile = ".fluxrc.flux"
+
+// replCommands lists the session commands offered by tab completion
+var replCommands = []string{":help", ":load", ":paste", ":prompt", ":save", ":trace", ":transcript"}
+
+// newREPLSession creates a session reading from in and writing to out
+func newREPLSession(in io.Reader, out io.Writer) *replSession {
+    s := &replSession{
+        in:     bufio.NewReader(in),
+        out:    out,
+        prompt: defaultPrompt,
+    }
+    s.vm = NewVM(nil, s.in, replOutput{s})
+    s.editor = newLineEditor(s.in, out, os.Stdin)
+    s.editor.complete = s.completeLine
+    return s
+}
+
+// completeLine completes session command names, their fixed arguments and
+// file paths for the commands that take one
+func (s *replSession) completeLine(line string) (int, []string) {
+    if !strings.HasPrefix(line, ":") {
+        return 0, nil
+    }
+
+    start := strings.LastIndex(line, " ") + 1
+    word := line[start:]
+    args := strings.Fields(line[:start])
+
+    if len(args) == 0 {
+        return start, completeWord(word, replCommands)
+    }
+
+    switch args[0] {
+    case ":load", ":save":
+        if len(args) == 1 {
+            return start, completePath(word)
+        }
+    case ":trace":
+        if len(args) == 1 {
+            return start, completeWord(word, []string{"on", "off"})
+        }
+    case ":transcript":
+        if len(args) == 1 {
+            return start, completeWord(word, []string{"start", "stop"})
+        }
+        if len(args) == 2 && args[1] == "start" {
+            return start, completePath(word)
+        }
+    }
+    return start, nil
+}
+
+// replOutput routes program output to the terminal and, while a transcript
+// is being recorded, into the transcript as well
+type replOutput struct {
+    s *replSession
+}
+
+func (o replOutput) Write(p []byte) (int, error) {
+    if o.s.transcript != nil {
+        o.s.transcript.output.Write(p)
+    }
+    return o.s.out.Write(p)
+}
+
+// runInteractive starts an interactive REPL
+func runInteractive() {
+    fmt.Println("")
+    fmt.Println("                   FLUX INTERACTIVE MODE (REPL)                            ")
+    fmt.Println("")
+    fmt.Println("Enter Flux code and press Enter to execute.")
+    fmt.Println("Type 'exit' or 'quit' to leave, 'help' for quick reference.")
+    fmt.Println("Commands starting with ':' control the session (':help' lists them).")
+    fmt.Println("")
+
+    s := newREPLSession(os.Stdin, os.Stdout)
+    defer s.stopTranscript()
+
+    if home, err := os.UserHomeDir(); err == nil {
+        s.runStartupFile(filepath.Join(home, startupFile))
+    }
+
+    for {
+        line, err := s.editor.ReadLine(s.renderPrompt())
+        if err == errInterrupted {
+            continue
+        }
+        if err != nil {
+            break
+        }
+
+        line = strings.TrimSpace(line)
+
+        if line == "" {
+            continue
+        }
+
+        if line == "exit" || line == "quit" {
+            fmt.Fprintln(s.out, "Goodbye!")
+            break
+        }
+
+        if line == "help" {
+            fmt.Fprintln(s.out, "Quick Reference:")
+            fmt.Fprintln(s.out, "  +  Increment    *  Push      [  Loop start")
+            fmt.Fprintln(s.out, "  -  Decrement    /  Pop       ]  Loop end")
+            fmt.Fprintln(s.out, "  .  Output char  ,  Input     #  Output number")
+            continue
+        }
+
+        if strings.HasPrefix(line, ":") {
+            s.runMeta(line)
+            continue
+        }
+
+        s.execute(line)
+        fmt.Fprintln(s.out)
+    }
+}
+
+// execute compiles one input and runs it against the session's machine
+func (s *replSession) execute(source string) {
+    s.entries++
+    if s.transcript != nil {
+        s.transcript.beginEntry(s.entries, source)
+    }
+
+    compiled, failure := s.run(source)
+    if compiled {
+        s.history = append(s.history, source)
+    }
+
+    if s.transcript != nil {
+        s.transcript.endEntry(failure, s.stateSummary())
+    }
+}
+
+// run compiles source and runs it on the session's machine, reporting any
+// error to the terminal. It returns whether the source compiled and the
+// error that stopped it, if any.
+func (s *replSession) run(source string) (bool, error) {
+    program, err := NewCompiler(source).Compile()
+    if err != nil {
+        fmt.Fprintf(s.out, "Compilation error: %v\n", err)
+        return false, err
+    }
+
+    s.vm.Load(program)
+    if err := s.vm.Run(); err != nil {
+        fmt.Fprintf(s.out, "\nRuntime error: %v\n", err)
+        return true, err
+    }
+    return true, nil
+}
+
+// renderPrompt expands the prompt format. {acc} is the accumulator, {depth}
+// the stack depth, {top} the top of the stack (empty when the stack is) and
+// {n} the number of the next input.
+func (s *replSession) renderPrompt() string {
+    top := ""
+    if len(s.vm.stack) > 0 {
+        top = strconv.Itoa(s.vm.stack[len(s.vm.stack)-1])
+    }
+    return strings.NewReplacer(
+        "{acc}", strconv.Itoa(s.vm.Accumulator()),
+        "{depth}", strconv.Itoa(len(s.vm.stack)),
+        "{top}", top,
+        "{n}", strconv.Itoa(s.entries+1),
+    ).Replace(s.prompt)
+}
+
+// runStartupFile runs the startup file at path if it exists. Lines starting
+// with ':' are session commands, so the file can set the prompt or start a
+// transcript; runs of other lines are executed as one program each, so the
+// machine starts out with whatever state they build.
+func (s *replSession) runStartupFile(path string) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            fmt.Fprintf(s.out, "Error reading startup file '%s': %v\n", path, err)
+        }
+        return
+    }
+
+    var block []string
+    flush := func() {
+        if len(block) > 0 {
+            s.run(strings.Join(block, "\n"))
+            block = block[:0]
+        }
+    }
+
+    for _, line := range strings.Split(string(data), "\n") {
+        if strings.HasPrefix(strings.TrimSpace(line), ":") {
+            flush()
+            s.runMeta(strings.TrimSpace(line))
+            continue
+        }
+        block = append(block, line)
+    }
+    flush()
+}
+
+// stateSummary describes the machine state in one line
+func (s *replSession) stateSummary() string {
+    stack := s.vm.Stack()
+    return fmt.Sprintf("acc=%d, stack=%v (depth %d)", s.vm.Accumulator(), stack, len(stack))
+}
+
+// runMeta dispatches a ':' session command
+func (s *replSession) runMeta(line string) {
+    fields := strings.Fields(line)
+
+    switch fields[0] {
+    case ":help":
+        fmt.Fprintln(s.out, "Session commands:")
+        fmt.Fprintln(s.out, "  :load <file>                  Run a Flux file in this session")
+        fmt.Fprintln(s.out, "  :paste                        Enter a multi-line block, end with '.' or Ctrl-D")
+        fmt.Fprintln(s.out, "  :prompt [format]              Set the prompt; {acc} {depth} {top} {n} expand")
+        fmt.Fprintln(s.out, "  :save <file>                  Save the inputs entered so far")
+        fmt.Fprintln(s.out, "  :trace on|off                 Trace each executed instruction")
+        fmt.Fprintln(s.out, "  :transcript start <file.md>   Record the session as Markdown")
+        fmt.Fprintln(s.out, "  :transcript stop              Stop recording")
+
+    case ":load":
+        if len(fields) != 2 {
+            fmt.Fprintln(s.out, "Usage: :load <file>")
+            return
+        }
+        data, err := os.ReadFile(fields[1])
+        if err != nil {
+            fmt.Fprintf(s.out, "Error reading file '%s': %v\n", fields[1], err)
+            return
+        }
+        s.execute(string(data))
+        fmt.Fprintln(s.out)
+
+    case ":paste":
+        s.paste()
+
+    case ":prompt":
+        format := strings.TrimSpace(strings.TrimPrefix(line, ":prompt"))
+        if format == "" {
+            s.prompt = defaultPrompt
+            return
+        }
+        s.prompt = format + " "
+
+    case ":save":
+        if len(fields) != 2 {
+            fmt.Fprintln(s.out, "Usage: :save <file>")
+            return
+        }
+        content := strings.Join(s.history, "\n")
+        if content != "" {
+            content += "\n"
+        }
+        if err := os.WriteFile(fields[1], []byte(content), 0644); err != nil {
+            fmt.Fprintf(s.out, "Error writing file '%s': %v\n", fields[1], err)
+            return
+        }
+        fmt.Fprintf(s.out, "Saved %d input(s) to %s\n", len(s.history), fields[1])
+
+    case ":trace":
+        if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+            fmt.Fprintln(s.out, "Usage: :trace on|off")
+            return
+        }
+        if fields[1] == "on" {
+            s.vm.SetTrace(s.out)
+        } else {
+            s.vm.SetTrace(nil)
+        }
+        fmt.Fprintf(s.out, "Tracing %s\n", fields[1])
+
+    case ":transcript":
+        if len(fields) >= 2 && fields[1] == "stop" {
+            if s.transcript == nil {
+                fmt.Fprintln(s.out, "No transcript is being recorded")
+                return
+            }
+            path := s.transcript.path
+            s.stopTranscript()
+            fmt.Fprintf(s.out, "Transcript saved to %s\n", path)
+            return
+        }
+        if len(fields) != 3 || fields[1] != "start" {
+            fmt.Fprintln(s.out, "Usage: :transcript start <file.md> | :transcript stop")
+            return
+        }
+        if s.transcript != nil {
+            fmt.Fprintf(s.out, "Already recording to %s\n", s.transcript.path)
+            return
+        }
+        t, err := startTranscript(fields[2], s.stateSummary())
+        if err != nil {
+            fmt.Fprintf(s.out, "Error starting transcript: %v\n", err)
+            return
+        }
+        s.transcript = t
+        fmt.Fprintf(s.out, "Recording transcript to %s\n", t.path)
+
+    default:
+        fmt.Fprintf(s.out, "Unknown command: %s (try ':help')\n", fields[0])
+    }
+}
+
+// paste reads a multi-line block until a line holding only '.' or end of
+// input, then runs it as a single program. The prompt shows how many loops
+// are still open so unbalanced pastes are noticed before they are run.
+func (s *replSession) paste() {
+    fmt.Fprintln(s.out, "Paste mode: end with a line containing only '.' or Ctrl-D")
+
+    var lines []string
+    depth := 0
+    for {
+        prompt := "paste> "
+        if depth > 0 {
+            prompt = fmt.Sprintf("paste[%d]> ", depth)
+        }
+
+        line, err := s.editor.ReadLine(prompt)
+        if err == errInterrupted {
+            fmt.Fprintln(s.out, "Paste cancelled")
+            return
+        }
+        if err != nil || strings.TrimSpace(line) == "." {
+            break
+        }
+
+        lines = append(lines, line)
+        depth += strings.Count(line, "[") - strings.Count(line, "]")
+    }
+
+    if len(lines) == 0 {
+        return
+    }
+    s.execute(strings.Join(lines, "\n"))
+    fmt.Fprintln(s.out)
+}
+
+// stopTranscript finishes and closes the active transcript, if any
+func (s *replSession) stopTranscript() {
+    if s.transcript == nil {
+        return
+    }
+    if err := s.transcript.close(s.stateSummary()); err != nil {
+        fmt.Fprintf(s.out, "Error writing transcript: %v\n", err)
+    }
+    s.transcript = nil
+}
+
+// transcript records REPL inputs, their output and the resulting machine
+// state as a Markdown document that can be pasted into lessons or bug reports
+type transcript struct {
+    path   string
+    file   *os.File
+    w      *bufio.Writer
+    output strings.Builder // Output captured for the entry being executed
+}
+
+// startTranscript creates the transcript file and writes its header
+func startTranscript(path string, state string) (*transcript, error) {
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+    t := &transcript{path: path, file: f, w: bufio.NewWriter(f)}
+    fmt.Fprintf(t.w, "# Flux REPL transcript\n\n")
+    fmt.Fprintf(t.w, "Started %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
+    fmt.Fprintf(t.w, "Initial state: `%s`\n\n", state)
+    return t, nil
+}
+
+// beginEntry records an input and starts capturing its output
+func (t *transcript) beginEntry(n int, source string) {
+    t.output.Reset()
+    fmt.Fprintf(t.w, "## Input %d\n\n", n)
+    fmt.Fprintf(t.w, "```flux\n%s\n```\n\n", source)
+}
+
+// endEntry records the captured output, any error and the resulting state
+func (t *transcript) endEntry(err error, state string) {
+    if t.output.Len() > 0 {
+        fmt.Fprintf(t.w, "Output:\n\n```\n%s\n```\n\n", strings.TrimRight(t.output.String(), "\n"))
+    }
+    if err != nil {
+        fmt.Fprintf(t.w, "Error: `%v`\n\n", err)
+    }
+    fmt.Fprintf(t.w, "State: `%s`\n\n", state)
+    t.output.Reset()
+}
+
+// close writes the footer and closes the file
+func (t *transcript) close(state string) error {
+    fmt.Fprintf(t.w, "---\n\nStopped %s with final state `%s`\n", time.Now().Format("2006-01-02 15:04:05"), state)
+    if err := t.w.Flush(); err != nil {
+        t.file.Close()
+        return err
+    }
+    return t.file.Close()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "errors"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+// RunResultVersion is the version of the RunResult schema. It changes
+// when a field is removed or changes meaning, not when one is added.
+const RunResultVersion = 1
+
+// How a run ended, the Exit of a RunResult
+const (
+    ExitHalted       = "halted"        // The program ran to its end
+    ExitLimit        = "limit"         // It hit the step limit or a resource limit
+    ExitTimeout      = "timeout"       // It ran out of time
+    ExitError        = "error"         // It failed with a runtime error
+    ExitCompileError = "compile_error" // It did not compile
+)
+
+// RunRequest asks for a program to be run, as a client of an HTTP front
+// end sends it
+type RunRequest struct {
+    Source     string `json:"source"`
+    Stdin      string `json:"stdin,omitempty"`
+    Extensions string `json:"extensions,omitempty"` // Comma-separated, as for -ext
+    Base64     bool   `json:"base64,omitempty"`     // Return stdout base64-encoded
+}
+
+// RunLimits bound a run of RunSource. Zero fields impose no limit.
+type RunLimits struct {
+    MaxSteps  int
+    MaxOutput int // Bytes of output kept
+    Timeout   time.Duration
+}
+
+// RunResult describes a run for clients that would otherwise have to
+// pick apart flux's messages:
+//
+//	{"version": 1, "stdout": "hi\n", "stdout_encoding": "text", "exit": "halted",
+//	 "steps": 12, "peak_stack": 2, "duration_ms": 0.04}
+type RunResult struct {
+    Version         int          `json:"version"`
+    Stdout          string       `json:"stdout"`
+    StdoutEncoding  string       `json:"stdout_encoding"` // "text", or "base64" if asked for or not UTF-8
+    StdoutTruncated bool         `json:"stdout_truncated,omitempty"`
+    Exit            string       `json:"exit"`            // One of the Exit constants
+    Error           string       `json:"error,omitempty"` // The message of a runtime error
+    Steps           int          `json:"steps"`
+    PeakStack       int          `json:"peak_stack"`
+    Diagnostics     []Diagnostic `json:"diagnostics"` // Compilation errors and warnings
+    DurationMS      float64      `json:"duration_ms"` // Time spent running, not compiling
+}
+
+// Diagnostic is a problem the compiler found. Line and Column are 1-based,
+// and zero when the problem is not at one place, such as a bracket that
+// is never closed.
+type Diagnostic struct {
+    Severity string `json:"severity"` // "error" or "warning"
+    Message  string `json:"message"`
+    Line     int    `json:"line,omitempty"`
+    Column   int    `json:"column,omitempty"`
+}
+
+// RunSource compiles and runs the requested program on a fresh machine
+// within the limits, and describes the outcome. Canceling ctx ends the
+// run as a timeout.
+func RunSource(ctx context.Context, req RunRequest, limits RunLimits) RunResult {
+    return runSource(ctx, req, limits, nil)
+}
+
+// runSource is RunSource with the program run by run, or by VM.Run if it
+// is nil
+func runSource(ctx context.Context, req RunRequest, limits RunLimits, run func(*VM) error) RunResult {
+    result := RunResult{Version: RunResultVersion, StdoutEncoding: "text", Diagnostics: []Diagnostic{}}
+    extensions, err := parseExtensions(req.Extensions)
+    if err != nil {
+        result.Exit = ExitCompileError
+        result.Diagnostics = append(result.Diagnostics, Diagnostic{Severity: "error", Message: err.Error()})
+        return result
+    }
+    compiler := NewCompiler(req.Source)
+    compiler.SetExtensions(extensions)
+    program, err := compiler.Compile()
+    if err != nil {
+        result.Exit = ExitCompileError
+        result.Diagnostics = append(result.Diagnostics, compileDiagnostic(req.Source, err))
+        return result
+    }
+    for _, w := range rangeWarnings(program) {
+        d := Diagnostic{Severity: "warning", Message: w.message}
+        if pos, ok := program.Position(w.pc); ok {
+            d.Line, d.Column = lineCol([]byte(req.Source), pos)
+        }
+        result.Diagnostics = append(result.Diagnostics, d)
+    }
+
+    vm, out, elapsed, err := runLimited(ctx, program, extensions, req.Stdin, limits, nil, run)
+    result.DurationMS = float64(elapsed.Microseconds()) / 1000
+    stats := vm.Stats()
+    result.Steps, result.PeakStack = stats.Steps, stats.MaxStackDepth
+    result.Exit = exitReason(err)
+    if err != nil {
+        result.Error = err.Error()
+    }
+    stdout := out.Bytes()
+    if req.Base64 || !utf8.Valid(stdout) {
+        result.Stdout, result.StdoutEncoding = base64.StdEncoding.EncodeToString(stdout), "base64"
+    } else {
+        result.Stdout = string(stdout)
+    }
+    result.StdoutTruncated = out.Truncated()
+    return result
+}
+
+// runLimited runs program on a fresh machine within the limits, with
+// stdin as its input, and returns the machine, its output and how long
+// the run took. setup, if not nil, configures the machine further, and
+// run, if not nil, runs it in place of VM.Run.
+func runLimited(ctx context.Context, program *Program, extensions ExtensionSet, stdin string, limits RunLimits, setup func(*VM), run func(*VM) error) (*VM, *CaptureDevice, time.Duration, error) {
+    if limits.Timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+        defer cancel()
+    }
+    out := NewCaptureDevice(limits.MaxOutput)
+    out.SetInput(strings.NewReader(stdin))
+    vm := NewVM(program, nil, nil)
+    vm.SetDevice(out)
+    vm.SetExtensions(extensions)
+    vm.SetMaxSteps(limits.MaxSteps)
+    vm.SetContext(ctx)
+    if setup != nil {
+        setup(vm)
+    }
+    if run == nil {
+        run = (*VM).Run
+    }
+    start := time.Now()
+    err := run(vm)
+    elapsed := time.Since(start)
+    if cerr := vm.CloseFiles(); err == nil {
+        err = cerr
+    }
+    return vm, out, elapsed, err
+}
+
+// exitReason classifies the error a run ended with
+func exitReason(err error) string {
+    var stepLimit *StepLimitError
+    var f *Fault
+    switch {
+    case err == nil:
+        return ExitHalted
+    case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+        return ExitTimeout
+    case errors.As(err, &stepLimit), errors.As(err, &f) && f.Code == FaultLimit:
+        return ExitLimit
+    }
+    return ExitError
+}
+
+// compileDiagnostic turns a compilation error into a diagnostic at the
+// position it names
+func compileDiagnostic(source string, err error) Diagnostic {
+    d := Diagnostic{Severity: "error", Message: err.Error()}
+    var ce *CompileError
+    if errors.As(err, &ce) {
+        d.Message = ce.Msg
+        if ce.Pos >= 0 {
+            d.Line, d.Column = lineCol([]byte(source), ce.Pos)
+        }
+    }
+    return d
+}
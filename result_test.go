@@ -0,0 +1,68 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestRunSource(t *testing.T) {
+    tests := []struct {
+        name     string
+        req      RunRequest
+        limits   RunLimits
+        exit     string
+        stdout   string
+        encoding string
+    }{
+        {"halted", RunRequest{Source: ",+#", Stdin: "A"}, RunLimits{}, ExitHalted, "66", "text"},
+        {"step limit", RunRequest{Source: "+[]"}, RunLimits{MaxSteps: 100}, ExitLimit, "", "text"},
+        {"timeout", RunRequest{Source: "+[]"}, RunLimits{Timeout: 20 * time.Millisecond}, ExitTimeout, "", "text"},
+        {"runtime error", RunRequest{Source: "+*++A", Extensions: "assert"}, RunLimits{}, ExitError, "", "text"},
+        {"compile error", RunRequest{Source: "]"}, RunLimits{}, ExitCompileError, "", "text"},
+        {"unknown extension", RunRequest{Source: "+", Extensions: "nope"}, RunLimits{}, ExitCompileError, "", "text"},
+        {"base64 asked for", RunRequest{Source: "+#", Base64: true}, RunLimits{}, ExitHalted, "MQ==", "base64"},
+        {"not UTF-8", RunRequest{Source: ",.", Stdin: "\xff"}, RunLimits{}, ExitHalted, "/w==", "base64"},
+        {"truncated", RunRequest{Source: "+[#]"}, RunLimits{MaxSteps: 100, MaxOutput: 3}, ExitLimit, "111", "text"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := RunSource(context.Background(), tt.req, tt.limits)
+            if r.Version != RunResultVersion || r.Exit != tt.exit || r.Stdout != tt.stdout || r.StdoutEncoding != tt.encoding {
+                t.Errorf("version %d, exit %s, stdout %q (%s); want %d, %s, %q (%s)",
+                    r.Version, r.Exit, r.Stdout, r.StdoutEncoding, RunResultVersion, tt.exit, tt.stdout, tt.encoding)
+            }
+            if (r.Error != "") != (tt.exit != ExitHalted && tt.exit != ExitCompileError) {
+                t.Errorf("error %q with exit %s", r.Error, r.Exit)
+            }
+            if r.StdoutTruncated != (tt.name == "truncated") {
+                t.Errorf("stdout_truncated %v", r.StdoutTruncated)
+            }
+        })
+    }
+}
+
+func TestRunSourceDiagnostics(t *testing.T) {
+    tests := []struct {
+        source       string
+        severity     string
+        line, column int
+    }{
+        {"+\n+]", "error", 2, 2},
+        {"[+", "error", 0, 0},
+        {"%name x\n%requires ext:nonesuch\n+", "error", 2, 1},
+        {"+\n +[]", "warning", 2, 3},
+    }
+    for _, tt := range tests {
+        t.Run(tt.source, func(t *testing.T) {
+            r := RunSource(context.Background(), RunRequest{Source: tt.source}, RunLimits{MaxSteps: 10})
+            if len(r.Diagnostics) != 1 {
+                t.Fatalf("diagnostics %+v, want one", r.Diagnostics)
+            }
+            d := r.Diagnostics[0]
+            if d.Severity != tt.severity || d.Line != tt.line || d.Column != tt.column || d.Message == "" {
+                t.Errorf("diagnostic %+v, want a %s at %d:%d", d, tt.severity, tt.line, tt.column)
+            }
+        })
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sync"
+)
+
+// DefaultTimeSlice is how many instructions a Scheduler runs a program
+// for before moving on to the next
+const DefaultTimeSlice = 10000
+
+// Scheduler runs many machines on a fixed number of worker goroutines,
+// taking turns: a worker runs a program for a time slice of instructions
+// and puts it back at the end of the queue, so hundreds of programs share
+// a few cores fairly, and a program that loops forever delays the others
+// instead of taking a core from them. A program waiting for input holds
+// its worker while it waits, so give scheduled programs input that is
+// already there, such as a bytes.Reader.
+type Scheduler struct {
+    slice   int
+    mu      sync.Mutex
+    ready   *sync.Cond
+    queue   []*scheduledRun // Programs waiting for their turn, next first
+    closed  bool
+    workers sync.WaitGroup
+    active  sync.WaitGroup // Programs submitted and not finished
+}
+
+// scheduledRun is a program submitted to a Scheduler
+type scheduledRun struct {
+    vm   *VM
+    done chan error
+}
+
+// NewScheduler starts a scheduler running programs on the given number of
+// workers, slice instructions at a time; zero or less for slice means
+// DefaultTimeSlice
+func NewScheduler(workers, slice int) *Scheduler {
+    if slice <= 0 {
+        slice = DefaultTimeSlice
+    }
+    s := &Scheduler{slice: slice}
+    s.ready = sync.NewCond(&s.mu)
+    for range max(workers, 1) {
+        s.workers.Add(1)
+        go s.work()
+    }
+    return s
+}
+
+// Submit queues vm to run its program from where it stands. The returned
+// channel receives what Run would have returned once the program ends.
+// The machine must not be used by anyone else until then; cancelling its
+// context stops it as usual.
+func (s *Scheduler) Submit(vm *VM) (<-chan error, error) {
+    if vm.runnable != nil {
+        return nil, vm.runnable
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return nil, errors.New("the scheduler is closed")
+    }
+    r := &scheduledRun{vm: vm, done: make(chan error, 1)}
+    s.active.Add(1)
+    s.queue = append(s.queue, r)
+    s.ready.Signal()
+    return r.done, nil
+}
+
+// Run runs vm's program on the scheduler and returns what Run would have
+// returned, once it has ended
+func (s *Scheduler) Run(vm *VM) error {
+    done, err := s.Submit(vm)
+    if err != nil {
+        return err
+    }
+    return <-done
+}
+
+// RunSource is the function RunSource with the program run on the
+// scheduler, taking turns with the others
+func (s *Scheduler) RunSource(ctx context.Context, req RunRequest, limits RunLimits) RunResult {
+    return runSource(ctx, req, limits, s.Run)
+}
+
+// Queued returns how many submitted programs are waiting for a worker
+func (s *Scheduler) Queued() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.queue)
+}
+
+// Close refuses further programs, waits for those submitted to finish and
+// stops the workers
+func (s *Scheduler) Close() {
+    s.mu.Lock()
+    s.closed = true
+    s.mu.Unlock()
+    s.active.Wait()
+    s.mu.Lock()
+    s.ready.Broadcast()
+    s.mu.Unlock()
+    s.workers.Wait()
+}
+
+// work runs queued programs a slice at a time until the scheduler closes
+func (s *Scheduler) work() {
+    defer s.workers.Done()
+    for {
+        s.mu.Lock()
+        for len(s.queue) == 0 && !s.closed {
+            s.ready.Wait()
+        }
+        if len(s.queue) == 0 {
+            s.mu.Unlock()
+            return
+        }
+        r := s.queue[0]
+        s.queue[0] = nil
+        s.queue = s.queue[1:]
+        s.mu.Unlock()
+
+        halted, err := r.vm.RunSteps(s.slice)
+        if halted {
+            r.done <- err
+            s.active.Done()
+            continue
+        }
+        s.mu.Lock()
+        s.queue = append(s.queue, r)
+        s.ready.Signal()
+        s.mu.Unlock()
+    }
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+)
+
+func TestSchedulerTimeSlicing(t *testing.T) {
+    s := NewScheduler(1, 100)
+    defer s.Close()
+    ctx, cancel := context.WithCancel(context.Background())
+    long, _ := newTestVM(t, "+[]", 0, 0)
+    long.SetContext(ctx)
+    longDone, err := s.Submit(long)
+    if err != nil {
+        t.Fatal(err)
+    }
+    short, out := newTestVM(t, "+++#", 0, 0)
+    if err := s.Run(short); err != nil {
+        t.Fatal(err)
+    }
+    if out.String() != "3" {
+        t.Errorf("output %q, want %q", out.String(), "3")
+    }
+    select {
+    case err := <-longDone:
+        t.Fatalf("the endless program ended before the short one had its turn: %v", err)
+    default:
+    }
+    cancel()
+    if err := <-longDone; !errors.Is(err, context.Canceled) {
+        t.Errorf("canceled program ended with %v, want context.Canceled", err)
+    }
+}
+
+func TestSchedulerRun(t *testing.T) {
+    tests := []struct {
+        source   string
+        maxSteps int
+        output   string
+        fails    bool
+    }{
+        {"+++#", 0, "3", false},
+        {"++++++++++[#-]", 0, "10987654321", false},
+        {"+[+#-]", 20, "2222", true},
+        {"+[]", 1000, "", true},
+    }
+    s := NewScheduler(3, 7)
+    defer s.Close()
+    var wg sync.WaitGroup
+    for i := range 20 {
+        tt := tests[i%len(tests)]
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            vm, out := newTestVM(t, tt.source, 0, tt.maxSteps)
+            err := s.Run(vm)
+            if (err != nil) != tt.fails || out.String() != tt.output {
+                t.Errorf("%s: output %q, error %v; want %q, failure %v", tt.source, out.String(), err, tt.output, tt.fails)
+            }
+        }()
+    }
+    wg.Wait()
+}
+
+func TestSchedulerSubmit(t *testing.T) {
+    s := NewScheduler(1, 0)
+    vm, _ := newTestVM(t, "+L#", ExtHeap, 0)
+    vm.SetExtensions(0)
+    if _, err := s.Submit(vm); err == nil {
+        t.Errorf("Submit of a program needing a disabled extension succeeded")
+    }
+    s.Close()
+    vm, _ = newTestVM(t, "+#", 0, 0)
+    if _, err := s.Submit(vm); err == nil {
+        t.Errorf("Submit after Close succeeded")
+    }
+}
+
+func TestSchedulerRunSource(t *testing.T) {
+    s := NewScheduler(2, 10)
+    defer s.Close()
+    limits := RunLimits{MaxSteps: 500}
+    for i, source := range []string{"+++#", "+[+#-]", "[", ",#"} {
+        t.Run(fmt.Sprint(i), func(t *testing.T) {
+            req := RunRequest{Source: source, Stdin: "A"}
+            got, want := s.RunSource(context.Background(), req, limits), RunSource(context.Background(), req, limits)
+            if got.Exit != want.Exit || got.Stdout != want.Stdout || got.Steps != want.Steps || got.Error != want.Error {
+                t.Errorf("scheduled run %+v, want %+v", got, want)
+            }
+        })
+    }
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+)
+
+// selfTest is a case of 'flux selftest': a program using only the nine
+// core operations, its input, and the output the language defines for it
+type selfTest struct {
+    area   string // What it exercises, to group the report
+    name   string
+    source string
+    input  string
+    output string
+}
+
+// selfTests is the battery of 'flux selftest', edge cases of the core
+// semantics in the order the reference describes them. Comments are
+// whitespace only, since letters are operators of some extensions.
+var selfTests = []selfTest{
+    {"accumulator", "starts at zero", "#", "", "0"},
+    {"accumulator", "increments", "+++#", "", "3"},
+    {"accumulator", "goes below zero", "--#", "", "-2"},
+    {"accumulator", "whitespace is a comment", "+ +\n+\t#", "", "3"},
+
+    {"stack", "popping an empty stack gives zero", "+++/#", "", "0"},
+    {"stack", "pushing keeps the accumulator", "+++*#/#", "", "33"},
+    {"stack", "last in, first out", "+*+*+*/#/#/#", "", "321"},
+    {"stack", "draining past the bottom gives zero", "+*//#", "", "0"},
+
+    {"loops", "skipped when zero", "[+++]#", "", "0"},
+    {"loops", "count down", "+++[#-]#", "", "3210"},
+    {"loops", "nested", "++[*++[#-]/-]", "", "4321321"},
+    {"loops", "checked only at the brackets", "+[-#+-]#", "", "00"},
+    {"loops", "deeply nested", "+" + strings.Repeat("[", 50) + "-" + strings.Repeat("]", 50) + "#", "", "0"},
+
+    {"output", "byte", strings.Repeat("+", 65) + ".", "", "A"},
+    {"output", "wraps at 256", strings.Repeat("+", 321) + ".", "", "A"},
+    {"output", "negative values wrap", "-.", "", "\xff"},
+    {"output", "zero byte", ".", "", "\x00"},
+
+    {"input", "byte", ",#", "A", "65"},
+    {"input", "bytes are unsigned", ",#", "\xff", "255"},
+    {"input", "end of input gives zero", ",#", "", "0"},
+    {"input", "stays at end of input", ",,,#", "a", "0"},
+    {"input", "copy until end of input", ",[.,]", "hello", "hello"},
+    {"input", "reverse through the stack", "*,[*,]/[./]", "abc", "cba"},
+}
+
+// selfTestCommand implements 'flux selftest': it runs the battery with
+// the optimizer and machine configured as the flags say, and reports the
+// cases where this configuration departs from the reference semantics.
+// It exits with status 1 if there are any.
+func selfTestCommand(args []string) {
+    fs := commandFlags("selftest")
+    level := fs.Int("O", 0, "optimization `level`: 0 (only long constant output), 1 or 2")
+    strictStack := fs.Bool("strict-stack", false, "treat popping an empty stack as an error")
+    checkOverflow := fs.Bool("check-overflow", false, "treat accumulator overflow as an error instead of wrapping")
+    maxSteps := fs.Int("max-steps", 1000000, "fail a case after `n` instructions")
+    verbose := fs.Bool("v", false, "list every case, not only those that fail")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 0 {
+        fmt.Println("Error: selftest takes no files")
+        printUsage("selftest")
+        return
+    }
+
+    fmt.Printf("Self-test at -O%d, extensions %s", *level, source.extensions)
+    if *strictStack {
+        fmt.Print(", strict stack")
+    }
+    if *checkOverflow {
+        fmt.Print(", overflow checked")
+    }
+    fmt.Println()
+    failed, area := 0, ""
+    for _, t := range selfTests {
+        err := t.run(source, *level, func(vm *VM) {
+            vm.SetStrictStack(*strictStack)
+            vm.SetCheckOverflow(*checkOverflow)
+            vm.SetMaxSteps(*maxSteps)
+        })
+        if err == nil && !*verbose {
+            continue
+        }
+        if t.area != area {
+            area = t.area
+            fmt.Printf("\n  %s\n", area)
+        }
+        if err != nil {
+            failed++
+            fmt.Printf("    FAIL  %s: %v\n", t.name, err)
+        } else {
+            fmt.Printf("    ok    %s\n", t.name)
+        }
+    }
+    if area != "" {
+        fmt.Println()
+    }
+    fmt.Printf("%d of %d cases conform to the reference semantics\n", len(selfTests)-failed, len(selfTests))
+    if failed > 0 {
+        os.Exit(1)
+    }
+}
+
+// run compiles and runs the case, returning how its outcome differs from
+// the expected one
+func (t selfTest) run(source sourceOptions, level int, configure func(vm *VM)) error {
+    program, err := source.compiler(t.source).Compile()
+    if err != nil {
+        return fmt.Errorf("compilation error: %v", err)
+    }
+    program, _ = Optimize(program, level)
+    out := NewCaptureDevice(specMaxOutput)
+    out.SetInput(strings.NewReader(t.input))
+    vm := NewVM(program, nil, nil)
+    vm.SetDevice(out)
+    vm.SetExtensions(source.extensions)
+    configure(vm)
+    if err := vm.Run(); err != nil {
+        return fmt.Errorf("runtime error: %v", err)
+    }
+    if got := out.String(); got != t.output {
+        return fmt.Errorf("expected output %q, got %q", t.output, got)
+    }
+    return nil
+}
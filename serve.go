@@ -0,0 +1,304 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/netip"
+    "os"
+    "os/signal"
+    "runtime"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// serveOptions configures the HTTP service of 'flux serve'
+type serveOptions struct {
+    extensions    ExtensionSet      // Extensions programs may use
+    limits        RunLimits         // Bounds of each run; the timeout bounds evaluations in sessions too
+    sessions      SessionOptions    // Sessions of the remote REPL
+    sessionSteps  int               // Most instructions a session may execute in all (0 = no limit)
+    reportSteps   int               // Log sessions the first time they pass this many instructions (0 = never)
+    requests      RequestLimits     // Rate and size limits of each client
+    keys          map[string]string // API keys clients must present, with the client each was issued to; nil for none
+    workers, tick int               // Workers of the scheduler and the instructions of a time slice
+}
+
+// server is the HTTP service of 'flux serve': runs of whole programs,
+// which take turns on a scheduler, and sessions of a remote REPL
+type server struct {
+    opts      serveOptions
+    scheduler *Scheduler
+    sessions  *SessionStore
+}
+
+// sessionRequest is the body of an evaluation in a session
+type sessionRequest struct {
+    Source string `json:"source"`
+    Stdin  string `json:"stdin,omitempty"`
+}
+
+// sessionResponse describes an evaluation in a session and the state it
+// left the session in
+type sessionResponse struct {
+    Output      string `json:"output"`
+    Truncated   bool   `json:"truncated,omitempty"`
+    Error       string `json:"error,omitempty"`
+    Accumulator int    `json:"acc"`
+    Stack       []int  `json:"stack"`
+}
+
+// newServer starts the scheduler and the session store of a server
+func newServer(opts serveOptions) *server {
+    s := &server{opts: opts, scheduler: NewScheduler(opts.workers, opts.tick)}
+    opts.sessions.Extensions = opts.extensions
+    opts.sessions.Setup = func(vm *VM) {
+        vm.SetMaxSteps(opts.sessionSteps)
+        if opts.reportSteps > 0 {
+            vm.SetQuota(Quota{Steps: opts.reportSteps}, func(r Resource, u Usage) error {
+                log.Printf("a session has executed %d instructions", u.Steps)
+                return nil
+            })
+        }
+    }
+    s.sessions = NewSessionStore(opts.sessions)
+    return s
+}
+
+// handler returns the routes of the service, behind the authentication
+// and the request limits
+func (s *server) handler() http.Handler {
+    var h http.Handler = http.HandlerFunc(s.route)
+    if s.opts.keys != nil {
+        h = RequireAuth(h, APIKeyAuth(s.opts.keys))
+    }
+    return LimitRequests(h, s.opts.requests)
+}
+
+// route dispatches a request by method and path. Patterns with methods
+// and wildcards need Go 1.22 semantics, which a build without a go.mod
+// does not get, so the routes are matched here.
+func (s *server) route(w http.ResponseWriter, r *http.Request) {
+    id, session := strings.CutPrefix(r.URL.Path, "/sessions/")
+    switch {
+    case r.URL.Path == "/run" && r.Method == http.MethodPost:
+        s.run(w, r)
+    case r.URL.Path == "/sessions" && r.Method == http.MethodPost:
+        s.createSession(w)
+    case session && id != "" && r.Method == http.MethodPost:
+        s.eval(w, r, id)
+    case session && id != "" && r.Method == http.MethodDelete:
+        s.closeSession(w, id)
+    default:
+        WriteAPIError(w, &APIError{Status: http.StatusNotFound, Code: "not_found",
+            Message: fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path)})
+    }
+}
+
+// close waits for the runs in progress and stops the scheduler
+func (s *server) close() {
+    s.scheduler.Close()
+}
+
+// run runs a whole program, POST /run with a RunRequest
+func (s *server) run(w http.ResponseWriter, r *http.Request) {
+    var req RunRequest
+    if !s.decode(w, r, &req) {
+        return
+    }
+    if e := s.opts.requests.CheckSizes(req.Source, req.Stdin); e != nil {
+        WriteAPIError(w, e)
+        return
+    }
+    if exts, err := parseExtensions(req.Extensions); err == nil && exts&^s.opts.extensions != 0 {
+        WriteAPIError(w, &APIError{Status: http.StatusForbidden, Code: "extension_not_allowed",
+            Message: fmt.Sprintf("extension(s) %s are not allowed here", exts&^s.opts.extensions)})
+        return
+    }
+    writeJSON(w, s.scheduler.RunSource(r.Context(), req, s.opts.limits))
+}
+
+// createSession starts a session, POST /sessions, and returns its ID
+func (s *server) createSession(w http.ResponseWriter) {
+    id, err := s.sessions.Create()
+    if err != nil {
+        WriteAPIError(w, &APIError{Status: http.StatusServiceUnavailable, Code: "too_many_sessions", Message: err.Error()})
+        return
+    }
+    writeJSON(w, struct {
+        ID string `json:"id"`
+    }{id})
+}
+
+// eval evaluates source in a session, POST /sessions/{id} with a
+// sessionRequest
+func (s *server) eval(w http.ResponseWriter, r *http.Request, id string) {
+    var req sessionRequest
+    if !s.decode(w, r, &req) {
+        return
+    }
+    if e := s.opts.requests.CheckSizes(req.Source, req.Stdin); e != nil {
+        WriteAPIError(w, e)
+        return
+    }
+    ctx, cancel := s.context(r)
+    defer cancel()
+    result, err := s.sessions.Eval(ctx, id, req.Source, []byte(req.Stdin))
+    if err != nil {
+        WriteAPIError(w, &APIError{Status: http.StatusNotFound, Code: "no_session", Message: err.Error()})
+        return
+    }
+    resp := sessionResponse{Output: string(result.Output), Truncated: result.Truncated,
+        Accumulator: result.Accumulator, Stack: result.Stack}
+    if result.Err != nil {
+        resp.Error = result.Err.Error()
+    }
+    if resp.Stack == nil {
+        resp.Stack = []int{}
+    }
+    writeJSON(w, resp)
+}
+
+// closeSession discards a session, DELETE /sessions/{id}
+func (s *server) closeSession(w http.ResponseWriter, id string) {
+    s.sessions.Close(id)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// context returns the context of a run for r, which ends with the
+// request or after the timeout
+func (s *server) context(r *http.Request) (context.Context, context.CancelFunc) {
+    if s.opts.limits.Timeout > 0 {
+        return context.WithTimeout(r.Context(), s.opts.limits.Timeout)
+    }
+    return context.WithCancel(r.Context())
+}
+
+// decode reads the JSON body of r into v, or replies with the error and
+// returns false
+func (s *server) decode(w http.ResponseWriter, r *http.Request, v any) bool {
+    err := json.NewDecoder(r.Body).Decode(v)
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.As(err, &tooLarge):
+        WriteAPIError(w, &APIError{Status: http.StatusRequestEntityTooLarge, Code: "body_too_large",
+            Message: fmt.Sprintf("request body exceeds the limit of %d bytes", tooLarge.Limit)})
+    case err != nil:
+        WriteAPIError(w, &APIError{Status: http.StatusBadRequest, Code: "bad_request", Message: "invalid JSON body: " + err.Error()})
+    }
+    return err == nil
+}
+
+// writeJSON sends v as the response
+func writeJSON(w http.ResponseWriter, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+// loadAPIKeys reads a file of API keys, one per line with the name of the
+// client it was issued to after it. Blank lines and lines starting with
+// '#' are skipped.
+func loadAPIKeys(filename string) (map[string]string, error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    keys := make(map[string]string)
+    scanner := bufio.NewScanner(f)
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        key, name, _ := strings.Cut(line, " ")
+        if name = strings.TrimSpace(name); name == "" {
+            return nil, fmt.Errorf("%s:%d: expected a key and the name of its client", filename, n)
+        }
+        keys[key] = name
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("%s holds no keys", filename)
+    }
+    return keys, nil
+}
+
+// serveCommand implements 'flux serve', which runs programs for clients
+// over HTTP until it is interrupted
+func serveCommand(args []string) {
+    var opts serveOptions
+    fs := commandFlags("serve")
+    addr := fs.String("addr", "localhost:8080", "listen on `address`")
+    fs.IntVar(&opts.workers, "workers", runtime.NumCPU(), "run programs on `n` workers")
+    fs.IntVar(&opts.tick, "slice", DefaultTimeSlice, "let a program run `n` instructions before the next takes its turn")
+    fs.IntVar(&opts.limits.MaxSteps, "max-steps", 10_000_000, "stop a run after `n` instructions (0 = no limit)")
+    fs.IntVar(&opts.limits.MaxOutput, "max-output", 1<<20, "keep at most `n` bytes of a run's output")
+    fs.DurationVar(&opts.limits.Timeout, "timeout", 10*time.Second, "stop a run or a session's evaluation after `duration` (0 = no limit)")
+    fs.IntVar(&opts.sessionSteps, "session-steps", 10_000_000, "let a session execute at most `n` instructions in all (0 = no limit)")
+    fs.IntVar(&opts.reportSteps, "report-steps", 0, "log sessions that pass `n` instructions (0 = never)")
+    fs.DurationVar(&opts.sessions.TTL, "session-ttl", DefaultSessionTTL, "discard sessions idle for `duration`")
+    fs.IntVar(&opts.sessions.MaxSessions, "max-sessions", DefaultMaxSessions, "keep at most `n` sessions")
+    fs.IntVar(&opts.sessions.MaxLive, "max-live", 0, "keep the machines of at most `n` sessions, evicting the others to snapshots (0 = all)")
+    fs.Float64Var(&opts.requests.Rate, "rate", 5, "let a client make `r` requests per second on average (0 = no limit)")
+    fs.IntVar(&opts.requests.Burst, "burst", 0, "let a client make `n` requests at once (0 = the rate rounded up)")
+    fs.Int64Var(&opts.requests.MaxBody, "max-body", 1<<20, "refuse request bodies over `n` bytes (0 = no limit)")
+    fs.IntVar(&opts.requests.MaxSource, "max-source", 64<<10, "refuse sources over `n` bytes (0 = no limit)")
+    fs.IntVar(&opts.requests.MaxStdin, "max-stdin", 64<<10, "refuse input over `n` bytes (0 = no limit)")
+    fs.BoolVar(&opts.requests.TrustProxy, "trust-proxy", false, "take the client IP from X-Forwarded-For, behind a reverse proxy")
+    fs.Func("trusted-proxies", "with -trust-proxy, pass over the addresses in `list` (comma-separated prefixes) in X-Forwarded-For", func(list string) error {
+        for _, p := range strings.Split(list, ",") {
+            prefix, err := netip.ParsePrefix(strings.TrimSpace(p))
+            if err != nil {
+                return err
+            }
+            opts.requests.TrustedProxies = append(opts.requests.TrustedProxies, prefix)
+        }
+        return nil
+    })
+    keysFile := fs.String("api-keys", "", "require one of the API keys in `file`, a key and its client's name per line")
+    registerExtFlag(fs, &opts.extensions)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) > 0 {
+        fmt.Println("Error: Please specify no arguments")
+        printUsage("serve")
+        return
+    }
+    if opts.sessionSteps == 0 && opts.limits.Timeout == 0 {
+        // A session could then run forever, holding its machine
+        fmt.Println("Error: -session-steps 0 needs a -timeout")
+        return
+    }
+    if *keysFile != "" {
+        if opts.keys, err = loadAPIKeys(*keysFile); err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    s := newServer(opts)
+    defer s.close()
+    srv := &http.Server{Addr: *addr, Handler: s.handler()}
+    go func() {
+        <-ctx.Done()
+        shutdown, cancel := context.WithTimeout(context.Background(), opts.limits.Timeout+time.Second)
+        defer cancel()
+        srv.Shutdown(shutdown)
+    }()
+    log.Printf("serving on %s", *addr)
+    if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+        fmt.Printf("Error: %v\n", err)
+    }
+}
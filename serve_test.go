@@ -0,0 +1,207 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// request sends a request with a JSON body to h and decodes the response
+// into v, if not nil
+func request(t *testing.T, h http.Handler, method, path, body, key string, v any) int {
+    t.Helper()
+    r := httptest.NewRequest(method, path, strings.NewReader(body))
+    if key != "" {
+        r.Header.Set("X-API-Key", key)
+    }
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+    if v != nil && w.Code < 300 {
+        if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+            t.Fatalf("%s %s: %v in %q", method, path, err, w.Body)
+        }
+    }
+    return w.Code
+}
+
+func TestServeRun(t *testing.T) {
+    s := newServer(serveOptions{extensions: ExtAssert, limits: RunLimits{MaxSteps: 1000}, workers: 2})
+    defer s.close()
+    h := s.handler()
+    tests := []struct {
+        name   string
+        path   string
+        body   string
+        status int
+        exit   string
+        stdout string
+    }{
+        {"halted", "/run", `{"source": ",+#", "stdin": "A"}`, http.StatusOK, ExitHalted, "66"},
+        {"step limit", "/run", `{"source": "+[]"}`, http.StatusOK, ExitLimit, ""},
+        {"allowed extension", "/run", `{"source": "+*+A", "extensions": "assert"}`, http.StatusOK, ExitError, ""},
+        {"extension not allowed", "/run", `{"source": "+", "extensions": "heap"}`, http.StatusForbidden, "", ""},
+        {"unknown extension", "/run", `{"source": "+", "extensions": "nonesuch"}`, http.StatusOK, ExitCompileError, ""},
+        {"compile error", "/run", `{"source": "["}`, http.StatusOK, ExitCompileError, ""},
+        {"bad JSON", "/run", `{"source": `, http.StatusBadRequest, "", ""},
+        {"unknown route", "/nowhere", `{}`, http.StatusNotFound, "", ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var r RunResult
+            if status := request(t, h, "POST", tt.path, tt.body, "", &r); status != tt.status {
+                t.Fatalf("status %d, want %d", status, tt.status)
+            }
+            if r.Exit != tt.exit || r.Stdout != tt.stdout {
+                t.Errorf("exit %s, stdout %q; want %s, %q", r.Exit, r.Stdout, tt.exit, tt.stdout)
+            }
+        })
+    }
+}
+
+func TestServeSessions(t *testing.T) {
+    s := newServer(serveOptions{sessionSteps: 10, sessions: SessionOptions{MaxSessions: 1}})
+    defer s.close()
+    h := s.handler()
+    var created struct{ ID string }
+    if status := request(t, h, "POST", "/sessions", "", "", &created); status != http.StatusOK || created.ID == "" {
+        t.Fatalf("creating a session: status %d, ID %q", status, created.ID)
+    }
+    if status := request(t, h, "POST", "/sessions", "", "", nil); status != http.StatusServiceUnavailable {
+        t.Errorf("session past the limit: status %d, want %d", status, http.StatusServiceUnavailable)
+    }
+    path := "/sessions/" + created.ID
+    steps := []struct {
+        body   string
+        output string
+        failed bool
+        acc    int
+    }{
+        {`{"source": "++*"}`, "", false, 2},
+        {`{"source": ",#", "stdin": "A"}`, "65", false, 65},
+        {`{"source": "["}`, "", true, 65},
+        {`{"source": "+[]"}`, "", true, 66}, // Past the session's 10 instructions
+    }
+    for _, step := range steps {
+        var r sessionResponse
+        if status := request(t, h, "POST", path, step.body, "", &r); status != http.StatusOK {
+            t.Fatalf("%s: status %d", step.body, status)
+        }
+        if r.Output != step.output || (r.Error != "") != step.failed || r.Accumulator != step.acc || len(r.Stack) != 1 {
+            t.Errorf("%s: %+v", step.body, r)
+        }
+    }
+    if status := request(t, h, "DELETE", path, "", "", nil); status != http.StatusNoContent {
+        t.Errorf("closing the session: status %d", status)
+    }
+    if status := request(t, h, "POST", path, `{"source": "#"}`, "", nil); status != http.StatusNotFound {
+        t.Errorf("closed session: status %d, want %d", status, http.StatusNotFound)
+    }
+}
+
+func TestServeSessionTimeout(t *testing.T) {
+    s := newServer(serveOptions{limits: RunLimits{Timeout: 20 * time.Millisecond}})
+    defer s.close()
+    h := s.handler()
+    var created struct{ ID string }
+    request(t, h, "POST", "/sessions", "", "", &created)
+    var r sessionResponse
+    if status := request(t, h, "POST", "/sessions/"+created.ID, `{"source": "+[]"}`, "", &r); status != http.StatusOK || r.Error == "" {
+        t.Errorf("endless evaluation: status %d, %+v; want it stopped by the timeout", status, r)
+    }
+}
+
+func TestServeLimits(t *testing.T) {
+    s := newServer(serveOptions{requests: RequestLimits{Rate: 1, Burst: 4, MaxBody: 64, MaxSource: 8, MaxStdin: 4}})
+    defer s.close()
+    h := s.handler()
+    tests := []struct {
+        name   string
+        body   string
+        status int
+    }{
+        {"within the limits", `{"source": "#"}`, http.StatusOK},
+        {"body too large", `{"source": "` + strings.Repeat("+", 64) + `"}`, http.StatusRequestEntityTooLarge},
+        {"source too large", `{"source": "` + strings.Repeat("+", 9) + `"}`, http.StatusRequestEntityTooLarge},
+        {"input too large", `{"source": "#", "stdin": "abcde"}`, http.StatusRequestEntityTooLarge},
+        {"rate limited", `{"source": "#"}`, http.StatusTooManyRequests},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if status := request(t, h, "POST", "/run", tt.body, "", nil); status != tt.status {
+                t.Errorf("status %d, want %d", status, tt.status)
+            }
+        })
+    }
+}
+
+func TestServeAuth(t *testing.T) {
+    keys, err := loadAPIKeys(writeFile(t, "# key, client\nsecret alice\n\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    log.SetOutput(io.Discard) // Rejected credentials are logged
+    defer log.SetOutput(os.Stderr)
+    s := newServer(serveOptions{keys: keys})
+    defer s.close()
+    h := s.handler()
+    tests := []struct {
+        name   string
+        key    string
+        status int
+    }{
+        {"no key", "", http.StatusUnauthorized},
+        {"wrong key", "guess", http.StatusUnauthorized},
+        {"key", "secret", http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if status := request(t, h, "POST", "/run", `{"source": "#"}`, tt.key, nil); status != tt.status {
+                t.Errorf("status %d, want %d", status, tt.status)
+            }
+        })
+    }
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        keys    int
+    }{
+        {"keys", "a alice\n  b   bob  \n# c carol\n", 2},
+        {"key without a client", "a alice\nb\n", -1},
+        {"no keys", "# none yet\n", -1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            keys, err := loadAPIKeys(writeFile(t, tt.content))
+            if tt.keys < 0 {
+                if err == nil {
+                    t.Errorf("loaded %v, want an error", keys)
+                }
+                return
+            }
+            if err != nil || len(keys) != tt.keys || keys["b"] != "bob" {
+                t.Errorf("loaded %v, %v; want %d keys", keys, err, tt.keys)
+            }
+        })
+    }
+}
+
+// writeFile writes content to a file in a temporary directory and returns
+// its name
+func writeFile(t *testing.T, content string) string {
+    t.Helper()
+    name := filepath.Join(t.TempDir(), "file")
+    if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    return name
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Defaults of SessionOptions
+const (
+    DefaultSessionTTL       = 30 * time.Minute
+    DefaultMaxSessions      = 1000
+    DefaultMaxSessionOutput = 1 << 20
+)
+
+// ErrNoSession is returned for a session ID that never existed, has been
+// closed or has expired
+var ErrNoSession = errors.New("no such session")
+
+// SessionOptions configures a SessionStore. Zero fields take the defaults.
+type SessionOptions struct {
+    TTL         time.Duration // Sessions idle this long are discarded
+    MaxSessions int           // Most sessions kept, live or evicted
+    MaxLive     int           // Most sessions holding a machine; default MaxSessions
+    MaxOutput   int           // Most output kept from one evaluation
+    Extensions  ExtensionSet  // Extensions sessions may use
+    Setup       func(vm *VM)  // Configures every machine, such as its step limit
+}
+
+// SessionStore keeps remote REPL sessions between requests: like 'flux
+// interactive', each session has a machine whose accumulator, stack,
+// registers and heap carry over from one evaluation to the next. Sessions
+// idle for longer than the TTL are discarded. Beyond MaxLive sessions the
+// least recently used are evicted to a snapshot of their state, which
+// frees their machine, and restored on their next evaluation; open files
+// and coroutines do not survive eviction. A store is safe for concurrent
+// use; evaluations of one session run one at a time.
+type SessionStore struct {
+    opts     SessionOptions
+    mu       sync.Mutex
+    sessions map[string]*session
+    live     int   // Sessions holding a machine
+    spare    []*VM // Machines freed by eviction, for reuse
+}
+
+// session is one session of a SessionStore
+type session struct {
+    id   string
+    mu   sync.Mutex // Held while evaluating
+    busy int        // Evaluations holding or waiting for mu
+
+    // Guarded by the store's mutex
+    vm       *VM      // Nil while evicted
+    saved    runState // State of an evicted session
+    lastUsed time.Time
+}
+
+// SessionResult is the outcome of evaluating code in a session
+type SessionResult struct {
+    Output      []byte
+    Truncated   bool  // Whether output past MaxOutput was dropped
+    Err         error // The compilation or runtime error, if any
+    Accumulator int   // State the session was left in
+    Stack       []int
+}
+
+// NewSessionStore returns an empty store
+func NewSessionStore(opts SessionOptions) *SessionStore {
+    if opts.TTL <= 0 {
+        opts.TTL = DefaultSessionTTL
+    }
+    if opts.MaxSessions <= 0 {
+        opts.MaxSessions = DefaultMaxSessions
+    }
+    if opts.MaxLive <= 0 || opts.MaxLive > opts.MaxSessions {
+        opts.MaxLive = opts.MaxSessions
+    }
+    if opts.MaxOutput <= 0 {
+        opts.MaxOutput = DefaultMaxSessionOutput
+    }
+    return &SessionStore{opts: opts, sessions: make(map[string]*session)}
+}
+
+// Create starts a session and returns its ID, a random hex string that
+// is hard to guess
+func (st *SessionStore) Create() (string, error) {
+    var b [16]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", err
+    }
+    id := hex.EncodeToString(b[:])
+
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    st.expire(time.Now())
+    if len(st.sessions) >= st.opts.MaxSessions {
+        return "", errors.New("too many sessions")
+    }
+    st.sessions[id] = &session{id: id, lastUsed: time.Now()}
+    return id, nil
+}
+
+// Eval compiles source and runs it in the session with the given input,
+// as the REPL runs a line. Canceling ctx stops the run, leaving the
+// session as the program left it.
+func (st *SessionStore) Eval(ctx context.Context, id, source string, input []byte) (SessionResult, error) {
+    s, err := st.acquire(id)
+    if err != nil {
+        return SessionResult{}, err
+    }
+    defer st.release(s)
+
+    var r SessionResult
+    compiler := NewCompiler(source)
+    compiler.SetExtensions(st.opts.Extensions)
+    program, err := compiler.Compile()
+    if err != nil {
+        r.Err = err
+    } else {
+        out := NewCaptureDevice(st.opts.MaxOutput)
+        out.SetInput(strings.NewReader(string(input)))
+        s.vm.SetDevice(out)
+        s.vm.SetContext(ctx)
+        s.vm.Load(program)
+        r.Err = s.vm.Run()
+        s.vm.SetContext(context.Background())
+        s.vm.SetDevice(NewStreamDevice(nil, nil)) // Let the output go
+        r.Output, r.Truncated = out.Bytes(), out.Truncated()
+    }
+    r.Accumulator, r.Stack = s.vm.Accumulator(), s.vm.Stack()
+    return r, nil
+}
+
+// Close discards the session
+func (st *SessionStore) Close(id string) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    if s, ok := st.sessions[id]; ok {
+        st.remove(id, s)
+    }
+}
+
+// Len returns how many sessions the store holds, and how many of those
+// hold a machine
+func (st *SessionStore) Len() (sessions, live int) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    st.expire(time.Now())
+    return len(st.sessions), st.live
+}
+
+// acquire waits for the session's evaluations before and gives it a
+// machine, restoring its state if it was evicted
+func (st *SessionStore) acquire(id string) (*session, error) {
+    st.mu.Lock()
+    st.expire(time.Now())
+    s, ok := st.sessions[id]
+    if ok {
+        s.busy++
+    }
+    st.mu.Unlock()
+    if !ok {
+        return nil, ErrNoSession
+    }
+
+    s.mu.Lock()
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    if st.sessions[id] != s {
+        // Closed while waiting
+        st.releaseLocked(s)
+        return nil, ErrNoSession
+    }
+    s.lastUsed = time.Now()
+    if s.vm == nil {
+        var vm *VM
+        if n := len(st.spare); n > 0 {
+            vm, st.spare = st.spare[n-1], st.spare[:n-1]
+        }
+        s.vm = st.restore(vm, s.saved)
+        s.saved = runState{}
+        st.live++
+        st.evict()
+    }
+    return s, nil
+}
+
+// release ends an evaluation of the session
+func (st *SessionStore) release(s *session) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    s.lastUsed = time.Now()
+    st.releaseLocked(s)
+    st.evict()
+}
+
+// releaseLocked ends an evaluation, freeing the machine of a session
+// closed in the meantime
+func (st *SessionStore) releaseLocked(s *session) {
+    s.busy--
+    s.mu.Unlock()
+    if s.busy == 0 && st.sessions[s.id] != s {
+        st.free(s)
+    }
+}
+
+// restore sets up vm, or a new machine, with a session's saved state
+func (st *SessionStore) restore(vm *VM, state runState) *VM {
+    if vm == nil {
+        vm = NewVM(nil, nil, nil)
+    }
+    vm.Reset(NewProgram(nil))
+    vm.SetExtensions(st.opts.Extensions)
+    if st.opts.Setup != nil {
+        st.opts.Setup(vm)
+    }
+    vm.Restore(state.snapshot)
+    vm.steps = state.steps // Step limits span the session, evictions included
+    return vm
+}
+
+// evict saves and frees the machines of the least recently used idle
+// sessions until at most MaxLive sessions hold one. Sessions being
+// evaluated are left alone, so there may be more for a while.
+func (st *SessionStore) evict() {
+    for st.live > st.opts.MaxLive {
+        var oldest *session
+        for _, s := range st.sessions {
+            if s.vm != nil && s.busy == 0 && (oldest == nil || s.lastUsed.Before(oldest.lastUsed)) {
+                oldest = s
+            }
+        }
+        if oldest == nil {
+            return
+        }
+        oldest.saved = captureState(oldest.vm)
+        st.free(oldest)
+    }
+}
+
+// expire discards the sessions idle for longer than the TTL
+func (st *SessionStore) expire(now time.Time) {
+    for id, s := range st.sessions {
+        if s.busy == 0 && now.Sub(s.lastUsed) > st.opts.TTL {
+            st.remove(id, s)
+        }
+    }
+}
+
+// remove discards a session. A busy session keeps its machine until its
+// evaluations end.
+func (st *SessionStore) remove(id string, s *session) {
+    delete(st.sessions, id)
+    if s.busy == 0 {
+        st.free(s)
+    }
+}
+
+// free keeps the machine of a session that needs it no more for reuse
+func (st *SessionStore) free(s *session) {
+    if s.vm != nil {
+        s.vm.CloseFiles()
+        st.spare = append(st.spare, s.vm)
+        s.vm = nil
+        st.live--
+    }
+}
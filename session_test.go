@@ -0,0 +1,114 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+// mustEval evaluates source in a session and returns its output
+func mustEval(t *testing.T, st *SessionStore, id, source string) string {
+    t.Helper()
+    r, err := st.Eval(context.Background(), id, source, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if r.Err != nil {
+        t.Fatalf("%s: %v", source, r.Err)
+    }
+    return string(r.Output)
+}
+
+func TestSessionState(t *testing.T) {
+    st := NewSessionStore(SessionOptions{})
+    id, err := st.Create()
+    if err != nil {
+        t.Fatal(err)
+    }
+    mustEval(t, st, id, "+++")
+    r, err := st.Eval(context.Background(), id, "[", nil)
+    if err != nil || r.Err == nil {
+        t.Errorf("Eval of a compilation error = %v, %v; want the error in the result", r.Err, err)
+    }
+    if out := mustEval(t, st, id, "+#"); out != "4" {
+        t.Errorf("output %q, want %q", out, "4")
+    }
+    r, _ = st.Eval(context.Background(), id, ",", []byte("A"))
+    if r.Accumulator != 'A' {
+        t.Errorf("accumulator %d after reading input, want %d", r.Accumulator, 'A')
+    }
+    st.Close(id)
+    if _, err := st.Eval(context.Background(), id, "#", nil); !errors.Is(err, ErrNoSession) {
+        t.Errorf("Eval after Close = %v, want ErrNoSession", err)
+    }
+}
+
+func TestSessionEviction(t *testing.T) {
+    st := NewSessionStore(SessionOptions{MaxLive: 1, Setup: func(vm *VM) { vm.SetMaxSteps(10) }})
+    a, _ := st.Create()
+    b, _ := st.Create()
+    mustEval(t, st, a, "+++")
+    mustEval(t, st, b, "++*")
+    if sessions, live := st.Len(); sessions != 2 || live != 1 {
+        t.Errorf("%d sessions, %d live; want 2, 1", sessions, live)
+    }
+    // a was evicted to a snapshot, the least recently used, and comes back
+    // as it was
+    if out := mustEval(t, st, a, "#"); out != "3" {
+        t.Errorf("a: output %q after eviction, want %q", out, "3")
+    }
+    r, err := st.Eval(context.Background(), b, "#", nil)
+    if err != nil || string(r.Output) != "2" || len(r.Stack) != 1 || r.Stack[0] != 2 {
+        t.Errorf("b: output %q, stack %v, %v after eviction; want \"2\", [2]", r.Output, r.Stack, err)
+    }
+    // The step limit counts the instructions before the eviction
+    r, _ = st.Eval(context.Background(), a, "+#+#+#+#+#", nil)
+    var stepLimit *StepLimitError
+    if !errors.As(r.Err, &stepLimit) {
+        t.Errorf("a: %v past 10 instructions across an eviction, want the step limit", r.Err)
+    }
+}
+
+func TestSessionCancel(t *testing.T) {
+    st := NewSessionStore(SessionOptions{})
+    id, _ := st.Create()
+    mustEval(t, st, id, "+++")
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    r, err := st.Eval(ctx, id, "[]", nil)
+    if err != nil || r.Err == nil || !strings.Contains(r.Err.Error(), "interrupted") {
+        t.Fatalf("endless evaluation past its deadline = %v, %v; want an interruption", r.Err, err)
+    }
+    if out := mustEval(t, st, id, "#"); out != "3" {
+        t.Errorf("output %q after the interruption, want %q", out, "3")
+    }
+}
+
+func TestSessionExpiry(t *testing.T) {
+    st := NewSessionStore(SessionOptions{TTL: 20 * time.Millisecond})
+    old, _ := st.Create()
+    time.Sleep(30 * time.Millisecond)
+    fresh, _ := st.Create()
+    if _, err := st.Eval(context.Background(), old, "#", nil); !errors.Is(err, ErrNoSession) {
+        t.Errorf("Eval of an expired session = %v, want ErrNoSession", err)
+    }
+    mustEval(t, st, fresh, "#")
+    if sessions, _ := st.Len(); sessions != 1 {
+        t.Errorf("%d sessions, want 1", sessions)
+    }
+}
+
+func TestSessionLimit(t *testing.T) {
+    st := NewSessionStore(SessionOptions{MaxSessions: 2})
+    a, _ := st.Create()
+    st.Create()
+    if _, err := st.Create(); err == nil {
+        t.Errorf("Create past MaxSessions succeeded")
+    }
+    st.Close(a)
+    if _, err := st.Create(); err != nil {
+        t.Errorf("Create after Close = %v", err)
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// sourceMapVersion is the format version written by writeSourceMap
+const sourceMapVersion = 1
+
+// SourceMap relates the instructions of a compiled program to the source
+// they came from. 'flux compile -o' writes one next to the .fluxc file, so
+// a program compiled with -strip can still be debugged, and report errors
+// by line, where its source is at hand.
+type SourceMap struct {
+    Version      int           `json:"version"`
+    File         string        `json:"file"`         // Source file, relative to the map
+    SourceHash   string        `json:"sourceHash"`   // SHA-256 of the source, in hex
+    Instructions []SourceRange `json:"instructions"` // Where each instruction came from, by address
+    Lines        map[int][]int `json:"lines"`        // Addresses of the instructions starting on each line
+}
+
+// SourceRange is the stretch of source an instruction was compiled from.
+// It runs up to the next instruction's source, leaving out whitespace, so
+// it includes comments and, for instructions the optimizer merged, every
+// operator merged. Lines and columns are 1-based; the end is exclusive.
+type SourceRange struct {
+    Offset    int `json:"offset"`
+    Line      int `json:"line"`
+    Column    int `json:"column"`
+    EndLine   int `json:"endLine"`
+    EndColumn int `json:"endColumn"`
+}
+
+// sourceMapPath returns the name of the source map for a .fluxc file
+func sourceMapPath(bytecodePath string) string {
+    return strings.TrimSuffix(bytecodePath, filepath.Ext(bytecodePath)) + ".fluxmap"
+}
+
+// newSourceMap builds the source map of a program with debug information;
+// the source file is named relative to mapPath
+func newSourceMap(program *Program, mapPath string) *SourceMap {
+    debug := program.Debug
+    m := &SourceMap{
+        Version:    sourceMapVersion,
+        File:       debug.File,
+        SourceHash: hex.EncodeToString(program.SourceHash[:]),
+        Lines:      make(map[int][]int),
+    }
+    if abs, err := filepath.Abs(debug.File); err == nil {
+        if dir, err := filepath.Abs(filepath.Dir(mapPath)); err == nil {
+            if rel, err := filepath.Rel(dir, abs); err == nil {
+                m.File = filepath.ToSlash(rel)
+            }
+        }
+    }
+
+    // An instruction's source ends where the next one's, in source order, starts
+    starts := append([]int(nil), debug.Positions...)
+    sort.Ints(starts)
+    lines := lineStarts(debug.Source)
+    for pc, pos := range debug.Positions {
+        end := len(debug.Source)
+        if i := sort.SearchInts(starts, pos+1); i < len(starts) {
+            end = starts[i]
+        }
+        for end > pos+1 && strings.IndexByte(" \t\r\n", debug.Source[end-1]) >= 0 {
+            end--
+        }
+        r := SourceRange{Offset: pos}
+        r.Line, r.Column = lineColAt(lines, pos)
+        r.EndLine, r.EndColumn = lineColAt(lines, end)
+        m.Instructions = append(m.Instructions, r)
+        m.Lines[r.Line] = append(m.Lines[r.Line], pc)
+    }
+    return m
+}
+
+// writeSourceMap writes the source map of a program with debug information
+// to path
+func writeSourceMap(program *Program, path string) error {
+    data, err := json.MarshalIndent(newSourceMap(program, path), "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// loadSourceMap gives a program loaded from the .fluxc file bytecodePath
+// without debug information the debug information of its source map, if
+// the map and the source it names are there and match the program.
+// Anything missing or stale leaves the program as it is.
+func loadSourceMap(program *Program, bytecodePath string) {
+    path := sourceMapPath(bytecodePath)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return
+    }
+    var m SourceMap
+    if json.Unmarshal(data, &m) != nil || m.Version != sourceMapVersion || len(m.Instructions) != len(program.Instructions) {
+        return
+    }
+    if m.SourceHash != hex.EncodeToString(program.SourceHash[:]) {
+        return
+    }
+    file := filepath.Join(filepath.Dir(path), filepath.FromSlash(m.File))
+    source, err := os.ReadFile(file)
+    if err != nil || sha256.Sum256(source) != program.SourceHash {
+        return
+    }
+    debug := &DebugInfo{File: file, Source: source}
+    for _, r := range m.Instructions {
+        if r.Offset < 0 || r.Offset > len(source) {
+            return
+        }
+        debug.Positions = append(debug.Positions, r.Offset)
+    }
+    program.Debug = debug
+}
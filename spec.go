@@ -0,0 +1,400 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "./fluxgrade"
+)
+
+// specMaxOutput is the most output a spec test keeps, so that a program
+// printing without end fails its test instead of exhausting memory
+const specMaxOutput = 1 << 20
+
+// specFile is a conformance suite file: a JSON document holding a list of
+// spec tests. The format is deliberately plain so alternative Flux
+// implementations can run the same suite without this toolchain. A suite
+// may also hold .flux fixtures, each a test of its own whose expectations
+// are annotations at the top of the program (see annotate).
+type specFile struct {
+    Description string     `json:"description,omitempty"`
+    Tests       []specTest `json:"tests"`
+}
+
+// specTest describes one program run and what it must produce. Expectations
+// that are left out are not checked.
+type specTest struct {
+    Name        string            `json:"name"`
+    Source      string            `json:"source"`
+    Stdin       string            `json:"stdin,omitempty"`
+    Stdout      *string           `json:"stdout,omitempty"`          // Expected output as text
+    StdoutBytes []byte            `json:"stdout_bytes,omitempty"`    // Expected output as raw bytes, for non-UTF-8 output
+    Acc         *int              `json:"acc,omitempty"`             // Expected final accumulator
+    Stack       []int             `json:"stack,omitempty"`           // Expected final stack, bottom first
+    EmptyStack  bool              `json:"empty_stack,omitempty"`     // Expect the stack to end empty
+    Registers   map[string]int    `json:"registers,omitempty"`       // Expected final registers by name; others are not checked
+    Heap        []int             `json:"heap,omitempty"`            // Expected final heap cells, address 1 first
+    MaxSteps    int               `json:"max_steps,omitempty"`       // Step limit for the run
+    StrictStack bool              `json:"strict_stack,omitempty"`    // Run with strict stack checking
+    Error       string            `json:"error,omitempty"`           // "compile" or "runtime" when the run must fail
+    ErrorText   string            `json:"error_contains,omitempty"`  // Text the expected error's message must contain
+    MaxDepth    int               `json:"max_stack_depth,omitempty"` // Deepest the stack may get
+    Extensions  string            `json:"extensions,omitempty"`      // Comma-separated extensions to enable
+    ClockStepMs int               `json:"clock_step_ms,omitempty"`   // Milliseconds the fake clock advances per reading
+    Dumps       *string           `json:"dumps,omitempty"`           // Expected output of the dump extension
+    Env         map[string]string `json:"env,omitempty"`             // Environment variables the env extension may read
+    Skip        string            `json:"skip,omitempty"`            // Reason to leave the test out, such as a known bug
+}
+
+// specCase is a test of a suite together with the file it came from
+type specCase struct {
+    path    string
+    test    specTest
+    broken  bool          // The file could not be loaded; err says why
+    skipped bool          // The test was not run because of its skip field
+    err     error         // Unmet expectation of the run, if any
+    elapsed time.Duration // How long the test took
+}
+
+// id names the test for -run: the suite's file name without .json or
+// .flux, a slash and the test's name
+func (c *specCase) id() string {
+    base := filepath.Base(c.path)
+    return strings.TrimSuffix(base, filepath.Ext(base)) + "/" + c.test.Name
+}
+
+// specCommand implements 'flux spec'
+func specCommand(args []string) {
+    if len(args) > 0 && args[0] == "export" {
+        specExportCommand(args[1:])
+        return
+    }
+    if len(args) == 0 || args[0] != "run" {
+        printUsage("spec")
+        return
+    }
+
+    fs := commandFlags("spec run")
+    verbose := fs.Bool("v", false, "list every test, not just failures")
+    workers := fs.Int("p", runtime.GOMAXPROCS(0), "run `n` tests at a time")
+    pattern := fs.String("run", "", "run only the tests whose file/name matches `regexp`")
+    shardSpec := fs.String("shard", "", "run only shard `k/n` of the tests, for splitting a suite across n machines")
+    format := fs.String("format", "text", "report results as `format`: text, junit (XML), tap or json")
+    paths, err := parseArgs(fs, args[1:])
+    if err != nil {
+        return
+    }
+    if len(paths) == 0 || *workers < 1 {
+        fmt.Println("Error: Please specify a spec directory or file")
+        printUsage("spec")
+        return
+    }
+    var filter *regexp.Regexp
+    if *pattern != "" {
+        if filter, err = regexp.Compile(*pattern); err != nil {
+            fmt.Printf("Error: invalid -run pattern: %v\n", err)
+            return
+        }
+    }
+    shard, shards, err := parseShard(*shardSpec)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    report, ok := specFormats[*format]
+    if !ok {
+        fmt.Printf("Error: unknown format %q; use text, junit, tap or json\n", *format)
+        return
+    }
+
+    files, err := specFiles(paths)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    // Every instance of a sharded run sees the tests in the same order and
+    // takes every nth of those selected by -run. Files that cannot be
+    // loaded fail every shard.
+    var cases []*specCase
+    selected := 0
+    for _, path := range files {
+        tests, err := loadSpecFile(path)
+        if err != nil {
+            cases = append(cases, &specCase{path: path, broken: true, err: err})
+            continue
+        }
+        for _, test := range tests {
+            c := &specCase{path: path, test: test}
+            if filter != nil && !filter.MatchString(c.id()) {
+                continue
+            }
+            if selected%shards == shard-1 {
+                cases = append(cases, c)
+            }
+            selected++
+        }
+    }
+
+    runSpecCases(cases, *workers)
+    report(os.Stdout, cases, *verbose)
+    for _, c := range cases {
+        if c.err != nil {
+            os.Exit(1)
+        }
+    }
+}
+
+// parseShard parses a -shard value k/n, 1 <= k <= n; the empty string is
+// the single shard 1/1
+func parseShard(spec string) (int, int, error) {
+    if spec == "" {
+        return 1, 1, nil
+    }
+    var k, n int
+    if _, err := fmt.Sscanf(spec, "%d/%d", &k, &n); err != nil || n < 1 || k < 1 || k > n || fmt.Sprintf("%d/%d", k, n) != spec {
+        return 0, 0, fmt.Errorf("invalid -shard %q: expected k/n with 1 <= k <= n, such as 2/5", spec)
+    }
+    return k, n, nil
+}
+
+// runSpecCases runs the tests on the given number of goroutines, storing
+// each outcome in its case
+func runSpecCases(cases []*specCase, workers int) {
+    next := make(chan *specCase)
+    var wg sync.WaitGroup
+    for range min(workers, len(cases)) {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for c := range next {
+                if c.test.Skip != "" {
+                    c.skipped = true
+                    continue
+                }
+                start := time.Now()
+                c.err = c.test.run()
+                c.elapsed = time.Since(start)
+            }
+        }()
+    }
+    for _, c := range cases {
+        if !c.broken {
+            next <- c
+        }
+    }
+    close(next)
+    wg.Wait()
+}
+
+// loadSpecFile reads the tests of a suite file or fixture
+func loadSpecFile(path string) ([]specTest, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("Error reading spec file '%s': %v", path, err)
+    }
+    var suite specFile
+    if filepath.Ext(path) == ".flux" {
+        base := filepath.Base(path)
+        suite.Tests = []specTest{{Name: strings.TrimSuffix(base, ".flux"), Source: string(data)}}
+    } else if err := json.Unmarshal(data, &suite); err != nil {
+        return nil, fmt.Errorf("Error parsing spec file '%s': %v", path, err)
+    }
+    for i := range suite.Tests {
+        if err := suite.Tests[i].annotate(); err != nil {
+            return nil, fmt.Errorf("Error in spec test '%s' of '%s': %v", suite.Tests[i].Name, path, err)
+        }
+    }
+    return suite.Tests, nil
+}
+
+// annotationPrefix starts the lines at the top of a test's source that
+// set its expectations
+const annotationPrefix = "# flux:"
+
+// annotate applies the annotations at the top of the test's source and
+// removes them from it, since '#' is an instruction:
+//
+//	# flux:skip [reason]                        skip, "annotated" if no reason
+//	# flux:expect-error compile|runtime [text]  error and error_contains
+//	# flux:max-steps n                          max_steps; 1e6 is a million
+//
+// An annotation overrides the field it sets.
+func (t *specTest) annotate() error {
+    for strings.HasPrefix(t.Source, annotationPrefix) {
+        line, rest, _ := strings.Cut(t.Source, "\n")
+        t.Source = rest
+        key, value, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, annotationPrefix)), " ")
+        value = strings.TrimSpace(value)
+        switch key {
+        case "skip":
+            t.Skip = value
+            if value == "" {
+                t.Skip = "annotated"
+            }
+        case "expect-error":
+            kind, text, _ := strings.Cut(value, " ")
+            if kind != "compile" && kind != "runtime" {
+                return fmt.Errorf("%sexpect-error %q: expected compile or runtime", annotationPrefix, value)
+            }
+            t.Error, t.ErrorText = kind, strings.TrimSpace(text)
+        case "max-steps":
+            n, err := strconv.ParseFloat(value, 64)
+            if err != nil || n < 1 || n != float64(int(n)) {
+                return fmt.Errorf("%smax-steps %q: expected a positive whole number", annotationPrefix, value)
+            }
+            t.MaxSteps = int(n)
+        default:
+            return fmt.Errorf("unknown annotation %s%s", annotationPrefix, key)
+        }
+    }
+    return nil
+}
+
+// specFiles expands directories into the .json suites and .flux fixtures
+// they contain
+func specFiles(paths []string) ([]string, error) {
+    var files []string
+    for _, path := range paths {
+        info, err := os.Stat(path)
+        if err != nil {
+            return nil, err
+        }
+        if !info.IsDir() {
+            files = append(files, path)
+            continue
+        }
+        var matches []string
+        for _, pattern := range []string{"*.json", "*.flux"} {
+            m, err := filepath.Glob(filepath.Join(path, pattern))
+            if err != nil {
+                return nil, err
+            }
+            matches = append(matches, m...)
+        }
+        sort.Strings(matches)
+        files = append(files, matches...)
+    }
+    return files, nil
+}
+
+// run grades the test as a single case, with a Grader that leaves the
+// final state of the machine for the test to check, and returns a
+// description of the first unmet expectation
+func (t specTest) run() error {
+    extensions, err := parseExtensions(t.Extensions)
+    if err != nil {
+        return err
+    }
+    var vm *VM
+    var dumps bytes.Buffer
+    runner := GradeRunner{
+        Limits:     RunLimits{MaxSteps: t.MaxSteps, MaxOutput: specMaxOutput},
+        Extensions: extensions,
+        Setup: func(m *VM) {
+            vm = m
+            m.SetDumpOutput(&dumps)
+            m.SetStrictStack(t.StrictStack)
+            if t.Env != nil {
+                m.SetEnv(t.Env)
+            }
+            m.SetClock(NewFakeClock(time.Unix(0, 0), time.Duration(t.ClockStepMs)*time.Millisecond))
+        },
+    }
+    g := fluxgrade.Grader{Runner: runner, Exact: true}
+    checkStdout := t.Stdout != nil || t.StdoutBytes != nil
+    c := fluxgrade.GradeCase{Name: t.Name, Input: t.Stdin, Expected: string(t.StdoutBytes)}
+    if t.Stdout != nil {
+        c.Expected = *t.Stdout
+    }
+    report, err := g.Grade(context.Background(), t.Source, []fluxgrade.GradeCase{c})
+    if err != nil {
+        return err
+    }
+    if report.Verdict == fluxgrade.VerdictCompileError {
+        if t.Error == "compile" {
+            return t.checkErrorText(report.Compile)
+        }
+        return fmt.Errorf("unexpected compilation error: %s", report.Compile)
+    }
+    if t.Error == "compile" {
+        return fmt.Errorf("expected a compilation error")
+    }
+
+    r := report.Cases[0]
+    failed := r.Verdict == fluxgrade.VerdictRuntimeError || r.Verdict == fluxgrade.VerdictTimeLimit
+    switch {
+    case failed && t.Error != "runtime":
+        return fmt.Errorf("unexpected runtime error: %s", r.Error)
+    case !failed && t.Error == "runtime":
+        return fmt.Errorf("expected a runtime error")
+    case failed:
+        if err := t.checkErrorText(r.Error); err != nil {
+            return err
+        }
+    }
+
+    // The grader only compares the output of runs that end normally
+    if checkStdout && (r.Verdict == fluxgrade.VerdictWrongAnswer || failed && r.Output != c.Expected) {
+        switch {
+        case r.Truncated:
+            return fmt.Errorf("stdout: more than the %d bytes of output a test may write", specMaxOutput)
+        case t.Stdout != nil:
+            return fmt.Errorf("stdout: expected %q, got %q", *t.Stdout, r.Output)
+        default:
+            return fmt.Errorf("stdout: expected bytes %v, got %v", t.StdoutBytes, []byte(r.Output))
+        }
+    }
+    if t.Dumps != nil && dumps.String() != *t.Dumps {
+        return fmt.Errorf("dumps: expected %q, got %q", *t.Dumps, dumps.String())
+    }
+    if t.Acc != nil && vm.Accumulator() != *t.Acc {
+        return fmt.Errorf("acc: expected %d, got %d", *t.Acc, vm.Accumulator())
+    }
+    stack := vm.Stack()
+    if t.Stack != nil && fmt.Sprint(stack) != fmt.Sprint(t.Stack) {
+        return fmt.Errorf("stack: expected %v, got %v", t.Stack, stack)
+    }
+    if t.EmptyStack && len(stack) != 0 {
+        return fmt.Errorf("stack: expected empty, got %v", stack)
+    }
+    for name := range t.Registers {
+        if len(name) != 1 || !strings.Contains(registerNames, name) {
+            return fmt.Errorf("registers: no register named %q", name)
+        }
+    }
+    registers := vm.Snapshot().Registers
+    for r, got := range registers {
+        name := registerNames[r : r+1]
+        if want, ok := t.Registers[name]; ok && got != want {
+            return fmt.Errorf("register %s: expected %d, got %d", name, want, got)
+        }
+    }
+    if heap := vm.Heap(); t.Heap != nil && fmt.Sprint(heap) != fmt.Sprint(t.Heap) {
+        return fmt.Errorf("heap: expected %v, got %v", t.Heap, heap)
+    }
+    if t.MaxDepth > 0 && vm.Stats().MaxStackDepth > t.MaxDepth {
+        return fmt.Errorf("stack: expected at most %d deep, got %d", t.MaxDepth, vm.Stats().MaxStackDepth)
+    }
+    return nil
+}
+
+// checkErrorText returns an error unless message, that of the failure
+// the test expected, has the text the test asks for
+func (t specTest) checkErrorText(message string) error {
+    if !strings.Contains(message, t.ErrorText) {
+        return fmt.Errorf("error: expected a message containing %q, got %q", t.ErrorText, message)
+    }
+    return nil
+}
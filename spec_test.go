@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestSpecAnnotate(t *testing.T) {
+    tests := []struct {
+        name   string
+        source string
+        want   specTest
+        fails  bool
+    }{
+        {"none", "+#", specTest{Source: "+#"}, false},
+        {"skip", "# flux:skip known bug\n+#", specTest{Source: "+#", Skip: "known bug"}, false},
+        {"skip without a reason", "# flux:skip\n+", specTest{Source: "+", Skip: "annotated"}, false},
+        {"expect-error", "# flux:expect-error compile unmatched '['\n[", specTest{Source: "[", Error: "compile", ErrorText: "unmatched '['"}, false},
+        {"max-steps", "# flux:max-steps 1e6\r\n# flux:expect-error runtime\n+[]", specTest{Source: "+[]", Error: "runtime", MaxSteps: 1000000}, false},
+        {"only at the top", "+\n# flux:skip\n", specTest{Source: "+\n# flux:skip\n"}, false},
+        {"bad error kind", "# flux:expect-error link\n+", specTest{}, true},
+        {"fractional max-steps", "# flux:max-steps 1.5\n+", specTest{}, true},
+        {"unknown", "# flux:nonesuch\n+", specTest{}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := specTest{Source: tt.source}
+            err := got.annotate()
+            if tt.fails {
+                if err == nil {
+                    t.Errorf("annotated as %+v, want an error", got)
+                }
+                return
+            }
+            if err != nil || got.Source != tt.want.Source || got.Skip != tt.want.Skip || got.Error != tt.want.Error ||
+                got.ErrorText != tt.want.ErrorText || got.MaxSteps != tt.want.MaxSteps {
+                t.Errorf("annotated as %+v, %v; want %+v", got, err, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math/bits"
+    "sort"
+)
+
+// SemanticsVersion is the version of the document 'flux spec export'
+// writes. It changes when a field changes meaning, not when operations
+// are added.
+const SemanticsVersion = 1
+
+// Semantics is the operational semantics of the language in a form other
+// implementations and verifiers can read: the machine state, the state
+// transition of every opcode, the options that change them and the
+// extensions. It is generated from opTable, opDocs and opTransitions, so
+// it describes exactly the opcodes this flux executes.
+type Semantics struct {
+    Version    int                  `json:"flux_semantics"`
+    ISA        int                  `json:"isa"` // Instruction set version, as in bytecode
+    Notation   []string             `json:"notation"`
+    State      []SemanticsField     `json:"state"`
+    Execution  []string             `json:"execution"`
+    Faults     []SemanticsFault     `json:"faults"`
+    Options    []SemanticsOption    `json:"options"`
+    Extensions []SemanticsExtension `json:"extensions"`
+    Operations []OpSemantics        `json:"operations"`
+}
+
+// SemanticsField is a component of the machine state
+type SemanticsField struct {
+    Name        string `json:"name"`
+    Initial     string `json:"initial"`
+    Description string `json:"description"`
+}
+
+// SemanticsFault is a fault a program may catch with the trap extension
+type SemanticsFault struct {
+    Code        int    `json:"code"`
+    Name        string `json:"name"`
+    Description string `json:"description"`
+}
+
+// SemanticsOption is a machine option that changes the transitions
+type SemanticsOption struct {
+    Name    string `json:"name"`
+    Flag    string `json:"flag,omitempty"` // Option of 'flux run', if it has one
+    Default string `json:"default"`
+    Effect  string `json:"effect"`
+}
+
+// SemanticsExtension is an opt-in extension
+type SemanticsExtension struct {
+    Name       string   `json:"name"`
+    Bit        int      `json:"bit"` // Bit of the extension set in bytecode
+    Summary    string   `json:"summary"`
+    Operations []string `json:"operations"` // Mnemonics of its opcodes
+}
+
+// OpSemantics is the state transition of an opcode
+type OpSemantics struct {
+    Code       int      `json:"code"`
+    Mnemonic   string   `json:"mnemonic"`
+    Name       string   `json:"name"`
+    Symbol     string   `json:"symbol,omitempty"` // Absent for opcodes only the optimizer emits
+    Operand    string   `json:"operand"`
+    Extension  string   `json:"extension,omitempty"`
+    Summary    string   `json:"summary"`
+    Transition []string `json:"transition"`
+    Semantics  []string `json:"semantics,omitempty"` // The prose of 'flux doc'
+}
+
+// semanticsNotation explains how the transitions are written
+var semanticsNotation = []string{
+    "A transition is a list of rules, applied in order; a rule 'condition: updates' applies only if the condition holds",
+    "x' is component x after the step; components not updated keep their value, and pc' = pc + 1 unless a rule sets pc'",
+    "Arg is the operand of the instruction at pc, and inst[n] the instruction at address n",
+    "pop removes the top of the stack and yields it, or yields 0 if the stack is empty (fault underflow with strict_stack); v = pop names the value",
+    "s ++ t appends to a sequence; |s| is its length; stack is listed bottom first",
+    "Integer arithmetic is on 64-bit two's complement values and wraps (fault overflow with check_overflow)",
+    "byte(x) is x modulo 256 as an unsigned byte; f(x) reads the 64 bits of x as an IEEE 754 double and bits(y) does the reverse",
+    "fault(name) stops the step with the fault, which a trap handler may catch; error(...) stops the program and cannot be caught",
+    "yield lets the next coroutine that can make progress run after the step",
+}
+
+// semanticsState describes the machine state
+var semanticsState = []SemanticsField{
+    {"pc", "0", "Address of the next instruction"},
+    {"acc", "0", "The accumulator, a 64-bit signed integer"},
+    {"stack", "[]", "Unbounded stack of 64-bit signed integers"},
+    {"in", "the input", "Bytes not yet read from standard input"},
+    {"out", "[]", "Bytes written to standard output"},
+    {"reg", "[0 x 8]", "Registers a to h of the registers extension, reg[0] to reg[7]"},
+    {"calls", "[]", "Return addresses of the executing blocks of the eval extension"},
+    {"traps", "[]", "Handlers of the trap extension: (handler, stack depth, call depth) each"},
+    {"heap", "the data blocks", "Cells of the heap extension, the program's data blocks first; address 1 is heap[0]"},
+    {"coroutines", "[main]", "Coroutines of the coroutine extension, each with its own pc, acc, stack and calls, and an inbox"},
+    {"files", "{}", "Files open through the fs extension, by handle"},
+    {"conn", "none", "The TCP connection accepted through the net extension"},
+}
+
+// semanticsExecution describes how steps make a run
+var semanticsExecution = []string{
+    "A program is a sequence of instructions, each an opcode and an operand Arg",
+    "A step executes inst[pc]; the run halts when pc = |program| in the main coroutine, and a coroutine ends when it does so in its own",
+    "A fault with a trap installed is caught: traps' = traps without its last entry (h, d, c), stack' = the bottom d values, calls' = the first c entries, acc' = the fault code, pc' = h",
+    "An uncaught fault or any error ends the run unsuccessfully; output written before it remains",
+    "Executing an opcode of an extension the machine has not enabled is an error before the first step",
+}
+
+// semanticsFaults lists the fault codes
+var semanticsFaults = []SemanticsFault{
+    {FaultUnderflow, "underflow", "Pop from an empty stack with strict_stack"},
+    {FaultAssert, "assert", "Failed assertion"},
+    {FaultOverflow, "overflow", "Accumulator overflow with check_overflow"},
+    {FaultOperand, "operand", "Operand out of range: a shift count, block, coroutine, heap cell, row or color"},
+    {FaultLimit, "limit", "Too many block calls, coroutines or heap cells"},
+}
+
+// semanticsOptions lists the machine options that change transitions
+var semanticsOptions = []SemanticsOption{
+    {"strict_stack", "-strict-stack", "false", "pop on an empty stack is fault(underflow) instead of yielding 0"},
+    {"check_overflow", "-check-overflow", "false", "arithmetic and SHL that leave the 64-bit range are fault(overflow) instead of wrapping"},
+    {"max_steps", "-max-steps", "0", "the run ends with an error after this many steps; 0 is no limit"},
+    {"max_call_depth", "", fmt.Sprint(DefaultMaxCallDepth), "EXEC with this many blocks executing is fault(limit); 0 is no limit"},
+    {"max_heap", "-max-heap", fmt.Sprint(DefaultMaxHeap), "ALLOC beyond this many cells in all is fault(limit); 0 is no limit"},
+    {"max_sleep", "-max-sleep", DefaultMaxSleep.String(), "SLEEP pauses at most this long"},
+    {"max_coroutines", "", fmt.Sprint(MaxCoroutines), "SPAWN with more coroutines than this is fault(limit); fixed"},
+    {"deterministic", "-deterministic", "false", "programs using the probe, clock, fs, env or net extensions are refused before the first step"},
+}
+
+// opTransitions gives the state transition of every opcode, indexed by
+// opcode, in the notation of semanticsNotation. Effects outside the
+// machine, such as on files, are given by what the program can observe.
+var opTransitions = [...][]string{
+    OpInc:       {"acc' = acc + 1"},
+    OpDec:       {"acc' = acc - 1"},
+    OpPush:      {"stack' = stack ++ [acc]"},
+    OpPop:       {"acc' = pop"},
+    OpLoop:      {"acc = 0: pc' = Arg"},
+    OpEnd:       {"acc != 0: pc' = Arg"},
+    OpOut:       {"out' = out ++ [byte(acc)]"},
+    OpIn:        {"in = [b] ++ rest: acc' = b, in' = rest", "in = []: acc' = 0"},
+    OpOutNum:    {"out' = out ++ the decimal digits of acc, with a leading '-' if negative"},
+    OpAdd:       {"acc' = acc + Arg"},
+    OpSet:       {"acc' = the integer constant Arg"},
+    OpEmitBytes: {"out' = out ++ the byte string constant Arg"},
+    OpProbe:     {"input is waiting: acc' = 1", "otherwise: acc' = 0"},
+    OpSleep:     {"acc > 0: pause for min(acc milliseconds, max_sleep)"},
+    OpClock:     {"acc' = milliseconds since the run started"},
+    OpTime:      {"acc' = seconds since the Unix epoch"},
+    OpFileOpen: {
+        "n = pop; n < 0 or n > |stack|: error",
+        "name = the n topmost values of stack as bytes, deepest first; stack' = stack without them",
+        "acc not in {0 read, 1 write, 2 append}: error",
+        "h = a new handle greater than any before, or 0 if the file cannot be opened",
+        "stack' = stack ++ [h], acc' = h",
+    },
+    OpFileRead: {
+        "h = the top of stack, not removed; h is not a file open for reading: error",
+        "acc' = the next byte of file h, or -1 at its end",
+    },
+    OpFileWrite: {"h = the top of stack, not removed; h is not a file open for writing: error", "file h ++ [byte(acc)]"},
+    OpFileClose: {"h = the top of stack; h is not an open file: error", "stack' = stack without h; file h is closed"},
+    OpAnd:       {"v = pop; acc' = acc AND v"},
+    OpOr:        {"v = pop; acc' = acc OR v"},
+    OpXor:       {"v = pop; acc' = acc XOR v"},
+    OpShl:       {"v = pop; v < 0: fault(operand)", "v >= 64: acc' = 0", "v < 64: acc' = acc << v"},
+    OpShr:       {"v = pop; v < 0: fault(operand)", "v >= 64: acc' = 0 if acc >= 0, else -1", "v < 64: acc' = acc >> v, arithmetic"},
+    OpIf:        {"acc = 0: pc' = Arg + 1"},
+    OpElse:      {"pc' = Arg + 1"},
+    OpEndIf:     {},
+    OpBreak:     {"pc' = Arg + 1"},
+    OpContinue:  {"pc' = Arg"},
+    OpLoadReg:   {"acc' = reg[Arg]"},
+    OpStoreReg:  {"reg'[Arg] = acc"},
+    OpDup:       {"a = pop; stack' = stack ++ [a, a]"},
+    OpSwap:      {"b = pop, a = pop; stack' = stack ++ [b, a]"},
+    OpRot:       {"c = pop, b = pop, a = pop; stack' = stack ++ [b, c, a]"},
+    OpOver:      {"b = pop, a = pop; stack' = stack ++ [a, b, a]"},
+    OpDepth:     {"acc' = |stack|"},
+    OpDump:      {"acc and stack are written to standard error; the state does not change"},
+    OpAssert:    {"v = pop; acc != v: fault(assert)"},
+    OpQuote:     {"stack' = stack ++ [inst[Arg].Arg], the number of the block; pc' = Arg + 1"},
+    OpReturn:    {"calls = []: error", "calls = c ++ [r]: calls' = c, pc' = r"},
+    OpExec: {
+        "n = pop; n is not a block number: fault(operand)",
+        "max_call_depth > 0 and |calls| >= max_call_depth: fault(limit)",
+        "calls' = calls ++ [pc + 1], pc' = the first address of block n",
+    },
+    OpSpawn: {
+        "n = pop; n is not a block number: fault(operand); |coroutines| > max_coroutines: fault(limit)",
+        "id = |coroutines|; coroutines' = coroutines ++ [a coroutine with acc = id, stack = [], pc = the first address of block n, calls = [|program|], inbox = []]",
+        "acc' = id",
+    },
+    OpSend: {
+        "to = pop; to is not a coroutine, or it has ended: fault(operand)",
+        "the inbox of coroutine to ++ [acc]; yield",
+    },
+    OpReceive: {
+        "inbox = [v] ++ rest: acc' = v, inbox' = rest",
+        "inbox = []: pc' = pc; the coroutine waits until its inbox is not empty; yield; every coroutine waiting: error",
+    },
+    OpTry:    {"traps' = traps ++ [(Arg + 1, |stack|, |calls|)]"},
+    OpCatch:  {"traps = []: error", "traps' = traps without its last entry, pc' = Arg + 1"},
+    OpEndTry: {},
+    OpAlloc: {
+        "acc < 0: fault(operand); max_heap > 0 and |heap| + acc > max_heap: fault(limit)",
+        "acc' = |heap| + 1, heap' = heap ++ [0 x acc]",
+    },
+    OpPeek:     {"i = pop, a = pop; a < 1 or i < 0 or a + i > |heap|: fault(operand)", "acc' = heap[a + i - 1]"},
+    OpPoke:     {"i = pop, a = pop; a < 1 or i < 0 or a + i > |heap|: fault(operand)", "heap'[a + i - 1] = acc"},
+    OpData:     {"acc' = Arg + 1, the address of the data block at offset Arg of the data"},
+    OpToFloat:  {"acc' = bits(acc as a double, rounded to nearest)"},
+    OpToInt:    {"f(acc) is NaN or outside the 64-bit range: fault(operand)", "acc' = f(acc) truncated toward zero"},
+    OpFAdd:     {"v = pop; acc' = bits(f(acc) + f(v))"},
+    OpFSub:     {"v = pop; acc' = bits(f(acc) - f(v))"},
+    OpFMul:     {"v = pop; acc' = bits(f(acc) * f(v))"},
+    OpFDiv:     {"v = pop; acc' = bits(f(acc) / f(v))"},
+    OpOutFloat: {"out' = out ++ f(acc) in decimal, with as many digits as needed to read it back unless a precision is set"},
+    OpAnsi: {
+        "acc = 0: out ++ reset colors; 1: clear the screen and home the cursor; 5: hide the cursor; 6: show it; 7: clear the line",
+        "acc = 2: col = pop, row = pop; row < 1 or col < 1: fault(operand); out ++ move the cursor to row, col",
+        "acc = 3 or 4: c = pop; c < 0 or c > 255: fault(operand); out ++ set the foreground (3) or background (4) color to c",
+        "other acc: fault(operand)",
+    },
+    OpGetenv: {
+        "n = pop; n < 0 or n > |stack|: error",
+        "name = the n topmost values of stack as bytes, deepest first; stack' = stack without them",
+        "name is unset or not allowed: acc' = -1",
+        "otherwise, with value v: stack' = stack ++ the bytes of v last first, so the first is on top; acc' = |v|",
+    },
+    OpAccept:   {"conn is set: error", "conn' = the first TCP connection to the allowed address, acc' = 1"},
+    OpNetRead:  {"conn is unset: error", "acc' = the next byte from conn, or -1 once the peer has closed it"},
+    OpNetWrite: {"conn is unset: error", "conn ++ [byte(acc)]"},
+}
+
+// Every opcode must have a transition
+var _ = [1]struct{}{}[len(opTransitions)-len(opTable)]
+
+// LanguageSemantics returns the operational semantics of the language
+func LanguageSemantics() Semantics {
+    s := Semantics{
+        Version:   SemanticsVersion,
+        ISA:       ISAVersion,
+        Notation:  semanticsNotation,
+        State:     semanticsState,
+        Execution: semanticsExecution,
+        Faults:    semanticsFaults,
+        Options:   semanticsOptions,
+    }
+
+    byExtension := make(map[ExtensionSet][]string)
+    for op, doc := range Ops() {
+        info := opTable[op]
+        byExtension[info.Extension] = append(byExtension[info.Extension], info.Mnemonic)
+        s.Operations = append(s.Operations, OpSemantics{
+            Code:       op,
+            Mnemonic:   doc.Mnemonic,
+            Name:       doc.Name,
+            Symbol:     doc.Symbol,
+            Operand:    info.Operand.String(),
+            Extension:  doc.Extension,
+            Summary:    doc.Summary,
+            Transition: append([]string{}, opTransitions[op]...),
+            Semantics:  doc.Semantics,
+        })
+    }
+
+    var exts []ExtensionSet
+    for ext := range extensionNames {
+        exts = append(exts, ext)
+    }
+    sort.Slice(exts, func(i, j int) bool { return exts[i] < exts[j] })
+    for _, ext := range exts {
+        s.Extensions = append(s.Extensions, SemanticsExtension{
+            Name:       extensionNames[ext],
+            Bit:        bits.TrailingZeros64(uint64(ext)),
+            Summary:    extensionSummaries[ext],
+            Operations: byExtension[ext],
+        })
+    }
+    return s
+}
+
+// specExportCommand implements 'flux spec export'
+func specExportCommand(args []string) {
+    fs := commandFlags("spec export")
+    format := fs.String("format", "json", "write the semantics as `format`: json")
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 0 {
+        fmt.Println("Error: spec export takes no files")
+        printUsage("spec")
+        return
+    }
+    if *format != "json" {
+        fmt.Printf("Error: unknown format '%s' (expected json)\n", *format)
+        return
+    }
+    out, _ := json.MarshalIndent(LanguageSemantics(), "", "  ")
+    fmt.Println(string(out))
+}
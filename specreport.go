@@ -0,0 +1,192 @@
+package main
+
+import (
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// specFormats lists the ways 'flux spec run -format' reports results.
+// Only text output depends on -v.
+var specFormats = map[string]func(w io.Writer, cases []*specCase, verbose bool){
+    "text":  textSpecReport,
+    "junit": junitSpecReport,
+    "tap":   tapSpecReport,
+    "json":  jsonSpecReport,
+}
+
+// specTally counts the passed, failed and skipped cases
+func specTally(cases []*specCase) (passed, failed, skipped int) {
+    for _, c := range cases {
+        switch {
+        case c.skipped:
+            skipped++
+        case c.err != nil:
+            failed++
+        default:
+            passed++
+        }
+    }
+    return passed, failed, skipped
+}
+
+// textSpecReport lists the failures, and with verbose the passes too
+func textSpecReport(w io.Writer, cases []*specCase, verbose bool) {
+    for _, c := range cases {
+        switch {
+        case c.broken:
+            fmt.Fprintf(w, "%v\n", c.err)
+        case c.err != nil:
+            fmt.Fprintf(w, "FAIL  %s: %s\n      %v\n", c.path, c.test.Name, c.err)
+        case c.skipped && verbose:
+            fmt.Fprintf(w, "skip  %s: %s (%s)\n", c.path, c.test.Name, c.test.Skip)
+        case verbose:
+            fmt.Fprintf(w, "ok    %s: %s\n", c.path, c.test.Name)
+        }
+    }
+    passed, failed, skipped := specTally(cases)
+    if skipped > 0 {
+        fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+    } else {
+        fmt.Fprintf(w, "%d passed, %d failed\n", passed, failed)
+    }
+}
+
+// junitSpecReport writes the JUnit XML that CI servers read, with one
+// test suite per spec file
+func junitSpecReport(w io.Writer, cases []*specCase, verbose bool) {
+    type failure struct {
+        Message string `xml:"message,attr"`
+        Text    string `xml:",chardata"`
+    }
+    type testCase struct {
+        Name      string   `xml:"name,attr"`
+        ClassName string   `xml:"classname,attr"`
+        Time      string   `xml:"time,attr"`
+        Failure   *failure `xml:"failure,omitempty"`
+        Error     *failure `xml:"error,omitempty"`
+        Skipped   *failure `xml:"skipped,omitempty"`
+    }
+    type testSuite struct {
+        Name     string     `xml:"name,attr"`
+        Tests    int        `xml:"tests,attr"`
+        Failures int        `xml:"failures,attr"`
+        Errors   int        `xml:"errors,attr"`
+        Skipped  int        `xml:"skipped,attr"`
+        Time     string     `xml:"time,attr"`
+        Cases    []testCase `xml:"testcase"`
+    }
+    type testSuites struct {
+        XMLName  xml.Name     `xml:"testsuites"`
+        Tests    int          `xml:"tests,attr"`
+        Failures int          `xml:"failures,attr"`
+        Errors   int          `xml:"errors,attr"`
+        Skipped  int          `xml:"skipped,attr"`
+        Suites   []*testSuite `xml:"testsuite"`
+    }
+    seconds := func(c *specCase) string { return fmt.Sprintf("%.3f", c.elapsed.Seconds()) }
+
+    all := testSuites{}
+    suites := make(map[string]*testSuite)
+    times := make(map[string]float64) // Seconds by suite
+    for _, c := range cases {
+        suite := suites[c.path]
+        if suite == nil {
+            suite = &testSuite{Name: c.path}
+            suites[c.path] = suite
+            all.Suites = append(all.Suites, suite)
+        }
+        className := strings.TrimSuffix(c.id(), "/"+c.test.Name)
+        tc := testCase{Name: c.test.Name, ClassName: className, Time: seconds(c)}
+        switch {
+        case c.broken:
+            // A file that cannot be loaded is an error of its suite
+            tc.Name = "(load)"
+            tc.Error = &failure{Message: c.err.Error()}
+            suite.Errors++
+            all.Errors++
+        case c.err != nil:
+            tc.Failure = &failure{Message: c.err.Error(), Text: c.err.Error()}
+            suite.Failures++
+            all.Failures++
+        case c.skipped:
+            tc.Skipped = &failure{Message: c.test.Skip}
+            suite.Skipped++
+            all.Skipped++
+        }
+        suite.Tests++
+        all.Tests++
+        times[c.path] += c.elapsed.Seconds()
+        suite.Cases = append(suite.Cases, tc)
+    }
+    for _, suite := range all.Suites {
+        suite.Time = fmt.Sprintf("%.3f", times[suite.Name])
+    }
+
+    io.WriteString(w, xml.Header)
+    enc := xml.NewEncoder(w)
+    enc.Indent("", "  ")
+    enc.Encode(all)
+    io.WriteString(w, "\n")
+}
+
+// tapSpecReport writes the Test Anything Protocol, version 13
+func tapSpecReport(w io.Writer, cases []*specCase, verbose bool) {
+    fmt.Fprintln(w, "TAP version 13")
+    fmt.Fprintf(w, "1..%d\n", len(cases))
+    for i, c := range cases {
+        name := c.id()
+        if c.broken {
+            name = c.path
+        }
+        if c.skipped {
+            fmt.Fprintf(w, "ok %d - %s # SKIP %s\n", i+1, name, c.test.Skip)
+            continue
+        }
+        if c.err == nil {
+            fmt.Fprintf(w, "ok %d - %s\n", i+1, name)
+            continue
+        }
+        fmt.Fprintf(w, "not ok %d - %s\n", i+1, name)
+        fmt.Fprintln(w, "  ---")
+        fmt.Fprintf(w, "  message: %q\n", c.err.Error())
+        fmt.Fprintf(w, "  file: %q\n", c.path)
+        fmt.Fprintln(w, "  ...")
+    }
+}
+
+// jsonSpecReport writes the results as one JSON document
+func jsonSpecReport(w io.Writer, cases []*specCase, verbose bool) {
+    type result struct {
+        File       string  `json:"file"`
+        Name       string  `json:"name,omitempty"`
+        Status     string  `json:"status"` // "pass", "fail", "skip" or "error" for a file that cannot be loaded
+        Error      string  `json:"error,omitempty"`
+        DurationMs float64 `json:"duration_ms"`
+    }
+    var report struct {
+        Passed  int      `json:"passed"`
+        Failed  int      `json:"failed"`
+        Skipped int      `json:"skipped"`
+        Tests   []result `json:"tests"`
+    }
+    report.Passed, report.Failed, report.Skipped = specTally(cases)
+    report.Tests = []result{}
+    for _, c := range cases {
+        r := result{File: c.path, Name: c.test.Name, Status: "pass", DurationMs: float64(c.elapsed.Microseconds()) / 1000}
+        switch {
+        case c.broken:
+            r.Status, r.Error = "error", c.err.Error()
+        case c.err != nil:
+            r.Status, r.Error = "fail", c.err.Error()
+        case c.skipped:
+            r.Status, r.Error = "skip", c.test.Skip
+        }
+        report.Tests = append(report.Tests, r)
+    }
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(report)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "sort"
+)
+
+// statsCommand implements 'flux stats', which summarizes the shape of a
+// program: its size, the operations it uses and how deeply its loops nest
+func statsCommand(args []string) {
+    fs := commandFlags("stats")
+    level := fs.Int("O", 0, "optimization `level` to apply first: 0 (only long constant output), 1 or 2")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to analyze")
+        printUsage("stats")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    program, err := loadProgram(filename, data, source)
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+    program, _ = Optimize(program, *level)
+
+    fmt.Printf("Statistics for %s\n\n", filename)
+    printMetadata(program.Metadata())
+    if program.Debug != nil {
+        source := program.Debug.Source
+        lines := bytes.Count(source, []byte("\n"))
+        if len(source) > 0 && source[len(source)-1] != '\n' {
+            lines++
+        }
+        fmt.Printf("  Source:        %d bytes, %d lines\n", len(source), lines)
+    }
+    fmt.Printf("  Instructions:  %d\n", len(program.Instructions))
+    fmt.Printf("  Constants:     %d\n", program.Constants.Len())
+
+    counts := make(map[OpCode]int)
+    for _, inst := range program.Instructions {
+        counts[inst.Op]++
+    }
+    depth, deepest := loopNesting(program.Instructions)
+    if depth == 0 {
+        fmt.Printf("  Loops:         0\n")
+    } else {
+        fmt.Printf("  Loops:         %d, nested at most %d deep (innermost at %s)\n", counts[OpLoop], depth, program.Location(deepest))
+    }
+
+    ops := make([]OpCode, 0, len(counts))
+    for op := range counts {
+        ops = append(ops, op)
+    }
+    sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+    if len(ops) > 0 {
+        fmt.Println("\n  Operations:")
+    }
+    for _, op := range ops {
+        fmt.Printf("    %-8s %6d\n", op, counts[op])
+    }
+}
+
+// loopNesting returns how deeply the loops in instructions nest and the
+// address of the first loop at that depth (-1 if there are no loops)
+func loopNesting(instructions []Instruction) (int, int) {
+    depth, max, at := 0, 0, -1
+    for i, inst := range instructions {
+        switch inst.Op {
+        case OpLoop:
+            depth++
+            if depth > max {
+                max, at = depth, i
+            }
+        case OpEnd:
+            depth--
+        }
+    }
+    return max, at
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+)
+
+// termState holds terminal settings to restore after raw mode, in the
+// form printed by 'stty -g'
+type termState struct {
+    settings string
+}
+
+// isTerminal reports whether f is connected to a character device
+func isTerminal(f *os.File) bool {
+    info, err := f.Stat()
+    if err != nil {
+        return false
+    }
+    return info.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs the stty utility against the terminal on f. Going through stty
+// keeps terminal handling portable across Unix systems without per-platform
+// ioctl code; where stty is unavailable raw mode simply cannot be entered.
+func stty(f *os.File, args ...string) (string, error) {
+    cmd := exec.Command("stty", args...)
+    cmd.Stdin = f
+    out, err := cmd.Output()
+    return strings.TrimSpace(string(out)), err
+}
+
+// makeRaw switches the terminal to raw mode for key-by-key input and
+// returns the previous settings. Output post-processing is left on so
+// newlines written by the program still return the carriage.
+func makeRaw(f *os.File) (*termState, error) {
+    saved, err := stty(f, "-g")
+    if err != nil {
+        return nil, err
+    }
+    if _, err := stty(f, "raw", "-echo", "opost"); err != nil {
+        return nil, err
+    }
+    return &termState{settings: saved}, nil
+}
+
+// makeCbreak switches the terminal to deliver keys as they are pressed,
+// without echoing them, and returns the previous settings. Unlike raw
+// mode, Ctrl-C still interrupts the program.
+func makeCbreak(f *os.File) (*termState, error) {
+    saved, err := stty(f, "-g")
+    if err != nil {
+        return nil, err
+    }
+    if _, err := stty(f, "-icanon", "-echo", "min", "1"); err != nil {
+        return nil, err
+    }
+    return &termState{settings: saved}, nil
+}
+
+// restoreTerminal puts the terminal back into the saved state
+func restoreTerminal(f *os.File, state *termState) error {
+    _, err := stty(f, state.settings)
+    return err
+}
+
+// terminalSize returns the number of rows and columns of the terminal on f
+func terminalSize(f *os.File) (int, int, error) {
+    out, err := stty(f, "size")
+    if err != nil {
+        return 0, 0, err
+    }
+    var rows, cols int
+    if _, err := fmt.Sscan(out, &rows, &cols); err != nil {
+        return 0, 0, err
+    }
+    return rows, cols, nil
+}
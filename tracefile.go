@@ -0,0 +1,399 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+)
+
+// traceMagic starts every trace file written by 'flux run -record-trace'
+const traceMagic = "FLXT"
+
+// traceVersion is the layout version written by RecordTrace
+const traceVersion = 1
+
+// The .ftrace layout is "FLXT" followed by a gzip stream of:
+//
+//    version (uvarint)
+//    program length (uvarint) and the program in .fluxc form
+//    per executed instruction, as signed varints:
+//        address minus the one after the previous instruction's
+//        change of the accumulator since the previous instruction
+//        change of the stack depth since the previous instruction
+//
+// The first instruction is measured against address 0, accumulator 0
+// and an empty stack. Straight-line code records zero jumps, which
+// compress well. The changes are measured after each instruction, handler
+// and coroutine switch included, so adding them up gives the machine's
+// state.
+
+// traceRecorder writes the trace of a running program
+type traceRecorder struct {
+    gz    *gzip.Writer
+    w     *bufio.Writer
+    buf   []byte
+    pc    int // Address after the previous instruction
+    acc   int // Accumulator after the previous instruction
+    depth int // Stack depth after the previous instruction
+    err   error
+}
+
+// RecordTrace makes the machine write a compressed trace of every
+// instruction it executes to w, starting with the program, for 'flux
+// trace analyze'. StopTrace finishes the trace.
+func (vm *VM) RecordTrace(w io.Writer) error {
+    if _, err := io.WriteString(w, traceMagic); err != nil {
+        return err
+    }
+    gz := gzip.NewWriter(w)
+    r := &traceRecorder{gz: gz, w: bufio.NewWriter(gz)}
+    program := encodeBytecode(vm.program)
+    r.buf = binary.AppendUvarint(r.buf, traceVersion)
+    r.buf = binary.AppendUvarint(r.buf, uint64(len(program)))
+    r.w.Write(r.buf)
+    r.w.Write(program)
+    vm.recorder = r
+    return nil
+}
+
+// StopTrace stops recording and writes out the rest of the trace,
+// reporting any error writing it
+func (vm *VM) StopTrace() error {
+    r := vm.recorder
+    if r == nil {
+        return nil
+    }
+    vm.recorder = nil
+    if err := r.w.Flush(); r.err == nil {
+        r.err = err
+    }
+    if err := r.gz.Close(); r.err == nil {
+        r.err = err
+    }
+    return r.err
+}
+
+// recordStep executes an instruction, as Step does, and records it
+func (vm *VM) recordStep() error {
+    pc, steps := vm.pc, vm.steps
+    err := vm.catch(vm.step())
+    if vm.steps > steps {
+        vm.recorder.record(pc, vm.accumulator, len(vm.stack))
+    }
+    return err
+}
+
+// record adds an instruction to the trace. The first write error is kept
+// for StopTrace; the program runs on regardless.
+func (r *traceRecorder) record(pc, acc, depth int) {
+    r.buf = binary.AppendVarint(r.buf[:0], int64(pc-r.pc))
+    r.buf = binary.AppendVarint(r.buf, int64(acc-r.acc))
+    r.buf = binary.AppendVarint(r.buf, int64(depth-r.depth))
+    if _, err := r.w.Write(r.buf); err != nil && r.err == nil {
+        r.err = err
+    }
+    r.pc, r.acc, r.depth = pc+1, acc, depth
+}
+
+// traceStep is an executed instruction read back from a trace, with the
+// machine's state after it
+type traceStep struct {
+    PC          int
+    Accumulator int
+    Depth       int
+}
+
+// traceReader reads a trace file
+type traceReader struct {
+    r       *bufio.Reader
+    Program *Program
+    last    traceStep
+    next    int // Address after the previous instruction
+}
+
+// openTrace checks a trace's header and reads the program from it
+func openTrace(r io.Reader) (*traceReader, error) {
+    magic := make([]byte, len(traceMagic))
+    if _, err := io.ReadFull(r, magic); err != nil || string(magic) != traceMagic {
+        return nil, fmt.Errorf("not a trace file: missing %q header", traceMagic)
+    }
+    gz, err := gzip.NewReader(r)
+    if err != nil {
+        return nil, fmt.Errorf("invalid trace file: %v", err)
+    }
+    t := &traceReader{r: bufio.NewReader(gz)}
+    if v, err := binary.ReadUvarint(t.r); err != nil || v != traceVersion {
+        return nil, fmt.Errorf("unsupported trace file version (expected %d)", traceVersion)
+    }
+    n, err := binary.ReadUvarint(t.r)
+    if err != nil || n > 1<<30 {
+        return nil, fmt.Errorf("invalid trace file: bad program length")
+    }
+    data := make([]byte, n)
+    if _, err := io.ReadFull(t.r, data); err != nil {
+        return nil, fmt.Errorf("invalid trace file: %v", err)
+    }
+    if t.Program, err = decodeBytecode(data); err != nil {
+        return nil, fmt.Errorf("invalid trace file: %v", err)
+    }
+    return t, nil
+}
+
+// Next returns the next executed instruction, or io.EOF after the last
+func (t *traceReader) Next() (traceStep, error) {
+    var deltas [3]int64
+    for i := range deltas {
+        d, err := binary.ReadVarint(t.r)
+        if err != nil {
+            if i == 0 && err == io.EOF {
+                return traceStep{}, io.EOF
+            }
+            return traceStep{}, fmt.Errorf("invalid trace file: truncated record")
+        }
+        deltas[i] = d
+    }
+    t.last.PC = t.next + int(deltas[0])
+    t.last.Accumulator += int(deltas[1])
+    t.last.Depth += int(deltas[2])
+    if t.last.PC < 0 || t.last.PC >= len(t.Program.Instructions) {
+        return traceStep{}, fmt.Errorf("invalid trace file: address %d is outside the program", t.last.PC)
+    }
+    t.next = t.last.PC + 1
+    return t.last, nil
+}
+
+// traceCommand implements 'flux trace analyze', which summarizes a trace
+// recorded by 'flux run -record-trace'
+func traceCommand(args []string) {
+    if len(args) == 0 || args[0] != "analyze" {
+        printUsage("trace")
+        return
+    }
+    fs := commandFlags("trace analyze")
+    top := fs.Int("top", 10, "list the `n` most executed instructions")
+    events := fs.Int("events", 50, "show at most `n` entries of the I/O timeline (0 = all)")
+    positional, err := parseArgs(fs, args[1:])
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a trace file")
+        printUsage("trace")
+        return
+    }
+    f, err := os.Open(positional[0])
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", positional[0], err)
+        return
+    }
+    defer f.Close()
+    t, err := openTrace(f)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    a, err := analyzeTrace(t)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+    }
+    a.print(t.Program, *top, *events)
+}
+
+// loopTrips counts how often a loop was entered and how many iterations
+// each entry ran
+type loopTrips struct {
+    entries, iterations int
+    min, max            int
+    current             int // Iterations of the entry in progress
+}
+
+// ioEvent is a run of output, or a run of input, in the timeline
+type ioEvent struct {
+    input      bool
+    first      int // Step of the first byte
+    last       int // Step of the last byte
+    data       bytes.Buffer
+    incomplete bool // Input ended
+}
+
+// traceAnalysis is what 'flux trace analyze' reports
+type traceAnalysis struct {
+    steps    int
+    maxDepth int
+    counts   []int // Executions of each instruction
+    loops    map[int]*loopTrips
+    timeline []*ioEvent
+}
+
+// analyzeTrace replays a trace, counting instructions and loop trips and
+// collecting what the program wrote and read. A damaged trace is analyzed
+// up to the damage.
+func analyzeTrace(t *traceReader) (*traceAnalysis, error) {
+    program := t.Program
+    a := &traceAnalysis{counts: make([]int, len(program.Instructions)), loops: make(map[int]*loopTrips)}
+    prev, loopAt := -1, -1 // Previous address; the LOOP it was, if any
+    for {
+        s, err := t.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            a.finishLoops()
+            return a, err
+        }
+        a.steps++
+        a.counts[s.PC]++
+        a.maxDepth = max(a.maxDepth, s.Depth)
+
+        // A LOOP followed by its body started an iteration
+        if loopAt >= 0 && s.PC == loopAt+1 {
+            l := a.loops[loopAt]
+            l.iterations++
+            l.current++
+        }
+        loopAt = -1
+        inst := program.Instructions[s.PC]
+        switch inst.Op {
+        case OpLoop:
+            l := a.loops[s.PC]
+            if l == nil {
+                l = &loopTrips{min: -1}
+                a.loops[s.PC] = l
+            }
+            if prev != inst.Arg { // Not back from its END, so a new entry
+                l.finish()
+                l.entries++
+            }
+            loopAt = s.PC
+        case OpOut:
+            a.event(false, s, []byte{byte(s.Accumulator % 256)})
+        case OpOutNum:
+            a.event(false, s, strconv.AppendInt(nil, int64(s.Accumulator), 10))
+        case OpOutFloat:
+            a.event(false, s, strconv.AppendFloat(nil, toFloat(s.Accumulator), 'g', -1, 64))
+        case OpEmitBytes:
+            if c, err := program.Constants.At(inst.Arg); err == nil {
+                a.event(false, s, c.Bytes)
+            }
+        case OpIn:
+            if s.Accumulator == 0 {
+                a.event(true, s, nil)
+            } else {
+                a.event(true, s, []byte{byte(s.Accumulator)})
+            }
+        }
+        prev = s.PC
+    }
+    a.finishLoops()
+    return a, nil
+}
+
+// finish closes the entry in progress, if any
+func (l *loopTrips) finish() {
+    if l.entries == 0 {
+        return
+    }
+    if l.min < 0 || l.current < l.min {
+        l.min = l.current
+    }
+    l.max = max(l.max, l.current)
+    l.current = 0
+}
+
+// finishLoops closes the entries of every loop
+func (a *traceAnalysis) finishLoops() {
+    for _, l := range a.loops {
+        l.finish()
+    }
+}
+
+// event adds output or input data to the timeline, extending the last
+// entry if it is of the same kind. Reading 0 marks the end of input.
+func (a *traceAnalysis) event(input bool, s traceStep, data []byte) {
+    n := len(a.timeline)
+    if n == 0 || a.timeline[n-1].input != input || a.timeline[n-1].incomplete {
+        a.timeline = append(a.timeline, &ioEvent{input: input, first: a.steps})
+        n++
+    }
+    e := a.timeline[n-1]
+    e.last = a.steps
+    e.data.Write(data)
+    if input && data == nil {
+        e.incomplete = true
+    }
+}
+
+// print writes the analysis
+func (a *traceAnalysis) print(program *Program, top, events int) {
+    fmt.Printf("Trace of %d steps over %d instructions, stack at most %d deep\n", a.steps, len(program.Instructions), a.maxDepth)
+
+    hot := make([]int, 0, len(a.counts))
+    for pc, n := range a.counts {
+        if n > 0 {
+            hot = append(hot, pc)
+        }
+    }
+    sort.SliceStable(hot, func(i, j int) bool { return a.counts[hot[i]] > a.counts[hot[j]] })
+    if len(hot) > top {
+        hot = hot[:top]
+    }
+    fmt.Printf("\nMost executed instructions:\n")
+    for _, pc := range hot {
+        fmt.Printf("  %04d  %-8s %10d  %5.1f%%  %s\n", pc, program.Instructions[pc].Op, a.counts[pc], 100*float64(a.counts[pc])/float64(a.steps), program.Location(pc))
+    }
+    fmt.Printf("  (%d of %d instructions never executed)\n", countZero(a.counts), len(a.counts))
+
+    if len(a.loops) > 0 {
+        loops := make([]int, 0, len(a.loops))
+        for pc := range a.loops {
+            loops = append(loops, pc)
+        }
+        sort.Ints(loops)
+        fmt.Printf("\nLoops:%44s\n", "entries  iterations  trips min/avg/max")
+        for _, pc := range loops {
+            l := a.loops[pc]
+            fmt.Printf("  %04d %-20s %9d %11d  %d/%.1f/%d\n", pc, program.Location(pc), l.entries, l.iterations, l.min, float64(l.iterations)/float64(l.entries), l.max)
+        }
+    }
+
+    fmt.Printf("\nI/O timeline:\n")
+    if len(a.timeline) == 0 {
+        fmt.Println("  (no input or output)")
+    }
+    for i, e := range a.timeline {
+        if events > 0 && i == events {
+            fmt.Printf("  ... %d more\n", len(a.timeline)-events)
+            break
+        }
+        steps := fmt.Sprintf("step %d", e.first)
+        if e.last != e.first {
+            steps = fmt.Sprintf("steps %d-%d", e.first, e.last)
+        }
+        verb := "wrote"
+        if e.input {
+            verb = "read"
+        }
+        end := ""
+        if e.incomplete {
+            end = " then end of input"
+        }
+        fmt.Printf("  %-22s %s %q%s\n", steps, verb, e.data.Bytes(), end)
+    }
+}
+
+// countZero counts the zeros in counts
+func countZero(counts []int) int {
+    n := 0
+    for _, c := range counts {
+        if c == 0 {
+            n++
+        }
+    }
+    return n
+}
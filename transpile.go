@@ -0,0 +1,497 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+)
+
+// transpileTargets lists the languages 'flux transpile' can generate
+var transpileTargets = map[string]func(program *Program, name string) string{
+    "go": transpileGo,
+    "c":  transpileC,
+}
+
+// transpileExtensions lists the extensions each target can translate
+var transpileExtensions = map[string]ExtensionSet{
+    "go": ExtBitwise | ExtIf | ExtBreak | ExtRegisters | ExtStack | ExtAssert,
+    "c":  ExtBitwise | ExtIf | ExtBreak | ExtRegisters | ExtStack | ExtAssert,
+}
+
+// checkTranspilable returns an error if target cannot translate every
+// extension the program uses
+func checkTranspilable(target string, program *Program) error {
+    if missing := program.Extensions &^ transpileExtensions[target]; missing != 0 {
+        return fmt.Errorf("the %s target does not support extension(s) %s", target, missing)
+    }
+    return nil
+}
+
+// transpileCommand implements 'flux transpile'
+func transpileCommand(args []string) {
+    fs := commandFlags("transpile")
+    target := fs.String("target", "go", "output language: `go` or c")
+    output := fs.String("o", "", "write the generated code to `file` instead of standard output")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to transpile")
+        printUsage("transpile")
+        return
+    }
+
+    generate, ok := transpileTargets[*target]
+    if !ok {
+        fmt.Printf("Error: unknown target '%s' (expected go or c)\n", *target)
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+
+    program, err := source.compiler(string(data)).Compile()
+    if err != nil {
+        fmt.Printf("Compilation error: %v\n", err)
+        return
+    }
+    if err := checkTranspilable(*target, program); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+
+    code := generate(program, filename)
+    if *output == "" {
+        fmt.Print(code)
+        return
+    }
+    if err := os.WriteFile(*output, []byte(code), 0644); err != nil {
+        fmt.Printf("Error writing file '%s': %v\n", *output, err)
+    }
+}
+
+// codeWriter accumulates indented lines of generated code
+type codeWriter struct {
+    b      strings.Builder
+    indent int
+    unit   string // One level of indentation
+}
+
+func (w *codeWriter) line(format string, args ...interface{}) {
+    w.b.WriteString(strings.Repeat(w.unit, w.indent))
+    fmt.Fprintf(&w.b, format, args...)
+    w.b.WriteByte('\n')
+}
+
+// walkInstructions calls emit for each instruction, folding runs of
+// increments, decrements and additions into a single delta so the
+// generated code stays readable. They are reported as one OpAdd with the
+// net delta; other instructions are passed through.
+func walkInstructions(instructions []Instruction, emit func(inst Instruction)) {
+    for i := 0; i < len(instructions); i++ {
+        if _, ok := accDelta(instructions[i]); !ok {
+            emit(instructions[i])
+            continue
+        }
+
+        delta := 0
+        for ; i < len(instructions); i++ {
+            d, ok := accDelta(instructions[i])
+            if !ok {
+                break
+            }
+            delta += d
+        }
+        i--
+        if delta != 0 {
+            emit(Instruction{Op: OpAdd, Arg: delta})
+        }
+    }
+}
+
+// transpileGo translates a program into an equivalent Go program with the
+// same semantics as the VM: a 64-bit accumulator that wraps on overflow,
+// zero from an empty stack, byte output modulo 256 and zero on end of input
+func transpileGo(program *Program, name string) string {
+    pool := program.Constants
+    w := &codeWriter{unit: "\t"}
+    w.line("// Code generated by flux transpile from %s. DO NOT EDIT.", name)
+    w.line("")
+    w.line("package main")
+    w.line("")
+    w.line("import (")
+    w.line("\t\"bufio\"")
+    w.line("\t\"fmt\"")
+    w.line("\t\"os\"")
+    w.line(")")
+    w.line("")
+    w.line("var (")
+    w.line("\tin    = bufio.NewReader(os.Stdin)")
+    w.line("\tout   = bufio.NewWriter(os.Stdout)")
+    w.line("\tacc   int64")
+    w.line("\tstack = make([]int64, 0, 256)")
+    w.line(")")
+    w.line("")
+    if program.Extensions&ExtRegisters != 0 {
+        w.line("var reg [%d]int64", NumRegisters)
+        w.line("")
+    }
+    w.line("func push() { stack = append(stack, acc) }")
+    w.line("")
+    w.line("func pop() {")
+    w.line("\tif n := len(stack); n > 0 {")
+    w.line("\t\tacc = stack[n-1]")
+    w.line("\t\tstack = stack[:n-1]")
+    w.line("\t} else {")
+    w.line("\t\tacc = 0")
+    w.line("\t}")
+    w.line("}")
+    w.line("")
+    w.line("func put() { out.WriteByte(byte(acc %% 256)) }")
+    w.line("")
+    w.line("func putNum() { fmt.Fprintf(out, \"%%d\", acc) }")
+    w.line("")
+    w.line("func get() {")
+    w.line("\tout.Flush()")
+    w.line("\tif b, err := in.ReadByte(); err == nil {")
+    w.line("\t\tacc = int64(b)")
+    w.line("\t} else {")
+    w.line("\t\tacc = 0")
+    w.line("\t}")
+    w.line("}")
+    w.line("")
+    if program.Extensions&(ExtBitwise|ExtStack|ExtAssert) != 0 {
+        w.line("func take() int64 {")
+        w.line("\tif n := len(stack); n > 0 {")
+        w.line("\t\tv := stack[n-1]")
+        w.line("\t\tstack = stack[:n-1]")
+        w.line("\t\treturn v")
+        w.line("\t}")
+        w.line("\treturn 0")
+        w.line("}")
+        w.line("")
+    }
+    if program.Extensions&ExtAssert != 0 {
+        w.line("func check() {")
+        w.line("\tif want := take(); acc != want {")
+        w.line("\t\tout.Flush()")
+        w.line("\t\tfmt.Fprintf(os.Stderr, \"assertion failed: expected %%d, got %%d\\n\", want, acc)")
+        w.line("\t\tos.Exit(1)")
+        w.line("\t}")
+        w.line("}")
+        w.line("")
+    }
+    if program.Extensions&ExtStack != 0 {
+        w.line("func dup() { a := take(); stack = append(stack, a, a) }")
+        w.line("")
+        w.line("func swap() { b, a := take(), take(); stack = append(stack, b, a) }")
+        w.line("")
+        w.line("func rot() { c, b, a := take(), take(), take(); stack = append(stack, b, c, a) }")
+        w.line("")
+        w.line("func over() { b, a := take(), take(); stack = append(stack, a, b, a) }")
+        w.line("")
+    }
+    if program.Extensions&ExtBitwise != 0 {
+        w.line("func shift(n int64) uint64 {")
+        w.line("\tif n < 0 {")
+        w.line("\t\tpanic(fmt.Sprintf(\"negative shift count %%d\", n))")
+        w.line("\t}")
+        w.line("\treturn uint64(n)")
+        w.line("}")
+        w.line("")
+    }
+    w.line("func main() {")
+    w.line("\tdefer out.Flush()")
+    w.indent = 1
+
+    walkInstructions(program.Instructions, func(inst Instruction) {
+        switch inst.Op {
+        case OpAdd:
+            w.line("acc += %d", inst.Arg)
+        case OpPush:
+            w.line("push()")
+        case OpPop:
+            w.line("pop()")
+        case OpLoop:
+            w.line("for acc != 0 {")
+            w.indent++
+        case OpEnd:
+            w.indent--
+            w.line("}")
+        case OpIf:
+            w.line("if acc != 0 {")
+            w.indent++
+        case OpElse:
+            w.indent--
+            w.line("} else {")
+            w.indent++
+        case OpEndIf:
+            w.indent--
+            w.line("}")
+        case OpBreak:
+            w.line("break")
+        case OpContinue:
+            w.line("continue")
+        case OpLoadReg:
+            w.line("acc = reg[%d]", inst.Arg)
+        case OpStoreReg:
+            w.line("reg[%d] = acc", inst.Arg)
+        case OpDup:
+            w.line("dup()")
+        case OpSwap:
+            w.line("swap()")
+        case OpRot:
+            w.line("rot()")
+        case OpOver:
+            w.line("over()")
+        case OpDepth:
+            w.line("acc = int64(len(stack))")
+        case OpAssert:
+            w.line("check()")
+        case OpOut:
+            w.line("put()")
+        case OpIn:
+            w.line("get()")
+        case OpOutNum:
+            w.line("putNum()")
+        case OpSet:
+            v, _ := pool.IntValue(inst.Arg)
+            w.line("acc = %d", v)
+        case OpEmitBytes:
+            c, _ := pool.At(inst.Arg)
+            w.line("out.WriteString(%q)", c.Bytes)
+        case OpAnd:
+            w.line("acc &= take()")
+        case OpOr:
+            w.line("acc |= take()")
+        case OpXor:
+            w.line("acc ^= take()")
+        case OpShl:
+            w.line("acc <<= shift(take())")
+        case OpShr:
+            w.line("acc >>= shift(take())")
+        }
+    })
+
+    w.indent = 0
+    w.line("}")
+    return w.b.String()
+}
+
+// transpileC translates a program into an equivalent C99 program. The
+// accumulator is an int64_t updated through unsigned arithmetic so that it
+// wraps on overflow like the VM instead of invoking undefined behavior.
+func transpileC(program *Program, name string) string {
+    pool := program.Constants
+    w := &codeWriter{unit: "    "}
+    w.line("/* Code generated by flux transpile from %s. DO NOT EDIT. */", name)
+    w.line("")
+    w.line("#include <stdint.h>")
+    w.line("#include <stdio.h>")
+    w.line("#include <stdlib.h>")
+    w.line("")
+    w.line("static int64_t acc;")
+    w.line("static int64_t *stack;")
+    w.line("static size_t depth, capacity;")
+    w.line("")
+    if program.Extensions&ExtRegisters != 0 {
+        w.line("static int64_t reg[%d];", NumRegisters)
+        w.line("")
+    }
+    w.line("static void add(int64_t delta) { acc = (int64_t)((uint64_t)acc + (uint64_t)delta); }")
+    w.line("")
+    w.line("static void push_value(int64_t v) {")
+    w.line("    if (depth == capacity) {")
+    w.line("        capacity = capacity ? capacity * 2 : 256;")
+    w.line("        stack = realloc(stack, capacity * sizeof *stack);")
+    w.line("        if (!stack) {")
+    w.line("            perror(\"flux\");")
+    w.line("            exit(1);")
+    w.line("        }")
+    w.line("    }")
+    w.line("    stack[depth++] = v;")
+    w.line("}")
+    w.line("")
+    w.line("static void push(void) { push_value(acc); }")
+    w.line("")
+    w.line("static void pop(void) { acc = depth ? stack[--depth] : 0; }")
+    w.line("")
+    w.line("static void put(void) { putchar((unsigned char)(acc %% 256)); }")
+    w.line("")
+    w.line("static void put_num(void) { printf(\"%%lld\", (long long)acc); }")
+    w.line("")
+    w.line("static void get(void) {")
+    w.line("    int c;")
+    w.line("    fflush(stdout);")
+    w.line("    c = getchar();")
+    w.line("    acc = c == EOF ? 0 : c;")
+    w.line("}")
+    w.line("")
+    if program.Extensions&(ExtBitwise|ExtStack|ExtAssert) != 0 {
+        w.line("static int64_t take(void) { return depth ? stack[--depth] : 0; }")
+        w.line("")
+    }
+    if program.Extensions&ExtAssert != 0 {
+        w.line("static void check(void) {")
+        w.line("    int64_t want = take();")
+        w.line("    if (acc != want) {")
+        w.line("        fflush(stdout);")
+        w.line("        fprintf(stderr, \"assertion failed: expected %%lld, got %%lld\\n\", (long long)want, (long long)acc);")
+        w.line("        exit(1);")
+        w.line("    }")
+        w.line("}")
+        w.line("")
+    }
+    if program.Extensions&ExtStack != 0 {
+        w.line("static void dup_top(void) {")
+        w.line("    int64_t a = take();")
+        w.line("    push_value(a);")
+        w.line("    push_value(a);")
+        w.line("}")
+        w.line("")
+        w.line("static void swap_top(void) {")
+        w.line("    int64_t b = take(), a = take();")
+        w.line("    push_value(b);")
+        w.line("    push_value(a);")
+        w.line("}")
+        w.line("")
+        w.line("static void rot_top(void) {")
+        w.line("    int64_t c = take(), b = take(), a = take();")
+        w.line("    push_value(b);")
+        w.line("    push_value(c);")
+        w.line("    push_value(a);")
+        w.line("}")
+        w.line("")
+        w.line("static void over_top(void) {")
+        w.line("    int64_t b = take(), a = take();")
+        w.line("    push_value(a);")
+        w.line("    push_value(b);")
+        w.line("    push_value(a);")
+        w.line("}")
+        w.line("")
+    }
+    if program.Extensions&ExtBitwise != 0 {
+        w.line("static void shl(int64_t n) {")
+        w.line("    if (n < 0) {")
+        w.line("        fprintf(stderr, \"negative shift count %%lld\\n\", (long long)n);")
+        w.line("        exit(1);")
+        w.line("    }")
+        w.line("    acc = n >= 64 ? 0 : (int64_t)((uint64_t)acc << n);")
+        w.line("}")
+        w.line("")
+        w.line("static void shr(int64_t n) {")
+        w.line("    if (n < 0) {")
+        w.line("        fprintf(stderr, \"negative shift count %%lld\\n\", (long long)n);")
+        w.line("        exit(1);")
+        w.line("    }")
+        w.line("    if (n > 63) {")
+        w.line("        n = 63;")
+        w.line("    }")
+        w.line("    acc = acc < 0 ? ~(~acc >> n) : acc >> n;")
+        w.line("}")
+        w.line("")
+    }
+    w.line("int main(void) {")
+    w.indent = 1
+
+    walkInstructions(program.Instructions, func(inst Instruction) {
+        switch inst.Op {
+        case OpAdd:
+            w.line("add(%d);", inst.Arg)
+        case OpPush:
+            w.line("push();")
+        case OpPop:
+            w.line("pop();")
+        case OpLoop:
+            w.line("while (acc != 0) {")
+            w.indent++
+        case OpEnd:
+            w.indent--
+            w.line("}")
+        case OpIf:
+            w.line("if (acc != 0) {")
+            w.indent++
+        case OpElse:
+            w.indent--
+            w.line("} else {")
+            w.indent++
+        case OpEndIf:
+            w.indent--
+            w.line("}")
+        case OpBreak:
+            w.line("break;")
+        case OpContinue:
+            w.line("continue;")
+        case OpLoadReg:
+            w.line("acc = reg[%d];", inst.Arg)
+        case OpStoreReg:
+            w.line("reg[%d] = acc;", inst.Arg)
+        case OpDup:
+            w.line("dup_top();")
+        case OpSwap:
+            w.line("swap_top();")
+        case OpRot:
+            w.line("rot_top();")
+        case OpOver:
+            w.line("over_top();")
+        case OpDepth:
+            w.line("acc = (int64_t)depth;")
+        case OpAssert:
+            w.line("check();")
+        case OpOut:
+            w.line("put();")
+        case OpIn:
+            w.line("get();")
+        case OpOutNum:
+            w.line("put_num();")
+        case OpSet:
+            v, _ := pool.IntValue(inst.Arg)
+            w.line("acc = INT64_C(%d);", v)
+        case OpEmitBytes:
+            c, _ := pool.At(inst.Arg)
+            w.line("fwrite(%s, 1, %d, stdout);", cString(c.Bytes), len(c.Bytes))
+        case OpAnd:
+            w.line("acc &= take();")
+        case OpOr:
+            w.line("acc |= take();")
+        case OpXor:
+            w.line("acc ^= take();")
+        case OpShl:
+            w.line("shl(take());")
+        case OpShr:
+            w.line("shr(take());")
+        }
+    })
+
+    w.line("return 0;")
+    w.indent = 0
+    w.line("}")
+    return w.b.String()
+}
+
+// cString quotes data as a C string literal, escaping every byte that is
+// not printable ASCII (and '?', which could start a trigraph)
+func cString(data []byte) string {
+    var b strings.Builder
+    b.WriteByte('"')
+    for _, c := range data {
+        switch {
+        case c == '"' || c == '\\':
+            b.WriteByte('\\')
+            b.WriteByte(c)
+        case c >= ' ' && c <= '~' && c != '?':
+            b.WriteByte(c)
+        default:
+            fmt.Fprintf(&b, "\\%03o", c)
+        }
+    }
+    b.WriteByte('"')
+    return b.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+)
+
+// Fault codes, loaded into the accumulator when a trap handler catches a
+// fault
+const (
+    FaultUnderflow = 1 // Pop from an empty stack with strict stack checking
+    FaultAssert    = 2 // Failed assertion
+    FaultOverflow  = 3 // Accumulator overflow with overflow checking
+    FaultOperand   = 4 // Operand out of range: a shift count, heap cell, block or coroutine number
+    FaultLimit     = 5 // Too many block calls, coroutines or heap cells
+)
+
+// Fault is a runtime error caused by the program itself rather than by
+// the machine or its surroundings, which the trap extension lets the
+// program catch
+type Fault struct {
+    Code    int    // What went wrong, one of the Fault constants
+    Message string // Description for the user, with the source location
+}
+
+// Error returns the fault's description
+func (f *Fault) Error() string {
+    return f.Message
+}
+
+// fault returns a Fault with the given code and formatted description
+func fault(code int, format string, args ...interface{}) error {
+    return &Fault{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Trap is a handler installed by TRY
+type Trap struct {
+    Handler int // Address execution continues at when a fault is caught
+    Depth   int // Stack depth when the handler was installed
+    Calls   int // Block call depth when the handler was installed
+}
+
+// catch hands err to the innermost trap handler if it is a fault and there
+// is a handler. The stack and block calls are unwound to where they were
+// when the handler was installed and the accumulator is set to the fault
+// code. Any other error is returned as is.
+func (vm *VM) catch(err error) error {
+    if err == nil || len(vm.traps) == 0 {
+        return err
+    }
+    var f *Fault
+    if !errors.As(err, &f) {
+        return err
+    }
+    t := vm.traps[len(vm.traps)-1]
+    vm.traps = vm.traps[:len(vm.traps)-1]
+    if len(vm.stack) > t.Depth {
+        vm.stack = vm.stack[:t.Depth]
+    }
+    if len(vm.calls) > t.Calls {
+        vm.calls = vm.calls[:t.Calls]
+    }
+    vm.accumulator = f.Code
+    vm.pc = t.Handler
+    return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// ANSI sequences used by the full-screen debugger
+const (
+    ansiAltScreen  = "\x1b[?1049h"
+    ansiMainScreen = "\x1b[?1049l"
+    ansiHome       = "\x1b[H"
+    ansiClear      = "\x1b[2J"
+    ansiReverse    = "\x1b[7m"
+    ansiBold       = "\x1b[1m"
+    ansiReset      = "\x1b[0m"
+)
+
+// tuiMessageLines is the number of lines reserved for command responses
+const tuiMessageLines = 3
+
+// runTUI runs the debugger with a full-screen interface: source and
+// bytecode panes on top (disassembly and machine state for programs
+// without source), output and stack panes below, then the responses
+// to the last command and the command line. The screen is redrawn after
+// every command. Program output is collected into its own pane instead of
+// being written over the display.
+func (d *debugger) runTUI() {
+    var messages, output bytes.Buffer
+    d.out = &messages
+    d.output = &output
+    d.restart()
+
+    fmt.Fprint(os.Stdout, ansiAltScreen)
+    defer fmt.Fprint(os.Stdout, ansiMainScreen)
+
+    d.greet()
+    for {
+        d.render(os.Stdout, messages.String(), output.String())
+        messages.Reset()
+
+        line, err := d.commands.ReadString('\n')
+        if err != nil && line == "" {
+            return
+        }
+        if !d.execute(strings.TrimSpace(line)) {
+            return
+        }
+    }
+}
+
+// render draws the whole screen and leaves the cursor on the command line
+func (d *debugger) render(w *os.File, messages, output string) {
+    rows, cols, err := terminalSize(w)
+    if err != nil || rows < 12 || cols < 40 {
+        rows, cols = 24, 80
+    }
+
+    paneRows := rows - tuiMessageLines - 2 // Message lines, separator, command line
+    topRows := paneRows * 2 / 3
+    bottomRows := paneRows - topRows - 1 // One row for the middle border
+    leftCols := cols * 3 / 5
+    rightCols := cols - leftCols - 1 // One column for the vertical border
+
+    // Without source the disassembly takes its place, next to the rest of
+    // the machine state
+    leftTitle, rightTitle := " Source: "+d.name+" ", " Bytecode "
+    var source, code []string
+    if d.program.Debug != nil {
+        source = d.sourcePane(topRows, leftCols)
+        code = d.bytecodePane(topRows, rightCols)
+    } else {
+        leftTitle, rightTitle = " Disassembly: "+d.name+" ", " Machine "
+        source = d.bytecodePane(topRows, leftCols)
+        code = d.machinePane(topRows, rightCols)
+    }
+    out := lastLines(output, bottomRows, leftCols)
+    stack := d.stackPane(bottomRows, rightCols)
+
+    var b strings.Builder
+    b.WriteString(ansiHome + ansiClear)
+    b.WriteString(border(leftTitle, leftCols) + "┬" + border(rightTitle, rightCols) + "\n")
+    for i := 0; i < topRows-1; i++ {
+        b.WriteString(source[i] + "│" + code[i] + "\n")
+    }
+    b.WriteString(border(" Output ", leftCols) + "┼" + border(" Stack ", rightCols) + "\n")
+    for i := 0; i < bottomRows; i++ {
+        b.WriteString(out[i] + "│" + stack[i] + "\n")
+    }
+    b.WriteString(strings.Repeat("─", cols) + "\n")
+
+    msg := lastLines(messages, tuiMessageLines, cols)
+    for _, line := range msg {
+        b.WriteString(line + "\n")
+    }
+    b.WriteString(ansiBold + "(fdb) " + ansiReset)
+    fmt.Fprint(w, b.String())
+}
+
+// sourcePane shows the source around the current instruction with the
+// operator about to run highlighted
+func (d *debugger) sourcePane(rows, cols int) []string {
+    lines := strings.Split(string(d.program.Debug.Source), "\n")
+    curLine, curCol := -1, -1
+    if !d.vm.Halted() {
+        curLine, curCol = lineCol(d.program.Debug.Source, d.program.Debug.Positions[d.vm.pc])
+    }
+
+    first := 1
+    if curLine > 0 {
+        first = curLine - (rows-1)/2
+    }
+    if first < 1 {
+        first = 1
+    }
+
+    pane := make([]string, rows)
+    for i := range pane {
+        n := first + i
+        if n > len(lines) {
+            pane[i] = fit("", cols)
+            continue
+        }
+
+        prefix := fmt.Sprintf("  %4d ", n)
+        if n == curLine {
+            prefix = fmt.Sprintf("=>%4d ", n)
+        }
+        text := []rune(strings.ReplaceAll(lines[n-1], "\t", " "))
+        width := cols - len(prefix)
+
+        // Scroll long lines horizontally so the current column stays visible
+        start := 0
+        if n == curLine && curCol > width {
+            start = curCol - width/2
+        }
+        if start > len(text) {
+            start = len(text)
+        }
+        text = text[start:]
+        if len(text) > width {
+            text = text[:width]
+        }
+
+        plain := prefix + string(text)
+        if n == curLine {
+            col := curCol - 1 - start
+            if col >= 0 && col < len(text) {
+                plain = prefix + string(text[:col]) + ansiReverse + string(text[col]) + ansiReset + string(text[col+1:])
+            }
+        }
+        pane[i] = plain + strings.Repeat(" ", width-len(text))
+    }
+    return pane
+}
+
+// bytecodePane disassembles the instructions around the program counter
+func (d *debugger) bytecodePane(rows, cols int) []string {
+    start := d.vm.pc - (rows-1)/2
+    if start < 0 {
+        start = 0
+    }
+
+    pane := make([]string, rows)
+    for i := range pane {
+        addr := start + i
+        if addr >= len(d.program.Instructions) {
+            pane[i] = fit("", cols)
+            continue
+        }
+
+        inst := d.program.Instructions[addr]
+        marker := "  "
+        for _, b := range d.breakpoints {
+            if b.addr == addr {
+                marker = " *"
+            }
+        }
+        text := fmt.Sprintf("%s %04d  %-7s", marker, addr, inst.Op)
+        if hasJumpTarget(inst.Op) {
+            text += fmt.Sprintf(" -> %04d", inst.Arg)
+        } else if operand := valueOperand(inst, d.program.Constants); operand != "" {
+            text += " " + operand
+        }
+        if addr == d.vm.pc {
+            pane[i] = ansiReverse + fit(text, cols) + ansiReset
+        } else {
+            pane[i] = fit(text, cols)
+        }
+    }
+    return pane
+}
+
+// stackPane shows the accumulator and the stack, top first
+func (d *debugger) stackPane(rows, cols int) []string {
+    lines := []string{
+        fmt.Sprintf(" acc   %d", d.vm.accumulator),
+        fmt.Sprintf(" depth %d", len(d.vm.stack)),
+    }
+    if d.vm.Halted() {
+        lines = append(lines, " (program finished)")
+    }
+    for i := len(d.vm.stack) - 1; i >= 0; i-- {
+        label := fmt.Sprintf(" [%d]", i)
+        if i == len(d.vm.stack)-1 {
+            label = " top"
+        }
+        lines = append(lines, fmt.Sprintf("%-6s%d", label, d.vm.stack[i]))
+    }
+
+    pane := make([]string, rows)
+    for i := range pane {
+        if i < len(lines) {
+            pane[i] = fit(lines[i], cols)
+        } else {
+            pane[i] = fit("", cols)
+        }
+    }
+    if len(lines) > rows && rows > 0 {
+        pane[rows-1] = fit(fmt.Sprintf(" ... %d more", len(lines)-rows+1), cols)
+    }
+    return pane
+}
+
+// machinePane shows the machine state other than the stack: the program
+// counter, registers, heap, block calls, trap handlers and coroutines
+func (d *debugger) machinePane(rows, cols int) []string {
+    lines := []string{fmt.Sprintf(" pc    %04d", d.vm.pc), fmt.Sprintf(" steps %d", d.vm.steps)}
+    if d.program.Extensions&ExtRegisters != 0 {
+        for i, v := range d.vm.registers {
+            lines = append(lines, fmt.Sprintf(" %c     %d", registerNames[i], v))
+        }
+    }
+    if n := len(d.vm.heap); n > 0 {
+        lines = append(lines, fmt.Sprintf(" heap  %d cell(s)", n))
+    }
+    for i := len(d.vm.calls) - 1; i >= 0; i-- {
+        lines = append(lines, fmt.Sprintf(" call  returns to %04d", d.vm.calls[i]))
+    }
+    for i := len(d.vm.traps) - 1; i >= 0; i-- {
+        lines = append(lines, fmt.Sprintf(" trap  handler at %04d", d.vm.traps[i].Handler))
+    }
+    if n := len(d.vm.coroutines); n > 0 {
+        lines = append(lines, fmt.Sprintf(" coroutine %d of %d", d.vm.current, n))
+    }
+
+    pane := make([]string, rows)
+    for i := range pane {
+        if i < len(lines) {
+            pane[i] = fit(lines[i], cols)
+        } else {
+            pane[i] = fit("", cols)
+        }
+    }
+    return pane
+}
+
+// lastLines returns the final n lines of text, each fitted to cols
+func lastLines(text string, n, cols int) []string {
+    lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+    if len(lines) > n {
+        lines = lines[len(lines)-n:]
+    }
+
+    pane := make([]string, n)
+    for i := range pane {
+        pane[i] = fit("", cols)
+    }
+    offset := n - len(lines)
+    for i, line := range lines {
+        pane[offset+i] = fit(strings.Map(printableRune, line), cols)
+    }
+    return pane
+}
+
+// printableRune replaces control characters so program output cannot move
+// the cursor or otherwise disturb the display
+func printableRune(r rune) rune {
+    if r < 32 || r == 127 {
+        return '.'
+    }
+    return r
+}
+
+// fit pads or truncates s to exactly cols runes
+func fit(s string, cols int) string {
+    r := []rune(s)
+    if len(r) > cols {
+        return string(r[:cols])
+    }
+    return s + strings.Repeat(" ", cols-len(r))
+}
+
+// border draws a horizontal rule of width cols with a title near its start
+func border(title string, cols int) string {
+    return fit("──"+title+strings.Repeat("─", cols), cols)
+}
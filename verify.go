@@ -0,0 +1,200 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// verifyBackend runs a program through one alternative implementation
+type verifyBackend struct {
+    name string
+    // run executes the program with the given input. It returns errSkipped
+    // when the backend's toolchain is not available.
+    run func(ctx context.Context, program *Program, name string, input []byte, dir string) ([]byte, error)
+}
+
+// errSkipped reports that a backend could not run on this machine
+var errSkipped = errors.New("skipped")
+
+// verifyBackends lists the backends 'flux verify' compares against the VM
+var verifyBackends = []verifyBackend{
+    {"go", runGoBackend},
+    {"c", runCBackend},
+}
+
+// verifyCommand implements 'flux verify': it runs a program on the VM and
+// through every transpiler backend with identical input and compares the
+// output, guarding the backends against drifting from the VM's semantics
+func verifyCommand(args []string) {
+    fs := commandFlags("verify")
+    inputFile := fs.String("input", "", "feed the contents of `file` to every run (default: no input)")
+    timeout := fs.Duration("timeout", 30*time.Second, "give up on a backend after `duration`")
+    maxSteps := fs.Int("max-steps", 100000000, "abort the reference run after `n` instructions")
+    var source sourceOptions
+    source.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to verify")
+        printUsage("verify")
+        return
+    }
+
+    filename := positional[0]
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+
+    var input []byte
+    if *inputFile != "" {
+        input, err = os.ReadFile(*inputFile)
+        if err != nil {
+            fmt.Printf("Error reading input file '%s': %v\n", *inputFile, err)
+            return
+        }
+    }
+
+    program, err := source.compiler(string(data)).Compile()
+    if err != nil {
+        fmt.Printf("Compilation error: %v\n", err)
+        return
+    }
+
+    var expected bytes.Buffer
+    vm := NewVM(program, bytes.NewReader(input), &expected)
+    vm.SetMaxSteps(*maxSteps)
+    vm.SetExtensions(source.extensions)
+    if err := vm.Run(); err != nil {
+        fmt.Printf("Reference run failed: %v\n", err)
+        os.Exit(1)
+    }
+    fmt.Printf("Verifying %s: vm produced %d byte(s) in %d steps\n", filename, expected.Len(), vm.StepCount())
+
+    dir, err := os.MkdirTemp("", "flux-verify-")
+    if err != nil {
+        fmt.Printf("Error creating work directory: %v\n", err)
+        return
+    }
+    defer os.RemoveAll(dir)
+
+    failed := false
+    for _, backend := range verifyBackends {
+        if err := checkTranspilable(backend.name, program); err != nil {
+            fmt.Printf("  %-4s skipped: %v\n", backend.name, err)
+            continue
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+        got, err := backend.run(ctx, program, filename, input, dir)
+        cancel()
+
+        switch {
+        case errors.Is(err, errSkipped):
+            fmt.Printf("  %-4s skipped: %v\n", backend.name, err)
+        case err != nil:
+            failed = true
+            fmt.Printf("  %-4s FAILED: %v\n", backend.name, err)
+        case !bytes.Equal(got, expected.Bytes()):
+            failed = true
+            fmt.Printf("  %-4s MISMATCH: %s\n", backend.name, describeMismatch(expected.Bytes(), got))
+        default:
+            fmt.Printf("  %-4s ok\n", backend.name)
+        }
+    }
+
+    if failed {
+        os.Exit(1)
+    }
+}
+
+// describeMismatch locates the first byte where two outputs differ
+func describeMismatch(want, got []byte) string {
+    i := 0
+    for i < len(want) && i < len(got) && want[i] == got[i] {
+        i++
+    }
+    excerpt := func(b []byte) string {
+        end := i + 16
+        if end > len(b) {
+            end = len(b)
+        }
+        if i >= len(b) {
+            return "<end of output>"
+        }
+        return fmt.Sprintf("%q", b[i:end])
+    }
+    return fmt.Sprintf("outputs differ at byte %d (vm %d bytes, backend %d bytes): vm %s, backend %s",
+        i, len(want), len(got), excerpt(want), excerpt(got))
+}
+
+// runGoBackend transpiles to Go and runs the result with 'go run'
+func runGoBackend(ctx context.Context, program *Program, name string, input []byte, dir string) ([]byte, error) {
+    goTool, err := exec.LookPath("go")
+    if err != nil {
+        return nil, fmt.Errorf("%w: go toolchain not found", errSkipped)
+    }
+
+    src := filepath.Join(dir, "main.go")
+    if err := os.WriteFile(src, []byte(transpileGo(program, name)), 0644); err != nil {
+        return nil, err
+    }
+    bin := filepath.Join(dir, "prog-go")
+    if out, err := exec.CommandContext(ctx, goTool, "build", "-o", bin, src).CombinedOutput(); err != nil {
+        return nil, fmt.Errorf("build failed: %v\n%s", err, strings.TrimSpace(string(out)))
+    }
+    return runBinary(ctx, bin, input)
+}
+
+// runCBackend transpiles to C, compiles with the system C compiler and runs
+// the result
+func runCBackend(ctx context.Context, program *Program, name string, input []byte, dir string) ([]byte, error) {
+    var cc string
+    for _, candidate := range []string{os.Getenv("CC"), "cc", "gcc", "clang"} {
+        if candidate == "" {
+            continue
+        }
+        if path, err := exec.LookPath(candidate); err == nil {
+            cc = path
+            break
+        }
+    }
+    if cc == "" {
+        return nil, fmt.Errorf("%w: no C compiler found", errSkipped)
+    }
+
+    src := filepath.Join(dir, "prog.c")
+    if err := os.WriteFile(src, []byte(transpileC(program, name)), 0644); err != nil {
+        return nil, err
+    }
+    bin := filepath.Join(dir, "prog-c")
+    if out, err := exec.CommandContext(ctx, cc, "-std=c99", "-O1", "-o", bin, src).CombinedOutput(); err != nil {
+        return nil, fmt.Errorf("build failed: %v\n%s", err, strings.TrimSpace(string(out)))
+    }
+    return runBinary(ctx, bin, input)
+}
+
+// runBinary runs a compiled backend with input on stdin and returns stdout
+func runBinary(ctx context.Context, bin string, input []byte) ([]byte, error) {
+    cmd := exec.CommandContext(ctx, bin)
+    cmd.Stdin = bytes.NewReader(input)
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        if ctx.Err() != nil {
+            return nil, fmt.Errorf("timed out")
+        }
+        return nil, fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+    }
+    return stdout.Bytes(), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strconv"
+)
+
+// wordSize is the size in bytes of a machine value
+const wordSize = strconv.IntSize / 8
+
+// Stats describes the resources a run has used so far
+type Stats struct {
+    Steps         int // Instructions executed
+    MaxStackDepth int // Most values the stack has held at once
+    HeapCells     int // Cells allocated by the heap extension
+    Memory        int // Approximate bytes held for the program's data
+}
+
+// Stats reports the resources the machine has used. Memory counts the
+// space reserved for the stack, the heap, block calls, trap handlers and
+// the saved state of coroutines, which is what grows with the program;
+// the program itself and the VM's fixed overhead are left out.
+func (vm *VM) Stats() Stats {
+    words := cap(vm.stack) + cap(vm.heap) + cap(vm.calls) + 3*cap(vm.traps) + NumRegisters
+    for _, c := range vm.coroutines {
+        words += cap(c.state.Stack) + cap(c.state.Calls) + 3*cap(c.state.Traps) + NumRegisters + cap(c.inbox)
+    }
+    return Stats{
+        Steps:         vm.steps,
+        MaxStackDepth: vm.maxDepth,
+        HeapCells:     len(vm.heap),
+        Memory:        words * wordSize,
+    }
+}
+
+// Print writes the statistics to w for 'flux run -stats'
+func (s Stats) Print(w io.Writer) {
+    fmt.Fprintln(w, "Statistics:")
+    fmt.Fprintf(w, "  Steps:             %d\n", s.Steps)
+    fmt.Fprintf(w, "  Peak stack depth:  %d\n", s.MaxStackDepth)
+    if s.HeapCells > 0 {
+        fmt.Fprintf(w, "  Heap cells:        %d\n", s.HeapCells)
+    }
+    fmt.Fprintf(w, "  Memory:            about %s\n", formatBytes(s.Memory))
+}
+
+// formatBytes formats a byte count in the largest binary unit that keeps
+// it at least 1
+func formatBytes(n int) string {
+    const units = "KMGTPE"
+    if n < 1024 {
+        return fmt.Sprintf("%d bytes", n)
+    }
+    v, i := float64(n)/1024, 0
+    for v >= 1024 && i < len(units)-1 {
+        v /= 1024
+        i++
+    }
+    return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+)
+
+// watchCommand implements 'flux watch', which runs a program and runs it
+// again whenever its source file changes
+func watchCommand(args []string) {
+    var opts runOptions
+    fs := commandFlags("watch")
+    hot := fs.Bool("hot", false, "continue the changed program where it was, keeping the machine's state")
+    interval := fs.Duration("interval", 500*time.Millisecond, "check the file for changes every `duration`")
+    opts.register(fs)
+    positional, err := parseArgs(fs, args)
+    if err != nil {
+        return
+    }
+    if len(positional) != 1 {
+        fmt.Println("Error: Please specify a file to watch")
+        printUsage("watch")
+        return
+    }
+    if opts.coreFile != "" || opts.digest || opts.traceFile != "" || opts.profile != 0 {
+        fmt.Println("Error: -core, -digest, -record-trace and -profile apply to a single run; use 'flux run'")
+        return
+    }
+    watchFile(positional[0], *hot, *interval, opts)
+}
+
+// fileVersion identifies a version of a file well enough to notice edits
+type fileVersion struct {
+    modTime time.Time
+    size    int64
+}
+
+// statVersion returns the current version of a file
+func statVersion(filename string) (fileVersion, error) {
+    info, err := os.Stat(filename)
+    if err != nil {
+        return fileVersion{}, err
+    }
+    return fileVersion{info.ModTime(), info.Size()}, nil
+}
+
+// watchFile runs the program in filename until it is interrupted, starting
+// over each time the file changes. With hot set, a program still running
+// when the file changes carries on in the new version from the same place
+// in the source, with its accumulator, stack, registers, heap and open
+// files intact, if that place survived the edit; otherwise it restarts.
+func watchFile(filename string, hot bool, interval time.Duration, opts runOptions) {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    version, err := statVersion(filename)
+    if err != nil {
+        fmt.Printf("Error reading file '%s': %v\n", filename, err)
+        return
+    }
+    program, err := loadWatched(filename, opts)
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return
+    }
+    fmt.Printf("Watching %s (Ctrl-C to stop)...\n\n", filename)
+
+    input := newInputPump(os.Stdin)
+    output := bufio.NewWriter(os.Stdout)
+    vm := NewVM(program, nil, output)
+    if err := opts.apply(vm); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    defer vm.CloseFiles()
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        // Run until the program ends or the file changes
+        runCtx, cancel := context.WithCancel(ctx)
+        vm.SetContext(runCtx)
+        vm.SetIO(input.reader(runCtx), output)
+        done := make(chan error, 1)
+        go func() { done <- vm.Run() }()
+        running := true
+        for running {
+            select {
+            case err := <-done:
+                running = false
+                if ctx.Err() != nil {
+                    cancel()
+                    return
+                }
+                if err != nil {
+                    fmt.Printf("\nRuntime error: %v\n", err)
+                } else {
+                    fmt.Println()
+                }
+                if opts.stats {
+                    vm.Stats().Print(os.Stdout)
+                }
+                fmt.Printf("Waiting for %s to change...\n", filename)
+            case <-ticker.C:
+                if v, err := statVersion(filename); err != nil || v == version {
+                    continue
+                }
+                cancel()
+                <-done
+                running = false
+            case <-ctx.Done():
+                <-done
+                cancel()
+                return
+            }
+        }
+        cancel()
+
+        // Wait for a version of the file that compiles
+        for {
+            if v, err := statVersion(filename); err == nil && v != version {
+                version = v
+                changed, err := loadWatched(filename, opts)
+                if err == nil {
+                    fmt.Printf("\n--- %s changed: %s ---\n\n", filename, reload(vm, changed, hot))
+                    break
+                }
+                fmt.Printf("\n%v\n", err)
+                fmt.Printf("Waiting for %s to change...\n", filename)
+            }
+            select {
+            case <-ticker.C:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }
+}
+
+// loadWatched compiles and optimizes the watched file
+func loadWatched(filename string, opts runOptions) (*Program, error) {
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("Error reading file '%s': %v", filename, err)
+    }
+    program, err := loadProgram(filename, data, opts.sourceOptions)
+    if err != nil {
+        return nil, err
+    }
+    program, _ = Optimize(program, opts.optLevel)
+    return program, nil
+}
+
+// reload switches the machine to the changed program, continuing where it
+// left off if hot is set and that can be done unambiguously, and describes
+// what it did
+func reload(vm *VM, changed *Program, hot bool) string {
+    if !hot {
+        vm.Reset(changed)
+        return "restarting"
+    }
+    if vm.Halted() {
+        vm.Reset(changed)
+        return "restarting, the program had finished"
+    }
+    pc, ok := hotResume(vm, changed)
+    if !ok {
+        vm.Reset(changed)
+        return "restarting, the edit touched the place the program was at"
+    }
+    state := vm.Snapshot()
+    vm.Load(changed)
+    state.PC = pc
+    state.Heap = vm.Heap() // With the changed program's data
+    vm.Restore(state)
+    return "continuing at " + changed.Location(pc)
+}
+
+// hotResume finds the instruction of the changed program at which the
+// machine can carry on: the only one compiled from the same place in the
+// source as the instruction it is at, provided the edit left that place
+// and everything before or after it alone. Machines inside a block, a trap
+// or a coroutine cannot carry on, since their saved return addresses
+// belong to the old program.
+func hotResume(vm *VM, changed *Program) (int, bool) {
+    old := vm.Program()
+    if old.Debug == nil || changed.Debug == nil || len(vm.calls) > 0 || len(vm.traps) > 0 || len(vm.coroutines) > 0 {
+        return 0, false
+    }
+    pos, ok := old.Position(vm.pc)
+    if !ok {
+        return 0, false
+    }
+
+    a, b := old.Debug.Source, changed.Debug.Source
+    prefix := 0
+    for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+        prefix++
+    }
+    suffix := 0
+    for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+        suffix++
+    }
+    switch {
+    case pos < prefix:
+    case pos >= len(a)-suffix:
+        pos += len(b) - len(a)
+    default:
+        return 0, false
+    }
+
+    pc := -1
+    for i, p := range changed.Debug.Positions {
+        if p == pos {
+            if pc >= 0 {
+                return 0, false
+            }
+            pc = i
+        }
+    }
+    return pc, pc >= 0
+}
+
+// inputPump reads standard input in the background, so that a run can be
+// abandoned while it waits for input without losing what is typed next
+type inputPump struct {
+    data    chan []byte
+    pending []byte
+}
+
+// newInputPump starts reading r
+func newInputPump(r io.Reader) *inputPump {
+    p := &inputPump{data: make(chan []byte)}
+    go func() {
+        defer close(p.data)
+        for {
+            buf := make([]byte, 4096)
+            n, err := r.Read(buf)
+            if n > 0 {
+                p.data <- buf[:n]
+            }
+            if err != nil {
+                return
+            }
+        }
+    }()
+    return p
+}
+
+// reader returns a reader of the pumped input that gives up once ctx is
+// done. Only one such reader may be in use at a time.
+func (p *inputPump) reader(ctx context.Context) io.Reader {
+    return &pumpReader{pump: p, ctx: ctx}
+}
+
+// pumpReader reads from an inputPump until its context is done
+type pumpReader struct {
+    pump *inputPump
+    ctx  context.Context
+}
+
+func (r *pumpReader) Read(buf []byte) (int, error) {
+    p := r.pump
+    if len(p.pending) == 0 {
+        select {
+        case data, ok := <-p.data:
+            if !ok {
+                return 0, io.EOF
+            }
+            p.pending = data
+        case <-r.ctx.Done():
+            return 0, r.ctx.Err()
+        }
+    }
+    n := copy(buf, p.pending)
+    p.pending = p.pending[n:]
+    return n, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// webSocketGUID is appended to a client's key to accept a WebSocket
+// handshake (RFC 6455, section 4.2.2)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketMaxMessage is the largest frame a WebSocketDevice accepts, so
+// that a client cannot make the server allocate without bound
+const webSocketMaxMessage = 1 << 20
+
+// WebSocket frame opcodes
+const (
+    wsContinuation = 0x0
+    wsText         = 0x1
+    wsBinary       = 0x2
+    wsClose        = 0x8
+    wsPing         = 0x9
+    wsPong         = 0xA
+)
+
+// WebSocketDevice is a Device for a program talking to a browser over a
+// WebSocket. The data of every text or binary message received is input,
+// read a byte at a time, and a close from the client ends it. Output is
+// collected and sent as one binary message whenever the machine flushes,
+// which it does before every read, so a prompt reaches the browser before
+// the program waits for the answer.
+type WebSocketDevice struct {
+    conn    net.Conn
+    r       *bufio.Reader
+    pending []byte // Rest of the message being read
+    out     []byte // Output not yet sent
+    eof     bool   // Whether the client has closed the connection
+    closed  bool   // Whether a close frame has been sent
+}
+
+// AcceptWebSocket answers a WebSocket handshake and takes over the
+// connection, returning the device for it. On failure it has already
+// replied with an HTTP error.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketDevice, error) {
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+        http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+        return nil, errors.New("not a WebSocket handshake")
+    }
+    hj, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+        return nil, errors.New("the connection cannot be taken over")
+    }
+    conn, rw, err := hj.Hijack()
+    if err != nil {
+        return nil, err
+    }
+    sum := sha1.Sum([]byte(key + webSocketGUID))
+    fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+        base64.StdEncoding.EncodeToString(sum[:]))
+    if err := rw.Flush(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return &WebSocketDevice{conn: conn, r: rw.Reader}, nil
+}
+
+// headerHas reports whether one of the comma-separated values of the
+// header is token, ignoring case
+func headerHas(h http.Header, name, token string) bool {
+    for _, v := range h.Values(name) {
+        for _, t := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func (d *WebSocketDevice) ReadByte() (byte, error) {
+    for len(d.pending) == 0 {
+        if d.eof {
+            return 0, io.EOF
+        }
+        if err := d.readMessage(); err != nil {
+            return 0, err
+        }
+    }
+    c := d.pending[0]
+    d.pending = d.pending[1:]
+    return c, nil
+}
+
+// readMessage reads frames until one with data or a close arrives,
+// answering pings on the way
+func (d *WebSocketDevice) readMessage() error {
+    for {
+        var head [2]byte
+        if _, err := io.ReadFull(d.r, head[:]); err != nil {
+            if err == io.EOF {
+                d.eof = true
+                return nil
+            }
+            return err
+        }
+        op := head[0] & 0x0F
+        if head[1]&0x80 == 0 {
+            return errors.New("WebSocket frame from the client is not masked")
+        }
+        size := uint64(head[1] & 0x7F)
+        switch size {
+        case 126:
+            var b [2]byte
+            if _, err := io.ReadFull(d.r, b[:]); err != nil {
+                return err
+            }
+            size = uint64(binary.BigEndian.Uint16(b[:]))
+        case 127:
+            var b [8]byte
+            if _, err := io.ReadFull(d.r, b[:]); err != nil {
+                return err
+            }
+            size = binary.BigEndian.Uint64(b[:])
+        }
+        if size > webSocketMaxMessage {
+            return fmt.Errorf("WebSocket frame of %d bytes is larger than %d", size, webSocketMaxMessage)
+        }
+        var mask [4]byte
+        if _, err := io.ReadFull(d.r, mask[:]); err != nil {
+            return err
+        }
+        data := make([]byte, size)
+        if _, err := io.ReadFull(d.r, data); err != nil {
+            return err
+        }
+        for i := range data {
+            data[i] ^= mask[i%4]
+        }
+        switch op {
+        case wsContinuation, wsText, wsBinary:
+            if len(data) > 0 {
+                d.pending = data
+                return nil
+            }
+        case wsClose:
+            d.eof = true
+            d.sendClose()
+            return nil
+        case wsPing:
+            if err := d.writeFrame(wsPong, data); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// writeFrame sends one unmasked frame, as servers do
+func (d *WebSocketDevice) writeFrame(op byte, data []byte) error {
+    head := []byte{0x80 | op, 0}
+    switch n := len(data); {
+    case n < 126:
+        head[1] = byte(n)
+    case n <= 0xFFFF:
+        head[1] = 126
+        head = binary.BigEndian.AppendUint16(head, uint16(n))
+    default:
+        head[1] = 127
+        head = binary.BigEndian.AppendUint64(head, uint64(n))
+    }
+    _, err := d.conn.Write(append(head, data...))
+    return err
+}
+
+func (d *WebSocketDevice) WriteByte(c byte) error {
+    d.out = append(d.out, c)
+    return nil
+}
+
+func (d *WebSocketDevice) WriteString(s string) (int, error) {
+    d.out = append(d.out, s...)
+    return len(s), nil
+}
+
+func (d *WebSocketDevice) Write(b []byte) (int, error) {
+    d.out = append(d.out, b...)
+    return len(b), nil
+}
+
+// Flush sends the output written since the last flush as one message
+func (d *WebSocketDevice) Flush() error {
+    if len(d.out) == 0 {
+        return nil
+    }
+    err := d.writeFrame(wsBinary, d.out)
+    d.out = d.out[:0]
+    return err
+}
+
+// Ready reports whether data has arrived that has not been read yet,
+// which may turn out to be a ping rather than input
+func (d *WebSocketDevice) Ready() bool {
+    return len(d.pending) > 0 || d.r.Buffered() > 0
+}
+
+// Close sends what is left of the output, closes the WebSocket and then
+// the connection
+func (d *WebSocketDevice) Close() error {
+    err := d.Flush()
+    d.sendClose()
+    if cerr := d.conn.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// sendClose sends a close frame, once; the reply to the client's close
+// and the close that ends the connection are the same frame
+func (d *WebSocketDevice) sendClose() {
+    if !d.closed {
+        d.closed = true
+        d.writeFrame(wsClose, nil)
+    }
+}